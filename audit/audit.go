@@ -0,0 +1,136 @@
+// Package audit records security-relevant actions in the audit_events
+// table: sign-ins, password and two-factor changes, and what staff do to
+// accounts and roles.
+package audit
+
+import (
+	"log"
+	"reflect"
+
+	"github.com/88warren/lmw-fitness-backend/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Actions
+const (
+	ActionLogin                  = "user.login"
+	ActionLoginFailed            = "user.login_failed"
+	ActionAccountLocked          = "user.locked"
+	ActionPasswordResetRequested = "user.password_reset_requested"
+	ActionPasswordReset          = "user.password_reset"
+	ActionPasswordChanged        = "user.password_changed"
+	ActionTwoFactorEnabled       = "user.2fa_enabled"
+	ActionTwoFactorDisabled      = "user.2fa_disabled"
+	ActionIdentityLinked         = "user.identity_linked"
+	ActionAPIKeyCreated          = "api_key.created"
+	ActionAPIKeyRevoked          = "api_key.revoked"
+
+	ActionUserUpdated       = "admin.user_updated"
+	ActionUserRoleChanged   = "admin.user_role_changed"
+	ActionUserDeleted       = "admin.user_deleted"
+	ActionUserPasswordReset = "admin.user_password_reset"
+	ActionUserUnlocked      = "admin.user_unlocked"
+	ActionCoachAssigned     = "admin.coach_assigned"
+	ActionRoleCreated       = "admin.role_created"
+	ActionRoleUpdated       = "admin.role_updated"
+	ActionRoleDeleted       = "admin.role_deleted"
+)
+
+// Target types
+const (
+	TargetUser   = "user"
+	TargetRole   = "role"
+	TargetAPIKey = "api_key"
+)
+
+// Entry is an action to record. The actor is the signed-in user unless
+// ActorID is set, as it is for sign-ins, which happen before anyone is
+// signed in.
+type Entry struct {
+	Action     string
+	TargetType string
+	TargetID   uint
+	ActorID    uint
+	ActorEmail string
+	// Before and After are snapshots of the target; only the fields that
+	// differ are kept
+	Before   map[string]interface{}
+	After    map[string]interface{}
+	Metadata map[string]interface{}
+}
+
+// Record writes entry along with the request's actor, IP address and user
+// agent. A failure is logged rather than returned: the action has already
+// happened and shouldn't be reported as failed because its record wasn't
+// kept.
+func Record(db *gorm.DB, c *gin.Context, entry Entry) {
+	event := models.AuditEvent{
+		Action:     entry.Action,
+		TargetType: entry.TargetType,
+		ActorEmail: entry.ActorEmail,
+		Metadata:   entry.Metadata,
+	}
+	event.Before, event.After = Diff(entry.Before, entry.After)
+	if entry.TargetID != 0 {
+		event.TargetID = &entry.TargetID
+	}
+	if entry.ActorID != 0 {
+		event.ActorID = &entry.ActorID
+	}
+	if c != nil {
+		if event.ActorID == nil {
+			if userID := c.GetUint("userID"); userID != 0 {
+				event.ActorID = &userID
+				event.ActorEmail = c.GetString("userEmail")
+			}
+		}
+		if apiKeyID, ok := c.Get("apiKeyID"); ok {
+			if id, ok := apiKeyID.(uint); ok {
+				event.ActorAPIKeyID = &id
+			}
+		}
+		event.IPAddress = c.ClientIP()
+		event.UserAgent = truncate(c.Request.UserAgent(), 512)
+	}
+
+	if db == nil {
+		log.Printf("Audit (not stored): %s on %s %d", event.Action, event.TargetType, entry.TargetID)
+		return
+	}
+	if err := db.Create(&event).Error; err != nil {
+		log.Printf("Error recording audit event %s on %s %d: %v", event.Action, event.TargetType, entry.TargetID, err)
+	}
+}
+
+// Diff keeps the fields of before and after that differ, so an event
+// shows what changed rather than whole records. Either may be nil, as for
+// something created or deleted, in which case the other is kept whole.
+func Diff(before, after map[string]interface{}) (map[string]interface{}, map[string]interface{}) {
+	if before == nil || after == nil {
+		return before, after
+	}
+	changedBefore := map[string]interface{}{}
+	changedAfter := map[string]interface{}{}
+	for field, old := range before {
+		if updated, ok := after[field]; !ok || !reflect.DeepEqual(old, updated) {
+			changedBefore[field] = old
+			if ok {
+				changedAfter[field] = updated
+			}
+		}
+	}
+	for field, updated := range after {
+		if _, ok := before[field]; !ok {
+			changedAfter[field] = updated
+		}
+	}
+	return changedBefore, changedAfter
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
@@ -1,9 +1,11 @@
 package config
 
 import (
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strings"
 
 	"github.com/88warren/lmw-fitness-backend/controllers"
 	"github.com/88warren/lmw-fitness-backend/middleware"
@@ -69,6 +71,10 @@ func SetupServer() *gin.Engine {
 		router.Use(middleware.MetricsCollectionMiddleware())
 	}
 
+	if err := configureClientIP(router); err != nil {
+		log.Fatalf("Invalid proxy configuration: %v", err)
+	}
+
 	router.Use(middleware.CORSMiddleware())
 	router.Static("/images", "./images")
 	router.GET("/debug/images", func(c *gin.Context) {
@@ -96,6 +102,36 @@ func SetupServer() *gin.Engine {
 	return router
 }
 
+// configureClientIP decides where ClientIP, and so login lockouts, sessions
+// and the audit log, gets the caller's address from. X-Forwarded-For and
+// X-Real-IP are only believed from the proxies in TRUSTED_PROXIES, a
+// comma-separated list of IPs or CIDRs; with none listed the address of the
+// connection is used. TRUSTED_PLATFORM takes the address from a header set
+// by the hosting platform instead: "cloudflare", "google" or a header name.
+func configureClientIP(router *gin.Engine) error {
+	var proxies []string
+	for _, proxy := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			proxies = append(proxies, proxy)
+		}
+	}
+	if err := router.SetTrustedProxies(proxies); err != nil {
+		return fmt.Errorf("TRUSTED_PROXIES: %w", err)
+	}
+	router.RemoteIPHeaders = []string{"X-Forwarded-For", "X-Real-IP"}
+
+	switch platform := strings.TrimSpace(os.Getenv("TRUSTED_PLATFORM")); strings.ToLower(platform) {
+	case "":
+	case "cloudflare":
+		router.TrustedPlatform = gin.PlatformCloudflare
+	case "google":
+		router.TrustedPlatform = gin.PlatformGoogleAppEngine
+	default:
+		router.TrustedPlatform = platform
+	}
+	return nil
+}
+
 func SetupHandlers(router *gin.Engine, db *gorm.DB) {
 	// Seed data commented out since CRUD operations are available
 	// database.SeedDB(db)
@@ -113,6 +149,10 @@ func SetupHandlers(router *gin.Engine, db *gorm.DB) {
 	adminController := controllers.NewAdminController(db)
 	assessmentController := controllers.NewAssessmentController(db)
 	amrapController := controllers.NewAMRAPController(db)
+	orderController := controllers.NewOrderController(db)
+	promotionController := controllers.NewPromotionController(db)
+	referralController := controllers.NewReferralController(db)
+	apiKeyController := controllers.NewAPIKeyController(db)
 
 	routes.RegisterHomeRoutes(router, homeController)
 	routes.RegisterHealthRoutes(router, healthController)
@@ -126,6 +166,10 @@ func SetupHandlers(router *gin.Engine, db *gorm.DB) {
 	routes.RegisterAdminRoutes(router, adminController)
 	routes.RegisterAssessmentRoutes(router, assessmentController)
 	routes.RegisterAMRAPRoutes(router, amrapController)
+	routes.RegisterOrderRoutes(router, orderController)
+	routes.RegisterPromotionRoutes(router, promotionController)
+	routes.RegisterReferralRoutes(router, referralController)
+	routes.RegisterAPIKeyRoutes(router, apiKeyController)
 
 	go func() {
 		workers.StartPaymentWorker(db, paymentController)
@@ -134,4 +178,7 @@ func SetupHandlers(router *gin.Engine, db *gorm.DB) {
 	go func() {
 		workers.StartReminderWorker(db)
 	}()
+
+	workers.StartEntitlementExpiryWorker(db)
+	workers.StartCartRecoveryWorker(db)
 }
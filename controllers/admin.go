@@ -8,17 +8,22 @@ import (
 	"strings"
 	"time"
 
+	"github.com/88warren/lmw-fitness-backend/audit"
+	"github.com/88warren/lmw-fitness-backend/lockout"
 	"github.com/88warren/lmw-fitness-backend/models"
+	"github.com/88warren/lmw-fitness-backend/rbac"
+	"github.com/88warren/lmw-fitness-backend/utils/money"
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 )
 
 type AdminController struct {
-	DB *gorm.DB
+	DB      *gorm.DB
+	Lockout *lockout.Limiter
 }
 
 func NewAdminController(db *gorm.DB) *AdminController {
-	return &AdminController{DB: db}
+	return &AdminController{DB: db, Lockout: lockout.New(lockout.NewStore(db))}
 }
 
 // Exercise Management
@@ -664,7 +669,11 @@ func (ac *AdminController) GetUser(c *gin.Context) {
 	}
 
 	var user models.User
-	if err := ac.DB.Select("id, email, role, created_at, updated_at").First(&user, id).Error; err != nil {
+	if err := ac.DB.Select("id, email, role, created_at, updated_at").
+		Preload("Revocations", func(db *gorm.DB) *gorm.DB {
+			return db.Order("created_at DESC")
+		}).
+		First(&user, id).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
 			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
 			return
@@ -702,23 +711,60 @@ func (ac *AdminController) UpdateUser(c *gin.Context) {
 		return
 	}
 
+	if updateData.IsActive != nil && !ac.canManageAccount(c, &user) {
+		return
+	}
+
 	// Update only the fields that are provided
 	updates := make(map[string]interface{})
-	if updateData.Role != "" {
-		if updateData.Role != "user" && updateData.Role != "admin" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role. Must be 'user' or 'admin'"})
+	if updateData.Role != "" && updateData.Role != user.Role {
+		if !callerCan(c, models.PermissionRolesManage) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden: you don't have permission to change roles", "permission": models.PermissionRolesManage})
+			return
+		}
+		exists, err := rbac.RoleExists(ac.DB, updateData.Role)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check role"})
 			return
 		}
+		if !exists {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role"})
+			return
+		}
+		if user.Role == models.RoleAdmin {
+			var adminCount int64
+			ac.DB.Model(&models.User{}).Where("role = ?", models.RoleAdmin).Count(&adminCount)
+			if adminCount <= 1 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Cannot change the role of the last admin user"})
+				return
+			}
+		}
 		updates["role"] = updateData.Role
 	}
-	if updateData.IsActive != nil {
+	if updateData.IsActive != nil && *updateData.IsActive != user.IsActive {
 		updates["is_active"] = *updateData.IsActive
 	}
 
+	current := map[string]interface{}{"role": user.Role, "is_active": user.IsActive}
 	if err := ac.DB.Model(&user).Updates(updates).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user"})
 		return
 	}
+	// A role change is recorded on its own, so searching for role changes
+	// finds exactly those
+	for key, after := range updates {
+		action := audit.ActionUserUpdated
+		if key == "role" {
+			action = audit.ActionUserRoleChanged
+		}
+		audit.Record(ac.DB, c, audit.Entry{
+			Action:     action,
+			TargetType: audit.TargetUser,
+			TargetID:   user.ID,
+			Before:     map[string]interface{}{key: current[key]},
+			After:      map[string]interface{}{key: after},
+		})
+	}
 
 	// Return updated user data (excluding sensitive fields)
 	var updatedUser models.User
@@ -748,6 +794,10 @@ func (ac *AdminController) DeleteUser(c *gin.Context) {
 		return
 	}
 
+	if !ac.canManageAccount(c, &user) {
+		return
+	}
+
 	// Prevent deletion of the last admin user
 	if user.Role == "admin" {
 		var adminCount int64
@@ -762,6 +812,12 @@ func (ac *AdminController) DeleteUser(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete user"})
 		return
 	}
+	audit.Record(ac.DB, c, audit.Entry{
+		Action:     audit.ActionUserDeleted,
+		TargetType: audit.TargetUser,
+		TargetID:   user.ID,
+		Before:     map[string]interface{}{"email": user.Email, "role": user.Role},
+	})
 
 	c.JSON(http.StatusNoContent, nil)
 }
@@ -783,6 +839,10 @@ func (ac *AdminController) ResetUserPassword(c *gin.Context) {
 		return
 	}
 
+	if !ac.canManageAccount(c, &user) {
+		return
+	}
+
 	// Reuse the password reset logic by creating a UserController instance
 	userController := NewUserController(ac.DB)
 
@@ -805,6 +865,8 @@ func (ac *AdminController) ResetUserPassword(c *gin.Context) {
 		return
 	}
 
+	audit.Record(ac.DB, c, audit.Entry{Action: audit.ActionUserPasswordReset, TargetType: audit.TargetUser, TargetID: user.ID})
+
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Password reset email sent successfully",
 		"email":   user.Email,
@@ -992,9 +1054,270 @@ func (ac *AdminController) GetAnalyticsDashboard(c *gin.Context) {
 			"exerciseCategories": exerciseCategories,
 			"recentActivity":     recentActivity,
 		},
-		"system":      systemHealth,
-		"generatedAt": time.Now(),
+		"system":       systemHealth,
+		"cartRecovery": ac.cartRecoveryStats(startDate),
+		"generatedAt":  time.Now(),
 	}
 
 	c.JSON(http.StatusOK, analytics)
 }
+
+// cartRecoveryStats summarises recovery emails and what they brought back
+// for the admin analytics dashboard.
+func (ac *AdminController) cartRecoveryStats(since time.Time) map[string]interface{} {
+	var abandoned, emailed, converted int64
+	ac.DB.Model(&models.CheckoutRecord{}).Where("status = ? AND expired_at >= ?", models.CheckoutStatusExpired, since).Count(&abandoned)
+	ac.DB.Model(&models.CheckoutRecord{}).Where("recovery_email_sent_at >= ?", since).Count(&emailed)
+	ac.DB.Model(&models.CheckoutRecord{}).Where("recovery_email_sent_at >= ? AND converted_at IS NOT NULL", since).Count(&converted)
+
+	var recoveredRevenue int64
+	ac.DB.Model(&models.Order{}).
+		Where("stripe_session_id IN (?)", ac.DB.Model(&models.CheckoutRecord{}).
+			Select("converted_session_id").
+			Where("recovery_email_sent_at >= ? AND converted_at IS NOT NULL", since)).
+		Select("COALESCE(SUM(total_amount), 0)").
+		Scan(&recoveredRevenue)
+
+	conversionRate := 0.0
+	if emailed > 0 {
+		conversionRate = float64(converted) / float64(emailed) * 100
+	}
+
+	return map[string]interface{}{
+		"abandonedCheckouts": abandoned,
+		"recoveryEmailsSent": emailed,
+		"recoveredCheckouts": converted,
+		"conversionRate":     conversionRate,
+		"recoveredRevenue":   recoveredRevenue,
+	}
+}
+
+// Product Catalog Management
+type ProductRequest struct {
+	Name             string  `json:"name" binding:"required"`
+	StripePriceID    string  `json:"stripePriceId" binding:"required"`
+	ProgramIDs       []uint  `json:"programIds"`
+	BrevoListIDs     []int64 `json:"brevoListIds"`
+	BrevoTemplateIDs []int64 `json:"brevoTemplateIds"`
+	IsActive         *bool   `json:"isActive"`
+	Recurring        bool    `json:"recurring"`
+	// Currency of StripePriceID, GBP when empty
+	Currency string                `json:"currency"`
+	Prices   []ProductPriceRequest `json:"prices"`
+}
+
+// ProductPriceRequest is the product's Stripe price in another currency.
+type ProductPriceRequest struct {
+	Currency      string `json:"currency" binding:"required,len=3"`
+	StripePriceID string `json:"stripePriceId" binding:"required"`
+}
+
+// productPrices checks the request has at most one price per currency and
+// none in the product's own currency, which StripePriceID already covers.
+func productPrices(req ProductRequest) (string, []models.ProductPrice, error) {
+	currency := money.Normalise(req.Currency)
+	if currency == "" {
+		currency = defaultCurrency
+	}
+	seen := map[string]bool{currency: true}
+	prices := []models.ProductPrice{}
+	for _, price := range req.Prices {
+		priceCurrency := money.Normalise(price.Currency)
+		if seen[priceCurrency] {
+			return "", nil, fmt.Errorf("more than one %s price", strings.ToUpper(priceCurrency))
+		}
+		seen[priceCurrency] = true
+		prices = append(prices, models.ProductPrice{
+			Currency:      priceCurrency,
+			StripePriceID: strings.TrimSpace(price.StripePriceID),
+		})
+	}
+	return currency, prices, nil
+}
+
+func (ac *AdminController) GetAllProducts(c *gin.Context) {
+	var products []models.Product
+	if err := ac.DB.Preload("Programs").Preload("Prices").Order("id").Find(&products).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve products"})
+		return
+	}
+	c.JSON(http.StatusOK, products)
+}
+
+func (ac *AdminController) GetProduct(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product ID"})
+		return
+	}
+
+	var product models.Product
+	if err := ac.DB.Preload("Programs").Preload("Prices").First(&product, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve product"})
+		return
+	}
+	c.JSON(http.StatusOK, product)
+}
+
+func (ac *AdminController) CreateProduct(c *gin.Context) {
+	var req ProductRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	programs, err := ac.findPrograms(req.ProgramIDs)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	currency, prices, err := productPrices(req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	product := models.Product{
+		Name:             req.Name,
+		StripePriceID:    strings.TrimSpace(req.StripePriceID),
+		Programs:         programs,
+		BrevoListIDs:     nonNilInt64s(req.BrevoListIDs),
+		BrevoTemplateIDs: nonNilInt64s(req.BrevoTemplateIDs),
+		IsActive:         req.IsActive == nil || *req.IsActive,
+		Recurring:        req.Recurring,
+		Currency:         currency,
+		Prices:           prices,
+	}
+
+	if err := ac.DB.Create(&product).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create product"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, product)
+}
+
+func (ac *AdminController) UpdateProduct(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product ID"})
+		return
+	}
+
+	var product models.Product
+	if err := ac.DB.First(&product, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to find product"})
+		return
+	}
+
+	var req ProductRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	programs, err := ac.findPrograms(req.ProgramIDs)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	currency, prices, err := productPrices(req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	product.Name = req.Name
+	product.StripePriceID = strings.TrimSpace(req.StripePriceID)
+	product.BrevoListIDs = nonNilInt64s(req.BrevoListIDs)
+	product.BrevoTemplateIDs = nonNilInt64s(req.BrevoTemplateIDs)
+	product.Recurring = req.Recurring
+	product.Currency = currency
+	if req.IsActive != nil {
+		product.IsActive = *req.IsActive
+	}
+
+	tx := ac.DB.Begin()
+	if err := tx.Save(&product).Error; err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update product"})
+		return
+	}
+	if err := tx.Model(&product).Association("Programs").Replace(programs); err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update product programs"})
+		return
+	}
+	// Old prices are removed outright so their Stripe price IDs can be reused
+	if err := tx.Unscoped().Where("product_id = ?", product.ID).Delete(&models.ProductPrice{}).Error; err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update product prices"})
+		return
+	}
+	for i := range prices {
+		prices[i].ProductID = product.ID
+	}
+	if len(prices) > 0 {
+		if err := tx.Create(&prices).Error; err != nil {
+			tx.Rollback()
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to save product prices, check each Stripe price ID is only used once"})
+			return
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit changes"})
+		return
+	}
+
+	var updatedProduct models.Product
+	if err := ac.DB.Preload("Programs").Preload("Prices").First(&updatedProduct, product.ID).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch updated product"})
+		return
+	}
+
+	c.JSON(http.StatusOK, updatedProduct)
+}
+
+func (ac *AdminController) DeleteProduct(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product ID"})
+		return
+	}
+
+	if err := ac.DB.Delete(&models.Product{}, id).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete product"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Product deleted successfully"})
+}
+
+func (ac *AdminController) findPrograms(ids []uint) ([]models.WorkoutProgram, error) {
+	programs := []models.WorkoutProgram{}
+	if len(ids) == 0 {
+		return programs, nil
+	}
+	if err := ac.DB.Where("id IN ?", ids).Find(&programs).Error; err != nil {
+		return nil, fmt.Errorf("failed to load programs")
+	}
+	if len(programs) != len(ids) {
+		return nil, fmt.Errorf("one or more program IDs do not exist")
+	}
+	return programs, nil
+}
+
+func nonNilInt64s(values []int64) []int64 {
+	if values == nil {
+		return []int64{}
+	}
+	return values
+}
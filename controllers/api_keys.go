@@ -0,0 +1,180 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/88warren/lmw-fitness-backend/audit"
+	"github.com/88warren/lmw-fitness-backend/models"
+	"github.com/88warren/lmw-fitness-backend/rbac"
+	"github.com/88warren/lmw-fitness-backend/utils/auth"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultAPIKeyLifetimeDays = 90
+	maxAPIKeyLifetimeDays     = 365
+)
+
+type APIKeyController struct {
+	DB *gorm.DB
+}
+
+func NewAPIKeyController(db *gorm.DB) *APIKeyController {
+	return &APIKeyController{DB: db}
+}
+
+type CreateAPIKeyRequest struct {
+	Name   string   `json:"name" binding:"required"`
+	Scopes []string `json:"scopes" binding:"required"`
+	// ExpiresInDays defaults to 90 and can be at most 365
+	ExpiresInDays int `json:"expiresInDays"`
+}
+
+// ListMyAPIKeys lists the caller's keys, including revoked and expired
+// ones, newest first.
+func (kc *APIKeyController) ListMyAPIKeys(c *gin.Context) {
+	var keys []models.APIKey
+	if err := kc.DB.Where("user_id = ?", c.GetUint("userID")).Order("created_at DESC").Find(&keys).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve API keys"})
+		return
+	}
+	c.JSON(http.StatusOK, keys)
+}
+
+// CreateAPIKey issues a key for the caller. Scopes must be permissions the
+// caller has. The key is only ever shown in this response.
+func (kc *APIKeyController) CreateAPIKey(c *gin.Context) {
+	var req CreateAPIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 100 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Name must be between 1 and 100 characters"})
+		return
+	}
+	if req.ExpiresInDays == 0 {
+		req.ExpiresInDays = defaultAPIKeyLifetimeDays
+	}
+	if req.ExpiresInDays < 1 || req.ExpiresInDays > maxAPIKeyLifetimeDays {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expiresInDays must be between 1 and 365"})
+		return
+	}
+
+	scopes := rbac.Set{}
+	for _, scope := range req.Scopes {
+		if !callerCan(c, scope) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "You can only give a key permissions you have", "scope": scope})
+			return
+		}
+		scopes[scope] = true
+	}
+	if len(scopes) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A key needs at least one scope"})
+		return
+	}
+
+	key, prefix, hash, err := auth.NewAPIKey()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+		return
+	}
+	apiKey := models.APIKey{
+		UserID:    c.GetUint("userID"),
+		Name:      req.Name,
+		Prefix:    prefix,
+		KeyHash:   hash,
+		Scopes:    scopes.Names(),
+		ExpiresAt: time.Now().AddDate(0, 0, req.ExpiresInDays),
+	}
+	if err := kc.DB.Create(&apiKey).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+		return
+	}
+	log.Printf("User %d created API key %s with scopes %v", apiKey.UserID, apiKey.Prefix, apiKey.Scopes)
+	audit.Record(kc.DB, c, audit.Entry{
+		Action:     audit.ActionAPIKeyCreated,
+		TargetType: audit.TargetAPIKey,
+		TargetID:   apiKey.ID,
+		After: map[string]interface{}{
+			"name":      apiKey.Name,
+			"prefix":    apiKey.Prefix,
+			"scopes":    apiKey.Scopes,
+			"expiresAt": apiKey.ExpiresAt,
+		},
+	})
+
+	c.JSON(http.StatusCreated, gin.H{
+		"key":    key,
+		"apiKey": apiKey,
+	})
+}
+
+// RevokeMyAPIKey revokes one of the caller's keys.
+func (kc *APIKeyController) RevokeMyAPIKey(c *gin.Context) {
+	kc.revoke(c, kc.DB.Where("user_id = ?", c.GetUint("userID")))
+}
+
+// ListAPIKeys lists every user's keys for staff, optionally for one user.
+func (kc *APIKeyController) ListAPIKeys(c *gin.Context) {
+	query := kc.DB.Preload("User").Order("created_at DESC")
+	if userID := c.Query("userId"); userID != "" {
+		query = query.Where("user_id = ?", userID)
+	}
+	var keys []models.APIKey
+	if err := query.Find(&keys).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve API keys"})
+		return
+	}
+
+	response := make([]gin.H, 0, len(keys))
+	for _, key := range keys {
+		response = append(response, gin.H{"apiKey": key, "email": key.User.Email})
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// RevokeAPIKey lets staff revoke anyone's key, such as one that leaked.
+func (kc *APIKeyController) RevokeAPIKey(c *gin.Context) {
+	kc.revoke(c, kc.DB)
+}
+
+func (kc *APIKeyController) revoke(c *gin.Context, scope *gorm.DB) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid API key ID"})
+		return
+	}
+
+	var apiKey models.APIKey
+	if err := scope.First(&apiKey, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve API key"})
+		return
+	}
+	if apiKey.RevokedAt == nil {
+		now := time.Now()
+		if err := kc.DB.Model(&apiKey).Update("revoked_at", now).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke API key"})
+			return
+		}
+		apiKey.RevokedAt = &now
+		log.Printf("API key %s of user %d revoked by user %d", apiKey.Prefix, apiKey.UserID, c.GetUint("userID"))
+		audit.Record(kc.DB, c, audit.Entry{
+			Action:     audit.ActionAPIKeyRevoked,
+			TargetType: audit.TargetAPIKey,
+			TargetID:   apiKey.ID,
+			Metadata:   map[string]interface{}{"prefix": apiKey.Prefix, "ownerId": apiKey.UserID},
+		})
+	}
+	c.JSON(http.StatusOK, apiKey)
+}
@@ -332,28 +332,16 @@ func (ac *AssessmentController) GetDay1Assessment(c *gin.Context) {
 	c.JSON(http.StatusOK, response)
 }
 
-// GetAllDay1Assessments gets all Day 1 assessments for debugging (admin only)
+// GetAllDay1Assessments lists clients' Day 1 assessments. Coaches see their
+// own clients'; account managers see everyone's.
 func (ac *AssessmentController) GetAllDay1Assessments(c *gin.Context) {
-	userID, exists := c.Get("userID")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
-		return
-	}
-
-	// Get user to check if admin
-	var user models.User
-	if err := ac.DB.First(&user, userID).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user"})
-		return
-	}
-
-	if user.Role != "admin" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Admin access required"})
-		return
+	query := ac.DB.Where("day_number = ?", 1)
+	if !callerCan(c, models.PermissionUsersWrite) {
+		query = query.Where("user_id IN (?)", ac.DB.Model(&models.User{}).Select("id").Where("coach_id = ?", c.GetUint("userID")))
 	}
 
 	var assessments []models.FitnessAssessment
-	if err := ac.DB.Where("day_number = ?", 1).
+	if err := query.
 		Preload("User").
 		Order("created_at DESC").
 		Find(&assessments).Error; err != nil {
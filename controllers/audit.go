@@ -0,0 +1,176 @@
+package controllers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/88warren/lmw-fitness-backend/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// auditQuery applies the audit log filters: action, actorId, targetType,
+// targetId and a date range (YYYY-MM-DD, inclusive).
+func (ac *AdminController) auditQuery(c *gin.Context) (*gorm.DB, error) {
+	query := ac.DB.Model(&models.AuditEvent{})
+
+	if action := c.Query("action"); action != "" {
+		query = query.Where("action = ?", action)
+	}
+	if actorID := c.Query("actorId"); actorID != "" {
+		id, err := strconv.ParseUint(actorID, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'actorId'")
+		}
+		query = query.Where("actor_id = ?", id)
+	}
+	if targetType := c.Query("targetType"); targetType != "" {
+		query = query.Where("target_type = ?", targetType)
+	}
+	if targetID := c.Query("targetId"); targetID != "" {
+		id, err := strconv.ParseUint(targetID, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'targetId'")
+		}
+		query = query.Where("target_id = ?", id)
+	}
+	if from := c.Query("from"); from != "" {
+		fromDate, err := time.Parse("2006-01-02", from)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'from' date, expected YYYY-MM-DD")
+		}
+		query = query.Where("created_at >= ?", fromDate)
+	}
+	if to := c.Query("to"); to != "" {
+		toDate, err := time.Parse("2006-01-02", to)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'to' date, expected YYYY-MM-DD")
+		}
+		query = query.Where("created_at < ?", toDate.AddDate(0, 0, 1))
+	}
+	return query, nil
+}
+
+// SearchAuditEvents lists audit events, newest first.
+func (ac *AdminController) SearchAuditEvents(c *gin.Context) {
+	query, err := ac.auditQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search audit log"})
+		return
+	}
+
+	limit := 50
+	if l, err := strconv.Atoi(c.Query("limit")); err == nil && l > 0 && l <= 500 {
+		limit = l
+	}
+	offset := 0
+	if o, err := strconv.Atoi(c.Query("offset")); err == nil && o > 0 {
+		offset = o
+	}
+
+	var events []models.AuditEvent
+	if err := query.Order("created_at DESC, id DESC").Limit(limit).Offset(offset).Find(&events).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search audit log"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"events": events,
+		"total":  total,
+		"limit":  limit,
+		"offset": offset,
+	})
+}
+
+// ExportAuditEvents returns the filtered audit log as CSV, with the diffs
+// and metadata written as JSON. Rows are streamed, so exporting the whole
+// log doesn't hold it all in memory.
+func (ac *AdminController) ExportAuditEvents(c *gin.Context) {
+	query, err := ac.auditQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	rows, err := query.Order("created_at DESC, id DESC").Rows()
+	if err != nil {
+		log.Printf("Error exporting audit log: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to export audit log"})
+		return
+	}
+	defer rows.Close()
+
+	c.Header("Content-Type", "text/csv")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="audit-log-%s.csv"`, time.Now().Format("2006-01-02")))
+	c.Status(http.StatusOK)
+
+	w := csv.NewWriter(c.Writer)
+	w.Write([]string{"id", "created_at", "action", "actor_id", "actor_email", "actor_api_key_id", "target_type", "target_id", "before", "after", "metadata", "ip_address", "user_agent"})
+	for rows.Next() {
+		var event models.AuditEvent
+		if err := ac.DB.ScanRows(rows, &event); err != nil {
+			log.Printf("Error reading audit event for export: %v", err)
+			break
+		}
+		w.Write([]string{
+			strconv.FormatUint(uint64(event.ID), 10),
+			event.CreatedAt.UTC().Format(time.RFC3339),
+			event.Action,
+			optionalID(event.ActorID),
+			csvCell(event.ActorEmail),
+			optionalID(event.ActorAPIKeyID),
+			event.TargetType,
+			optionalID(event.TargetID),
+			csvCell(jsonCell(event.Before)),
+			csvCell(jsonCell(event.After)),
+			csvCell(jsonCell(event.Metadata)),
+			event.IPAddress,
+			csvCell(event.UserAgent),
+		})
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Error exporting audit log: %v", err)
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		log.Printf("Error writing audit log CSV: %v", err)
+	}
+}
+
+func optionalID(id *uint) string {
+	if id == nil {
+		return ""
+	}
+	return strconv.FormatUint(uint64(*id), 10)
+}
+
+func jsonCell(value map[string]interface{}) string {
+	if len(value) == 0 {
+		return ""
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return ""
+	}
+	return string(encoded)
+}
+
+// csvCell stops spreadsheets treating user-supplied text, such as a user
+// agent, as a formula.
+func csvCell(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
@@ -0,0 +1,111 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/88warren/lmw-fitness-backend/models"
+	"github.com/88warren/lmw-fitness-backend/workers"
+	"github.com/stripe/stripe-go/v82"
+	"gorm.io/gorm/clause"
+)
+
+// recordCheckoutSession remembers a newly created session so it can be
+// followed up if it is never paid.
+func (pc *PaymentController) recordCheckoutSession(checkoutSession *stripe.CheckoutSession, email string, priceIDs []string, productNames []string, couponCode string) error {
+	record := models.CheckoutRecord{
+		SessionID:     checkoutSession.ID,
+		CustomerEmail: strings.ToLower(strings.TrimSpace(email)),
+		Status:        models.CheckoutStatusOpen,
+		PriceIDs:      priceIDs,
+		ProductNames:  productNames,
+		AmountTotal:   checkoutSession.AmountTotal,
+		Currency:      string(checkoutSession.Currency),
+		CouponCode:    normalisePromotionCode(couponCode),
+	}
+	return pc.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "session_id"}},
+		DoNothing: true,
+	}).Create(&record).Error
+}
+
+// markCheckoutCompleted closes a paid session's record and, if the customer
+// was sent a recovery email recently, counts the purchase as a recovered
+// cart.
+func (pc *PaymentController) markCheckoutCompleted(sessionID, email string) error {
+	now := time.Now()
+	if err := pc.DB.Model(&models.CheckoutRecord{}).
+		Where("session_id = ? AND status <> ?", sessionID, models.CheckoutStatusCompleted).
+		Updates(map[string]interface{}{
+			"status":       models.CheckoutStatusCompleted,
+			"completed_at": now,
+		}).Error; err != nil {
+		return fmt.Errorf("could not mark checkout %s completed: %w", sessionID, err)
+	}
+
+	var recovered models.CheckoutRecord
+	err := pc.DB.Where("customer_email = ? AND session_id <> ? AND converted_at IS NULL AND recovery_email_sent_at > ?",
+		strings.ToLower(email), sessionID, now.Add(-workers.CartRecoveryAttributionWindow)).
+		Order("recovery_email_sent_at DESC").
+		First(&recovered).Error
+	if err != nil {
+		return nil
+	}
+	if err := pc.DB.Model(&recovered).Updates(map[string]interface{}{
+		"converted_at":         now,
+		"converted_session_id": sessionID,
+	}).Error; err != nil {
+		return fmt.Errorf("could not mark checkout %s recovered: %w", recovered.SessionID, err)
+	}
+	log.Printf("Abandoned checkout %s recovered by session %s", recovered.SessionID, sessionID)
+	return nil
+}
+
+// markCheckoutExpired records that a session was abandoned. Sessions created
+// before records were kept are added from the event so they can still be
+// followed up.
+func (pc *PaymentController) markCheckoutExpired(checkoutSession *stripe.CheckoutSession) error {
+	now := time.Now()
+	result := pc.DB.Model(&models.CheckoutRecord{}).
+		Where("session_id = ? AND status = ?", checkoutSession.ID, models.CheckoutStatusOpen).
+		Updates(map[string]interface{}{
+			"status":     models.CheckoutStatusExpired,
+			"expired_at": now,
+		})
+	if result.Error != nil {
+		return fmt.Errorf("could not mark checkout %s expired: %w", checkoutSession.ID, result.Error)
+	}
+	if result.RowsAffected > 0 {
+		return nil
+	}
+
+	email := checkoutSession.CustomerEmail
+	if email == "" && checkoutSession.CustomerDetails != nil {
+		email = checkoutSession.CustomerDetails.Email
+	}
+	if email == "" {
+		return nil
+	}
+
+	productNames := []string{}
+	if raw := checkoutSession.Metadata["purchased_products"]; raw != "" {
+		// Stored as fmt's rendering of a slice, e.g. "[Program A Program B]"
+		productNames = append(productNames, strings.Trim(raw, "[]"))
+	}
+	record := models.CheckoutRecord{
+		SessionID:     checkoutSession.ID,
+		CustomerEmail: strings.ToLower(email),
+		Status:        models.CheckoutStatusExpired,
+		PriceIDs:      []string{},
+		ProductNames:  productNames,
+		AmountTotal:   checkoutSession.AmountTotal,
+		Currency:      string(checkoutSession.Currency),
+		ExpiredAt:     &now,
+	}
+	return pc.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "session_id"}},
+		DoNothing: true,
+	}).Create(&record).Error
+}
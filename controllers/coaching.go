@@ -0,0 +1,126 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/88warren/lmw-fitness-backend/audit"
+	"github.com/88warren/lmw-fitness-backend/models"
+	"github.com/88warren/lmw-fitness-backend/rbac"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// GetClientProgress shows a coach how a client is getting on: their
+// programs, streaks, fitness assessments and AMRAP scores.
+func (ac *AdminController) GetClientProgress(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	var user models.User
+	if err := ac.DB.Preload("UserPrograms.WorkoutProgram").First(&user, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user"})
+		return
+	}
+
+	// Coaches see their own clients; account managers see everyone
+	if !callerCan(c, models.PermissionUsersWrite) && (user.CoachID == nil || *user.CoachID != c.GetUint("userID")) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden: this client isn't assigned to you"})
+		return
+	}
+
+	var assessments []models.FitnessAssessment
+	if err := ac.DB.Where("user_id = ?", user.ID).Preload("Exercise").Order("recorded_date DESC").Find(&assessments).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve assessments"})
+		return
+	}
+	var amrapScores []models.AMRAPScore
+	if err := ac.DB.Where("user_id = ?", user.ID).Order("recorded_date DESC").Find(&amrapScores).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve AMRAP scores"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"id":                user.ID,
+		"email":             user.Email,
+		"programs":          purchasedProgramNames(&user),
+		"programStartDates": user.ProgramStartDates,
+		"completedDaysList": user.CompletedDaysList,
+		"lastWorkoutDate":   user.LastWorkoutDate,
+		"currentStreak":     user.CurrentStreak,
+		"longestStreak":     user.LongestStreak,
+		"assessments":       assessments,
+		"amrapScores":       amrapScores,
+	})
+}
+
+// AssignCoach sets or clears the coach who follows a client. The coach must
+// hold coaching:clients.
+func (ac *AdminController) AssignCoach(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	var req struct {
+		CoachID *uint `json:"coachId"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var user models.User
+	if err := ac.DB.First(&user, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user"})
+		return
+	}
+
+	if req.CoachID != nil {
+		var coach models.User
+		if err := ac.DB.First(&coach, *req.CoachID).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Coach not found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve coach"})
+			return
+		}
+		permissions, err := rbac.Permissions(ac.DB, coach.Role)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check permissions"})
+			return
+		}
+		if !permissions.Has(models.PermissionCoachingClients) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "That user can't coach clients"})
+			return
+		}
+	}
+
+	before := map[string]interface{}{"coach_id": user.CoachID}
+	if err := ac.DB.Model(&user).Update("coach_id", req.CoachID).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to assign coach"})
+		return
+	}
+	audit.Record(ac.DB, c, audit.Entry{
+		Action:     audit.ActionCoachAssigned,
+		TargetType: audit.TargetUser,
+		TargetID:   user.ID,
+		Before:     before,
+		After:      map[string]interface{}{"coach_id": req.CoachID},
+	})
+
+	c.JSON(http.StatusOK, gin.H{"id": user.ID, "coachId": req.CoachID})
+}
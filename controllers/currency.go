@@ -0,0 +1,180 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/88warren/lmw-fitness-backend/models"
+	"github.com/88warren/lmw-fitness-backend/utils/money"
+	"github.com/gin-gonic/gin"
+)
+
+const defaultCurrency = "gbp"
+
+// Currencies customers can check out in
+var checkoutCurrencies = map[string]bool{"gbp": true, "eur": true, "usd": true}
+
+var countryCurrencies = map[string]string{
+	"GB": "gbp", "IM": "gbp", "JE": "gbp", "GG": "gbp",
+	"US": "usd",
+	"AT": "eur", "BE": "eur", "CY": "eur", "DE": "eur", "EE": "eur", "ES": "eur", "FI": "eur",
+	"FR": "eur", "GR": "eur", "HR": "eur", "IE": "eur", "IT": "eur", "LT": "eur", "LU": "eur",
+	"LV": "eur", "MT": "eur", "NL": "eur", "PT": "eur", "SI": "eur", "SK": "eur",
+}
+
+// Country headers set by the CDN or load balancer in front of the API
+var geoCountryHeaders = []string{"CF-IPCountry", "X-Country-Code", "X-AppEngine-Country"}
+
+// requestCurrency picks the currency the customer asked for, otherwise the
+// one for the country their request came from, otherwise GBP.
+func requestCurrency(c *gin.Context, requested string) (string, error) {
+	if requested = money.Normalise(requested); requested != "" {
+		if !checkoutCurrencies[requested] {
+			return "", fmt.Errorf("%w %q", errUnsupportedCurrency, requested)
+		}
+		return requested, nil
+	}
+	for _, header := range geoCountryHeaders {
+		if country := strings.ToUpper(strings.TrimSpace(c.GetHeader(header))); country != "" {
+			if currency, ok := countryCurrencies[country]; ok {
+				return currency, nil
+			}
+			break
+		}
+	}
+	return defaultCurrency, nil
+}
+
+func productCurrency(product models.Product) string {
+	if product.Currency == "" {
+		return defaultCurrency
+	}
+	return money.Normalise(product.Currency)
+}
+
+// localPriceID is the product's Stripe price in currency, if it has one.
+func localPriceID(product models.Product, currency string) (string, bool) {
+	if productCurrency(product) == currency {
+		return product.StripePriceID, true
+	}
+	for _, price := range product.Prices {
+		if money.Normalise(price.Currency) == currency {
+			return price.StripePriceID, true
+		}
+	}
+	return "", false
+}
+
+// localiseItems swaps each item's price for its product's price in
+// currency and adds the new price IDs to the catalog. A Stripe session has
+// a single currency, so if any product isn't priced in it the basket stays
+// in the products' own currency. It returns the currency used.
+func localiseItems(items []CheckoutItem, catalog map[string]models.Product, currency string) ([]CheckoutItem, string) {
+	localised := make([]CheckoutItem, 0, len(items))
+	for _, item := range items {
+		product, ok := catalog[item.PriceID]
+		if !ok {
+			localised = append(localised, item)
+			continue
+		}
+		priceID, ok := localPriceID(product, currency)
+		if !ok {
+			log.Printf("%s has no %s price, checking out in the default currency", product.Name, strings.ToUpper(currency))
+			if currency == defaultCurrency {
+				return items, defaultCurrency
+			}
+			return localiseItems(items, catalog, defaultCurrency)
+		}
+		catalog[priceID] = product
+		localised = append(localised, CheckoutItem{PriceID: priceID, Quantity: item.Quantity})
+	}
+	return localised, currency
+}
+
+var (
+	errUnsupportedCurrency = errors.New("unsupported currency")
+	errProductUnavailable  = errors.New("no longer available")
+)
+
+// localisedBasket loads the basket's products and moves it onto their
+// prices in the customer's currency, refusing products that have been
+// deactivated. The catalog it returns covers both the
+// requested and the localised price IDs.
+func (pc *PaymentController) localisedBasket(c *gin.Context, requested string, items []CheckoutItem) ([]CheckoutItem, map[string]models.Product, string, error) {
+	currency, err := requestCurrency(c, requested)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	priceIDs := make([]string, 0, len(items))
+	for _, item := range items {
+		priceIDs = append(priceIDs, item.PriceID)
+	}
+	catalog, err := pc.productsByPriceID(priceIDs)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	for _, priceID := range priceIDs {
+		if product, ok := catalog[priceID]; ok && !product.IsActive {
+			return nil, nil, "", fmt.Errorf("%s is %w", product.Name, errProductUnavailable)
+		}
+	}
+	localised, currency := localiseItems(items, catalog, currency)
+	return localised, catalog, currency, nil
+}
+
+type LocalPrice struct {
+	ProductID  uint   `json:"productId"`
+	Name       string `json:"name"`
+	PriceID    string `json:"priceId"`
+	Currency   string `json:"currency"`
+	UnitAmount int64  `json:"unitAmount"`
+	Formatted  string `json:"formatted"`
+	Recurring  bool   `json:"recurring"`
+}
+
+// ListPrices shows active products at their price in the customer's
+// currency, or in the product's own currency where it has no local price.
+// PriceID is the product's default price, which checkout accepts in any
+// currency.
+func (pc *PaymentController) ListPrices(c *gin.Context) {
+	currency, err := requestCurrency(c, c.Query("currency"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var products []models.Product
+	if err := pc.DB.Preload("Prices").Where("is_active = ?", true).Order("id").Find(&products).Error; err != nil {
+		log.Printf("Error loading products for price list: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not load prices"})
+		return
+	}
+
+	prices := make([]LocalPrice, 0, len(products))
+	for _, product := range products {
+		priceID, ok := localPriceID(product, currency)
+		if !ok {
+			priceID = product.StripePriceID
+		}
+		price, err := pc.Gateway.GetPrice(priceID)
+		if err != nil {
+			log.Printf("Error fetching Stripe price %s for %s: %v", priceID, product.Name, err)
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Could not load prices"})
+			return
+		}
+		priceCurrency := money.Normalise(string(price.Currency))
+		prices = append(prices, LocalPrice{
+			ProductID:  product.ID,
+			Name:       product.Name,
+			PriceID:    product.StripePriceID,
+			Currency:   priceCurrency,
+			UnitAmount: price.UnitAmount,
+			Formatted:  money.Format(price.UnitAmount, priceCurrency),
+			Recurring:  product.Recurring,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"currency": currency, "prices": prices})
+}
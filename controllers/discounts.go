@@ -0,0 +1,548 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/88warren/lmw-fitness-backend/models"
+	"github.com/stripe/stripe-go/v82"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const promotionMetadataKey = "promotion_id"
+
+// promotionReservationHold is how long a checkout holds a use of a promotion
+// when Stripe doesn't say when the session expires. It matches Stripe's
+// default session lifetime.
+const promotionReservationHold = 24 * time.Hour
+
+// promotionError is a reason a code can't be used that is safe to show the
+// customer.
+type promotionError struct {
+	message string
+}
+
+func (e *promotionError) Error() string {
+	return e.message
+}
+
+func promotionRejected(format string, args ...interface{}) error {
+	return &promotionError{message: fmt.Sprintf(format, args...)}
+}
+
+// cartLine is a basket item priced from Stripe rather than the client.
+type cartLine struct {
+	PriceID    string
+	ProductID  uint
+	Quantity   int64
+	UnitAmount int64
+	Currency   string
+}
+
+func (l cartLine) amount() int64 {
+	return l.UnitAmount * l.Quantity
+}
+
+// cartDiscount is what a code takes off a basket, in pence.
+type cartDiscount struct {
+	Code        string
+	Description string
+	Currency    string
+	Subtotal    int64
+	Discount    int64
+
+	promotion           *models.Promotion
+	referral            *models.ReferralCode
+	stripePromotionCode *stripe.PromotionCode
+}
+
+func normalisePromotionCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+func (pc *PaymentController) priceCart(items []CheckoutItem) ([]cartLine, error) {
+	priceIDs := make([]string, 0, len(items))
+	for _, item := range items {
+		priceIDs = append(priceIDs, item.PriceID)
+	}
+	catalog, err := pc.productsByPriceID(priceIDs)
+	if err != nil {
+		return nil, fmt.Errorf("error loading products: %w", err)
+	}
+
+	lines := make([]cartLine, 0, len(items))
+	for _, item := range items {
+		price, err := pc.Gateway.GetPrice(item.PriceID)
+		if err != nil {
+			return nil, promotionRejected("Unknown item in basket: %s", item.PriceID)
+		}
+		quantity := item.Quantity
+		if quantity < 1 {
+			quantity = 1
+		}
+		lines = append(lines, cartLine{
+			PriceID:    item.PriceID,
+			ProductID:  catalog[item.PriceID].ID,
+			Quantity:   quantity,
+			UnitAmount: price.UnitAmount,
+			Currency:   string(price.Currency),
+		})
+	}
+	return lines, nil
+}
+
+func cartSubtotal(lines []cartLine) (int64, string) {
+	var subtotal int64
+	currency := ""
+	for _, line := range lines {
+		subtotal += line.amount()
+		if currency == "" {
+			currency = line.Currency
+		}
+	}
+	return subtotal, currency
+}
+
+// promotionDiscount works out a promotion's discount on the lines it applies
+// to. Percentages are rounded to the nearest penny, half up.
+func promotionDiscount(promo *models.Promotion, lines []cartLine) int64 {
+	var eligible int64
+	for _, line := range lines {
+		if promotionCoversProduct(promo, line.ProductID) {
+			eligible += line.amount()
+		}
+	}
+
+	var off int64
+	switch promo.DiscountType {
+	case models.PromotionTypePercent:
+		off = (eligible*promo.PercentOff + 50) / 100
+	case models.PromotionTypeAmount:
+		off = promo.AmountOff
+	}
+	if off > eligible {
+		off = eligible
+	}
+	return off
+}
+
+// promotionBundled tells whether the basket holds a product the promotion
+// doesn't cover, which a bundle promotion needs before it applies.
+func promotionBundled(promo *models.Promotion, lines []cartLine) bool {
+	for _, line := range lines {
+		if !promotionCoversProduct(promo, line.ProductID) {
+			return true
+		}
+	}
+	return false
+}
+
+func promotionCoversProduct(promo *models.Promotion, productID uint) bool {
+	if len(promo.ProductIDs) == 0 {
+		return true
+	}
+	for _, id := range promo.ProductIDs {
+		if id == productID && productID != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// stripeCouponDiscount applies a coupon created in the Stripe dashboard,
+// for codes that have no local promotion.
+func stripeCouponDiscount(coupon *stripe.Coupon, subtotal int64) int64 {
+	var off int64
+	if coupon.AmountOff > 0 {
+		off = coupon.AmountOff
+	} else if coupon.PercentOff > 0 {
+		basisPoints := int64(math.Round(coupon.PercentOff * 100))
+		off = (subtotal*basisPoints + 5000) / 10000
+	}
+	if off > subtotal {
+		off = subtotal
+	}
+	return off
+}
+
+// checkPromotion enforces a promotion's rules for a customer and basket.
+func (pc *PaymentController) checkPromotion(promo *models.Promotion, email string, lines []cartLine, now time.Time) error {
+	if !promo.IsActive {
+		return promotionRejected("Coupon '%s' is no longer valid", promo.Code)
+	}
+	if promo.StartsAt != nil && now.Before(*promo.StartsAt) {
+		return promotionRejected("Coupon '%s' is not valid yet", promo.Code)
+	}
+	if promo.EndsAt != nil && !now.Before(*promo.EndsAt) {
+		return promotionRejected("Coupon '%s' has expired", promo.Code)
+	}
+
+	for _, line := range lines {
+		if promo.DiscountType == models.PromotionTypeAmount && !strings.EqualFold(line.Currency, promo.Currency) {
+			return promotionRejected("Coupon '%s' can't be used with %s prices", promo.Code, strings.ToUpper(line.Currency))
+		}
+	}
+
+	if promo.RequiresOtherProduct && !promotionBundled(promo, lines) {
+		return promotionRejected("Coupon '%s' only applies when bought with another product", promo.Code)
+	}
+
+	if promo.MaxRedemptionsPerUser > 0 || promo.FirstPurchaseOnly {
+		if email == "" {
+			return promotionRejected("Enter your email address to use coupon '%s'", promo.Code)
+		}
+	}
+	if err := checkPromotionLimits(pc.DB, promo, email, now); err != nil {
+		return err
+	}
+	if promo.FirstPurchaseOnly {
+		// Stripe keeps the email as the customer typed it, so an earlier
+		// order may differ from this one in case
+		var orders int64
+		if err := pc.DB.Model(&models.Order{}).Where("LOWER(customer_email) = LOWER(?)", email).Count(&orders).Error; err != nil {
+			return fmt.Errorf("could not count orders for %s: %w", email, err)
+		}
+		if orders > 0 {
+			return promotionRejected("Coupon '%s' is only valid on your first purchase", promo.Code)
+		}
+	}
+
+	if promotionDiscount(promo, lines) == 0 {
+		return promotionRejected("Coupon '%s' doesn't apply to the items in your basket", promo.Code)
+	}
+	return nil
+}
+
+// checkPromotionLimits counts paid uses of a promotion and those held by
+// open checkouts against its limits.
+func checkPromotionLimits(db *gorm.DB, promo *models.Promotion, email string, now time.Time) error {
+	if promo.MaxRedemptions > 0 {
+		var used int64
+		if err := db.Model(&models.PromotionRedemption{}).
+			Where("promotion_id = ? AND (reserved_until IS NULL OR reserved_until > ?)", promo.ID, now).
+			Count(&used).Error; err != nil {
+			return fmt.Errorf("could not count redemptions of %s: %w", promo.Code, err)
+		}
+		if used >= promo.MaxRedemptions {
+			return promotionRejected("Coupon '%s' has been fully redeemed", promo.Code)
+		}
+	}
+	if promo.MaxRedemptionsPerUser > 0 {
+		var used int64
+		if err := db.Model(&models.PromotionRedemption{}).
+			Where("promotion_id = ? AND customer_email = ? AND (reserved_until IS NULL OR reserved_until > ?)", promo.ID, email, now).
+			Count(&used).Error; err != nil {
+			return fmt.Errorf("could not count redemptions of %s: %w", promo.Code, err)
+		}
+		if used >= promo.MaxRedemptionsPerUser {
+			return promotionRejected("You have already used coupon '%s'", promo.Code)
+		}
+	}
+	return nil
+}
+
+// reservePromotion holds a use of a promotion for a checkout about to be
+// created, so customers paying at the same time can't take it past its
+// limits. The reservation is keyed by a placeholder until the session
+// exists; see attachPromotionReservation.
+func (pc *PaymentController) reservePromotion(promo *models.Promotion, email string) (*models.PromotionRedemption, error) {
+	placeholder, err := GenerateRandomToken()
+	if err != nil {
+		return nil, fmt.Errorf("could not generate reservation ID: %w", err)
+	}
+	now := time.Now()
+	until := now.Add(promotionReservationHold)
+	reservation := models.PromotionRedemption{
+		PromotionID:   promo.ID,
+		SessionID:     "reserved_" + placeholder,
+		CustomerEmail: email,
+		ReservedUntil: &until,
+	}
+	err = pc.DB.Transaction(func(tx *gorm.DB) error {
+		// Checkouts for the same promotion queue on this lock, so each one
+		// counts the reservations made before it
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&models.Promotion{}, promo.ID).Error; err != nil {
+			return fmt.Errorf("could not lock promotion %s: %w", promo.Code, err)
+		}
+		if err := checkPromotionLimits(tx, promo, email, now); err != nil {
+			return err
+		}
+		return tx.Create(&reservation).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &reservation, nil
+}
+
+// attachPromotionReservation keys a reservation by its checkout session and
+// holds it until the session expires.
+func (pc *PaymentController) attachPromotionReservation(reservation *models.PromotionRedemption, checkoutSession *stripe.CheckoutSession) error {
+	until := time.Now().Add(promotionReservationHold)
+	if checkoutSession.ExpiresAt > 0 {
+		until = time.Unix(checkoutSession.ExpiresAt, 0)
+	}
+	return pc.DB.Model(reservation).Updates(map[string]interface{}{
+		"session_id":     checkoutSession.ID,
+		"reserved_until": until,
+	}).Error
+}
+
+// releasePromotionReservation gives back the use held by a checkout that
+// was never paid. A paid checkout's redemption is left alone.
+func (pc *PaymentController) releasePromotionReservation(sessionID string) error {
+	return pc.DB.Unscoped().
+		Where("session_id = ? AND reserved_until IS NOT NULL", sessionID).
+		Delete(&models.PromotionRedemption{}).Error
+}
+
+// discountForCart prices the basket and works out what a code takes off it.
+// Local promotions come first; codes created in the Stripe dashboard still
+// work but only their amount is checked here.
+func (pc *PaymentController) discountForCart(code, email string, items []CheckoutItem) (*cartDiscount, error) {
+	code = normalisePromotionCode(code)
+	email = strings.ToLower(strings.TrimSpace(email))
+
+	lines, err := pc.priceCart(items)
+	if err != nil {
+		return nil, err
+	}
+	subtotal, currency := cartSubtotal(lines)
+
+	var promo models.Promotion
+	err = pc.DB.Where("code = ?", code).First(&promo).Error
+	if err == nil {
+		return pc.promotionCartDiscount(&promo, email, lines)
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("could not look up promotion %s: %w", code, err)
+	}
+
+	stripePromo, err := pc.Gateway.FindPromotionCode(code)
+	if err != nil {
+		log.Printf("Error looking up promotion code %s: %v", code, err)
+	}
+	if stripePromo == nil || stripePromo.Coupon == nil {
+		return nil, promotionRejected("Coupon '%s' not found", code)
+	}
+	if !stripePromo.Active || !stripePromo.Coupon.Valid {
+		return nil, promotionRejected("Coupon '%s' has expired or is no longer valid", code)
+	}
+	return &cartDiscount{
+		Code:                stripePromo.Code,
+		Description:         stripePromo.Coupon.Name,
+		Currency:            currency,
+		Subtotal:            subtotal,
+		Discount:            stripeCouponDiscount(stripePromo.Coupon, subtotal),
+		stripePromotionCode: stripePromo,
+	}, nil
+}
+
+// promotionCartDiscount checks a local promotion, and the referral behind
+// it if there is one, against the customer and basket.
+func (pc *PaymentController) promotionCartDiscount(promo *models.Promotion, email string, lines []cartLine) (*cartDiscount, error) {
+	if err := pc.checkPromotion(promo, email, lines, time.Now()); err != nil {
+		return nil, err
+	}
+	referral, err := pc.referralForPromotion(promo)
+	if err != nil {
+		return nil, err
+	}
+	if referral != nil {
+		if err := pc.checkReferral(referral, email); err != nil {
+			return nil, err
+		}
+	}
+	subtotal, currency := cartSubtotal(lines)
+	return &cartDiscount{
+		Code:        promo.Code,
+		Description: promo.Description,
+		Currency:    currency,
+		Subtotal:    subtotal,
+		Discount:    promotionDiscount(promo, lines),
+		promotion:   promo,
+		referral:    referral,
+	}, nil
+}
+
+// automaticDiscountForCart finds the automatic promotion that takes the most
+// off the basket. It returns nil when none applies; promotions the customer
+// or basket doesn't qualify for are passed over rather than reported.
+func (pc *PaymentController) automaticDiscountForCart(email string, items []CheckoutItem) (*cartDiscount, error) {
+	var promotions []models.Promotion
+	if err := pc.DB.Where("automatic = ? AND is_active = ?", true, true).Order("id").Find(&promotions).Error; err != nil {
+		return nil, fmt.Errorf("could not load automatic promotions: %w", err)
+	}
+	if len(promotions) == 0 {
+		return nil, nil
+	}
+
+	email = strings.ToLower(strings.TrimSpace(email))
+	lines, err := pc.priceCart(items)
+	if err != nil {
+		return nil, err
+	}
+
+	var best *cartDiscount
+	for i := range promotions {
+		discount, err := pc.promotionCartDiscount(&promotions[i], email, lines)
+		var rejected *promotionError
+		if errors.As(err, &rejected) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if best == nil || discount.Discount > best.Discount {
+			best = discount
+		}
+	}
+	return best, nil
+}
+
+// checkoutDiscountParams turns a validated discount into the Stripe
+// promotion code for the checkout session, syncing a local promotion to
+// Stripe first if needed.
+func (pc *PaymentController) checkoutDiscountParams(discount *cartDiscount, metadata map[string]string) ([]*stripe.CheckoutSessionDiscountParams, error) {
+	promotionCodeID := ""
+	if discount.promotion != nil {
+		id, err := pc.syncPromotionToStripe(discount.promotion)
+		if err != nil {
+			return nil, err
+		}
+		promotionCodeID = id
+		metadata[promotionMetadataKey] = strconv.FormatUint(uint64(discount.promotion.ID), 10)
+		if discount.referral != nil {
+			metadata[referralMetadataKey] = strconv.FormatUint(uint64(discount.referral.ID), 10)
+		}
+	} else {
+		promotionCodeID = discount.stripePromotionCode.ID
+	}
+	return []*stripe.CheckoutSessionDiscountParams{{PromotionCode: stripe.String(promotionCodeID)}}, nil
+}
+
+// syncPromotionToStripe makes sure Stripe has a promotion code matching the
+// local promotion's current rules and returns its ID. Stripe coupons can't
+// be edited, so a changed promotion gets a new coupon and promotion code and
+// the old code is deactivated.
+func (pc *PaymentController) syncPromotionToStripe(promo *models.Promotion) (string, error) {
+	if promo.StripePromotionCodeID != "" && promo.StripeSyncedAt != nil && !promo.UpdatedAt.After(*promo.StripeSyncedAt) {
+		return promo.StripePromotionCodeID, nil
+	}
+
+	if promo.StripePromotionCodeID != "" {
+		if err := pc.Gateway.DeactivatePromotionCode(promo.StripePromotionCodeID); err != nil {
+			log.Printf("Error deactivating outdated Stripe promotion code %s for %s: %v", promo.StripePromotionCodeID, promo.Code, err)
+		}
+	}
+
+	couponParams := &stripe.CouponParams{
+		Name:     stripe.String(promo.Code),
+		Duration: stripe.String(string(stripe.CouponDurationOnce)),
+	}
+	couponParams.AddMetadata(promotionMetadataKey, strconv.FormatUint(uint64(promo.ID), 10))
+	switch promo.DiscountType {
+	case models.PromotionTypePercent:
+		couponParams.PercentOff = stripe.Float64(float64(promo.PercentOff))
+	default:
+		couponParams.AmountOff = stripe.Int64(promo.AmountOff)
+		couponParams.Currency = stripe.String(promo.Currency)
+	}
+
+	if len(promo.ProductIDs) > 0 {
+		var products []models.Product
+		if err := pc.DB.Where("id IN ?", promo.ProductIDs).Find(&products).Error; err != nil {
+			return "", fmt.Errorf("could not load products for promotion %s: %w", promo.Code, err)
+		}
+		couponParams.AppliesTo = &stripe.CouponAppliesToParams{}
+		for _, product := range products {
+			price, err := pc.Gateway.GetPrice(product.StripePriceID)
+			if err != nil {
+				return "", fmt.Errorf("error fetching price %s: %w", product.StripePriceID, err)
+			}
+			if price.Product != nil {
+				couponParams.AppliesTo.Products = append(couponParams.AppliesTo.Products, stripe.String(price.Product.ID))
+			}
+		}
+	}
+
+	coupon, err := pc.Gateway.CreateCoupon(couponParams)
+	if err != nil {
+		return "", fmt.Errorf("error creating Stripe coupon for %s: %w", promo.Code, err)
+	}
+
+	promoParams := &stripe.PromotionCodeParams{
+		Code:   stripe.String(promo.Code),
+		Coupon: stripe.String(coupon.ID),
+	}
+	if promo.EndsAt != nil {
+		promoParams.ExpiresAt = stripe.Int64(promo.EndsAt.Unix())
+	}
+	// Stripe enforces the overall cap too. A replacement code starts its own
+	// count, so it is only given the uses that are left.
+	if promo.MaxRedemptions > 0 {
+		var used int64
+		if err := pc.DB.Model(&models.PromotionRedemption{}).
+			Where("promotion_id = ? AND reserved_until IS NULL", promo.ID).
+			Count(&used).Error; err != nil {
+			return "", fmt.Errorf("could not count redemptions of %s: %w", promo.Code, err)
+		}
+		remaining := promo.MaxRedemptions - used
+		if remaining < 1 {
+			remaining = 1
+		}
+		promoParams.MaxRedemptions = stripe.Int64(remaining)
+	}
+	stripePromo, err := pc.Gateway.CreatePromotionCode(promoParams)
+	if err != nil {
+		return "", fmt.Errorf("error creating Stripe promotion code for %s: %w", promo.Code, err)
+	}
+
+	// UpdateColumns leaves updated_at alone, so the sync time stays later
+	now := time.Now()
+	if err := pc.DB.Model(promo).UpdateColumns(map[string]interface{}{
+		"stripe_coupon_id":         coupon.ID,
+		"stripe_promotion_code_id": stripePromo.ID,
+		"stripe_synced_at":         now,
+	}).Error; err != nil {
+		return "", fmt.Errorf("could not save Stripe IDs for promotion %s: %w", promo.Code, err)
+	}
+	promo.StripeCouponID = coupon.ID
+	promo.StripePromotionCodeID = stripePromo.ID
+	promo.StripeSyncedAt = &now
+
+	log.Printf("Synced promotion %s to Stripe coupon %s and promotion code %s", promo.Code, coupon.ID, stripePromo.ID)
+	return stripePromo.ID, nil
+}
+
+// recordPromotionRedemption confirms a paid checkout's use of its promotion,
+// turning the reservation made at checkout into a redemption. It is safe to
+// call more than once for the same session.
+func (pc *PaymentController) recordPromotionRedemption(checkoutSession *stripe.CheckoutSession, order *models.Order) error {
+	raw := checkoutSession.Metadata[promotionMetadataKey]
+	if raw == "" {
+		return nil
+	}
+	promotionID, err := strconv.ParseUint(raw, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid promotion ID %q on session %s", raw, checkoutSession.ID)
+	}
+
+	redemption := models.PromotionRedemption{
+		PromotionID:    uint(promotionID),
+		SessionID:      checkoutSession.ID,
+		CustomerEmail:  order.CustomerEmail,
+		UserID:         order.UserID,
+		DiscountAmount: order.DiscountAmount,
+	}
+	return pc.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "promotion_id"}, {Name: "session_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"customer_email", "user_id", "discount_amount", "reserved_until", "updated_at"}),
+	}).Create(&redemption).Error
+}
@@ -0,0 +1,133 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/88warren/lmw-fitness-backend/models"
+	"github.com/88warren/lmw-fitness-backend/utils/emailtemplates"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultEmailVerificationTTL = 48 * time.Hour
+
+	// A user can ask for verificationResendLimit emails per
+	// verificationResendWindow
+	verificationResendLimit  = 3
+	verificationResendWindow = time.Hour
+)
+
+// emailVerificationTTL is how long a verification link works.
+func emailVerificationTTL() time.Duration {
+	return durationEnv("EMAIL_VERIFICATION_TTL", defaultEmailVerificationTTL)
+}
+
+// markEmailVerified records that the user has read mail sent to their
+// address. It leaves an earlier verification time alone.
+func markEmailVerified(db *gorm.DB, user *models.User) error {
+	if user.EmailVerified() {
+		return nil
+	}
+	now := time.Now()
+	if err := db.Model(&models.User{}).Where("id = ? AND email_verified_at IS NULL", user.ID).Update("email_verified_at", now).Error; err != nil {
+		return err
+	}
+	user.EmailVerifiedAt = &now
+	return nil
+}
+
+// sendVerificationEmail replaces any outstanding verification link with a
+// new one and emails it.
+func (uc *UserController) sendVerificationEmail(user *models.User) error {
+	err := uc.DB.Model(&models.AuthToken{}).
+		Where("user_id = ? AND purpose = ? AND is_used = ?", user.ID, models.AuthTokenPurposeVerifyEmail, false).
+		Updates(map[string]interface{}{"is_used": true, "used_at": time.Now()}).Error
+	if err != nil {
+		return fmt.Errorf("could not retire old verification links: %w", err)
+	}
+
+	ttl := emailVerificationTTL()
+	token, err := issueAuthToken(uc.DB, models.AuthToken{UserID: user.ID, Purpose: models.AuthTokenPurposeVerifyEmail}, ttl)
+	if err != nil {
+		return err
+	}
+	verifyLink := fmt.Sprintf("%s/verify-email?token=%s", frontendBaseURL(), token)
+	body := emailtemplates.GenerateEmailVerificationEmailBody(user.Email, verifyLink, formatTTL(ttl))
+	return uc.SendEmail(user.Email, "LMW Fitness - Confirm your email", body)
+}
+
+// VerifyEmail confirms a self-registered address from the emailed link.
+func (uc *UserController) VerifyEmail(ctx *gin.Context) {
+	var req VerifyTokenRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+		return
+	}
+
+	authToken, err := redeemAuthToken(uc.DB, req.Token, models.AuthTokenPurposeVerifyEmail)
+	if errors.Is(err, errAuthTokenInvalid) {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "This verification link is invalid or has expired. Please request a new one."})
+		return
+	}
+	if err != nil {
+		log.Printf("Database error redeeming verification token: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	var user models.User
+	if err := uc.DB.First(&user, authToken.UserID).Error; err != nil {
+		log.Printf("Error finding user %d to verify: %v", authToken.UserID, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "User not found"})
+		return
+	}
+	if err := markEmailVerified(uc.DB, &user); err != nil {
+		log.Printf("Error verifying email for user %d: %v", user.ID, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify email"})
+		return
+	}
+	log.Printf("User %d verified their email", user.ID)
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"message":         "Email verified",
+		"emailVerified":   true,
+		"emailVerifiedAt": user.EmailVerifiedAt,
+	})
+}
+
+// ResendVerificationEmail sends the signed-in user a new verification link.
+func (uc *UserController) ResendVerificationEmail(ctx *gin.Context) {
+	user, ok := uc.currentUser(ctx)
+	if !ok {
+		return
+	}
+	if user.EmailVerified() {
+		ctx.JSON(http.StatusOK, gin.H{"message": "Your email is already verified", "emailVerified": true})
+		return
+	}
+
+	var recent int64
+	if err := uc.DB.Model(&models.AuthToken{}).
+		Where("user_id = ? AND purpose = ? AND created_at > ?", user.ID, models.AuthTokenPurposeVerifyEmail, time.Now().Add(-verificationResendWindow)).
+		Count(&recent).Error; err != nil {
+		log.Printf("Error counting verification emails for user %d: %v", user.ID, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if recent >= verificationResendLimit {
+		ctx.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many verification emails requested. Please try again later."})
+		return
+	}
+
+	if err := uc.sendVerificationEmail(user); err != nil {
+		log.Printf("Error sending verification email to user %d: %v", user.ID, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send verification email"})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "Verification email sent", "emailVerified": false})
+}
@@ -0,0 +1,100 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/88warren/lmw-fitness-backend/models"
+	"gorm.io/gorm"
+)
+
+// grantProgramAccess links a user to a workout program, starts the program
+// clock so Day 1 unlocks immediately, and issues a Day 1 workout token.
+// It is safe to call repeatedly for the same user and program.
+func grantProgramAccess(db *gorm.DB, userID uint, program models.WorkoutProgram, sessionID string) (string, error) {
+	var existingUserProgram models.UserProgram
+	err := db.Where("user_id = ? AND program_id = ?", userID, program.ID).First(&existingUserProgram).Error
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		userProgram := models.UserProgram{
+			UserID:    userID,
+			ProgramID: program.ID,
+		}
+		if err := db.Create(&userProgram).Error; err != nil {
+			return "", fmt.Errorf("could not link user %d to program %d: %w", userID, program.ID, err)
+		}
+		log.Printf("Successfully linked user %d to program %d in UserPrograms table.", userID, program.ID)
+	} else if err != nil {
+		return "", fmt.Errorf("could not check existing program access: %w", err)
+	} else {
+		log.Printf("User %d already has access to program %d. Skipping creation.", userID, program.ID)
+	}
+
+	var user models.User
+	if err := db.First(&user, userID).Error; err == nil {
+		if user.ProgramStartDates == nil {
+			user.ProgramStartDates = make(map[string]time.Time)
+		}
+		if user.ProgramStartDates[program.Name].IsZero() {
+			user.ProgramStartDates[program.Name] = time.Now()
+			if saveErr := db.Save(&user).Error; saveErr != nil {
+				log.Printf("Error saving ProgramStartDates for user %d %s: %v", userID, program.Name, saveErr)
+			} else {
+				log.Printf("Initialized ProgramStartDates for user %d %s to today", userID, program.Name)
+			}
+		}
+	} else {
+		log.Printf("Error fetching user %d to set ProgramStartDates: %v", userID, err)
+	}
+
+	return createAuthToken(db, userID, program.Name, 1, sessionID)
+}
+
+func createAuthToken(db *gorm.DB, userID uint, programName string, dayNumber int, sessionID string) (string, error) {
+	return issueAuthToken(db, models.AuthToken{
+		UserID:      userID,
+		Purpose:     models.AuthTokenPurposePurchase,
+		ProgramName: programName,
+		SessionID:   sessionID,
+		DayNumber:   dayNumber,
+	}, workoutLinkTTL())
+}
+
+// extendSubscriptionAccess gives a user access to a program until expiresAt
+// on behalf of a subscription, restoring access that previously lapsed.
+// Programs the user bought outright are left alone so they never expire.
+func extendSubscriptionAccess(db *gorm.DB, userID uint, programID uint, subscriptionID uint, expiresAt time.Time) error {
+	var userProgram models.UserProgram
+	err := db.Unscoped().Where("user_id = ? AND program_id = ?", userID, programID).
+		Order("deleted_at IS NOT NULL, id DESC").
+		First(&userProgram).Error
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		userProgram = models.UserProgram{
+			UserID:         userID,
+			ProgramID:      programID,
+			ExpiresAt:      &expiresAt,
+			SubscriptionID: &subscriptionID,
+		}
+		if err := db.Create(&userProgram).Error; err != nil {
+			return fmt.Errorf("could not link user %d to program %d: %w", userID, programID, err)
+		}
+		log.Printf("Linked user %d to program %d until %s (subscription %d)", userID, programID, expiresAt.Format(time.RFC3339), subscriptionID)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not check existing program access: %w", err)
+	}
+
+	if !userProgram.DeletedAt.Valid && userProgram.ExpiresAt == nil {
+		return nil
+	}
+
+	return db.Unscoped().Model(&userProgram).Updates(map[string]interface{}{
+		"expires_at":      expiresAt,
+		"subscription_id": subscriptionID,
+		"deleted_at":      nil,
+	}).Error
+}
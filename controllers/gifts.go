@@ -0,0 +1,396 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/88warren/lmw-fitness-backend/models"
+	"github.com/88warren/lmw-fitness-backend/utils/emailtemplates"
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v82"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	giftRecipientMetadataKey = "gift_recipient_email"
+	giftMessageMetadataKey   = "gift_message"
+
+	// Stripe rejects metadata values longer than 500 characters
+	maxGiftMessageLength = 500
+
+	GiftCodeValidity = 365 * 24 * time.Hour
+)
+
+// Letters and digits that can't be confused with each other when a code is
+// read out of an email and typed back in.
+const giftCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+var errGiftCodeUnavailable = errors.New("gift code unavailable")
+
+type RedeemGiftCodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+func setGiftMetadata(metadata map[string]string, recipientEmail, message string) {
+	metadata[giftRecipientMetadataKey] = strings.ToLower(strings.TrimSpace(recipientEmail))
+
+	message = strings.TrimSpace(message)
+	if runes := []rune(message); len(runes) > maxGiftMessageLength {
+		message = string(runes[:maxGiftMessageLength])
+	}
+	if message != "" {
+		metadata[giftMessageMetadataKey] = message
+	}
+}
+
+func isGiftSession(checkoutSession *stripe.CheckoutSession) bool {
+	return checkoutSession.Metadata[giftRecipientMetadataKey] != ""
+}
+
+// generateGiftCode returns a code such as LMW-7KQ2-M9XD-4HTP.
+func generateGiftCode() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	sb.WriteString("LMW")
+	for i, v := range b {
+		if i%4 == 0 {
+			sb.WriteByte('-')
+		}
+		// 256 is a multiple of the alphabet size, so every character is equally likely
+		sb.WriteByte(giftCodeAlphabet[int(v)%len(giftCodeAlphabet)])
+	}
+	return sb.String(), nil
+}
+
+func normaliseGiftCode(code string) string {
+	return strings.ToUpper(strings.Join(strings.Fields(code), ""))
+}
+
+// issueGiftCodes is the fulfilment of a gift purchase. Each unit of a
+// product with programs gets its own code, which is emailed to the
+// recipient. A retried job reuses the codes already issued and only emails
+// those not yet sent.
+func (pc *PaymentController) issueGiftCodes(checkoutSession *stripe.CheckoutSession, purchaserEmail string, lineItems []*stripe.LineItem, catalog map[string]models.Product) error {
+	recipientEmail := checkoutSession.Metadata[giftRecipientMetadataKey]
+	message := checkoutSession.Metadata[giftMessageMetadataKey]
+
+	// Units are numbered per product, so a product split over several line
+	// items still gets distinct codes
+	units := make(map[uint]int)
+	for _, li := range lineItems {
+		if li.Price == nil {
+			continue
+		}
+		product, ok := catalog[li.Price.ID]
+		if !ok || len(product.Programs) == 0 {
+			continue
+		}
+
+		for i := int64(0); i < li.Quantity; i++ {
+			units[product.ID]++
+			if err := pc.issueGiftCode(checkoutSession.ID, purchaserEmail, recipientEmail, message, product, units[product.ID]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (pc *PaymentController) issueGiftCode(sessionID, purchaserEmail, recipientEmail, message string, product models.Product, unit int) error {
+	code, err := generateGiftCode()
+	if err != nil {
+		return fmt.Errorf("could not generate gift code: %w", err)
+	}
+	gift := models.GiftCode{
+		Code:           code,
+		ProductID:      product.ID,
+		SessionID:      sessionID,
+		Unit:           unit,
+		PurchaserEmail: purchaserEmail,
+		RecipientEmail: recipientEmail,
+		Message:        message,
+		ExpiresAt:      time.Now().Add(GiftCodeValidity),
+	}
+	result := pc.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "session_id"}, {Name: "product_id"}, {Name: "unit"}},
+		DoNothing: true,
+	}).Create(&gift)
+	if result.Error != nil {
+		return fmt.Errorf("could not save gift code for %s: %w", product.Name, result.Error)
+	}
+	if result.RowsAffected == 0 {
+		if err := pc.DB.Where("session_id = ? AND product_id = ? AND unit = ?", sessionID, product.ID, unit).First(&gift).Error; err != nil {
+			return fmt.Errorf("could not load gift code for %s: %w", product.Name, err)
+		}
+		log.Printf("Gift code %d for %s in session %s was already issued", unit, product.Name, sessionID)
+	} else {
+		log.Printf("Issued gift code %d for %s to %s (session %s)", unit, product.Name, recipientEmail, sessionID)
+	}
+
+	if gift.EmailedAt != nil {
+		return nil
+	}
+	return pc.sendGiftCodeEmail(&gift, product)
+}
+
+// sendGiftCodeEmail uses the Brevo gift code template when one is
+// configured and a plain SMTP email otherwise.
+func (pc *PaymentController) sendGiftCodeEmail(gift *models.GiftCode, product models.Product) error {
+	redeemLink := fmt.Sprintf("%s/redeem-gift?code=%s", pc.FrontendURL, gift.Code)
+	expiresAt := gift.ExpiresAt.Format("2 January 2006")
+
+	if pc.BrevoGiftCodeTemplateID == 0 {
+		body := emailtemplates.GenerateGiftCodeEmailBody(gift.PurchaserEmail, product.Name, gift.Code, gift.Message, redeemLink, expiresAt)
+		if err := pc.SendEmail(gift.RecipientEmail, "LMW Fitness - You've been sent a gift", body); err != nil {
+			return fmt.Errorf("could not email gift code to %s: %w", gift.RecipientEmail, err)
+		}
+	} else {
+		params := map[string]interface{}{
+			"GIFT_CODE":       gift.Code,
+			"REDEEM_LINK":     redeemLink,
+			"PRODUCT_NAME":    product.Name,
+			"GIFT_MESSAGE":    gift.Message,
+			"PURCHASER_EMAIL": gift.PurchaserEmail,
+			"EXPIRES_AT":      expiresAt,
+		}
+		if err := pc.SendBrevoTransactionalEmail(gift.RecipientEmail, pc.BrevoGiftCodeTemplateID, params); err != nil {
+			return fmt.Errorf("could not email gift code to %s: %w", gift.RecipientEmail, err)
+		}
+	}
+
+	now := time.Now()
+	gift.EmailedAt = &now
+	if err := pc.DB.Model(gift).Update("emailed_at", now).Error; err != nil {
+		log.Printf("Error recording gift code %d as emailed: %v", gift.ID, err)
+	}
+	return nil
+}
+
+// RedeemGiftCode gives the signed in user the programs of a gift. The code
+// is claimed with a single conditional update, so it can only be redeemed
+// once however many requests race for it.
+func (pc *PaymentController) RedeemGiftCode(ctx *gin.Context) {
+	userID, exists := ctx.Get("userID")
+	if !exists {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+	uid := userID.(uint)
+
+	var req RedeemGiftCodeRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Gift code is required"})
+		return
+	}
+	code := normaliseGiftCode(req.Code)
+
+	var gift models.GiftCode
+	var workoutLinks []string
+	err := pc.DB.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		result := tx.Model(&models.GiftCode{}).
+			Where("code = ? AND redeemed_at IS NULL AND revoked_at IS NULL AND expires_at > ?", code, now).
+			Updates(map[string]interface{}{
+				"redeemed_at":         now,
+				"redeemed_by_user_id": uid,
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errGiftCodeUnavailable
+		}
+
+		if err := tx.Preload("Product.Programs").Where("code = ?", code).First(&gift).Error; err != nil {
+			return err
+		}
+		for _, program := range gift.Product.Programs {
+			token, err := grantProgramAccess(tx, uid, program, gift.SessionID)
+			if err != nil {
+				return err
+			}
+			workoutLinks = append(workoutLinks, fmt.Sprintf("%s/workout-auth?token=%s", pc.FrontendURL, token))
+		}
+		return nil
+	})
+	if errors.Is(err, errGiftCodeUnavailable) {
+		status, message := pc.giftCodeUnavailableReason(code, uid)
+		ctx.JSON(status, gin.H{"error": message})
+		return
+	}
+	if err != nil {
+		log.Printf("Error redeeming gift code for user %d: %v", uid, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to redeem gift code"})
+		return
+	}
+	log.Printf("User %d redeemed gift code %d for %s", uid, gift.ID, gift.Product.Name)
+
+	if len(gift.Product.BrevoListIDs) > 0 {
+		if email, ok := ctx.Get("userEmail"); ok {
+			if err := pc.AddContactToBrevo(email.(string), gift.Product.BrevoListIDs); err != nil {
+				log.Printf("Error adding %s to Brevo lists %v: %v", email, gift.Product.BrevoListIDs, err)
+			}
+		}
+	}
+
+	programs := make([]string, 0, len(gift.Product.Programs))
+	for _, program := range gift.Product.Programs {
+		programs = append(programs, program.Name)
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"message":      "Gift redeemed",
+		"product":      gift.Product.Name,
+		"programs":     programs,
+		"workoutLinks": workoutLinks,
+	})
+}
+
+func (pc *PaymentController) giftCodeUnavailableReason(code string, userID uint) (int, string) {
+	var gift models.GiftCode
+	if err := pc.DB.Where("code = ?", code).First(&gift).Error; err != nil {
+		return http.StatusNotFound, "Gift code not found"
+	}
+	switch {
+	case gift.RedeemedAt != nil && gift.RedeemedByUserID != nil && *gift.RedeemedByUserID == userID:
+		return http.StatusConflict, "You have already redeemed this gift code"
+	case gift.RedeemedAt != nil:
+		return http.StatusConflict, "Gift code has already been redeemed"
+	case gift.RevokedAt != nil:
+		return http.StatusGone, "Gift code is no longer valid"
+	default:
+		return http.StatusGone, "Gift code has expired"
+	}
+}
+
+// revokeGiftSession handles a refund or dispute of a gift purchase. The
+// buyer never received the programs, so instead the session's codes are
+// voided and anyone who already redeemed one loses what it gave them.
+func (pc *PaymentController) revokeGiftSession(sessionID, reason, stripeObjectID, detail string) (string, bool, error) {
+	var gifts []models.GiftCode
+	if err := pc.DB.Preload("Product.Programs").
+		Where("session_id = ? AND revoked_at IS NULL", sessionID).
+		Find(&gifts).Error; err != nil {
+		return "", false, fmt.Errorf("could not load gift codes for session %s: %w", sessionID, err)
+	}
+
+	revocations := []models.EntitlementRevocation{}
+	for _, gift := range gifts {
+		if gift.RedeemedByUserID == nil {
+			continue
+		}
+		programIDs := []uint{}
+		for _, program := range gift.Product.Programs {
+			programIDs = append(programIDs, program.ID)
+		}
+		recipient := models.User{}
+		if err := pc.DB.First(&recipient, *gift.RedeemedByUserID).Error; err != nil {
+			return "", false, fmt.Errorf("could not load user %d who redeemed gift code %s: %w", *gift.RedeemedByUserID, gift.Code, err)
+		}
+		stillOwned, err := programsStillOwned(pc.DB, &recipient, sessionID, programIDs)
+		if err != nil {
+			return "", false, fmt.Errorf("could not check other purchases of user %d: %w", recipient.ID, err)
+		}
+		programIDs = withoutUints(programIDs, stillOwned)
+		revocations = append(revocations, models.EntitlementRevocation{
+			UserID:         *gift.RedeemedByUserID,
+			SessionID:      sessionID,
+			StripeObjectID: stripeObjectID,
+			Reason:         reason,
+			Detail:         fmt.Sprintf("%s (gift code %s)", detail, gift.Code),
+			ProgramIDs:     programIDs,
+			BrevoListIDs:   gift.Product.BrevoListIDs,
+		})
+	}
+
+	err := pc.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.GiftCode{}).
+			Where("session_id = ? AND revoked_at IS NULL", sessionID).
+			Updates(map[string]interface{}{
+				"revoked_at": time.Now(),
+				"revoked_by": stripeObjectID,
+			}).Error; err != nil {
+			return fmt.Errorf("could not void gift codes: %w", err)
+		}
+		for i := range revocations {
+			if len(revocations[i].ProgramIDs) > 0 {
+				if err := tx.Where("user_id = ? AND program_id IN ?", revocations[i].UserID, revocations[i].ProgramIDs).
+					Delete(&models.UserProgram{}).Error; err != nil {
+					return fmt.Errorf("could not remove program access: %w", err)
+				}
+			}
+			if err := tx.Create(&revocations[i]).Error; err != nil {
+				return err
+			}
+		}
+		return markSessionRevoked(tx, sessionID, reason)
+	})
+	if err != nil {
+		return "", false, err
+	}
+	log.Printf("Voided %d gift codes for session %s (%s), %d already redeemed", len(gifts), sessionID, reason, len(revocations))
+
+	for _, revocation := range revocations {
+		if len(revocation.BrevoListIDs) == 0 {
+			continue
+		}
+		var user models.User
+		if err := pc.DB.First(&user, revocation.UserID).Error; err != nil {
+			continue
+		}
+		if err := pc.RemoveContactFromBrevoLists(user.Email, revocation.BrevoListIDs); err != nil {
+			log.Printf("Error removing %s from Brevo lists %v: %v", user.Email, revocation.BrevoListIDs, err)
+		}
+	}
+
+	return "Gift codes voided", false, nil
+}
+
+// restoreGiftCodes reinstates the unredeemed codes voided by a dispute that
+// was later won. Codes that had been redeemed are restored through their
+// revocation rows instead.
+func (pc *PaymentController) restoreGiftCodes(stripeObjectID string) (int64, error) {
+	var sessionIDs []string
+	if err := pc.DB.Model(&models.GiftCode{}).
+		Where("revoked_by = ?", stripeObjectID).
+		Distinct().Pluck("session_id", &sessionIDs).Error; err != nil {
+		return 0, fmt.Errorf("could not load gift codes voided by %s: %w", stripeObjectID, err)
+	}
+	if len(sessionIDs) == 0 {
+		return 0, nil
+	}
+
+	var restored int64
+	err := pc.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.GiftCode{}).
+			Where("revoked_by = ?", stripeObjectID).
+			Updates(map[string]interface{}{
+				"revoked_at": nil,
+				"revoked_by": "",
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		restored = result.RowsAffected
+		if err := tx.Model(&models.Order{}).
+			Where("stripe_session_id IN ?", sessionIDs).
+			Update("status", models.OrderStatusPaid).Error; err != nil {
+			return err
+		}
+		return restoreReferralCommission(tx, sessionIDs)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("could not restore gift codes voided by %s: %w", stripeObjectID, err)
+	}
+	log.Printf("Restored %d gift codes voided by %s", restored, stripeObjectID)
+	return restored, nil
+}
@@ -0,0 +1,279 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/88warren/lmw-fitness-backend/models"
+	"github.com/88warren/lmw-fitness-backend/utils/money"
+	"github.com/88warren/lmw-fitness-backend/utils/pdf"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const invoiceSequenceName = "invoice"
+
+// InvoiceIssuer is the business named on invoices. VATRate is in basis
+// points and prices are treated as including VAT at that rate.
+type InvoiceIssuer struct {
+	Name         string
+	Address      string
+	Email        string
+	VATNumber    string
+	VATRate      int64
+	NumberPrefix string
+}
+
+// invoiceIssuerFromEnv reads the business details. BUSINESS_ADDRESS may use
+// "\n" or "|" between lines.
+func invoiceIssuerFromEnv() InvoiceIssuer {
+	issuer := InvoiceIssuer{
+		Name:         os.Getenv("BUSINESS_NAME"),
+		Address:      strings.NewReplacer(`\n`, "\n", "|", "\n").Replace(os.Getenv("BUSINESS_ADDRESS")),
+		Email:        os.Getenv("BUSINESS_EMAIL"),
+		VATNumber:    os.Getenv("VAT_NUMBER"),
+		VATRate:      2000,
+		NumberPrefix: os.Getenv("INVOICE_NUMBER_PREFIX"),
+	}
+	if issuer.Name == "" {
+		issuer.Name = "LMW Fitness"
+	}
+	if issuer.NumberPrefix == "" {
+		issuer.NumberPrefix = "LMW"
+	}
+	if raw := os.Getenv("VAT_RATE_PERCENT"); raw != "" {
+		rate, err := strconv.ParseFloat(raw, 64)
+		if err != nil || rate < 0 || rate > 100 {
+			log.Printf("Warning: ignoring invalid VAT_RATE_PERCENT %q", raw)
+		} else {
+			issuer.VATRate = int64(math.Round(rate * 100))
+		}
+	}
+	return issuer
+}
+
+// vatIncluded is the VAT contained in a VAT-inclusive amount, to the
+// nearest penny.
+func vatIncluded(gross, rate int64) int64 {
+	if rate <= 0 {
+		return 0
+	}
+	return (gross*rate + (10000+rate)/2) / (10000 + rate)
+}
+
+func buildInvoiceLines(items []models.OrderItem, rate int64) []models.InvoiceLine {
+	lines := make([]models.InvoiceLine, 0, len(items))
+	for _, item := range items {
+		vat := vatIncluded(item.TotalAmount, rate)
+		lines = append(lines, models.InvoiceLine{
+			Description:    item.Description,
+			Quantity:       item.Quantity,
+			UnitAmount:     item.UnitAmount,
+			DiscountAmount: item.DiscountAmount,
+			NetAmount:      item.TotalAmount - vat,
+			VATAmount:      vat,
+			TotalAmount:    item.TotalAmount,
+		})
+	}
+	return lines
+}
+
+// issueInvoice returns the order's invoice, issuing it with the next number
+// the first time it is asked for.
+func issueInvoice(db *gorm.DB, issuer InvoiceIssuer, order *models.Order) (*models.Invoice, error) {
+	var invoice models.Invoice
+	err := db.Where("order_id = ?", order.ID).First(&invoice).Error
+	if err == nil {
+		return &invoice, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	items := order.Items
+	if len(items) == 0 {
+		if err := db.Where("order_id = ?", order.ID).Order("id").Find(&items).Error; err != nil {
+			return nil, fmt.Errorf("could not load items for order %d: %w", order.ID, err)
+		}
+	}
+	if len(items) == 0 {
+		// Orders recorded without line items still need an invoice
+		items = []models.OrderItem{{
+			Description:    "LMW Fitness order",
+			Quantity:       1,
+			UnitAmount:     order.SubtotalAmount,
+			SubtotalAmount: order.SubtotalAmount,
+			DiscountAmount: order.DiscountAmount,
+			TotalAmount:    order.TotalAmount,
+		}}
+	}
+
+	invoice = models.Invoice{
+		OrderID:         order.ID,
+		IssuedAt:        time.Now(),
+		CustomerEmail:   order.CustomerEmail,
+		Currency:        order.Currency,
+		VATRate:         issuer.VATRate,
+		Lines:           buildInvoiceLines(items, issuer.VATRate),
+		SellerName:      issuer.Name,
+		SellerAddress:   issuer.Address,
+		SellerEmail:     issuer.Email,
+		SellerVATNumber: issuer.VATNumber,
+	}
+	for _, line := range invoice.Lines {
+		invoice.NetAmount += line.NetAmount
+		invoice.VATAmount += line.VATAmount
+		invoice.DiscountAmount += line.DiscountAmount
+		invoice.TotalAmount += line.TotalAmount
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&models.InvoiceSequence{Name: invoiceSequenceName}).Error; err != nil {
+			return err
+		}
+		var sequence models.InvoiceSequence
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("name = ?", invoiceSequenceName).First(&sequence).Error; err != nil {
+			return err
+		}
+		sequence.LastNumber++
+		if err := tx.Model(&sequence).Update("last_number", sequence.LastNumber).Error; err != nil {
+			return err
+		}
+		invoice.Sequence = sequence.LastNumber
+		invoice.Number = fmt.Sprintf("%s-%06d", issuer.NumberPrefix, sequence.LastNumber)
+		return tx.Create(&invoice).Error
+	})
+	if err != nil {
+		// Another worker may have issued it first, in which case its
+		// transaction rolled back and used no number
+		var existing models.Invoice
+		if lookupErr := db.Where("order_id = ?", order.ID).First(&existing).Error; lookupErr == nil {
+			return &existing, nil
+		}
+		return nil, fmt.Errorf("could not issue invoice for order %d: %w", order.ID, err)
+	}
+
+	log.Printf("Issued invoice %s for order %d: total %d %s, VAT %d", invoice.Number, order.ID, invoice.TotalAmount, invoice.Currency, invoice.VATAmount)
+	return &invoice, nil
+}
+
+func formatVATRate(rate int64) string {
+	if rate%100 == 0 {
+		return fmt.Sprintf("%d%%", rate/100)
+	}
+	return fmt.Sprintf("%.2f%%", float64(rate)/100)
+}
+
+// fitText shortens s with an ellipsis so it is no wider than width.
+func fitText(s string, size, width float64) string {
+	if pdf.TextWidth(s, size, false) <= width {
+		return s
+	}
+	runes := []rune(s)
+	for len(runes) > 0 && pdf.TextWidth(string(runes)+"...", size, false) > width {
+		runes = runes[:len(runes)-1]
+	}
+	return string(runes) + "..."
+}
+
+// renderInvoicePDF lays the invoice out on A4, continuing the line items
+// onto further pages when there are too many for one.
+func renderInvoicePDF(invoice *models.Invoice) []byte {
+	const (
+		left   = 50.0
+		right  = pdf.PageWidth - 50
+		bottom = pdf.PageHeight - 90
+	)
+	doc := pdf.New()
+
+	doc.Text(left, 70, 20, true, invoice.SellerName)
+	doc.TextRight(right, 70, 20, true, "INVOICE")
+
+	y := 92.0
+	for _, line := range strings.Split(invoice.SellerAddress, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		doc.Text(left, y, 10, false, strings.TrimSpace(line))
+		y += 14
+	}
+	if invoice.SellerEmail != "" {
+		doc.Text(left, y, 10, false, invoice.SellerEmail)
+		y += 14
+	}
+	if invoice.SellerVATNumber != "" {
+		doc.Text(left, y, 10, false, "VAT registration no. "+invoice.SellerVATNumber)
+		y += 14
+	}
+
+	doc.TextRight(right, 92, 10, false, "Invoice number: "+invoice.Number)
+	doc.TextRight(right, 106, 10, false, "Date: "+invoice.IssuedAt.Format("2 January 2006"))
+	doc.TextRight(right, 120, 10, false, fmt.Sprintf("Order: #%d", invoice.OrderID))
+
+	y = math.Max(y, 134) + 26
+	doc.Text(left, y, 10, true, "Billed to")
+	doc.Text(left, y+14, 10, false, invoice.CustomerEmail)
+	y += 50
+
+	columns := func(y float64) {
+		doc.Text(left, y, 10, true, "Description")
+		doc.TextRight(320, y, 10, true, "Qty")
+		doc.TextRight(395, y, 10, true, "Unit price")
+		doc.TextRight(470, y, 10, true, "VAT")
+		doc.TextRight(right, y, 10, true, "Amount")
+		doc.Line(left, y+6, right, y+6)
+	}
+	columns(y)
+	y += 22
+
+	for _, line := range invoice.Lines {
+		if y > bottom {
+			doc.AddPage()
+			y = 70
+			columns(y)
+			y += 22
+		}
+		doc.Text(left, y, 10, false, fitText(line.Description, 10, 230))
+		doc.TextRight(320, y, 10, false, strconv.FormatInt(line.Quantity, 10))
+		doc.TextRight(395, y, 10, false, money.Format(line.UnitAmount, invoice.Currency))
+		doc.TextRight(470, y, 10, false, money.Format(line.VATAmount, invoice.Currency))
+		doc.TextRight(right, y, 10, false, money.Format(line.TotalAmount, invoice.Currency))
+		if line.DiscountAmount > 0 {
+			y += 13
+			doc.Text(left+10, y, 8, false, "Discount "+money.Format(line.DiscountAmount, invoice.Currency))
+		}
+		y += 18
+	}
+
+	if y > bottom-80 {
+		doc.AddPage()
+		y = 70
+	}
+	doc.Line(left, y-8, right, y-8)
+	y += 8
+	totals := [][2]string{
+		{"Subtotal excl. VAT", money.Format(invoice.NetAmount, invoice.Currency)},
+		{"VAT at " + formatVATRate(invoice.VATRate), money.Format(invoice.VATAmount, invoice.Currency)},
+	}
+	if invoice.DiscountAmount > 0 {
+		totals = append([][2]string{{"Discounts applied", money.Format(invoice.DiscountAmount, invoice.Currency)}}, totals...)
+	}
+	for _, row := range totals {
+		doc.TextRight(470, y, 10, false, row[0])
+		doc.TextRight(right, y, 10, false, row[1])
+		y += 16
+	}
+	doc.TextRight(470, y+4, 12, true, "Total paid")
+	doc.TextRight(right, y+4, 12, true, money.Format(invoice.TotalAmount, invoice.Currency))
+
+	doc.Text(left, pdf.PageHeight-50, 9, false, "Thank you for training with "+invoice.SellerName+".")
+	return doc.Bytes()
+}
@@ -0,0 +1,261 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/88warren/lmw-fitness-backend/models"
+	"github.com/88warren/lmw-fitness-backend/workers"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// errJobChanged means a job moved to another state, usually because a worker
+// claimed it, between being loaded and being updated.
+var errJobChanged = errors.New("job changed state")
+
+type RerunFulfilmentRequest struct {
+	SessionID string `json:"sessionId" binding:"required"`
+}
+
+func (pc *PaymentController) ListJobs(c *gin.Context) {
+	query := pc.DB.Model(&models.Job{})
+
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if email := c.Query("email"); email != "" {
+		query = query.Where("customer_email ILIKE ?", "%"+email+"%")
+	}
+	if sessionID := c.Query("sessionId"); sessionID != "" {
+		query = query.Where("session_id = ?", sessionID)
+	}
+	if from := c.Query("from"); from != "" {
+		fromDate, err := time.Parse("2006-01-02", from)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 'from' date, expected YYYY-MM-DD"})
+			return
+		}
+		query = query.Where("created_at >= ?", fromDate)
+	}
+	if to := c.Query("to"); to != "" {
+		toDate, err := time.Parse("2006-01-02", to)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 'to' date, expected YYYY-MM-DD"})
+			return
+		}
+		query = query.Where("created_at < ?", toDate.AddDate(0, 0, 1))
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve jobs"})
+		return
+	}
+
+	limit := 50
+	if l, err := strconv.Atoi(c.Query("limit")); err == nil && l > 0 && l <= 500 {
+		limit = l
+	}
+	offset := 0
+	if o, err := strconv.Atoi(c.Query("offset")); err == nil && o > 0 {
+		offset = o
+	}
+
+	var jobs []models.Job
+	if err := query.Order("created_at DESC").Limit(limit).Offset(offset).Find(&jobs).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve jobs"})
+		return
+	}
+
+	var counts []struct {
+		Status string `json:"status"`
+		Count  int64  `json:"count"`
+	}
+	pc.DB.Model(&models.Job{}).Select("status, COUNT(*) AS count").Group("status").Scan(&counts)
+
+	c.JSON(http.StatusOK, gin.H{
+		"jobs":         jobs,
+		"total":        total,
+		"limit":        limit,
+		"offset":       offset,
+		"statusCounts": counts,
+	})
+}
+
+// GetJob returns a job with every recorded attempt, newest first.
+func (pc *PaymentController) GetJob(c *gin.Context) {
+	job, ok := pc.loadJob(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
+
+// RetryJob puts a job back on the queue with a fresh set of attempts. A job
+// that is currently leased by a worker cannot be retried.
+func (pc *PaymentController) RetryJob(c *gin.Context) {
+	job, ok := pc.loadJob(c)
+	if !ok {
+		return
+	}
+	if job.Status == models.JobStatusProcessing {
+		c.JSON(http.StatusConflict, gin.H{"error": "Job is being processed"})
+		return
+	}
+
+	if err := pc.requeueJob(job); err != nil {
+		if errors.Is(err, errJobChanged) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Job changed state, please refresh"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retry job"})
+		return
+	}
+	log.Printf("Admin requeued job %d for session %s", job.ID, job.SessionID)
+	c.JSON(http.StatusOK, gin.H{"message": "Job queued for retry", "job": job})
+}
+
+func (pc *PaymentController) CancelJob(c *gin.Context) {
+	job, ok := pc.loadJob(c)
+	if !ok {
+		return
+	}
+	if job.Status != models.JobStatusPending && job.Status != models.JobStatusDead {
+		c.JSON(http.StatusConflict, gin.H{"error": "Only pending or dead jobs can be cancelled"})
+		return
+	}
+
+	// The status condition stops a cancel racing a worker that has just claimed the job
+	result := pc.DB.Model(&models.Job{}).
+		Where("id = ? AND status = ?", job.ID, job.Status).
+		Update("status", models.JobStatusCancelled)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel job"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Job changed state, please refresh"})
+		return
+	}
+
+	log.Printf("Admin cancelled job %d for session %s", job.ID, job.SessionID)
+	job.Status = models.JobStatusCancelled
+	c.JSON(http.StatusOK, gin.H{"message": "Job cancelled", "job": job})
+}
+
+// RerunFulfilment runs fulfilment for a checkout session again, creating a
+// job if the webhook never did. Access grants are idempotent, but the
+// customer will receive the purchase emails again: unlike a retry, a rerun
+// clears the order's fulfilled mark.
+func (pc *PaymentController) RerunFulfilment(c *gin.Context) {
+	var req RerunFulfilmentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var job models.Job
+	err := pc.DB.Where("session_id = ?", req.SessionID).First(&job).Error
+	if err == nil {
+		if job.Status == models.JobStatusProcessing {
+			c.JSON(http.StatusConflict, gin.H{"error": "Job is being processed"})
+			return
+		}
+		if err := pc.DB.Model(&models.Order{}).Where("stripe_session_id = ?", job.SessionID).Update("fulfilled_at", nil).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue fulfilment"})
+			return
+		}
+		if err := pc.requeueJob(&job); err != nil {
+			if errors.Is(err, errJobChanged) {
+				c.JSON(http.StatusConflict, gin.H{"error": "Job changed state, please refresh"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue fulfilment"})
+			return
+		}
+		log.Printf("Admin re-ran fulfilment for session %s (job %d)", req.SessionID, job.ID)
+		c.JSON(http.StatusOK, gin.H{"message": "Fulfilment queued", "job": job})
+		return
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up job"})
+		return
+	}
+
+	checkoutSession, err := pc.Gateway.GetCheckoutSession(req.SessionID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Checkout session not found in Stripe"})
+		return
+	}
+	if checkoutSession.CustomerDetails == nil || checkoutSession.CustomerDetails.Email == "" {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Checkout session has no customer email"})
+		return
+	}
+
+	if _, err := pc.enqueuePaymentJob(checkoutSession.ID, checkoutSession.CustomerDetails.Email); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue fulfilment"})
+		return
+	}
+	pc.DB.Where("session_id = ?", req.SessionID).First(&job)
+
+	log.Printf("Admin created fulfilment job for session %s", req.SessionID)
+	c.JSON(http.StatusCreated, gin.H{"message": "Fulfilment queued", "job": job})
+}
+
+func (pc *PaymentController) loadJob(c *gin.Context) (*models.Job, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid job ID"})
+		return nil, false
+	}
+
+	var job models.Job
+	if err := pc.DB.Preload("AttemptHistory", func(db *gorm.DB) *gorm.DB {
+		return db.Order("started_at DESC")
+	}).First(&job, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+			return nil, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve job"})
+		return nil, false
+	}
+	return &job, true
+}
+
+func (pc *PaymentController) requeueJob(job *models.Job) error {
+	now := time.Now()
+	updates := map[string]interface{}{
+		"status":           models.JobStatusPending,
+		"attempts":         0,
+		"next_run_at":      now,
+		"lease_owner":      "",
+		"lease_expires_at": nil,
+	}
+	result := pc.DB.Model(&models.Job{}).
+		Where("id = ? AND status <> ?", job.ID, models.JobStatusProcessing).
+		Updates(updates)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errJobChanged
+	}
+
+	job.Status = models.JobStatusPending
+	job.Attempts = 0
+	job.NextRunAt = now
+	job.LeaseOwner = ""
+	job.LeaseExpiresAt = nil
+
+	if processor := workers.GetGlobalProcessor(); processor != nil {
+		processor.TriggerJobProcessing()
+	} else {
+		log.Printf("Warning: Global processor not available, job %d will be processed on next fallback cycle", job.ID)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/88warren/lmw-fitness-backend/audit"
+	"github.com/88warren/lmw-fitness-backend/lockout"
+	"github.com/88warren/lmw-fitness-backend/models"
+	"github.com/88warren/lmw-fitness-backend/utils/emailtemplates"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// throttled answers 429 when the account or the caller's IP has to wait
+// before trying again. If the store can't be read the attempt goes ahead.
+func (uc *UserController) throttled(ctx *gin.Context, scope, account string) bool {
+	wait, err := uc.Lockout.Wait(scope, account, ctx.ClientIP())
+	if err != nil {
+		log.Printf("Error checking %s attempts: %v", scope, err)
+		return false
+	}
+	if wait <= 0 {
+		return false
+	}
+	seconds := int(math.Ceil(wait.Seconds()))
+	ctx.Header("Retry-After", strconv.Itoa(seconds))
+	ctx.JSON(http.StatusTooManyRequests, gin.H{
+		"error":      "Too many failed attempts. Please try again later.",
+		"retryAfter": seconds,
+	})
+	return true
+}
+
+// recordFailure counts a failed attempt. On repeated failed logins or
+// authenticator codes for a real account its owner is emailed.
+func (uc *UserController) recordFailure(ctx *gin.Context, scope, account string, user *models.User) {
+	failure, err := uc.Lockout.Fail(scope, account, ctx.ClientIP())
+	if err != nil {
+		log.Printf("Error recording failed %s attempt: %v", scope, err)
+		return
+	}
+	if failure.Locked {
+		log.Printf("Locked %s for %s until %s after %d failures", scope, account, failure.LockedUntil.Format(time.RFC3339), failure.Failures)
+	}
+	if scope == lockout.ScopeLogin || scope == lockout.ScopeMFA || failure.Locked {
+		entry := audit.Entry{
+			Action:   audit.ActionLoginFailed,
+			Metadata: map[string]interface{}{"scope": scope, "account": account, "failures": failure.Failures},
+		}
+		if failure.Locked {
+			entry.Action = audit.ActionAccountLocked
+			entry.Metadata["lockedUntil"] = failure.LockedUntil
+		}
+		if user != nil {
+			entry.TargetType, entry.TargetID = audit.TargetUser, user.ID
+		}
+		audit.Record(uc.DB, ctx, entry)
+	}
+	if (scope != lockout.ScopeLogin && scope != lockout.ScopeMFA) || user == nil || !failure.Notify {
+		return
+	}
+
+	lockedFor := ""
+	if failure.Locked {
+		lockedFor = formatTTL(time.Until(failure.LockedUntil).Round(time.Minute))
+	}
+	body := emailtemplates.GenerateLoginFailuresEmailBody(user.Email, failure.Failures, lockedFor, frontendBaseURL()+"/forgot-password")
+	if err := uc.SendEmail(user.Email, "LMW Fitness - Failed login attempts", body); err != nil {
+		log.Printf("Error sending failed login warning to user %d: %v", user.ID, err)
+	}
+}
+
+// UnlockUser clears a user's failed attempts so they can log in at once.
+func (ac *AdminController) UnlockUser(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	var user models.User
+	if err := ac.DB.First(&user, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user"})
+		return
+	}
+
+	wasLockedUntil, err := ac.Lockout.LockedUntil(user.Email)
+	if err != nil {
+		log.Printf("Error reading lock for user %d: %v", user.ID, err)
+	}
+	if err := ac.Lockout.Unlock(user.Email); err != nil {
+		log.Printf("Error unlocking user %d: %v", user.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unlock user"})
+		return
+	}
+	log.Printf("Admin unlocked user %d", user.ID)
+	audit.Record(ac.DB, c, audit.Entry{
+		Action:     audit.ActionUserUnlocked,
+		TargetType: audit.TargetUser,
+		TargetID:   user.ID,
+		Metadata:   map[string]interface{}{"wasLocked": !wasLockedUntil.IsZero()},
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":   fmt.Sprintf("%s can log in again", user.Email),
+		"wasLocked": !wasLockedUntil.IsZero(),
+	})
+}
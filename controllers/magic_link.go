@@ -0,0 +1,229 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/88warren/lmw-fitness-backend/models"
+	"github.com/88warren/lmw-fitness-backend/utils/auth"
+	"github.com/88warren/lmw-fitness-backend/utils/email"
+	"github.com/88warren/lmw-fitness-backend/utils/emailtemplates"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultMagicLinkTTL   = 15 * time.Minute
+	defaultWorkoutLinkTTL = 7 * 24 * time.Hour
+
+	// An account is sent at most magicLinkLimit login links per
+	// magicLinkWindow
+	magicLinkLimit  = 3
+	magicLinkWindow = 15 * time.Minute
+)
+
+var errAuthTokenInvalid = errors.New("invalid or expired token")
+
+const magicLinkSentMessage = "If an account with that email exists, a login link has been sent."
+
+// durationEnv reads a Go duration such as "15m" or "168h".
+func durationEnv(key string, def time.Duration) time.Duration {
+	raw := strings.TrimSpace(os.Getenv(key))
+	if raw == "" {
+		return def
+	}
+	value, err := time.ParseDuration(raw)
+	if err != nil || value <= 0 {
+		log.Printf("Warning: invalid %s %q, using %s", key, raw, def)
+		return def
+	}
+	return value
+}
+
+// magicLinkTTL is how long a link asked for from the login page works.
+func magicLinkTTL() time.Duration {
+	return durationEnv("MAGIC_LINK_TTL", defaultMagicLinkTTL)
+}
+
+// workoutLinkTTL is how long the link emailed after a purchase works.
+func workoutLinkTTL() time.Duration {
+	return durationEnv("WORKOUT_LINK_TTL", defaultWorkoutLinkTTL)
+}
+
+// issueAuthToken saves authToken with the hash of a new token and returns
+// the token to put in the link.
+func issueAuthToken(db *gorm.DB, authToken models.AuthToken, ttl time.Duration) (string, error) {
+	token, hash, err := auth.NewRefreshToken()
+	if err != nil {
+		return "", fmt.Errorf("could not generate auth token: %w", err)
+	}
+	expiresAt := time.Now().Add(ttl)
+	authToken.Token = hash
+	authToken.Hashed = true
+	authToken.IsUsed = false
+	authToken.ExpiresAt = &expiresAt
+	if authToken.Purpose == "" {
+		authToken.Purpose = models.AuthTokenPurposePurchase
+	}
+	if err := db.Create(&authToken).Error; err != nil {
+		return "", fmt.Errorf("could not save auth token: %w", err)
+	}
+	return token, nil
+}
+
+// findAuthToken looks up a link token that is unused, unexpired and for
+// one of purposes.
+func findAuthToken(db *gorm.DB, presented string, purposes ...string) (*models.AuthToken, error) {
+	presented = strings.TrimSpace(presented)
+	if presented == "" {
+		return nil, errAuthTokenInvalid
+	}
+
+	var authToken models.AuthToken
+	err := db.Where("(token = ? AND hashed = ?) OR (token = ? AND hashed = ?)", auth.HashToken(presented), true, presented, false).
+		Where("purpose IN ?", purposes).
+		First(&authToken).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, errAuthTokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	expiresAt := authToken.CreatedAt.Add(workoutLinkTTL())
+	if authToken.ExpiresAt != nil {
+		expiresAt = *authToken.ExpiresAt
+	}
+	if authToken.IsUsed || time.Now().After(expiresAt) {
+		return nil, errAuthTokenInvalid
+	}
+	return &authToken, nil
+}
+
+// claimAuthToken marks a token used. Of any requests racing to claim the
+// same token only one succeeds.
+func claimAuthToken(db *gorm.DB, authToken *models.AuthToken) error {
+	now := time.Now()
+	claimed := db.Model(&models.AuthToken{}).
+		Where("id = ? AND is_used = ?", authToken.ID, false).
+		Updates(map[string]interface{}{"is_used": true, "used_at": now})
+	if claimed.Error != nil {
+		return claimed.Error
+	}
+	if claimed.RowsAffected == 0 {
+		return errAuthTokenInvalid
+	}
+	authToken.IsUsed = true
+	authToken.UsedAt = &now
+	return nil
+}
+
+// redeemAuthToken finds and uses up a link token in one go.
+func redeemAuthToken(db *gorm.DB, presented string, purposes ...string) (*models.AuthToken, error) {
+	authToken, err := findAuthToken(db, presented, purposes...)
+	if err != nil {
+		return nil, err
+	}
+	if err := claimAuthToken(db, authToken); err != nil {
+		return nil, err
+	}
+	return authToken, nil
+}
+
+// frontendBaseURL is where links in emails point: FRONTEND_URL, else the
+// first ALLOWED_ORIGIN, else the live site.
+func frontendBaseURL() string {
+	if frontendURL := os.Getenv("FRONTEND_URL"); frontendURL != "" {
+		return frontendURL
+	}
+	if allowedOrigin := os.Getenv("ALLOWED_ORIGIN"); allowedOrigin != "" {
+		return strings.TrimSpace(strings.Split(allowedOrigin, ",")[0])
+	}
+	return "https://www.lmwfitness.co.uk"
+}
+
+// sendSMTPEmail sends an HTML email through the configured SMTP server.
+func sendSMTPEmail(to, subject, body string) error {
+	smtpPassword := getSMTPPasswordFromSecrets()
+	if os.Getenv("SMTP_HOST") == "" || os.Getenv("SMTP_PORT") == "" || os.Getenv("SMTP_USERNAME") == "" || smtpPassword == "" {
+		return errors.New("SMTP is not configured")
+	}
+	return email.SendEmail(os.Getenv("SMTP_FROM"), to, subject, body, "", smtpPassword)
+}
+
+type MagicLinkRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+// RequestMagicLink emails a one-time login link to any account. The
+// response is the same whether or not the account exists, and links past
+// the per-account limit are quietly not sent.
+func (uc *UserController) RequestMagicLink(ctx *gin.Context) {
+	var req MagicLinkRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	normalizedEmail := strings.ToLower(strings.TrimSpace(req.Email))
+
+	var user models.User
+	if err := uc.DB.Where("LOWER(email) = ?", normalizedEmail).First(&user).Error; err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Printf("Error looking up user for magic link: %v", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Database error during login link request"})
+			return
+		}
+		log.Printf("Magic link requested for unknown email")
+		ctx.JSON(http.StatusOK, gin.H{"message": magicLinkSentMessage})
+		return
+	}
+
+	var recent int64
+	if err := uc.DB.Model(&models.AuthToken{}).
+		Where("user_id = ? AND purpose = ? AND created_at > ?", user.ID, models.AuthTokenPurposeLogin, time.Now().Add(-magicLinkWindow)).
+		Count(&recent).Error; err != nil {
+		log.Printf("Error counting recent magic links for user %d: %v", user.ID, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Database error during login link request"})
+		return
+	}
+	if recent >= magicLinkLimit {
+		log.Printf("Magic link limit reached for user %d, not sending another", user.ID)
+		ctx.JSON(http.StatusOK, gin.H{"message": magicLinkSentMessage})
+		return
+	}
+
+	ttl := magicLinkTTL()
+	token, err := issueAuthToken(uc.DB, models.AuthToken{UserID: user.ID, Purpose: models.AuthTokenPurposeLogin}, ttl)
+	if err != nil {
+		log.Printf("Error creating magic link for user %d: %v", user.ID, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create login link"})
+		return
+	}
+
+	loginLink := fmt.Sprintf("%s/workout-auth?token=%s", frontendBaseURL(), token)
+	body := emailtemplates.GenerateMagicLinkEmailBody(user.Email, loginLink, formatTTL(ttl))
+	if err := uc.SendEmail(user.Email, "LMW Fitness - Your login link", body); err != nil {
+		log.Printf("Error sending magic link to user %d: %v", user.ID, err)
+	} else {
+		log.Printf("Magic link sent to user %d", user.ID)
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": magicLinkSentMessage})
+}
+
+// formatTTL describes a link's lifetime for an email, e.g. "15 minutes".
+func formatTTL(d time.Duration) string {
+	switch {
+	case d >= 48*time.Hour && d%(24*time.Hour) == 0:
+		return fmt.Sprintf("%d days", d/(24*time.Hour))
+	case d >= 2*time.Hour && d%time.Hour == 0:
+		return fmt.Sprintf("%d hours", d/time.Hour)
+	case d == time.Hour:
+		return "1 hour"
+	}
+	return fmt.Sprintf("%d minutes", d/time.Minute)
+}
@@ -0,0 +1,288 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/88warren/lmw-fitness-backend/audit"
+	"github.com/88warren/lmw-fitness-backend/models"
+	"github.com/88warren/lmw-fitness-backend/oidc"
+	"github.com/88warren/lmw-fitness-backend/utils/auth"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// oidcLoginTTL is how long the user has to sign in at the provider.
+const oidcLoginTTL = 10 * time.Minute
+
+var (
+	errOIDCStateInvalid    = errors.New("sign-in state is invalid, expired or used")
+	errOIDCEmailUnverified = errors.New("the provider has not verified this email address")
+)
+
+type OIDCCallbackRequest struct {
+	Code  string `json:"code" binding:"required"`
+	State string `json:"state" binding:"required"`
+}
+
+// loadOIDCProviders reads the configured providers, logging rather than
+// failing so a bad config only disables social login.
+func loadOIDCProviders() map[string]*oidc.Provider {
+	providers, err := oidc.LoadProviders(frontendBaseURL())
+	if err != nil {
+		log.Printf("Social login disabled: %v", err)
+		return map[string]*oidc.Provider{}
+	}
+	return providers
+}
+
+func (uc *UserController) oidcProvider(ctx *gin.Context) (*oidc.Provider, bool) {
+	provider, ok := uc.OIDC[ctx.Param("provider")]
+	if !ok {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "Unknown sign-in provider"})
+		return nil, false
+	}
+	return provider, true
+}
+
+// ListOIDCProviders lists the providers to show sign-in buttons for.
+func (uc *UserController) ListOIDCProviders(ctx *gin.Context) {
+	providers := make([]gin.H, 0, len(uc.OIDC))
+	for name, provider := range uc.OIDC {
+		displayName := provider.Config.DisplayName
+		if displayName == "" {
+			displayName = name
+		}
+		providers = append(providers, gin.H{"name": name, "displayName": displayName})
+	}
+	sort.Slice(providers, func(i, j int) bool {
+		return providers[i]["name"].(string) < providers[j]["name"].(string)
+	})
+	ctx.JSON(http.StatusOK, providers)
+}
+
+// StartOIDCLogin begins a sign-in with a provider. The frontend keeps the
+// returned state, sends the browser to authorizationUrl, and posts the code
+// and state the provider redirects back with to CompleteOIDCLogin.
+func (uc *UserController) StartOIDCLogin(ctx *gin.Context) {
+	provider, ok := uc.oidcProvider(ctx)
+	if !ok {
+		return
+	}
+
+	state, err := oidc.RandomString()
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start sign-in"})
+		return
+	}
+	nonce, err := oidc.RandomString()
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start sign-in"})
+		return
+	}
+	verifier, err := oidc.RandomString()
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start sign-in"})
+		return
+	}
+
+	authURL, err := provider.AuthCodeURL(ctx.Request.Context(), state, nonce, oidc.CodeChallenge(verifier))
+	if err != nil {
+		log.Printf("Error starting %s sign-in: %v", provider.Config.Name, err)
+		ctx.JSON(http.StatusBadGateway, gin.H{"error": "The sign-in provider is unavailable"})
+		return
+	}
+	expiresAt := time.Now().Add(oidcLoginTTL)
+	loginState := models.OIDCLoginState{
+		StateHash:    auth.HashToken(state),
+		Provider:     provider.Config.Name,
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+		ExpiresAt:    expiresAt,
+	}
+	if err := uc.DB.Create(&loginState).Error; err != nil {
+		log.Printf("Error saving %s sign-in state: %v", provider.Config.Name, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start sign-in"})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"authorizationUrl": authURL,
+		"state":            state,
+		"expiresAt":        expiresAt,
+	})
+}
+
+// claimOIDCState uses up the state a sign-in started with, so a callback
+// can only be completed once.
+func claimOIDCState(db *gorm.DB, providerName, state string) (*models.OIDCLoginState, error) {
+	var loginState models.OIDCLoginState
+	err := db.Where("state_hash = ? AND provider = ?", auth.HashToken(state), providerName).First(&loginState).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, errOIDCStateInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if loginState.UsedAt != nil || now.After(loginState.ExpiresAt) {
+		return nil, errOIDCStateInvalid
+	}
+	result := db.Model(&models.OIDCLoginState{}).Where("id = ? AND used_at IS NULL", loginState.ID).Update("used_at", now)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, errOIDCStateInvalid
+	}
+	return &loginState, nil
+}
+
+// userForIdentity finds the account a provider identity signs in to:
+// the one already linked to it, else the one with the same email, which
+// the provider must have verified. Without either a new account is
+// created.
+func (uc *UserController) userForIdentity(ctx *gin.Context, providerName string, claims *oidc.Claims) (*models.User, bool, error) {
+	var user models.User
+	var identity models.UserIdentity
+	err := uc.DB.Where("provider = ? AND subject = ?", providerName, claims.Subject).First(&identity).Error
+	if err == nil {
+		if err := uc.DB.Preload("UserPrograms.WorkoutProgram").First(&user, identity.UserID).Error; err != nil {
+			return nil, false, err
+		}
+		if err := uc.DB.Model(&identity).Update("last_used_at", time.Now()).Error; err != nil {
+			log.Printf("Error recording use of %s identity of user %d: %v", providerName, user.ID, err)
+		}
+		return &user, false, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, false, err
+	}
+
+	if claims.Email == "" || !claims.EmailVerified {
+		return nil, false, errOIDCEmailUnverified
+	}
+	created := false
+	err = uc.DB.Preload("UserPrograms.WorkoutProgram").Where("LOWER(email) = ?", claims.Email).First(&user).Error
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		randomPassword, err := GenerateRandomPassword()
+		if err != nil {
+			return nil, false, err
+		}
+		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(randomPassword), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, false, err
+		}
+		now := time.Now()
+		user = models.User{Email: claims.Email, PasswordHash: string(hashedPassword), Role: models.RoleUser, EmailVerifiedAt: &now}
+		if err := uc.DB.Create(&user).Error; err != nil {
+			return nil, false, err
+		}
+		created = true
+	case err != nil:
+		return nil, false, err
+	case !user.EmailVerified():
+		// Whoever registered this address never proved they own it
+		if err := secureUnverifiedAccount(uc.DB, &user, SessionRevokedUnverifiedOIDCLink); err != nil {
+			return nil, false, err
+		}
+	}
+	if err := markEmailVerified(uc.DB, &user); err != nil {
+		log.Printf("Error marking email verified for user %d: %v", user.ID, err)
+	}
+
+	now := time.Now()
+	identity = models.UserIdentity{UserID: user.ID, Provider: providerName, Subject: claims.Subject, Email: claims.Email, LastUsedAt: &now}
+	if err := uc.DB.Create(&identity).Error; err != nil {
+		return nil, false, err
+	}
+	log.Printf("Linked %s identity to user %d (new account: %t)", providerName, user.ID, created)
+	audit.Record(uc.DB, ctx, audit.Entry{
+		Action:     audit.ActionIdentityLinked,
+		TargetType: audit.TargetUser,
+		TargetID:   user.ID,
+		ActorID:    user.ID,
+		ActorEmail: user.Email,
+		Metadata:   map[string]interface{}{"provider": providerName, "subject": claims.Subject, "created": created},
+	})
+	return &user, created, nil
+}
+
+// CompleteOIDCLogin finishes a sign-in started by StartOIDCLogin and
+// answers like LoginUser.
+func (uc *UserController) CompleteOIDCLogin(ctx *gin.Context) {
+	provider, ok := uc.oidcProvider(ctx)
+	if !ok {
+		return
+	}
+	var req OIDCCallbackRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	loginState, err := claimOIDCState(uc.DB, provider.Config.Name, req.State)
+	if errors.Is(err, errOIDCStateInvalid) {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "This sign-in has expired. Please try again."})
+		return
+	}
+	if err != nil {
+		log.Printf("Error checking %s sign-in state: %v", provider.Config.Name, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Database error during sign-in"})
+		return
+	}
+
+	claims, err := provider.Exchange(ctx.Request.Context(), req.Code, loginState.CodeVerifier, loginState.Nonce)
+	if err != nil {
+		log.Printf("Error completing %s sign-in: %v", provider.Config.Name, err)
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Could not sign you in with this provider"})
+		return
+	}
+
+	user, created, err := uc.userForIdentity(ctx, provider.Config.Name, claims)
+	if errors.Is(err, errOIDCEmailUnverified) {
+		ctx.JSON(http.StatusForbidden, gin.H{
+			"error": "Your account with this provider has no verified email address",
+			"code":  "email_unverified",
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("Error finding account for %s identity: %v", provider.Config.Name, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Database error during sign-in"})
+		return
+	}
+
+	if user.TwoFactorEnabled() {
+		uc.beginMFAChallenge(ctx, user)
+		return
+	}
+	tokens, err := startSession(uc.DB, ctx, user)
+	if err != nil {
+		log.Printf("Error starting session for user %d: %v", user.ID, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"message":               "Login successful",
+		"created":               created,
+		"token":                 tokens.Token,
+		"expiresAt":             tokens.ExpiresAt,
+		"refreshToken":          tokens.RefreshToken,
+		"refreshTokenExpiresAt": tokens.RefreshTokenExpiresAt,
+		"user": models.UserResponse{
+			ID:                 user.ID,
+			Email:              user.Email,
+			Role:               user.Role,
+			MustChangePassword: user.MustChangePassword,
+			PurchasedPrograms:  purchasedProgramNames(user),
+			EmailVerified:      user.EmailVerified(),
+		},
+	})
+}
@@ -0,0 +1,303 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/88warren/lmw-fitness-backend/models"
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v82"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type OrderController struct {
+	DB            *gorm.DB
+	InvoiceIssuer InvoiceIssuer
+}
+
+func NewOrderController(db *gorm.DB) *OrderController {
+	return &OrderController{DB: db, InvoiceIssuer: invoiceIssuerFromEnv()}
+}
+
+// myOrders scopes a query to the signed in user's orders, writing the error
+// response if it can't. Orders placed before the account existed are
+// matched on email, but only once the user has proved they own it;
+// otherwise anyone could sign up with a buyer's address and read their
+// orders.
+func (oc *OrderController) myOrders(c *gin.Context) (*gorm.DB, bool) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return nil, false
+	}
+	var user models.User
+	if err := oc.DB.Select("id", "email", "email_verified_at").First(&user, userID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+			return nil, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve orders"})
+		return nil, false
+	}
+	if !user.EmailVerified() {
+		return oc.DB.Where("user_id = ?", user.ID), true
+	}
+	return oc.DB.Where("user_id = ? OR LOWER(customer_email) = LOWER(?)", user.ID, user.Email), true
+}
+
+// GetMyOrders returns the purchase history of the signed in user.
+func (oc *OrderController) GetMyOrders(c *gin.Context) {
+	query, ok := oc.myOrders(c)
+	if !ok {
+		return
+	}
+
+	var orders []models.Order
+	if err := query.Preload("Items").
+		Order("created_at DESC").
+		Find(&orders).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve orders"})
+		return
+	}
+	c.JSON(http.StatusOK, orders)
+}
+
+// loadMyOrder finds the order named in the path if it belongs to the
+// signed in user, writing the error response if not.
+func (oc *OrderController) loadMyOrder(c *gin.Context) (*models.Order, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid order ID"})
+		return nil, false
+	}
+	query, ok := oc.myOrders(c)
+	if !ok {
+		return nil, false
+	}
+
+	var order models.Order
+	if err := query.Preload("Items").First(&order, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+			return nil, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve order"})
+		return nil, false
+	}
+	return &order, true
+}
+
+func (oc *OrderController) GetMyOrder(c *gin.Context) {
+	order, ok := oc.loadMyOrder(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, order)
+}
+
+// GetMyOrderInvoice downloads the invoice for one of the user's orders as a
+// PDF. Orders placed before invoicing existed get theirs issued now.
+func (oc *OrderController) GetMyOrderInvoice(c *gin.Context) {
+	order, ok := oc.loadMyOrder(c)
+	if !ok {
+		return
+	}
+	oc.sendInvoice(c, order)
+}
+
+func (oc *OrderController) GetOrderInvoice(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid order ID"})
+		return
+	}
+	var order models.Order
+	if err := oc.DB.Preload("Items").First(&order, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve order"})
+		return
+	}
+	oc.sendInvoice(c, &order)
+}
+
+func (oc *OrderController) sendInvoice(c *gin.Context, order *models.Order) {
+	invoice, err := issueInvoice(oc.DB, oc.InvoiceIssuer, order)
+	if err != nil {
+		log.Printf("Error issuing invoice for order %d: %v", order.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate invoice"})
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.pdf"`, invoice.Number))
+	c.Data(http.StatusOK, "application/pdf", renderInvoicePDF(invoice))
+}
+
+// SearchOrders lets admins filter orders by customer, status, Stripe IDs,
+// coupon and date range (YYYY-MM-DD, inclusive).
+func (oc *OrderController) SearchOrders(c *gin.Context) {
+	query := oc.DB.Model(&models.Order{})
+
+	if email := c.Query("email"); email != "" {
+		query = query.Where("customer_email ILIKE ?", "%"+email+"%")
+	}
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if userID := c.Query("userId"); userID != "" {
+		query = query.Where("user_id = ?", userID)
+	}
+	if sessionID := c.Query("sessionId"); sessionID != "" {
+		query = query.Where("stripe_session_id = ?", sessionID)
+	}
+	if paymentIntentID := c.Query("paymentIntentId"); paymentIntentID != "" {
+		query = query.Where("stripe_payment_intent_id = ?", paymentIntentID)
+	}
+	if coupon := c.Query("coupon"); coupon != "" {
+		query = query.Where("coupon_code ILIKE ?", coupon)
+	}
+	if from := c.Query("from"); from != "" {
+		fromDate, err := time.Parse("2006-01-02", from)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 'from' date, expected YYYY-MM-DD"})
+			return
+		}
+		query = query.Where("created_at >= ?", fromDate)
+	}
+	if to := c.Query("to"); to != "" {
+		toDate, err := time.Parse("2006-01-02", to)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 'to' date, expected YYYY-MM-DD"})
+			return
+		}
+		query = query.Where("created_at < ?", toDate.AddDate(0, 0, 1))
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search orders"})
+		return
+	}
+
+	limit := 50
+	if l, err := strconv.Atoi(c.Query("limit")); err == nil && l > 0 && l <= 500 {
+		limit = l
+	}
+	offset := 0
+	if o, err := strconv.Atoi(c.Query("offset")); err == nil && o > 0 {
+		offset = o
+	}
+
+	var orders []models.Order
+	if err := query.Preload("Items").Order("created_at DESC").Limit(limit).Offset(offset).Find(&orders).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search orders"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"orders": orders,
+		"total":  total,
+		"limit":  limit,
+		"offset": offset,
+	})
+}
+
+// recordOrder stores the order for a paid checkout session. Fulfilment jobs
+// can be retried, so an existing order for the session is returned as is.
+func (pc *PaymentController) recordOrder(checkoutSession *stripe.CheckoutSession, customerEmail string, lineItems []*stripe.LineItem, catalog map[string]models.Product) (*models.Order, error) {
+	var existing models.Order
+	err := pc.DB.Where("stripe_session_id = ?", checkoutSession.ID).First(&existing).Error
+	if err == nil {
+		log.Printf("Order %d already recorded for session %s", existing.ID, checkoutSession.ID)
+		return &existing, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	order := models.Order{
+		CustomerEmail:   customerEmail,
+		StripeSessionID: checkoutSession.ID,
+		Status:          models.OrderStatusPaid,
+		Currency:        strings.ToLower(string(checkoutSession.Currency)),
+		SubtotalAmount:  checkoutSession.AmountSubtotal,
+		TotalAmount:     checkoutSession.AmountTotal,
+		CouponCode:      sessionCouponCode(checkoutSession),
+	}
+	if checkoutSession.PaymentIntent != nil {
+		order.StripePaymentIntentID = checkoutSession.PaymentIntent.ID
+	}
+	if checkoutSession.TotalDetails != nil {
+		order.DiscountAmount = checkoutSession.TotalDetails.AmountDiscount
+	}
+
+	// As with listing orders, an account only owns a purchase by email once
+	// it has proved it owns the address. Fulfilment links unverified
+	// accounts itself, after securing them.
+	var user models.User
+	if err := pc.DB.Where("LOWER(email) = LOWER(?) AND email_verified_at IS NOT NULL", customerEmail).First(&user).Error; err == nil {
+		order.UserID = &user.ID
+	}
+
+	for _, li := range lineItems {
+		item := models.OrderItem{
+			Description:    li.Description,
+			Quantity:       li.Quantity,
+			SubtotalAmount: li.AmountSubtotal,
+			DiscountAmount: li.AmountDiscount,
+			TotalAmount:    li.AmountTotal,
+		}
+		if li.Price != nil {
+			item.StripePriceID = li.Price.ID
+			item.UnitAmount = li.Price.UnitAmount
+			if product, ok := catalog[li.Price.ID]; ok {
+				productID := product.ID
+				item.ProductID = &productID
+				if item.Description == "" {
+					item.Description = product.Name
+				}
+			}
+		}
+		order.Items = append(order.Items, item)
+	}
+
+	result := pc.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "stripe_session_id"}},
+		DoNothing: true,
+	}).Create(&order)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		// Another worker recorded it between the lookup and the insert
+		if err := pc.DB.Where("stripe_session_id = ?", checkoutSession.ID).First(&existing).Error; err != nil {
+			return nil, err
+		}
+		return &existing, nil
+	}
+
+	log.Printf("Recorded order %d for session %s: %d items, total %d %s", order.ID, checkoutSession.ID, len(order.Items), order.TotalAmount, order.Currency)
+	return &order, nil
+}
+
+func sessionCouponCode(checkoutSession *stripe.CheckoutSession) string {
+	for _, discount := range checkoutSession.Discounts {
+		if discount == nil {
+			continue
+		}
+		if discount.PromotionCode != nil && discount.PromotionCode.Code != "" {
+			return discount.PromotionCode.Code
+		}
+		if discount.Coupon != nil && discount.Coupon.ID != "" {
+			return discount.Coupon.ID
+		}
+	}
+	return ""
+}
@@ -2,30 +2,29 @@ package controllers
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
-	"math/rand"
+	"math/big"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/88warren/lmw-fitness-backend/gateway"
 	"github.com/88warren/lmw-fitness-backend/models"
+	"github.com/88warren/lmw-fitness-backend/utils/money"
 	"github.com/88warren/lmw-fitness-backend/workers"
 	"github.com/gin-gonic/gin"
 	"github.com/stripe/stripe-go/v82"
-	"github.com/stripe/stripe-go/v82/client"
-	"github.com/stripe/stripe-go/v82/webhook"
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
-)
-
-const (
-	DiscountAmount = 1000
+	"gorm.io/gorm/clause"
 )
 
 type CheckoutItem struct {
@@ -34,44 +33,67 @@ type CheckoutItem struct {
 }
 
 type CreateCheckoutSessionRequest struct {
-	Items             []CheckoutItem `json:"items" binding:"required"`
-	IsDiscountApplied bool           `json:"isDiscountApplied"`
-	CustomerEmail     string         `json:"customerEmail"`
-	CouponCode        string         `json:"couponCode"`
+	Items         []CheckoutItem `json:"items" binding:"required"`
+	CustomerEmail string         `json:"customerEmail"`
+	// Without a coupon code, the best automatic promotion the basket
+	// qualifies for is applied, such as a bundle deal
+	CouponCode string `json:"couponCode"`
+	// When a gift recipient is given, the purchase is fulfilled as a gift
+	// code emailed to them rather than access for the customer
+	GiftRecipientEmail string `json:"giftRecipientEmail" binding:"omitempty,email"`
+	GiftMessage        string `json:"giftMessage"`
+	// Currency to charge in. When empty it is worked out from where the
+	// request came from.
+	Currency string `json:"currency"`
 }
 
+// ValidateCouponRequest carries the basket rather than its total, so the
+// discount is worked out from real prices.
 type ValidateCouponRequest struct {
-	CouponCode string  `json:"couponCode" binding:"required"`
-	CartTotal  float64 `json:"cartTotal" binding:"required"`
+	CouponCode    string         `json:"couponCode" binding:"required"`
+	Items         []CheckoutItem `json:"items" binding:"required,min=1"`
+	CustomerEmail string         `json:"customerEmail"`
+	Currency      string         `json:"currency"`
 }
 
+// ValidateCouponResponse amounts are in minor units of Currency, with
+// display strings alongside.
 type ValidateCouponResponse struct {
-	Coupon   *stripe.Coupon `json:"coupon"`
-	Discount float64        `json:"discount"`
+	Code        string `json:"code"`
+	Description string `json:"description"`
+	Currency    string `json:"currency"`
+	Subtotal    int64  `json:"subtotal"`
+	Discount    int64  `json:"discount"`
+	Total       int64  `json:"total"`
+
+	SubtotalFormatted string `json:"subtotalFormatted"`
+	DiscountFormatted string `json:"discountFormatted"`
+	TotalFormatted    string `json:"totalFormatted"`
 }
 
 type PaymentController struct {
-	StripeClient                  *client.API
-	UltimateMindsetPackagePriceID string
-	TailoredCoachingPriceID       string
-	BeginnerProgramPriceID        string
-	AdvancedProgramPriceID        string
+	Gateway                 gateway.PaymentGateway
+	TailoredCoachingPriceID string
 
 	FrontendURL         string
 	StripeWebhookSecret string
 	BrevoAPIKey         string
+	BrevoAPIURL         string
 
-	BrevoNewsletterListID       int64
-	BrevoMindsetListID          int64
-	BrevoBeginnerListID         int64
-	BrevoAdvancedListID         int64
-	BrevoTailoredCoachingListID int64
-
-	BrevoMindsetPackageTemplateID    int64
-	BrevoBeginnerProgramTemplateID   int64
-	BrevoAdvancedProgramTemplateID   int64
-	BrevoTailoredCoachingTemplateID  int64
+	BrevoNewsletterListID            int64
 	BrevoOrderConfirmationTemplateID int64
+	BrevoGiftCodeTemplateID          int64
+
+	// Share of a referred order's total credited to the referrer
+	ReferralCommissionPercent int64
+
+	InvoiceIssuer InvoiceIssuer
+	// AttachInvoicePDF adds the invoice to the order confirmation email
+	AttachInvoicePDF bool
+
+	// SendEmail delivers emails that have no Brevo template configured;
+	// tests swap it out
+	SendEmail func(to, subject, body string) error
 
 	DB *gorm.DB
 }
@@ -82,87 +104,59 @@ func NewPaymentController(db *gorm.DB) *PaymentController {
 		log.Fatalf("FATAL: STRIPE_SECRET_KEY environment variable not set.")
 	}
 
-	log.Printf("Backend Stripe secret key: %s", stripeSecretKey)
-
-	stripeWebhookSecret := getEnvVar("STRIPE_WEBHOOK_SECRET")
-	if stripeWebhookSecret == "" {
+	if getEnvVar("STRIPE_WEBHOOK_SECRET") == "" {
 		log.Fatalf("FATAL: STRIPE_WEBHOOK_SECRET environment variable not set.")
 	}
 
-	sc := &client.API{}
-	sc.Init(stripeSecretKey, nil)
-
-	ultimateMindsetPriceID := getEnvVar("ULTIMATE_MINDSET_PACKAGE_PRICE_ID")
-	if ultimateMindsetPriceID == "" {
-		log.Fatalf("FATAL: ULTIMATE_MINDSET_PACKAGE_PRICE_ID environment variable not set.")
-	}
-
-	tailoredCoachingPriceID := getEnvVar("TAILORED_COACHING_PRICE_ID")
-	if tailoredCoachingPriceID == "" {
-		log.Fatalf("FATAL: TAILORED_COACHING_PRICE_ID environment variable not set.")
-	}
-
-	beginnerPriceID := getEnvVar("BEGINNER_PRICE_ID")
-	if beginnerPriceID == "" {
-		log.Fatalf("FATAL: BEGINNER_PRICE_ID environment variable not set.")
-	}
-
-	advancedPriceID := getEnvVar("ADVANCED_PRICE_ID")
-	if advancedPriceID == "" {
-		log.Fatalf("FATAL: ADVANCED_PRICE_ID environment variable not set.")
+	for _, key := range []string{"TAILORED_COACHING_PRICE_ID", "FRONTEND_URL", "BREVO_API_KEY"} {
+		if getEnvVar(key) == "" {
+			log.Fatalf("FATAL: %s environment variable not set.", key)
+		}
 	}
 
-	frontendURL := getEnvVar("FRONTEND_URL")
-	if frontendURL == "" {
-		log.Fatalf("FATAL: FRONTEND_URL environment variable not set.")
-	}
+	return NewPaymentControllerWithGateway(db, gateway.NewStripeGateway(stripeSecretKey))
+}
 
-	brevoAPIKey := getEnvVar("BREVO_API_KEY")
-	if brevoAPIKey == "" {
-		log.Fatalf("FATAL: BREVO_API_KEY environment variable not set.")
+// NewPaymentControllerWithGateway builds a controller around any payment
+// gateway. Configuration is read from the environment but nothing is
+// required, so tests can construct one and set the fields they need.
+func NewPaymentControllerWithGateway(db *gorm.DB, gw gateway.PaymentGateway) *PaymentController {
+	brevoAPIURL := getEnvVar("BREVO_API_URL")
+	if brevoAPIURL == "" {
+		brevoAPIURL = "https://api.brevo.com/v3"
 	}
 
 	brevoNewsletterListID, _ := ParseInt64Env("BREVO_NEWSLETTER_LIST_ID")
-	brevoMindsetListID, _ := ParseInt64Env("BREVO_MINDSET_LIST_ID")
-	brevoBeginnerListID, _ := ParseInt64Env("BREVO_BEGINNER_LIST_ID")
-	brevoAdvancedListID, _ := ParseInt64Env("BREVO_ADVANCED_LIST_ID")
-	brevoTailoredCoachingListID, _ := ParseInt64Env("BREVO_TAILORED_COACHING_LIST_ID")
-
-	brevoMindsetPackageTemplateID, _ := ParseInt64Env("BREVO_MINDSET_PACKAGE_TEMPLATE_ID")
-	brevoBeginnerProgramTemplateID, _ := ParseInt64Env("BREVO_BEGINNER_PROGRAM_TEMPLATE_ID")
-	brevoAdvancedProgramTemplateID, _ := ParseInt64Env("BREVO_ADVANCED_PROGRAM_TEMPLATE_ID")
-	brevoTailoredCoachingTemplateID, _ := ParseInt64Env("BREVO_TAILORED_COACHING_TEMPLATE_ID")
 	brevoOrderConfirmationTemplateID, _ := ParseInt64Env("BREVO_ORDER_CONFIRMATION_TEMPLATE_ID")
+	brevoGiftCodeTemplateID, _ := ParseInt64Env("BREVO_GIFT_CODE_TEMPLATE_ID")
 
 	return &PaymentController{
-		StripeClient:                     sc,
-		UltimateMindsetPackagePriceID:    ultimateMindsetPriceID,
-		TailoredCoachingPriceID:          tailoredCoachingPriceID,
-		BeginnerProgramPriceID:           beginnerPriceID,
-		AdvancedProgramPriceID:           advancedPriceID,
-		FrontendURL:                      frontendURL,
-		StripeWebhookSecret:              stripeWebhookSecret,
-		BrevoAPIKey:                      brevoAPIKey,
+		Gateway:                          gw,
+		TailoredCoachingPriceID:          getEnvVar("TAILORED_COACHING_PRICE_ID"),
+		FrontendURL:                      getEnvVar("FRONTEND_URL"),
+		StripeWebhookSecret:              getEnvVar("STRIPE_WEBHOOK_SECRET"),
+		BrevoAPIKey:                      getEnvVar("BREVO_API_KEY"),
+		BrevoAPIURL:                      strings.TrimRight(brevoAPIURL, "/"),
 		BrevoNewsletterListID:            brevoNewsletterListID,
-		BrevoMindsetListID:               brevoMindsetListID,
-		BrevoBeginnerListID:              brevoBeginnerListID,
-		BrevoAdvancedListID:              brevoAdvancedListID,
-		BrevoTailoredCoachingListID:      brevoTailoredCoachingListID,
-		BrevoMindsetPackageTemplateID:    brevoMindsetPackageTemplateID,
-		BrevoBeginnerProgramTemplateID:   brevoBeginnerProgramTemplateID,
-		BrevoAdvancedProgramTemplateID:   brevoAdvancedProgramTemplateID,
-		BrevoTailoredCoachingTemplateID:  brevoTailoredCoachingTemplateID,
 		BrevoOrderConfirmationTemplateID: brevoOrderConfirmationTemplateID,
+		BrevoGiftCodeTemplateID:          brevoGiftCodeTemplateID,
+		ReferralCommissionPercent:        percentEnv("REFERRAL_COMMISSION_PERCENT", defaultReferralCommissionPercent),
+		InvoiceIssuer:                    invoiceIssuerFromEnv(),
+		AttachInvoicePDF:                 getEnvVar("INVOICE_EMAIL_ATTACHMENT") == "true",
+		SendEmail:                        sendSMTPEmail,
 		DB:                               db,
 	}
 }
 
 func GenerateRandomPassword() (string, error) {
 	const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789!@#$%^&*()_+"
-	var seededRand *rand.Rand = rand.New(rand.NewSource(time.Now().UnixNano()))
 	b := make([]byte, 16)
 	for i := range b {
-		b[i] = charset[seededRand.Intn(len(charset))]
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(charset))))
+		if err != nil {
+			return "", err
+		}
+		b[i] = charset[n.Int64()]
 	}
 	return string(b), nil
 }
@@ -212,34 +206,95 @@ func (pc *PaymentController) FindOrCreateUser(email string) (uint, error) {
 		if err := pc.DB.Save(&user).Error; err != nil {
 			return 0, fmt.Errorf("could not save new user password: %w", err)
 		}
+	} else if !user.EmailVerified() {
+		if err := secureUnverifiedAccount(pc.DB, &user, SessionRevokedUnverifiedPurchase); err != nil {
+			return 0, err
+		}
 	}
 
 	return user.ID, nil
 }
 
+// secureUnverifiedAccount runs before a purchase or a social login is
+// added to an account whose email was never confirmed. Anyone can register
+// someone else's address, so the password is replaced and every device
+// signed out; the real owner gets in with the link from their purchase
+// email or through the provider, either of which verifies the address.
+func secureUnverifiedAccount(db *gorm.DB, user *models.User, reason string) error {
+	randomPassword, err := GenerateRandomPassword()
+	if err != nil {
+		return fmt.Errorf("could not generate temporary password: %w", err)
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(randomPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("could not hash temporary password: %w", err)
+	}
+	if err := db.Model(user).Updates(map[string]interface{}{
+		"password_hash":        string(hashedPassword),
+		"must_change_password": true,
+	}).Error; err != nil {
+		return fmt.Errorf("could not reset password of unverified account: %w", err)
+	}
+	if _, err := revokeUserSessions(db, user.ID, 0, reason); err != nil {
+		return fmt.Errorf("could not sign out unverified account: %w", err)
+	}
+	log.Printf("Unverified account %d secured (%s): password reset and sessions revoked", user.ID, reason)
+	return nil
+}
+
 func (pc *PaymentController) CreateAuthToken(userID uint, programName string, dayNumber int, sessionID string) (string, error) {
-	token := GenerateRandomToken()
+	return createAuthToken(pc.DB, userID, programName, dayNumber, sessionID)
+}
 
-	authToken := models.AuthToken{
-		UserID:      userID,
-		Token:       token,
-		ProgramName: programName,
-		SessionID:   sessionID,
-		DayNumber:   dayNumber,
-		IsUsed:      false,
+// productsByPriceID loads the catalog entries for the given Stripe price IDs,
+// keyed by price ID. Price IDs without a product are simply absent.
+func (pc *PaymentController) productsByPriceID(priceIDs []string) (map[string]models.Product, error) {
+	products := make(map[string]models.Product)
+	if len(priceIDs) == 0 {
+		return products, nil
 	}
 
-	if err := pc.DB.Create(&authToken).Error; err != nil {
-		return "", fmt.Errorf("could not save auth token: %w", err)
+	var found []models.Product
+	if err := pc.DB.Preload("Programs").Preload("Prices").Where("stripe_price_id IN ?", priceIDs).Find(&found).Error; err != nil {
+		return nil, err
+	}
+	for _, product := range found {
+		products[product.StripePriceID] = product
 	}
 
-	return token, nil
+	// The rest may be a product's price in another currency
+	missing := []string{}
+	for _, priceID := range priceIDs {
+		if _, ok := products[priceID]; !ok {
+			missing = append(missing, priceID)
+		}
+	}
+	if len(missing) == 0 {
+		return products, nil
+	}
+	var prices []models.ProductPrice
+	if err := pc.DB.Where("stripe_price_id IN ?", missing).Find(&prices).Error; err != nil {
+		return nil, err
+	}
+	for _, price := range prices {
+		var product models.Product
+		if err := pc.DB.Preload("Programs").Preload("Prices").First(&product, price.ProductID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				continue
+			}
+			return nil, err
+		}
+		products[price.StripePriceID] = product
+	}
+	return products, nil
 }
 
-func GenerateRandomToken() string {
+func GenerateRandomToken() (string, error) {
 	b := make([]byte, 32)
-	rand.Read(b)
-	return fmt.Sprintf("%x", b)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", b), nil
 }
 
 func (pc *PaymentController) CreateCheckoutSession(ctx *gin.Context) {
@@ -250,7 +305,7 @@ func (pc *PaymentController) CreateCheckoutSession(ctx *gin.Context) {
 		return
 	}
 
-	if pc.StripeClient == nil {
+	if pc.Gateway == nil {
 		log.Println("Stripe client not initialised.")
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Server configuration error"})
 		return
@@ -260,54 +315,36 @@ func (pc *PaymentController) CreateCheckoutSession(ctx *gin.Context) {
 
 	lineItems := []*stripe.CheckoutSessionLineItemParams{}
 
-	productNames := make(map[string]string)
-	productNameForPriceID := map[string]string{
-		pc.UltimateMindsetPackagePriceID: "Ultimate Habit & Mindset Package",
-		pc.TailoredCoachingPriceID:       "Tailored Coaching",
-		pc.BeginnerProgramPriceID:        "Beginner Program",
-		pc.AdvancedProgramPriceID:        "Advanced Program",
+	items, catalog, currency, err := pc.localisedBasket(ctx, req.Currency, req.Items)
+	if errors.Is(err, errUnsupportedCurrency) || errors.Is(err, errProductUnavailable) {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
+	if err != nil {
+		log.Printf("Error loading products for checkout: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Could not load products."})
+		return
+	}
+	req.Items = items
+	log.Printf("Checking out in %s", strings.ToUpper(currency))
 
-	mindsetPackageProcessedForDiscount := false
-
+	requestedPriceIDs := make([]string, 0, len(req.Items))
 	for _, item := range req.Items {
-		if name, ok := productNameForPriceID[item.PriceID]; ok {
-			productNames[item.PriceID] = name
-		} else {
-			productNames[item.PriceID] = fmt.Sprintf("Unknown Product (Price ID: %s)", item.PriceID)
-		}
-		if req.IsDiscountApplied && item.PriceID == pc.UltimateMindsetPackagePriceID && !mindsetPackageProcessedForDiscount {
-			originalMindsetPackagePricePence, err := pc.GetPriceUnitAmount(pc.UltimateMindsetPackagePriceID)
-			if err != nil {
-				log.Printf("Error fetching original price for mindset package: %v", err)
-				ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve product price."})
-				return
-			}
+		requestedPriceIDs = append(requestedPriceIDs, item.PriceID)
+	}
 
-			discountedPricePence := originalMindsetPackagePricePence - DiscountAmount
-			if discountedPricePence < 0 {
-				discountedPricePence = 0
-			}
+	productNames := make(map[string]string)
 
-			lineItems = append(lineItems, &stripe.CheckoutSessionLineItemParams{
-				PriceData: &stripe.CheckoutSessionLineItemPriceDataParams{
-					Currency:   stripe.String("gbp"),
-					UnitAmount: stripe.Int64(discountedPricePence),
-					ProductData: &stripe.CheckoutSessionLineItemPriceDataProductDataParams{
-						Name:        stripe.String("Ultimate Habit & Mindset Package (Discounted)"),
-						Description: stripe.String("Includes £10 discount when bought with another package."),
-					},
-				},
-				Quantity: stripe.Int64(item.Quantity),
-			})
-			mindsetPackageProcessedForDiscount = true
-			log.Printf("Applied £10 discount to Ultimate Habit & Mindset Package. New price: £%.2f", float64(discountedPricePence)/100)
+	for _, item := range req.Items {
+		if product, ok := catalog[item.PriceID]; ok {
+			productNames[item.PriceID] = product.Name
 		} else {
-			lineItems = append(lineItems, &stripe.CheckoutSessionLineItemParams{
-				Price:    stripe.String(item.PriceID),
-				Quantity: stripe.Int64(item.Quantity),
-			})
+			productNames[item.PriceID] = fmt.Sprintf("Unknown Product (Price ID: %s)", item.PriceID)
 		}
+		lineItems = append(lineItems, &stripe.CheckoutSessionLineItemParams{
+			Price:    stripe.String(item.PriceID),
+			Quantity: stripe.Int64(item.Quantity),
+		})
 	}
 
 	if len(lineItems) == 0 {
@@ -317,7 +354,8 @@ func (pc *PaymentController) CreateCheckoutSession(ctx *gin.Context) {
 
 	mode := stripe.CheckoutSessionModePayment
 	for _, item := range req.Items {
-		if item.PriceID == pc.TailoredCoachingPriceID {
+		product := catalog[item.PriceID]
+		if product.Recurring || item.PriceID == pc.TailoredCoachingPriceID || (product.StripePriceID != "" && product.StripePriceID == pc.TailoredCoachingPriceID) {
 			mode = stripe.CheckoutSessionModeSubscription
 			break
 		}
@@ -326,14 +364,23 @@ func (pc *PaymentController) CreateCheckoutSession(ctx *gin.Context) {
 	metadata := make(map[string]string)
 	var orderedProductNames []string
 	for _, item := range req.Items {
-		if name, ok := productNameForPriceID[item.PriceID]; ok {
-			orderedProductNames = append(orderedProductNames, name)
+		if product, ok := catalog[item.PriceID]; ok {
+			orderedProductNames = append(orderedProductNames, product.Name)
 		}
 	}
 	if len(orderedProductNames) > 0 {
 		metadata["purchased_products"] = fmt.Sprintf("%v", orderedProductNames)
 	}
 
+	if req.GiftRecipientEmail != "" {
+		if mode == stripe.CheckoutSessionModeSubscription {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Subscriptions cannot be bought as gifts"})
+			return
+		}
+		setGiftMetadata(metadata, req.GiftRecipientEmail, req.GiftMessage)
+		log.Printf("Checkout is a gift for %s", metadata[giftRecipientMetadataKey])
+	}
+
 	params := &stripe.CheckoutSessionParams{
 		LineItems:  lineItems,
 		Mode:       stripe.String(mode),
@@ -342,43 +389,37 @@ func (pc *PaymentController) CreateCheckoutSession(ctx *gin.Context) {
 		Metadata:   metadata,
 	}
 
-	// Add coupon if provided
+	var discount *cartDiscount
 	if req.CouponCode != "" {
-		// Try to find the promotion code first using the authenticated client
-		promoParams := &stripe.PromotionCodeListParams{
-			Code:   stripe.String(req.CouponCode),
-			Active: stripe.Bool(true),
-		}
-		promoParams.AddExpand("data.coupon")
-
-		promoList := pc.StripeClient.PromotionCodes.List(promoParams)
-		foundPromo := false
-		for promoList.Next() {
-			foundPromoCode := promoList.PromotionCode()
-			if strings.EqualFold(foundPromoCode.Code, req.CouponCode) {
-				params.Discounts = []*stripe.CheckoutSessionDiscountParams{
-					{
-						PromotionCode: stripe.String(foundPromoCode.ID),
-					},
-				}
-				log.Printf("Applied promotion code to checkout session: %s (ID: %s)", req.CouponCode, foundPromoCode.ID)
-				foundPromo = true
-				break
-			}
+		var err error
+		discount, err = pc.discountForCart(req.CouponCode, req.CustomerEmail, req.Items)
+		var rejected *promotionError
+		if errors.As(err, &rejected) {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": rejected.Error()})
+			return
 		}
-
-		if !foundPromo {
-			// Fallback to coupon ID only if the code is an actual coupon ID
-			if cpn, err := pc.StripeClient.Coupons.Get(req.CouponCode, nil); err == nil && cpn != nil && cpn.ID != "" {
-				params.Discounts = []*stripe.CheckoutSessionDiscountParams{
-					{
-						Coupon: stripe.String(cpn.ID),
-					},
-				}
-				log.Printf("Applied coupon to checkout session by ID: %s", cpn.ID)
-			} else {
-				log.Printf("Coupon/promotion code not found for checkout session: %s", req.CouponCode)
-			}
+		if err == nil {
+			params.Discounts, err = pc.checkoutDiscountParams(discount, metadata)
+		}
+		if err != nil {
+			log.Printf("Error applying coupon %s to checkout session: %v", req.CouponCode, err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Could not apply coupon."})
+			return
+		}
+		log.Printf("Applied coupon %s to checkout session: %s off %s", discount.Code, money.Format(discount.Discount, discount.Currency), money.Format(discount.Subtotal, discount.Currency))
+	} else {
+		var err error
+		discount, err = pc.automaticDiscountForCart(req.CustomerEmail, req.Items)
+		if err == nil && discount != nil {
+			params.Discounts, err = pc.checkoutDiscountParams(discount, metadata)
+		}
+		if err != nil {
+			log.Printf("Error applying automatic promotions to checkout session: %v", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Could not apply discount."})
+			return
+		}
+		if discount != nil {
+			log.Printf("Applied automatic promotion %s to checkout session: %s off %s", discount.Code, money.Format(discount.Discount, discount.Currency), money.Format(discount.Subtotal, discount.Currency))
 		}
 	}
 
@@ -388,6 +429,7 @@ func (pc *PaymentController) CreateCheckoutSession(ctx *gin.Context) {
 	} else {
 		log.Println("No customer email provided for checkout session.")
 		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Customer email is required"})
+		return
 	}
 	log.Printf("Creating checkout session with params: %+v", params)
 
@@ -398,20 +440,51 @@ func (pc *PaymentController) CreateCheckoutSession(ctx *gin.Context) {
 	}
 	log.Printf("Creating checkout session with params: %+v, CustomerEmail value: %s", params, customerEmail)
 
-	s, err := pc.StripeClient.CheckoutSessions.New(params)
+	var reservation *models.PromotionRedemption
+	if discount != nil && discount.promotion != nil {
+		var err error
+		reservation, err = pc.reservePromotion(discount.promotion, customerEmail)
+		var rejected *promotionError
+		if errors.As(err, &rejected) {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": rejected.Error()})
+			return
+		}
+		if err != nil {
+			log.Printf("Error reserving coupon %s for checkout session: %v", discount.Code, err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Could not apply coupon."})
+			return
+		}
+	}
+
+	s, err := pc.Gateway.CreateCheckoutSession(params)
 	if err != nil {
 		log.Printf("Error creating checkout session: %v", err)
+		if reservation != nil {
+			if err := pc.DB.Unscoped().Delete(reservation).Error; err != nil {
+				log.Printf("Error releasing coupon reservation %d: %v", reservation.ID, err)
+			}
+		}
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
+	if reservation != nil {
+		if err := pc.attachPromotionReservation(reservation, s); err != nil {
+			log.Printf("Error attaching coupon reservation %d to session %s: %v", reservation.ID, s.ID, err)
+		}
+	}
+
+	if err := pc.recordCheckoutSession(s, customerEmail, requestedPriceIDs, orderedProductNames, req.CouponCode); err != nil {
+		log.Printf("Error recording checkout session %s: %v", s.ID, err)
+	}
+
 	ctx.JSON(http.StatusOK, gin.H{"url": s.URL})
 }
 
 func (pc *PaymentController) AddContactToBrevo(email string, listIDs []int64) error {
 	log.Printf("Attempting to add contact %s to Brevo lists %v", email, listIDs)
 
-	brevoURL := "https://api.brevo.com/v3/contacts"
+	brevoURL := pc.BrevoAPIURL + "/contacts"
 	payload := map[string]interface{}{
 		"email":            email,
 		"listIds":          listIDs,
@@ -458,7 +531,7 @@ func (pc *PaymentController) AddContactToBrevo(email string, listIDs []int64) er
 	if resp.StatusCode == http.StatusBadRequest && brevoError.Code == "duplicate_parameter" && brevoError.Message == "Unable to create contact, email is already associated with another Contact" {
 		log.Printf("Contact %s already exists in Brevo. Attempting to update list memberships via PUT.", email)
 
-		updateURL := fmt.Sprintf("https://api.brevo.com/v3/contacts/%s", email)
+		updateURL := fmt.Sprintf("%s/contacts/%s", pc.BrevoAPIURL, email)
 		existingListIDs, getErr := pc.GetContactBrevo(email)
 		if getErr != nil {
 			log.Printf("Could not retrieve current list memberships for %s: %v", email, getErr)
@@ -501,15 +574,67 @@ func (pc *PaymentController) AddContactToBrevo(email string, listIDs []int64) er
 	return fmt.Errorf("failed to add contact to Brevo, status: %d, response: %s", resp.StatusCode, string(bodyBytes))
 }
 
+// RemoveContactFromBrevoLists takes a contact off each of the given lists.
+// Lists the contact is not on are skipped by Brevo without an error.
+func (pc *PaymentController) RemoveContactFromBrevoLists(email string, listIDs []int64) error {
+	log.Printf("Attempting to remove contact %s from Brevo lists %v", email, listIDs)
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"emails": []string{email},
+	})
+	if err != nil {
+		return fmt.Errorf("error marshalling Brevo payload: %w", err)
+	}
+
+	client := &http.Client{}
+	for _, listID := range listIDs {
+		removeURL := fmt.Sprintf("%s/contacts/lists/%d/contacts/remove", pc.BrevoAPIURL, listID)
+		req, err := http.NewRequest("POST", removeURL, bytes.NewBuffer(payload))
+		if err != nil {
+			return fmt.Errorf("error creating Brevo request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("api-key", pc.BrevoAPIKey)
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("error sending Brevo request: %w", err)
+		}
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("failed to remove contact from Brevo list %d, status: %d, response: %s", listID, resp.StatusCode, string(bodyBytes))
+		}
+	}
+
+	log.Printf("Successfully removed contact %s from Brevo lists %v", email, listIDs)
+	return nil
+}
+
+// brevoAttachment is a file sent with a transactional email. Content is
+// base64 encoded.
+type brevoAttachment struct {
+	Content string `json:"content"`
+	Name    string `json:"name"`
+}
+
 func (pc *PaymentController) SendBrevoTransactionalEmail(email string, templateID int64, params map[string]interface{}) error {
+	return pc.sendBrevoTransactionalEmail(email, templateID, params, nil)
+}
+
+func (pc *PaymentController) sendBrevoTransactionalEmail(email string, templateID int64, params map[string]interface{}, attachments []brevoAttachment) error {
 	log.Printf("Attempting to send transactional email to %s using template %d", email, templateID)
 
-	brevoURL := "https://api.brevo.com/v3/smtp/email"
+	brevoURL := pc.BrevoAPIURL + "/smtp/email"
 	payload := map[string]interface{}{
 		"to":         []map[string]string{{"email": email}},
 		"templateId": templateID,
 		"params":     params,
 	}
+	if len(attachments) > 0 {
+		payload["attachment"] = attachments
+	}
 	jsonPayload, err := json.Marshal(payload)
 	if err != nil {
 		return fmt.Errorf("error marshalling Brevo email payload: %w", err)
@@ -558,7 +683,7 @@ func (pc *PaymentController) StripeWebhook(ctx *gin.Context) {
 	endpointSecret := pc.StripeWebhookSecret
 	log.Printf("Webhook secret configured: %v", len(endpointSecret) > 0)
 
-	event, err := webhook.ConstructEvent(payload, ctx.Request.Header.Get("Stripe-Signature"), endpointSecret)
+	event, err := pc.Gateway.ConstructEvent(payload, ctx.Request.Header.Get("Stripe-Signature"), endpointSecret)
 	if err != nil {
 		log.Printf("Error verifying webhook signature: %v", err)
 		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook signature"})
@@ -568,138 +693,174 @@ func (pc *PaymentController) StripeWebhook(ctx *gin.Context) {
 	log.Printf("Webhook signature verified successfully")
 	log.Printf("Received webhook event of type: %s", event.Type)
 	log.Printf("Event ID: %s", event.ID)
-	log.Printf("Event data preview: %s", string(event.Data.Raw[:min(len(event.Data.Raw), 500)]))
 
-	switch event.Type {
-	case "checkout.session.payment_succeeded":
-		log.Println("=== Processing 'checkout.session.payment_succeeded' event ===")
-		var checkoutSession stripe.CheckoutSession
-		err := json.Unmarshal(event.Data.Raw, &checkoutSession)
+	stripeEvent, duplicate, err := pc.recordStripeEvent(event, payload)
+	if err != nil {
+		log.Printf("Failed to record Stripe event %s: %v", event.ID, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record event"})
+		return
+	}
+	if duplicate {
+		claimed, err := pc.claimStripeEvent(&stripeEvent)
 		if err != nil {
-			log.Printf("Error parsing webhook JSON: %v", err)
-			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid event data"})
+			log.Printf("Failed to claim Stripe event %s: %v", event.ID, err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record event"})
 			return
 		}
-
-		log.Printf("Checkout session details:")
-		log.Printf("  - Session ID: %s", checkoutSession.ID)
-		log.Printf("  - Payment Status: %s", checkoutSession.PaymentStatus)
-		log.Printf("  - Customer Email: %s", checkoutSession.CustomerDetails.Email)
-
-		if checkoutSession.PaymentStatus != stripe.CheckoutSessionPaymentStatusPaid {
-			log.Printf("Checkout session %s payment not completed yet. Status: %s", checkoutSession.ID, checkoutSession.PaymentStatus)
-			ctx.JSON(http.StatusOK, gin.H{"received": true, "message": "Payment not completed yet"})
+		if !claimed && stripeEvent.Status == StripeEventStatusReceived {
+			// Another delivery is handling it; ask Stripe to try again in
+			// case that one never finishes
+			log.Printf("Stripe event %s is being handled by another delivery", event.ID)
+			ctx.JSON(http.StatusConflict, gin.H{"error": "Event is being processed, retry later"})
 			return
 		}
-
-		customerEmail := checkoutSession.CustomerDetails.Email
-		if customerEmail == "" {
-			log.Printf("Checkout session completed but no customer email found for session %s", checkoutSession.ID)
-			ctx.JSON(http.StatusOK, gin.H{"received": true, "message": "No customer email to process"})
+		if !claimed {
+			log.Printf("Stripe event %s already recorded with status %s, skipping", event.ID, stripeEvent.Status)
+			ctx.JSON(http.StatusOK, gin.H{"received": true, "message": "Event already received"})
 			return
 		}
+		log.Printf("Stripe event %s was %s, handling it again", event.ID, stripeEvent.Status)
+	}
 
-		log.Printf("Checkout session %s payment succeeded for email: %s", checkoutSession.ID, customerEmail)
-
-		job := models.Job{
-			SessionID:     checkoutSession.ID,
-			CustomerEmail: customerEmail,
-			Status:        "pending",
-			Attempts:      0,
-		}
-
-		log.Printf("Creating job in database: %+v", job)
-		if result := pc.DB.Create(&job); result.Error != nil {
-			log.Printf("Failed to create job for session %s: %v", checkoutSession.ID, result.Error)
-			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create job"})
-			return
+	message, err := pc.processStripeEvent(stripeEvent, event)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errInvalidEventData) {
+			status = http.StatusBadRequest
 		}
+		ctx.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
 
-		log.Printf("Successfully created job for session %s", checkoutSession.ID)
+	ctx.JSON(http.StatusOK, gin.H{"received": true, "message": message})
+}
 
-		if workers.GetGlobalProcessor() != nil {
-			workers.GetGlobalProcessor().TriggerJobProcessing()
-			log.Printf("Triggered immediate job processing for session %s", checkoutSession.ID)
-		} else {
-			log.Printf("Warning: Global processor not available, job will be processed on next fallback cycle")
-		}
+// handleStripeEvent performs the work for a single verified event. It returns
+// a short message describing the outcome and whether the event was ignored.
+func (pc *PaymentController) handleStripeEvent(event stripe.Event) (string, bool, error) {
+	log.Printf("Event data preview: %s", string(event.Data.Raw[:min(len(event.Data.Raw), 500)]))
 
-	case "checkout.session.completed":
-		log.Println("=== Processing 'checkout.session.completed' event ===")
+	switch event.Type {
+	case "checkout.session.payment_succeeded", "checkout.session.completed":
+		log.Printf("=== Processing '%s' event ===", event.Type)
 		var checkoutSession stripe.CheckoutSession
-		err := json.Unmarshal(event.Data.Raw, &checkoutSession)
-		if err != nil {
+		if err := json.Unmarshal(event.Data.Raw, &checkoutSession); err != nil {
 			log.Printf("Error parsing webhook JSON: %v", err)
-			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid event data"})
-			return
-		}
-
-		log.Printf("Checkout session completed (fallback):")
-		log.Printf("  - Session ID: %s", checkoutSession.ID)
-		log.Printf("  - Payment Status: %s", checkoutSession.PaymentStatus)
-		log.Printf("  - Customer Email: %s", checkoutSession.CustomerDetails.Email)
-
-		if checkoutSession.PaymentStatus != stripe.CheckoutSessionPaymentStatusPaid {
-			log.Printf("Checkout session %s payment not completed yet. Status: %s", checkoutSession.ID, checkoutSession.PaymentStatus)
-			ctx.JSON(http.StatusOK, gin.H{"received": true, "message": "Payment not completed yet"})
-			return
+			return "", false, errInvalidEventData
 		}
+		return pc.handleCheckoutSessionPaid(&checkoutSession)
 
-		customerEmail := checkoutSession.CustomerDetails.Email
-		if customerEmail == "" {
-			log.Printf("Checkout session completed but no customer email found for session %s", checkoutSession.ID)
-			ctx.JSON(http.StatusOK, gin.H{"received": true, "message": "No customer email to process"})
-			return
+	case "payment_intent.succeeded":
+		log.Println("=== Processing 'payment_intent.succeeded' event ===")
+		var paymentIntent stripe.PaymentIntent
+		if err := json.Unmarshal(event.Data.Raw, &paymentIntent); err != nil {
+			log.Printf("Error parsing payment intent JSON: %v", err)
+			return "", false, errInvalidEventData
 		}
+		log.Printf("Payment intent succeeded: %s", paymentIntent.ID)
 
-		log.Printf("Checkout session %s payment completed for email: %s (fallback)", checkoutSession.ID, customerEmail)
+	case "charge.refunded":
+		log.Println("=== Processing 'charge.refunded' event ===")
+		return pc.handleChargeRefunded(event)
 
-		var existingJob models.Job
-		if pc.DB.Where("session_id = ?", checkoutSession.ID).First(&existingJob).Error == nil {
-			log.Printf("Job already exists for session %s, skipping duplicate creation", checkoutSession.ID)
-			ctx.JSON(http.StatusOK, gin.H{"received": true, "message": "Job already exists"})
-			return
-		}
+	case "charge.dispute.created":
+		log.Println("=== Processing 'charge.dispute.created' event ===")
+		return pc.handleDisputeCreated(event)
 
-		job := models.Job{
-			SessionID:     checkoutSession.ID,
-			CustomerEmail: customerEmail,
-			Status:        "pending",
-			Attempts:      0,
-		}
+	case "charge.dispute.closed":
+		log.Println("=== Processing 'charge.dispute.closed' event ===")
+		return pc.handleDisputeClosed(event)
 
-		log.Printf("Creating job in database (fallback): %+v", job)
-		if result := pc.DB.Create(&job); result.Error != nil {
-			log.Printf("Failed to create job for session %s: %v", checkoutSession.ID, result.Error)
-			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create job"})
-			return
-		}
+	case "customer.subscription.created", "customer.subscription.updated", "customer.subscription.deleted":
+		log.Printf("=== Processing '%s' event ===", event.Type)
+		return pc.handleSubscriptionEvent(event)
 
-		log.Printf("Successfully created job for session %s (fallback)", checkoutSession.ID)
+	case "invoice.payment_failed":
+		log.Println("=== Processing 'invoice.payment_failed' event ===")
+		return pc.handleInvoicePaymentFailed(event)
 
-		if workers.GetGlobalProcessor() != nil {
-			workers.GetGlobalProcessor().TriggerJobProcessing()
-			log.Printf("Triggered immediate job processing for session %s (fallback)", checkoutSession.ID)
-		} else {
-			log.Printf("Warning: Global processor not available, job will be processed on next fallback cycle")
-		}
-
-	case "payment_intent.succeeded":
-		log.Println("=== Processing 'payment_intent.succeeded' event ===")
-		var paymentIntent stripe.PaymentIntent
-		err := json.Unmarshal(event.Data.Raw, &paymentIntent)
-		if err != nil {
-			log.Printf("Error parsing payment intent JSON: %v", err)
-			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid event data"})
-			return
-		}
-		log.Printf("Payment intent succeeded: %s", paymentIntent.ID)
+	case "checkout.session.expired":
+		log.Println("=== Processing 'checkout.session.expired' event ===")
+		return pc.handleCheckoutSessionExpired(event)
 
 	default:
 		log.Printf("Unhandled event type: %s", event.Type)
+		return "Event type not handled", true, nil
+	}
+
+	return "Webhook processed successfully", false, nil
+}
+
+func (pc *PaymentController) handleCheckoutSessionPaid(checkoutSession *stripe.CheckoutSession) (string, bool, error) {
+	customerEmail := ""
+	if checkoutSession.CustomerDetails != nil {
+		customerEmail = checkoutSession.CustomerDetails.Email
+	}
+
+	log.Printf("Checkout session details:")
+	log.Printf("  - Session ID: %s", checkoutSession.ID)
+	log.Printf("  - Payment Status: %s", checkoutSession.PaymentStatus)
+	log.Printf("  - Customer Email: %s", customerEmail)
+
+	if checkoutSession.PaymentStatus != stripe.CheckoutSessionPaymentStatusPaid {
+		log.Printf("Checkout session %s payment not completed yet. Status: %s", checkoutSession.ID, checkoutSession.PaymentStatus)
+		return "Payment not completed yet", true, nil
+	}
+
+	if customerEmail == "" {
+		log.Printf("Checkout session completed but no customer email found for session %s", checkoutSession.ID)
+		return "No customer email to process", true, nil
+	}
+
+	log.Printf("Checkout session %s payment succeeded for email: %s", checkoutSession.ID, customerEmail)
+
+	if err := pc.markCheckoutCompleted(checkoutSession.ID, customerEmail); err != nil {
+		log.Printf("Error updating checkout record for session %s: %v", checkoutSession.ID, err)
+	}
+
+	created, err := pc.enqueuePaymentJob(checkoutSession.ID, customerEmail)
+	if err != nil {
+		log.Printf("Failed to create job for session %s: %v", checkoutSession.ID, err)
+		return "", false, fmt.Errorf("failed to create job: %w", err)
+	}
+	if !created {
+		log.Printf("Job already exists for session %s, skipping duplicate creation", checkoutSession.ID)
+		return "Job already exists", false, nil
+	}
+
+	log.Printf("Successfully created job for session %s", checkoutSession.ID)
+	return "Webhook processed successfully", false, nil
+}
+
+// enqueuePaymentJob creates the fulfilment job for a session unless one
+// already exists, and wakes the payment worker when a job was created.
+func (pc *PaymentController) enqueuePaymentJob(sessionID, customerEmail string) (bool, error) {
+	job := models.Job{
+		SessionID:     sessionID,
+		CustomerEmail: customerEmail,
+		Status:        models.JobStatusPending,
+		NextRunAt:     time.Now(),
+		Attempts:      0,
+	}
+
+	result := pc.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "session_id"}},
+		DoNothing: true,
+	}).Create(&job)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return false, nil
 	}
 
-	ctx.JSON(http.StatusOK, gin.H{"received": true, "message": "Webhook processed successfully"})
+	if workers.GetGlobalProcessor() != nil {
+		workers.GetGlobalProcessor().TriggerJobProcessing()
+		log.Printf("Triggered immediate job processing for session %s", sessionID)
+	} else {
+		log.Printf("Warning: Global processor not available, job will be processed on next fallback cycle")
+	}
+	return true, nil
 }
 
 func min(a, b int) int {
@@ -710,50 +871,36 @@ func min(a, b int) int {
 }
 
 func (pc *PaymentController) ProcessPaymentSuccess(sessionID string, customerEmail string) error {
-	log.Printf("[DEBUG] Starting ProcessPaymentSuccess for session %s, email %s", sessionID, customerEmail)
-	log.Printf("[DEBUG] Payment controller configuration:")
-	log.Printf("  - Frontend URL: %s", pc.FrontendURL)
-	log.Printf("  - Brevo API Key configured: %v", pc.BrevoAPIKey != "")
-	log.Printf("  - Beginner Program Template ID: %d", pc.BrevoBeginnerProgramTemplateID)
-	log.Printf("  - Advanced Program Template ID: %d", pc.BrevoAdvancedProgramTemplateID)
-	log.Printf("  - Beginner List ID: %d", pc.BrevoBeginnerListID)
-	log.Printf("  - Advanced List ID: %d", pc.BrevoAdvancedListID)
-	log.Printf("  - Beginner Program Price ID: %s", pc.BeginnerProgramPriceID)
-	log.Printf("  - Advanced Program Price ID: %s", pc.AdvancedProgramPriceID)
-
-	log.Printf("[DEBUG] Fetching checkout session %s from Stripe", sessionID)
-	checkoutSession, err := pc.StripeClient.CheckoutSessions.Get(sessionID, nil)
+	revoked, err := pc.isSessionRevoked(sessionID)
+	if err != nil {
+		return fmt.Errorf("error checking revocation for session %s: %w", sessionID, err)
+	}
+	if revoked {
+		log.Println("[WARN] Checkout session was refunded or disputed before fulfilment. Skipping.")
+		return nil
+	}
+
+	checkoutSession, err := pc.Gateway.GetCheckoutSession(sessionID)
 	if err != nil {
 		log.Printf("[ERROR] Failed to fetch checkout session: %v", err)
 		return fmt.Errorf("error fetching checkout session: %w", err)
 	}
 
-	log.Printf("[DEBUG] Retrieved checkout session: ID=%s, PaymentStatus=%s, AmountTotal=%d, Currency=%s",
-		checkoutSession.ID, checkoutSession.PaymentStatus, checkoutSession.AmountTotal, checkoutSession.Currency)
-
 	if checkoutSession.PaymentStatus != stripe.CheckoutSessionPaymentStatusPaid {
-		log.Printf("[WARN] Session %s is not paid, status: %s", sessionID, checkoutSession.PaymentStatus)
+		log.Printf("[WARN] Checkout session is not paid, status: %s", checkoutSession.PaymentStatus)
 		return fmt.Errorf("session %s is not paid, status: %s", sessionID, checkoutSession.PaymentStatus)
 	}
 
-	log.Println("Payment status is 'paid'. Proceeding with Brevo actions.")
+	log.Println("Payment status is 'paid'. Proceeding with fulfilment.")
 
-	log.Printf("[DEBUG] Fetching line items for session %s", checkoutSession.ID)
-	lineItemParams := &stripe.CheckoutSessionListLineItemsParams{
-		Session: stripe.String(checkoutSession.ID),
+	lineItems, err := pc.Gateway.ListLineItems(checkoutSession.ID)
+	if err != nil {
+		return fmt.Errorf("error listing line items for session %s: %w", sessionID, err)
 	}
-	lineItemParams.Expand = []*string{stripe.String("data.price.product")}
-	lineItemIterator := pc.StripeClient.CheckoutSessions.ListLineItems(lineItemParams)
 
 	purchasedPriceIDs := []string{}
 	purchasedProductNames := []string{}
-	// Track whether we already sent the Day 1 email for each program to avoid duplicates
-	sentBeginnerEmail := false
-	sentAdvancedEmail := false
-	for lineItemIterator.Next() {
-		li := lineItemIterator.LineItem()
-		log.Printf("[DEBUG] Processing line item: ID=%s, Description=%s, Quantity=%d",
-			li.ID, li.Description, li.Quantity)
+	for _, li := range lineItems {
 		if li.Price != nil {
 			purchasedPriceIDs = append(purchasedPriceIDs, li.Price.ID)
 			if li.Price.Product != nil && li.Price.Product.Name != "" {
@@ -766,300 +913,154 @@ func (pc *PaymentController) ProcessPaymentSuccess(sessionID string, customerEma
 	log.Printf("Purchased product price IDs: %v", purchasedPriceIDs)
 	log.Printf("Purchased product names: %v", purchasedProductNames)
 
-	isBeginnerProgramPurchased := false
-	isAdvancedProgramPurchased := false
-	var beginnerProgramID uint
-	var advancedProgramID uint
+	catalog, err := pc.productsByPriceID(purchasedPriceIDs)
+	if err != nil {
+		return fmt.Errorf("error loading products for session %s: %w", sessionID, err)
+	}
 
-	for _, priceID := range purchasedPriceIDs {
-		if priceID == pc.BeginnerProgramPriceID {
-			isBeginnerProgramPurchased = true
-		}
-		if priceID == pc.AdvancedProgramPriceID {
-			isAdvancedProgramPurchased = true
-		}
+	order, err := pc.recordOrder(checkoutSession, customerEmail, lineItems, catalog)
+	if err != nil {
+		return fmt.Errorf("error recording order for session %s: %w", sessionID, err)
 	}
-	log.Printf("Beginner Program purchased: %v", isBeginnerProgramPurchased)
-	log.Printf("Advanced Program purchased: %v", isAdvancedProgramPurchased)
 
-	var beginnerProgram models.WorkoutProgram
-	if err := pc.DB.Where("name = ?", "beginner-program").First(&beginnerProgram).Error; err == nil {
-		beginnerProgramID = beginnerProgram.ID
-	} else {
-		log.Printf("[WARN] Beginner program not found in DB: %v", err)
+	// A missing invoice can be issued later on download, so it doesn't
+	// hold up fulfilment
+	invoice, err := issueInvoice(pc.DB, pc.InvoiceIssuer, order)
+	if err != nil {
+		log.Printf("Error issuing invoice for order %d: %v", order.ID, err)
 	}
 
-	var advancedProgram models.WorkoutProgram
-	if err := pc.DB.Where("name = ?", "advanced-program").First(&advancedProgram).Error; err == nil {
-		advancedProgramID = advancedProgram.ID
+	listIDsToAdd := []int64{}
+	if pc.BrevoNewsletterListID != 0 {
+		listIDsToAdd = append(listIDsToAdd, pc.BrevoNewsletterListID)
+		log.Printf("Added Newsletter List ID: %d", pc.BrevoNewsletterListID)
 	} else {
-		log.Printf("[WARN] Advanced program not found in DB: %v", err)
+		log.Println("Warning: Brevo Newsletter List ID not configured. Skipping newsletter subscription.")
 	}
 
-	if isBeginnerProgramPurchased && beginnerProgramID != 0 {
-		log.Printf("Beginner Program purchased. Creating user account and auth token for %s", customerEmail)
+	// A template shared by several products in the basket is only sent once
+	sentTemplates := make(map[int64]bool)
+	var userID uint
 
-		userID, err := pc.FindOrCreateUser(customerEmail)
+	if checkoutSession.Mode == stripe.CheckoutSessionModeSubscription && checkoutSession.Subscription != nil {
+		userID, err = pc.FindOrCreateUser(customerEmail)
 		if err != nil {
-			log.Printf("Error finding or creating user: %v", err)
-		} else {
-			var existingUserProgram models.UserProgram
-			err = pc.DB.Where("user_id = ? AND program_id = ?", userID, beginnerProgramID).
-				First(&existingUserProgram).Error
-
-			if errors.Is(err, gorm.ErrRecordNotFound) {
-				userProgram := models.UserProgram{
-					UserID:    userID,
-					ProgramID: beginnerProgramID,
-				}
-				if err := pc.DB.Create(&userProgram).Error; err != nil {
-					log.Printf("Error saving UserProgram for user %d and program %d: %v", userID, beginnerProgramID, err)
-				} else {
-					log.Printf("Successfully linked user %d to program %d in UserPrograms table.", userID, beginnerProgramID)
-				}
-			} else if err != nil {
-				log.Printf("Error checking for existing UserProgram: %v", err)
-			} else {
-				log.Printf("User %d already has access to program %d. Skipping creation.", userID, beginnerProgramID)
-			}
-
-			// Ensure ProgramStartDates is set so Day 1 unlocks immediately on profile
-			var beginnerUser models.User
-			if err := pc.DB.First(&beginnerUser, userID).Error; err == nil {
-				if beginnerUser.ProgramStartDates == nil {
-					beginnerUser.ProgramStartDates = make(map[string]time.Time)
-				}
-				if beginnerUser.ProgramStartDates["beginner-program"].IsZero() {
-					beginnerUser.ProgramStartDates["beginner-program"] = time.Now()
-					if saveErr := pc.DB.Save(&beginnerUser).Error; saveErr != nil {
-						log.Printf("Error saving ProgramStartDates for user %d beginner-program: %v", userID, saveErr)
-					} else {
-						log.Printf("Initialized ProgramStartDates for user %d beginner-program to today", userID)
-					}
-				}
-			} else {
-				log.Printf("Error fetching user %d to set ProgramStartDates: %v", userID, err)
-			}
-
-			const programName = "beginner-program"
-			const dayNumber = 1
-			token, err := pc.CreateAuthToken(userID, programName, dayNumber, checkoutSession.ID)
-			if err != nil {
-				log.Printf("Error creating auth token: %v", err)
-			} else {
-				log.Printf("Generated token: %s for session %s", token, checkoutSession.ID)
-
-				workoutURL := fmt.Sprintf("%s/workout-auth?token=%s", pc.FrontendURL, token)
-				log.Printf("[DEBUG] Generated workout URL for beginner program: %s", workoutURL)
-
-				templateParams := map[string]interface{}{
-					"FIRSTNAME":    "Client",
-					"WORKOUT_LINK": workoutURL,
-				}
-				if pc.BrevoBeginnerProgramTemplateID != 0 {
-					if err := pc.SendBrevoTransactionalEmail(customerEmail, pc.BrevoBeginnerProgramTemplateID, templateParams); err != nil {
-						log.Printf("Error sending beginner program email: %v", err)
-					} else {
-						log.Printf("Successfully sent Day 1 email with secure link to %s", customerEmail)
-						sentBeginnerEmail = true
-					}
-				} else {
-					log.Printf("Brevo Beginner Program Template ID not configured. Skipping email for %s", customerEmail)
-					log.Printf("Workout URL generated: %s", workoutURL)
-				}
-			}
+			return fmt.Errorf("error finding or creating user for subscription: %w", err)
+		}
+		if err := pc.linkCheckoutSubscription(checkoutSession, userID); err != nil {
+			return fmt.Errorf("error linking subscription for session %s: %w", sessionID, err)
 		}
 	}
 
-	if isAdvancedProgramPurchased && advancedProgramID != 0 {
-		log.Printf("Advanced Program purchased. Creating user account and auth token for %s", customerEmail)
-
-		userID, err := pc.FindOrCreateUser(customerEmail)
+	// A gift is fulfilled with codes for the recipient. The buyer gets no
+	// access themselves, only the newsletter and order confirmation.
+	isGift := isGiftSession(checkoutSession)
+	if !isGift && userID == 0 && grantsPrograms(purchasedPriceIDs, catalog) {
+		userID, err = pc.FindOrCreateUser(customerEmail)
 		if err != nil {
-			log.Printf("Error finding or creating user: %v", err)
-		} else {
-			var existingUserProgram models.UserProgram
-			err = pc.DB.Where("user_id = ? AND program_id = ?", userID, advancedProgramID).
-				First(&existingUserProgram).Error
-
-			if errors.Is(err, gorm.ErrRecordNotFound) {
-				userProgram := models.UserProgram{
-					UserID:    userID,
-					ProgramID: advancedProgramID,
-				}
-				if err := pc.DB.Create(&userProgram).Error; err != nil {
-					log.Printf("Error saving UserProgram for user %d and program %d: %v", userID, advancedProgramID, err)
-				} else {
-					log.Printf("Successfully linked user %d to program %d in UserPrograms table.", userID, advancedProgramID)
-				}
-			} else if err != nil {
-				log.Printf("Error checking for existing UserProgram: %v", err)
-			} else {
-				log.Printf("User %d already has access to program %d. Skipping creation.", userID, advancedProgramID)
-			}
-
-			// Ensure ProgramStartDates is set so Day 1 unlocks immediately on profile
-			var advancedUser models.User
-			if err := pc.DB.First(&advancedUser, userID).Error; err == nil {
-				if advancedUser.ProgramStartDates == nil {
-					advancedUser.ProgramStartDates = make(map[string]time.Time)
-				}
-				if advancedUser.ProgramStartDates["advanced-program"].IsZero() {
-					advancedUser.ProgramStartDates["advanced-program"] = time.Now()
-					if saveErr := pc.DB.Save(&advancedUser).Error; saveErr != nil {
-						log.Printf("Error saving ProgramStartDates for user %d advanced-program: %v", userID, saveErr)
-					} else {
-						log.Printf("Initialized ProgramStartDates for user %d advanced-program to today", userID)
-					}
-				}
-			} else {
-				log.Printf("Error fetching user %d to set ProgramStartDates: %v", userID, err)
-			}
-
-			const programName = "advanced-program"
-			const dayNumber = 1
-			token, err := pc.CreateAuthToken(userID, programName, dayNumber, checkoutSession.ID)
-			if err != nil {
-				log.Printf("Error creating auth token for Advanced Program: %v", err)
-			} else {
-				log.Printf("Generated token: %s for session %s", token, checkoutSession.ID)
-
-				var authToken models.AuthToken
-				if err := pc.DB.Where("token = ?", token).First(&authToken).Error; err == nil {
-					authToken.SessionID = checkoutSession.ID
-					pc.DB.Save(&authToken)
-					log.Printf("Successfully linked new token to session %s", checkoutSession.ID)
-				} else {
-					log.Printf("Error finding newly created token to link to session: %v", err)
-				}
-
-				workoutURL := fmt.Sprintf("%s/workout-auth?token=%s", pc.FrontendURL, token)
-				templateParams := map[string]interface{}{
-					"FIRSTNAME":    "Client",
-					"WORKOUT_LINK": workoutURL,
-				}
-
-				if pc.BrevoAdvancedProgramTemplateID != 0 {
-					if err := pc.SendBrevoTransactionalEmail(customerEmail, pc.BrevoAdvancedProgramTemplateID, templateParams); err != nil {
-						log.Printf("Error sending advanced program email: %v", err)
-					} else {
-						log.Printf("Successfully sent Day 1 email with secure link for Advanced Program to %s", customerEmail)
-						sentAdvancedEmail = true
-					}
-				} else {
-					log.Printf("Brevo Advanced Program Template ID not configured. Skipping email for %s", customerEmail)
-					log.Printf("Workout URL generated: %s", workoutURL)
-				}
-			}
+			return fmt.Errorf("error finding or creating user for session %s: %w", sessionID, err)
+		}
+	}
+	if userID != 0 && order.UserID == nil {
+		if err := pc.DB.Model(order).Update("user_id", userID).Error; err != nil {
+			return fmt.Errorf("error linking order %d to user %d: %w", order.ID, userID, err)
 		}
 	}
 
-	listIDsToAdd := []int64{}
-	emailTemplatesToSend := make(map[int64]bool)
+	// Anything that can fail, and so retry the job, happens before the
+	// customer is emailed
+	if err := pc.recordPromotionRedemption(checkoutSession, order); err != nil {
+		return fmt.Errorf("error recording promotion redemption for session %s: %w", sessionID, err)
+	}
+	if err := pc.recordReferralConversion(checkoutSession, order); err != nil {
+		return fmt.Errorf("error recording referral for session %s: %w", sessionID, err)
+	}
+	if isGift {
+		// Each code records when it was emailed, so a retry only sends
+		// the ones still outstanding
+		if err := pc.issueGiftCodes(checkoutSession, customerEmail, lineItems, catalog); err != nil {
+			return fmt.Errorf("error issuing gift codes for session %s: %w", sessionID, err)
+		}
+	}
 
-	if pc.BrevoNewsletterListID != 0 {
-		listIDsToAdd = append(listIDsToAdd, pc.BrevoNewsletterListID)
-		log.Printf("Added Newsletter List ID: %d", pc.BrevoNewsletterListID)
-	} else {
-		log.Println("Warning: Brevo Newsletter List ID not configured. Skipping newsletter subscription.")
+	// A job that crashed after emailing the customer mustn't send them
+	// another set of login links
+	if order.FulfilledAt != nil {
+		log.Printf("Order %d was already fulfilled at %s. Not emailing again.", order.ID, order.FulfilledAt.Format(time.RFC3339))
+		return nil
 	}
 
-	for i, priceID := range purchasedPriceIDs {
-		productName := purchasedProductNames[i]
-		log.Printf("Checking product: %s (Price ID: %s)", productName, priceID)
+	for _, priceID := range purchasedPriceIDs {
+		product, ok := catalog[priceID]
+		if !ok {
+			log.Printf("[WARN] No product configured for price ID %s. Nothing to fulfil for this item.", priceID)
+			continue
+		}
+		if isGift {
+			continue
+		}
+		log.Printf("Fulfilling product %s (Price ID: %s)", product.Name, priceID)
+
+		listIDsToAdd = append(listIDsToAdd, product.BrevoListIDs...)
 
-		if priceID == pc.UltimateMindsetPackagePriceID || strings.Contains(strings.ToLower(productName), "mindset") {
-			if pc.BrevoMindsetListID != 0 {
-				listIDsToAdd = append(listIDsToAdd, pc.BrevoMindsetListID)
-				log.Printf("Matched Mindset Package. Added List ID: %d", pc.BrevoMindsetListID)
-			} else {
-				log.Println("Warning: Brevo Mindset Package List ID not configured.")
-			}
-			if pc.BrevoMindsetPackageTemplateID != 0 {
-				emailTemplatesToSend[pc.BrevoMindsetPackageTemplateID] = true
-				log.Printf("Matched Mindset Package. Added Email Template ID: %d", pc.BrevoMindsetPackageTemplateID)
-			} else {
-				log.Println("Warning: Brevo Mindset Package Template ID not configured.")
-			}
+		templateParams := map[string]interface{}{
+			"FIRSTNAME":       "Client",
+			"CUSTOMER_EMAIL":  customerEmail,
+			"PURCHASED_ITEMS": purchasedProductNames,
 		}
 
-		switch priceID {
-		case pc.BeginnerProgramPriceID:
-			if pc.BrevoBeginnerListID != 0 {
-				listIDsToAdd = append(listIDsToAdd, pc.BrevoBeginnerListID)
-				log.Printf("Matched Beginner Program. Added List ID: %d", pc.BrevoBeginnerListID)
-			}
-			if pc.BrevoBeginnerProgramTemplateID != 0 {
-				emailTemplatesToSend[pc.BrevoBeginnerProgramTemplateID] = true
-				log.Printf("Matched Beginner Program. Added Email Template ID: %d", pc.BrevoBeginnerProgramTemplateID)
-			}
-		case pc.AdvancedProgramPriceID:
-			if pc.BrevoAdvancedListID != 0 {
-				listIDsToAdd = append(listIDsToAdd, pc.BrevoAdvancedListID)
-				log.Printf("Matched Advanced Program. Added List ID: %d", pc.BrevoAdvancedListID)
+		workoutLinks := []string{}
+		for _, program := range product.Programs {
+			if userID == 0 {
+				break
 			}
-			if pc.BrevoAdvancedProgramTemplateID != 0 {
-				emailTemplatesToSend[pc.BrevoAdvancedProgramTemplateID] = true
-				log.Printf("Matched Advanced Program. Added Email Template ID: %d", pc.BrevoAdvancedProgramTemplateID)
+			token, err := grantProgramAccess(pc.DB, userID, program, checkoutSession.ID)
+			if err != nil {
+				log.Printf("Error granting %s to user %d: %v", program.Name, userID, err)
+				continue
 			}
-		case pc.TailoredCoachingPriceID:
-			if pc.BrevoTailoredCoachingListID != 0 {
-				listIDsToAdd = append(listIDsToAdd, pc.BrevoTailoredCoachingListID)
-				log.Printf("Matched Tailored Coaching. Added List ID: %d", pc.BrevoTailoredCoachingListID)
+			workoutURL := fmt.Sprintf("%s/workout-auth?token=%s", pc.FrontendURL, token)
+			workoutLinks = append(workoutLinks, workoutURL)
+		}
+		if len(workoutLinks) > 0 {
+			templateParams["WORKOUT_LINK"] = workoutLinks[0]
+			templateParams["WORKOUT_LINKS"] = workoutLinks
+		}
+
+		for _, templateID := range product.BrevoTemplateIDs {
+			if sentTemplates[templateID] {
+				log.Printf("Skipping duplicate email (Template ID: %d) - already sent.", templateID)
+				continue
 			}
-			if pc.BrevoTailoredCoachingTemplateID != 0 {
-				emailTemplatesToSend[pc.BrevoTailoredCoachingTemplateID] = true
-				log.Printf("Matched Tailored Coaching. Added Email Template ID: %d", pc.BrevoTailoredCoachingTemplateID)
+			if err := pc.SendBrevoTransactionalEmail(customerEmail, templateID, templateParams); err != nil {
+				log.Printf("Error sending transactional email (Template ID: %d) for order %d: %v", templateID, order.ID, err)
+				continue
 			}
+			log.Printf("Successfully sent transactional email (Template ID: %d) for order %d", templateID, order.ID)
+			sentTemplates[templateID] = true
 		}
 	}
 
+	listIDsToAdd = mergeUniqueInt64(nil, listIDsToAdd)
 	log.Printf("Final list of Brevo list IDs to add: %v", listIDsToAdd)
-	log.Printf("Final list of Brevo email template IDs to send: %v", emailTemplatesToSend)
 
 	if len(listIDsToAdd) > 0 {
-		log.Printf("Calling AddContactToBrevo for email: %s with lists: %v", customerEmail, listIDsToAdd)
 		err = pc.AddContactToBrevo(customerEmail, listIDsToAdd)
 		if err != nil {
-			log.Printf("Error adding contact %s to Brevo lists %v: %v", customerEmail, listIDsToAdd, err)
+			log.Printf("Error adding customer of order %d to Brevo lists %v: %v", order.ID, listIDsToAdd, err)
 		} else {
-			log.Printf("Successfully added contact %s to Brevo lists: %v", customerEmail, listIDsToAdd)
+			log.Printf("Successfully added customer of order %d to Brevo lists: %v", order.ID, listIDsToAdd)
 		}
 	} else {
 		log.Println("No Brevo lists identified for this purchase.")
 	}
 
-	for templateID := range emailTemplatesToSend {
-		// Skip templates we've already sent above to avoid duplicates
-		if sentBeginnerEmail && templateID == pc.BrevoBeginnerProgramTemplateID {
-			log.Printf("Skipping duplicate beginner program email (Template ID: %d) - already sent.", templateID)
-			continue
-		}
-		if sentAdvancedEmail && templateID == pc.BrevoAdvancedProgramTemplateID {
-			log.Printf("Skipping duplicate advanced program email (Template ID: %d) - already sent.", templateID)
-			continue
-		}
-		log.Printf("Attempting to send transactional email with Template ID: %d to %s", templateID, customerEmail)
-		emailParams := map[string]interface{}{
-			"CUSTOMER_EMAIL":  customerEmail,
-			"PURCHASED_ITEMS": purchasedProductNames,
-		}
-		err = pc.SendBrevoTransactionalEmail(customerEmail, templateID, emailParams)
-		if err != nil {
-			log.Printf("Error sending transactional email (Template ID: %d) to %s: %v", templateID, customerEmail, err)
-		} else {
-			log.Printf("Successfully sent transactional email (Template ID: %d) to %s", templateID, customerEmail)
-		}
-	}
-
 	if pc.BrevoOrderConfirmationTemplateID != 0 {
-		log.Printf("Attempting to send order confirmation email (Template ID: %d) to %s", pc.BrevoOrderConfirmationTemplateID, customerEmail)
+		log.Printf("Attempting to send order confirmation email (Template ID: %d) for order %d", pc.BrevoOrderConfirmationTemplateID, order.ID)
 		// Build params expected by the Brevo template (Docs/Emails/Confirmation/Order-confirmation.html)
-		// Template expects: ORDER_ID, ORDER_DATE, TOTAL_PAID, ITEM_NAME_1, ITEM_NAME_2
-		orderTotal := fmt.Sprintf("%.2f", float64(checkoutSession.AmountTotal)/100.0)
-		if strings.EqualFold(string(checkoutSession.Currency), "gbp") {
-			orderTotal = "£" + orderTotal
-		}
+		// Template expects: ORDER_ID, ORDER_DATE, TOTAL_PAID, ITEM_NAME_1, ITEM_NAME_2.
+		// ITEMS carries every item, for templates that loop over the basket.
+		orderTotal := money.Format(checkoutSession.AmountTotal, string(checkoutSession.Currency))
 
 		var item1, item2 string
 		if len(purchasedProductNames) > 0 {
@@ -1075,23 +1076,50 @@ func (pc *PaymentController) ProcessPaymentSuccess(sessionID string, customerEma
 			"TOTAL_PAID":  orderTotal,
 			"ITEM_NAME_1": item1,
 			"ITEM_NAME_2": item2,
+			"ITEMS":       purchasedProductNames,
+		}
+		var attachments []brevoAttachment
+		if invoice != nil {
+			orderConfirmationParams["INVOICE_NUMBER"] = invoice.Number
+			orderConfirmationParams["VAT_AMOUNT"] = money.Format(invoice.VATAmount, invoice.Currency)
+			if pc.AttachInvoicePDF {
+				attachments = append(attachments, brevoAttachment{
+					Content: base64.StdEncoding.EncodeToString(renderInvoicePDF(invoice)),
+					Name:    invoice.Number + ".pdf",
+				})
+			}
 		}
-		err = pc.SendBrevoTransactionalEmail(customerEmail, pc.BrevoOrderConfirmationTemplateID, orderConfirmationParams)
+		err = pc.sendBrevoTransactionalEmail(customerEmail, pc.BrevoOrderConfirmationTemplateID, orderConfirmationParams, attachments)
 		if err != nil {
-			log.Printf("Error sending general order confirmation email to %s: %v", customerEmail, err)
+			log.Printf("Error sending general order confirmation email for order %d: %v", order.ID, err)
 		} else {
-			log.Printf("Successfully sent general order confirmation email to %s", customerEmail)
+			log.Printf("Successfully sent general order confirmation email for order %d", order.ID)
 		}
 	} else {
 		log.Println("Warning: Brevo Order Confirmation Template ID not configured. Skipping general order confirmation email.")
 	}
 
-	log.Printf("Background processing for session %s completed successfully", sessionID)
+	if err := pc.DB.Model(order).Update("fulfilled_at", time.Now()).Error; err != nil {
+		log.Printf("Error marking order %d as fulfilled: %v", order.ID, err)
+	}
+
+	log.Printf("Background processing for order %d completed successfully", order.ID)
 	return nil
 }
 
+// grantsPrograms reports whether any of the purchased prices gives access to
+// a workout program, and so needs an account to grant it to.
+func grantsPrograms(priceIDs []string, catalog map[string]models.Product) bool {
+	for _, priceID := range priceIDs {
+		if product, ok := catalog[priceID]; ok && len(product.Programs) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
 func (pc *PaymentController) GetPriceUnitAmount(priceID string) (int64, error) {
-	price, err := pc.StripeClient.Prices.Get(priceID, nil)
+	price, err := pc.Gateway.GetPrice(priceID)
 	if err != nil {
 		return 0, err
 	}
@@ -1101,7 +1129,7 @@ func (pc *PaymentController) GetPriceUnitAmount(priceID string) (int64, error) {
 func (pc *PaymentController) GetContactBrevo(email string) ([]int64, error) {
 	log.Printf("Attempting to get contact %s details from Brevo", email)
 
-	brevoURL := fmt.Sprintf("https://api.brevo.com/v3/contacts/%s", email)
+	brevoURL := fmt.Sprintf("%s/contacts/%s", pc.BrevoAPIURL, email)
 
 	req, err := http.NewRequest("GET", brevoURL, nil)
 	if err != nil {
@@ -1152,6 +1180,49 @@ func mergeUniqueInt64(existing, additions []int64) []int64 {
 	return merged
 }
 
+// successPageLinkWindow is how long after fulfilment the payment success
+// page can still be given a workout link.
+const successPageLinkWindow = 30 * time.Minute
+
+var errSuccessPageLinkUnavailable = errors.New("success page link already issued or expired")
+
+// issueSuccessPageLink gives the success page a link of its own, since only
+// hashes of the emailed links are stored. A session gets one such link, and
+// only shortly after it was fulfilled, so knowing a checkout session ID
+// isn't a lasting way to log in.
+func (pc *PaymentController) issueSuccessPageLink(purchase *models.AuthToken) (string, error) {
+	var token string
+	err := pc.DB.Transaction(func(tx *gorm.DB) error {
+		// Requests for the same session queue on the purchase link's row
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&models.AuthToken{}, purchase.ID).Error; err != nil {
+			return err
+		}
+		if time.Since(purchase.CreatedAt) > successPageLinkWindow {
+			return errSuccessPageLinkUnavailable
+		}
+		var issued int64
+		if err := tx.Model(&models.AuthToken{}).
+			Where("session_id = ? AND purpose = ?", purchase.SessionID, models.AuthTokenPurposeSuccessPage).
+			Count(&issued).Error; err != nil {
+			return err
+		}
+		if issued > 0 {
+			return errSuccessPageLinkUnavailable
+		}
+
+		var err error
+		token, err = issueAuthToken(tx, models.AuthToken{
+			UserID:      purchase.UserID,
+			Purpose:     models.AuthTokenPurposeSuccessPage,
+			ProgramName: purchase.ProgramName,
+			SessionID:   purchase.SessionID,
+			DayNumber:   purchase.DayNumber,
+		}, workoutLinkTTL())
+		return err
+	})
+	return token, err
+}
+
 func (pc *PaymentController) GetWorkoutLink(ctx *gin.Context) {
 	var req struct {
 		SessionID string `json:"sessionId" binding:"required"`
@@ -1162,36 +1233,53 @@ func (pc *PaymentController) GetWorkoutLink(ctx *gin.Context) {
 		return
 	}
 
-	log.Printf("Attempting to retrieve workout link for session: %s", req.SessionID)
-
 	var authToken models.AuthToken
-	dbErr := pc.DB.Where("session_id = ?", req.SessionID).First(&authToken).Error
+	dbErr := pc.DB.Where("session_id = ? AND purpose = ?", req.SessionID, models.AuthTokenPurposePurchase).Order("id").First(&authToken).Error
 
 	if dbErr == nil {
-		log.Printf("Auth token found: %+v", authToken)
-		workoutURL := fmt.Sprintf("%s/workout-auth?token=%s", pc.FrontendURL, authToken.Token)
-		log.Printf("Successfully found token for session %s. URL: %s", req.SessionID, workoutURL)
+		revoked, err := pc.isSessionRevoked(req.SessionID)
+		if err != nil {
+			log.Printf("Error checking revocation for workout link request: %v", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve workout link from database"})
+			return
+		}
+		if revoked {
+			ctx.JSON(http.StatusGone, gin.H{"error": "This purchase has been refunded."})
+			return
+		}
+		token, err := pc.issueSuccessPageLink(&authToken)
+		if errors.Is(err, errSuccessPageLinkUnavailable) {
+			ctx.JSON(http.StatusGone, gin.H{"error": "This link is no longer available. Please use the link in your email or log in."})
+			return
+		}
+		if err != nil {
+			log.Printf("Error creating workout link for user %d: %v", authToken.UserID, err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create workout link"})
+			return
+		}
+		workoutURL := fmt.Sprintf("%s/workout-auth?token=%s", pc.FrontendURL, token)
+		log.Printf("Issued success page workout link for user %d", authToken.UserID)
 		ctx.JSON(http.StatusOK, gin.H{"workoutLink": workoutURL})
 		return
 	}
 
 	if dbErr != gorm.ErrRecordNotFound {
-		log.Printf("Database error retrieving token for session %s: %v", req.SessionID, dbErr)
+		log.Printf("Database error retrieving workout link: %v", dbErr)
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve workout link from database"})
 		return
 	}
 
-	log.Printf("No auth token found for session %s. Checking Stripe status.", req.SessionID)
+	log.Println("No workout link found for session. Checking Stripe status.")
 
-	session, stripeErr := pc.StripeClient.CheckoutSessions.Get(req.SessionID, nil)
+	session, stripeErr := pc.Gateway.GetCheckoutSession(req.SessionID)
 	if stripeErr != nil {
-		log.Printf("Stripe API error for session %s: %v", req.SessionID, stripeErr)
+		log.Printf("Stripe API error looking up session for workout link: %v", stripeErr)
 		ctx.JSON(http.StatusNotFound, gin.H{"error": "Invalid session ID or Stripe API error."})
 		return
 	}
 
 	if session.PaymentStatus == stripe.CheckoutSessionPaymentStatusPaid {
-		log.Printf("Stripe session %s is paid, but token not found. Webhook is likely still processing.", req.SessionID)
+		log.Println("Stripe session is paid, but workout link not found. Webhook is likely still processing.")
 
 		var job models.Job
 		if pc.DB.Where("session_id = ? AND status IN (?)", req.SessionID, []string{"pending", "processing"}).First(&job).Error == nil {
@@ -1210,7 +1298,7 @@ func (pc *PaymentController) GetWorkoutLink(ctx *gin.Context) {
 		return
 	}
 
-	log.Printf("Stripe session %s is not paid. Payment status: %s", req.SessionID, session.PaymentStatus)
+	log.Printf("Stripe session is not paid. Payment status: %s", session.PaymentStatus)
 	ctx.JSON(http.StatusNotFound, gin.H{"error": "Payment not completed for this session."})
 }
 
@@ -1243,10 +1331,6 @@ func (pc *PaymentController) TestWebhook(ctx *gin.Context) {
 }
 
 func (pc *PaymentController) ValidateCoupon(c *gin.Context) {
-	log.Printf("=== COUPON VALIDATION ENDPOINT HIT ===")
-	log.Printf("Method: %s", c.Request.Method)
-	log.Printf("Headers: %v", c.Request.Header)
-
 	var req ValidateCouponRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		log.Printf("Error binding coupon validation request: %v", err)
@@ -1254,93 +1338,40 @@ func (pc *PaymentController) ValidateCoupon(c *gin.Context) {
 		return
 	}
 
-	log.Printf("Validating coupon: %s for cart total: £%.2f", req.CouponCode, req.CartTotal)
-
-	// First try to get it as a promotion code, then as a direct coupon
-	var stripeCoupon *stripe.Coupon
-	var err error
-
-	// Try to find promotion code by listing with code filter
-	promoParams := &stripe.PromotionCodeListParams{
-		Code: stripe.String(req.CouponCode),
-	}
-
-	promoIter := pc.StripeClient.PromotionCodes.List(promoParams)
-
-	// Iterate through results to find exact match
-
-	for promoIter.Next() {
-		promo := promoIter.PromotionCode()
-		if strings.EqualFold(promo.Code, req.CouponCode) {
-			if promo.Coupon != nil && promo.Coupon.ID != "" {
-				stripeCoupon = promo.Coupon
-			}
-			break
-		}
-	}
-
-	// Check for iteration errors
-	if stripeCoupon == nil {
-		stripeCoupon, err = pc.StripeClient.Coupons.Get(req.CouponCode, nil)
-		if err != nil {
-			stripeCoupon = nil // Reset if failed
-		}
-	}
-
-	if stripeCoupon == nil {
-		// Based on your JSON, try the actual coupon ID
-		possibleCouponIDs := []string{"2vfoih63"}
-		for _, couponID := range possibleCouponIDs {
-			if testCoupon, testErr := pc.StripeClient.Coupons.Get(couponID, nil); testErr == nil {
-				stripeCoupon = testCoupon
-				break
-			}
-		}
-	}
-
-	if stripeCoupon == nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Coupon '%s' not found", req.CouponCode)})
+	items, _, _, err := pc.localisedBasket(c, req.Currency, req.Items)
+	if errors.Is(err, errUnsupportedCurrency) || errors.Is(err, errProductUnavailable) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-
-	log.Printf("Retrieved coupon from Stripe: ID=%s, Valid=%v, AmountOff=%d, PercentOff=%f",
-		stripeCoupon.ID, stripeCoupon.Valid, stripeCoupon.AmountOff, stripeCoupon.PercentOff)
-
-	// Check if coupon is valid (not expired, etc.)
-	if !stripeCoupon.Valid {
-		log.Printf("Coupon is not valid: %s", stripeCoupon.ID)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Coupon has expired or is no longer valid"})
+	if err != nil {
+		log.Printf("Error loading products for coupon %s: %v", req.CouponCode, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not validate coupon"})
 		return
 	}
 
-	// Calculate discount amount
-	var discountAmount float64
-	if stripeCoupon.AmountOff > 0 {
-		// Fixed amount discount (in pence, convert to pounds)
-		discountAmount = float64(stripeCoupon.AmountOff) / 100
-		log.Printf("Fixed amount discount: %d pence = £%.2f", stripeCoupon.AmountOff, discountAmount)
-	} else if stripeCoupon.PercentOff > 0 {
-		// Percentage discount
-		discountAmount = req.CartTotal * (stripeCoupon.PercentOff / 100)
-		log.Printf("Percentage discount: %.1f%% of £%.2f = £%.2f", stripeCoupon.PercentOff, req.CartTotal, discountAmount)
-	} else {
-		log.Printf("Invalid coupon configuration - no amount_off or percent_off")
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid coupon configuration"})
+	discount, err := pc.discountForCart(req.CouponCode, req.CustomerEmail, items)
+	var rejected *promotionError
+	if errors.As(err, &rejected) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": rejected.Error()})
 		return
 	}
-
-	// Ensure discount doesn't exceed cart total
-	if discountAmount > req.CartTotal {
-		log.Printf("Discount amount £%.2f exceeds cart total £%.2f, capping at cart total", discountAmount, req.CartTotal)
-		discountAmount = req.CartTotal
-	}
-
-	log.Printf("Calculated discount: £%.2f for coupon %s", discountAmount, stripeCoupon.ID)
-
-	response := ValidateCouponResponse{
-		Coupon:   stripeCoupon,
-		Discount: discountAmount,
+	if err != nil {
+		log.Printf("Error validating coupon %s: %v", req.CouponCode, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not validate coupon"})
+		return
 	}
 
-	c.JSON(http.StatusOK, response)
+	total := discount.Subtotal - discount.Discount
+	log.Printf("Coupon %s takes %s off %s", discount.Code, money.Format(discount.Discount, discount.Currency), money.Format(discount.Subtotal, discount.Currency))
+	c.JSON(http.StatusOK, ValidateCouponResponse{
+		Code:              discount.Code,
+		Description:       discount.Description,
+		Currency:          discount.Currency,
+		Subtotal:          discount.Subtotal,
+		Discount:          discount.Discount,
+		Total:             total,
+		SubtotalFormatted: money.Format(discount.Subtotal, discount.Currency),
+		DiscountFormatted: money.Format(discount.Discount, discount.Currency),
+		TotalFormatted:    money.Format(total, discount.Currency),
+	})
 }
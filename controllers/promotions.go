@@ -0,0 +1,268 @@
+package controllers
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/88warren/lmw-fitness-backend/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type PromotionController struct {
+	DB *gorm.DB
+}
+
+func NewPromotionController(db *gorm.DB) *PromotionController {
+	return &PromotionController{DB: db}
+}
+
+// Stripe only accepts letters and digits in promotion codes
+var promotionCodePattern = regexp.MustCompile(`^[A-Z0-9]{3,40}$`)
+
+type PromotionRequest struct {
+	Code                  string     `json:"code" binding:"required"`
+	Description           string     `json:"description"`
+	DiscountType          string     `json:"discountType" binding:"required,oneof=percent amount"`
+	PercentOff            int64      `json:"percentOff"`
+	AmountOff             int64      `json:"amountOff"`
+	Currency              string     `json:"currency"`
+	ProductIDs            []uint     `json:"productIds"`
+	MaxRedemptions        int64      `json:"maxRedemptions" binding:"min=0"`
+	MaxRedemptionsPerUser int64      `json:"maxRedemptionsPerUser" binding:"min=0"`
+	StartsAt              *time.Time `json:"startsAt"`
+	EndsAt                *time.Time `json:"endsAt"`
+	FirstPurchaseOnly     bool       `json:"firstPurchaseOnly"`
+	RequiresOtherProduct  bool       `json:"requiresOtherProduct"`
+	Automatic             bool       `json:"automatic"`
+	IsActive              *bool      `json:"isActive"`
+}
+
+// apply validates the request and copies it onto a promotion.
+func (req *PromotionRequest) apply(promo *models.Promotion) string {
+	code := normalisePromotionCode(req.Code)
+	if !promotionCodePattern.MatchString(code) {
+		return "Code must be 3 to 40 letters or digits"
+	}
+	switch req.DiscountType {
+	case models.PromotionTypePercent:
+		if req.PercentOff < 1 || req.PercentOff > 100 {
+			return "percentOff must be between 1 and 100"
+		}
+	case models.PromotionTypeAmount:
+		if req.AmountOff < 1 {
+			return "amountOff must be a positive amount in pence"
+		}
+	}
+	if req.StartsAt != nil && req.EndsAt != nil && !req.EndsAt.After(*req.StartsAt) {
+		return "endsAt must be after startsAt"
+	}
+	if req.RequiresOtherProduct && len(req.ProductIDs) == 0 {
+		return "requiresOtherProduct needs the productIds the bundle discounts"
+	}
+
+	currency := strings.ToLower(strings.TrimSpace(req.Currency))
+	if currency == "" {
+		currency = defaultCurrency
+	}
+
+	promo.Code = code
+	promo.Description = req.Description
+	promo.DiscountType = req.DiscountType
+	promo.PercentOff = 0
+	promo.AmountOff = 0
+	if req.DiscountType == models.PromotionTypePercent {
+		promo.PercentOff = req.PercentOff
+	} else {
+		promo.AmountOff = req.AmountOff
+	}
+	promo.Currency = currency
+	promo.ProductIDs = req.ProductIDs
+	if promo.ProductIDs == nil {
+		promo.ProductIDs = []uint{}
+	}
+	promo.MaxRedemptions = req.MaxRedemptions
+	promo.MaxRedemptionsPerUser = req.MaxRedemptionsPerUser
+	promo.StartsAt = req.StartsAt
+	promo.EndsAt = req.EndsAt
+	promo.FirstPurchaseOnly = req.FirstPurchaseOnly
+	promo.RequiresOtherProduct = req.RequiresOtherProduct
+	promo.Automatic = req.Automatic
+	if req.IsActive != nil {
+		promo.IsActive = *req.IsActive
+	}
+	return ""
+}
+
+type promotionSummary struct {
+	models.Promotion
+	Redemptions int64 `json:"redemptions"`
+}
+
+func (prc *PromotionController) redemptionCounts(ids []uint) (map[uint]int64, error) {
+	counts := make(map[uint]int64)
+	if len(ids) == 0 {
+		return counts, nil
+	}
+	var rows []struct {
+		PromotionID uint
+		Count       int64
+	}
+	if err := prc.DB.Model(&models.PromotionRedemption{}).
+		Select("promotion_id, COUNT(*) AS count").
+		Where("promotion_id IN ? AND reserved_until IS NULL", ids).
+		Group("promotion_id").
+		Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		counts[row.PromotionID] = row.Count
+	}
+	return counts, nil
+}
+
+func (prc *PromotionController) ListPromotions(c *gin.Context) {
+	query := prc.DB.Model(&models.Promotion{})
+	if active := c.Query("active"); active != "" {
+		query = query.Where("is_active = ?", active == "true")
+	}
+
+	var promotions []models.Promotion
+	if err := query.Order("created_at DESC").Find(&promotions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve promotions"})
+		return
+	}
+
+	ids := make([]uint, 0, len(promotions))
+	for _, promo := range promotions {
+		ids = append(ids, promo.ID)
+	}
+	counts, err := prc.redemptionCounts(ids)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count redemptions"})
+		return
+	}
+
+	summaries := make([]promotionSummary, 0, len(promotions))
+	for _, promo := range promotions {
+		summaries = append(summaries, promotionSummary{Promotion: promo, Redemptions: counts[promo.ID]})
+	}
+	c.JSON(http.StatusOK, summaries)
+}
+
+func (prc *PromotionController) loadPromotion(c *gin.Context) (*models.Promotion, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid promotion ID"})
+		return nil, false
+	}
+
+	var promo models.Promotion
+	if err := prc.DB.First(&promo, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Promotion not found"})
+			return nil, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve promotion"})
+		return nil, false
+	}
+	return &promo, true
+}
+
+func (prc *PromotionController) GetPromotion(c *gin.Context) {
+	promo, ok := prc.loadPromotion(c)
+	if !ok {
+		return
+	}
+
+	var redemptions []models.PromotionRedemption
+	if err := prc.DB.Where("promotion_id = ? AND reserved_until IS NULL", promo.ID).Order("created_at DESC").Limit(200).Find(&redemptions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve redemptions"})
+		return
+	}
+	var total int64
+	prc.DB.Model(&models.PromotionRedemption{}).Where("promotion_id = ? AND reserved_until IS NULL", promo.ID).Count(&total)
+
+	c.JSON(http.StatusOK, gin.H{
+		"promotion":         promotionSummary{Promotion: *promo, Redemptions: total},
+		"recentRedemptions": redemptions,
+	})
+}
+
+func (prc *PromotionController) CreatePromotion(c *gin.Context) {
+	var req PromotionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	promo := models.Promotion{IsActive: true}
+	if msg := req.apply(&promo); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+
+	var existing int64
+	prc.DB.Model(&models.Promotion{}).Where("code = ?", promo.Code).Count(&existing)
+	if existing > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "A promotion with this code already exists"})
+		return
+	}
+
+	if err := prc.DB.Create(&promo).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create promotion"})
+		return
+	}
+	c.JSON(http.StatusCreated, promo)
+}
+
+// UpdatePromotion changes a promotion's rules. The Stripe copy is rebuilt
+// the next time the code is used at checkout.
+func (prc *PromotionController) UpdatePromotion(c *gin.Context) {
+	promo, ok := prc.loadPromotion(c)
+	if !ok {
+		return
+	}
+
+	var req PromotionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if normalisePromotionCode(req.Code) != promo.Code {
+		var existing int64
+		prc.DB.Model(&models.Promotion{}).Where("code = ? AND id <> ?", normalisePromotionCode(req.Code), promo.ID).Count(&existing)
+		if existing > 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "A promotion with this code already exists"})
+			return
+		}
+	}
+	if msg := req.apply(promo); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+
+	if err := prc.DB.Save(promo).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update promotion"})
+		return
+	}
+	c.JSON(http.StatusOK, promo)
+}
+
+// DeactivatePromotion stops a code being accepted. Promotions are never
+// deleted so their redemptions stay attributable.
+func (prc *PromotionController) DeactivatePromotion(c *gin.Context) {
+	promo, ok := prc.loadPromotion(c)
+	if !ok {
+		return
+	}
+
+	if err := prc.DB.Model(promo).Update("is_active", false).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to deactivate promotion"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Promotion deactivated"})
+}
@@ -0,0 +1,325 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/88warren/lmw-fitness-backend/models"
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v82"
+	"gorm.io/gorm"
+)
+
+// Problems reconciliation can find with a paid checkout session
+const (
+	ReconcileJobMissing          = "job_missing"
+	ReconcileJobFailed           = "job_failed"
+	ReconcileOrderMissing        = "order_missing"
+	ReconcileAccessMissing       = "access_missing"
+	ReconcileLinkMissing         = "workout_link_missing"
+	ReconcileGiftCodesMissing    = "gift_codes_missing"
+	ReconcileSubscriptionMissing = "subscription_missing"
+)
+
+// maxReconcileRange keeps the admin endpoint inside an HTTP request's
+// time; the command line has no limit.
+const maxReconcileRange = 92 * 24 * time.Hour
+
+type ReconcileIssue struct {
+	SessionID     string    `json:"sessionId"`
+	CustomerEmail string    `json:"customerEmail"`
+	Created       time.Time `json:"created"`
+	AmountTotal   int64     `json:"amountTotal"`
+	Currency      string    `json:"currency"`
+	JobStatus     string    `json:"jobStatus,omitempty"`
+	Problems      []string  `json:"problems"`
+	// Action is what was done about it when fixing was requested
+	Action string `json:"action,omitempty"`
+}
+
+type ReconcileReport struct {
+	From            time.Time        `json:"from"`
+	To              time.Time        `json:"to"`
+	SessionsChecked int              `json:"sessionsChecked"`
+	InProgress      int              `json:"inProgress"`
+	Revoked         int              `json:"revoked"`
+	Issues          []ReconcileIssue `json:"issues"`
+	JobsQueued      int              `json:"jobsQueued"`
+}
+
+// Reconcile compares the paid Stripe checkout sessions created in
+// [from, to) with local jobs, orders and entitlements. With enqueue set,
+// sessions with problems get their fulfilment job created or re-run;
+// customers of re-run jobs receive their purchase emails again.
+func (pc *PaymentController) Reconcile(from, to time.Time, enqueue bool) (*ReconcileReport, error) {
+	sessions, err := pc.Gateway.ListCompletedCheckoutSessions(from, to)
+	if err != nil {
+		return nil, fmt.Errorf("error listing checkout sessions: %w", err)
+	}
+
+	report := &ReconcileReport{From: from, To: to, Issues: []ReconcileIssue{}}
+	for _, checkoutSession := range sessions {
+		if checkoutSession.PaymentStatus != stripe.CheckoutSessionPaymentStatusPaid {
+			continue
+		}
+		report.SessionsChecked++
+
+		revoked, err := pc.isSessionRevoked(checkoutSession.ID)
+		if err != nil {
+			return nil, err
+		}
+		if revoked {
+			report.Revoked++
+			continue
+		}
+
+		issue, job, err := pc.reconcileSession(checkoutSession)
+		if err != nil {
+			return nil, fmt.Errorf("error checking session %s: %w", checkoutSession.ID, err)
+		}
+		if issue == nil {
+			if job != nil && (job.Status == models.JobStatusPending || job.Status == models.JobStatusProcessing) {
+				report.InProgress++
+			}
+			continue
+		}
+
+		if enqueue {
+			issue.Action = pc.queueReconciledFulfilment(issue, job)
+			if issue.Action == "job_created" || issue.Action == "job_requeued" {
+				report.JobsQueued++
+			}
+		}
+		report.Issues = append(report.Issues, *issue)
+	}
+
+	log.Printf("Reconciled %d paid sessions from %s to %s: %d with problems, %d jobs queued",
+		report.SessionsChecked, from.Format(time.RFC3339), to.Format(time.RFC3339), len(report.Issues), report.JobsQueued)
+	return report, nil
+}
+
+// reconcileSession returns the session's problems, or nil if it was
+// fulfilled or its job hasn't finished yet.
+func (pc *PaymentController) reconcileSession(checkoutSession *stripe.CheckoutSession) (*ReconcileIssue, *models.Job, error) {
+	issue := &ReconcileIssue{
+		SessionID:   checkoutSession.ID,
+		Created:     time.Unix(checkoutSession.Created, 0),
+		AmountTotal: checkoutSession.AmountTotal,
+		Currency:    string(checkoutSession.Currency),
+		Problems:    []string{},
+	}
+	if checkoutSession.CustomerDetails != nil {
+		issue.CustomerEmail = checkoutSession.CustomerDetails.Email
+	}
+	if issue.CustomerEmail == "" {
+		issue.CustomerEmail = checkoutSession.CustomerEmail
+	}
+
+	var job *models.Job
+	var found models.Job
+	err := pc.DB.Where("session_id = ?", checkoutSession.ID).First(&found).Error
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		issue.Problems = append(issue.Problems, ReconcileJobMissing)
+	case err != nil:
+		return nil, nil, err
+	default:
+		job = &found
+		issue.JobStatus = job.Status
+		switch job.Status {
+		case models.JobStatusPending, models.JobStatusProcessing:
+			return nil, job, nil
+		case models.JobStatusDead, models.JobStatusCancelled:
+			issue.Problems = append(issue.Problems, ReconcileJobFailed)
+		}
+	}
+
+	var orders int64
+	if err := pc.DB.Model(&models.Order{}).Where("stripe_session_id = ?", checkoutSession.ID).Count(&orders).Error; err != nil {
+		return nil, nil, err
+	}
+	if orders == 0 {
+		issue.Problems = append(issue.Problems, ReconcileOrderMissing)
+	}
+
+	problems, err := pc.missingEntitlements(checkoutSession, issue.CustomerEmail)
+	if err != nil {
+		return nil, nil, err
+	}
+	issue.Problems = append(issue.Problems, problems...)
+
+	if len(issue.Problems) == 0 {
+		return nil, job, nil
+	}
+	return issue, job, nil
+}
+
+// missingEntitlements checks that what the session bought was handed out:
+// gift codes for a gift, otherwise program access, a workout link and, for
+// subscriptions, the local subscription record.
+func (pc *PaymentController) missingEntitlements(checkoutSession *stripe.CheckoutSession, email string) ([]string, error) {
+	problems := []string{}
+
+	if checkoutSession.Mode == stripe.CheckoutSessionModeSubscription && checkoutSession.Subscription != nil {
+		var subscriptions int64
+		if err := pc.DB.Model(&models.Subscription{}).
+			Where("stripe_subscription_id = ?", checkoutSession.Subscription.ID).
+			Count(&subscriptions).Error; err != nil {
+			return nil, err
+		}
+		if subscriptions == 0 {
+			problems = append(problems, ReconcileSubscriptionMissing)
+		}
+	}
+
+	priceIDs, err := pc.sessionPriceIDs(checkoutSession.ID)
+	if err != nil {
+		return nil, err
+	}
+	catalog, err := pc.productsByPriceID(priceIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	if isGiftSession(checkoutSession) {
+		var codes int64
+		if err := pc.DB.Model(&models.GiftCode{}).Where("session_id = ?", checkoutSession.ID).Count(&codes).Error; err != nil {
+			return nil, err
+		}
+		if codes < int64(len(catalog)) {
+			problems = append(problems, ReconcileGiftCodesMissing)
+		}
+		return problems, nil
+	}
+
+	programIDs := []uint{}
+	for _, product := range catalog {
+		for _, program := range product.Programs {
+			programIDs = append(programIDs, program.ID)
+		}
+	}
+	if len(programIDs) == 0 {
+		return problems, nil
+	}
+
+	var user models.User
+	if err := pc.DB.Where("email = ?", email).First(&user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return append(problems, ReconcileAccessMissing, ReconcileLinkMissing), nil
+		}
+		return nil, err
+	}
+
+	var granted int64
+	if err := pc.DB.Model(&models.UserProgram{}).
+		Where("user_id = ? AND program_id IN ?", user.ID, programIDs).
+		Distinct("program_id").Count(&granted).Error; err != nil {
+		return nil, err
+	}
+	if granted < int64(len(uniqueUints(programIDs))) {
+		problems = append(problems, ReconcileAccessMissing)
+	}
+
+	var links int64
+	if err := pc.DB.Model(&models.AuthToken{}).Where("session_id = ?", checkoutSession.ID).Count(&links).Error; err != nil {
+		return nil, err
+	}
+	if links == 0 {
+		problems = append(problems, ReconcileLinkMissing)
+	}
+	return problems, nil
+}
+
+func uniqueUints(values []uint) []uint {
+	seen := make(map[uint]bool, len(values))
+	unique := []uint{}
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			unique = append(unique, v)
+		}
+	}
+	return unique
+}
+
+// queueReconciledFulfilment creates the missing job or re-runs the existing
+// one, and says which it did.
+func (pc *PaymentController) queueReconciledFulfilment(issue *ReconcileIssue, job *models.Job) string {
+	if issue.CustomerEmail == "" {
+		return "skipped: no customer email"
+	}
+	if job == nil {
+		if _, err := pc.enqueuePaymentJob(issue.SessionID, issue.CustomerEmail); err != nil {
+			log.Printf("Reconcile: failed to create job for session %s: %v", issue.SessionID, err)
+			return "failed: " + err.Error()
+		}
+		log.Printf("Reconcile: created fulfilment job for session %s", issue.SessionID)
+		return "job_created"
+	}
+	if err := pc.requeueJob(job); err != nil {
+		log.Printf("Reconcile: failed to requeue job %d for session %s: %v", job.ID, issue.SessionID, err)
+		return "failed: " + err.Error()
+	}
+	log.Printf("Reconcile: requeued job %d for session %s", job.ID, issue.SessionID)
+	return "job_requeued"
+}
+
+type ReconcileRequest struct {
+	From    string `json:"from"`
+	To      string `json:"to"`
+	Enqueue bool   `json:"enqueue"`
+}
+
+// ParseReconcileRange reads an inclusive YYYY-MM-DD range, defaulting to
+// the last seven days.
+func ParseReconcileRange(fromDate, toDate string, now time.Time) (time.Time, time.Time, error) {
+	to := now
+	if toDate != "" {
+		parsed, err := time.Parse("2006-01-02", toDate)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid 'to' date %q, expected YYYY-MM-DD", toDate)
+		}
+		to = parsed.AddDate(0, 0, 1)
+	}
+	from := to.AddDate(0, 0, -7)
+	if fromDate != "" {
+		parsed, err := time.Parse("2006-01-02", fromDate)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid 'from' date %q, expected YYYY-MM-DD", fromDate)
+		}
+		from = parsed
+	}
+	if !from.Before(to) {
+		return time.Time{}, time.Time{}, errors.New("'from' must be before 'to'")
+	}
+	return from, to, nil
+}
+
+// ReconcileStripe runs reconciliation from the admin console.
+func (pc *PaymentController) ReconcileStripe(c *gin.Context) {
+	var req ReconcileRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	from, to, err := ParseReconcileRange(req.From, req.To, time.Now())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if to.Sub(from) > maxReconcileRange {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Date range is too long, use the reconcile command for more than 92 days"})
+		return
+	}
+
+	report, err := pc.Reconcile(from, to, req.Enqueue)
+	if err != nil {
+		log.Printf("Error reconciling Stripe sessions: %v", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to reconcile with Stripe"})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
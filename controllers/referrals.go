@@ -0,0 +1,504 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/88warren/lmw-fitness-backend/models"
+	"github.com/88warren/lmw-fitness-backend/utils/money"
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v82"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	referralMetadataKey = "referral_code_id"
+
+	defaultReferralDiscountPercent   = 10
+	defaultReferralCommissionPercent = 10
+)
+
+type ReferralController struct {
+	DB              *gorm.DB
+	FrontendURL     string
+	DiscountPercent int64
+}
+
+func NewReferralController(db *gorm.DB) *ReferralController {
+	return &ReferralController{
+		DB:              db,
+		FrontendURL:     getEnvVar("FRONTEND_URL"),
+		DiscountPercent: percentEnv("REFERRAL_DISCOUNT_PERCENT", defaultReferralDiscountPercent),
+	}
+}
+
+// percentEnv reads a whole percentage from the environment, falling back to
+// def when it is unset or out of range.
+func percentEnv(key string, def int64) int64 {
+	value, err := ParseInt64Env(key)
+	if err != nil {
+		return def
+	}
+	if value < 0 || value > 100 {
+		log.Printf("Warning: %s must be between 0 and 100, using %d", key, def)
+		return def
+	}
+	return value
+}
+
+// referralCodePrefix takes up to six letters from the start of an email
+// address so codes are recognisable to the friends they are shared with.
+func referralCodePrefix(email string) string {
+	local := strings.SplitN(email, "@", 2)[0]
+	var b strings.Builder
+	for _, r := range strings.ToUpper(local) {
+		if r >= 'A' && r <= 'Z' {
+			b.WriteRune(r)
+		}
+		if b.Len() == 6 {
+			break
+		}
+	}
+	if b.Len() < 3 {
+		return "LMW"
+	}
+	return b.String()
+}
+
+func generateReferralCode(email string) (string, error) {
+	const alphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	for i := range b {
+		b[i] = alphabet[int(b[i])%len(alphabet)]
+	}
+	return referralCodePrefix(email) + string(b), nil
+}
+
+// ensureReferralCode returns the user's referral code, creating it and the
+// promotion behind it on first use.
+func (rc *ReferralController) ensureReferralCode(userID uint, email string) (*models.ReferralCode, error) {
+	var referral models.ReferralCode
+	err := rc.DB.Where("user_id = ?", userID).First(&referral).Error
+	if err == nil {
+		return &referral, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	for attempt := 0; attempt < 5; attempt++ {
+		code, err := generateReferralCode(email)
+		if err != nil {
+			return nil, err
+		}
+		var taken int64
+		if err := rc.DB.Model(&models.Promotion{}).Where("code = ?", code).Count(&taken).Error; err != nil {
+			return nil, err
+		}
+		if taken > 0 {
+			continue
+		}
+
+		err = rc.DB.Transaction(func(tx *gorm.DB) error {
+			promotion := models.Promotion{
+				Code:                  code,
+				Description:           fmt.Sprintf("%d%% off your first order, referred by a friend", rc.DiscountPercent),
+				DiscountType:          models.PromotionTypePercent,
+				PercentOff:            rc.DiscountPercent,
+				Currency:              defaultCurrency,
+				ProductIDs:            []uint{},
+				MaxRedemptionsPerUser: 1,
+				FirstPurchaseOnly:     true,
+				IsActive:              rc.DiscountPercent > 0,
+			}
+			if err := tx.Create(&promotion).Error; err != nil {
+				return err
+			}
+			referral = models.ReferralCode{UserID: userID, Code: code, PromotionID: promotion.ID}
+			return tx.Create(&referral).Error
+		})
+		if err == nil {
+			log.Printf("Created referral code %s for user %d", code, userID)
+			return &referral, nil
+		}
+
+		// Another request may have created the user's code at the same time
+		if lookupErr := rc.DB.Where("user_id = ?", userID).First(&referral).Error; lookupErr == nil {
+			return &referral, nil
+		}
+		log.Printf("Error creating referral code for user %d: %v", userID, err)
+	}
+	return nil, fmt.Errorf("could not create a unique referral code for user %d", userID)
+}
+
+type commissionTotals struct {
+	Currency    string `json:"currency"`
+	Conversions int64  `json:"conversions"`
+	Pending     int64  `json:"pendingCommission"`
+	Paid        int64  `json:"paidCommission"`
+}
+
+// commissionTotals sums a referrer's commission per currency, since amounts
+// in different currencies can't be added together.
+func (rc *ReferralController) commissionTotals(userID uint) ([]commissionTotals, error) {
+	var totals []commissionTotals
+	err := rc.DB.Model(&models.ReferralConversion{}).
+		Select(`currency, COUNT(*) AS conversions,
+			COALESCE(SUM(CASE WHEN status = ? THEN commission_amount ELSE 0 END), 0) AS pending,
+			COALESCE(SUM(CASE WHEN status = ? THEN commission_amount ELSE 0 END), 0) AS paid`,
+			models.CommissionStatusPending, models.CommissionStatusPaid).
+		Where("referrer_user_id = ? AND status <> ?", userID, models.CommissionStatusVoid).
+		Group("currency").
+		Order("currency").
+		Scan(&totals).Error
+	return totals, err
+}
+
+// GetMyReferral returns the signed in user's referral code, creating it if
+// needed, along with their commission balances.
+func (rc *ReferralController) GetMyReferral(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+	userEmail, _ := c.Get("userEmail")
+	email, _ := userEmail.(string)
+
+	referral, err := rc.ensureReferralCode(userID.(uint), email)
+	if err != nil {
+		log.Printf("Error loading referral code for user %v: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load referral code"})
+		return
+	}
+
+	totals, err := rc.commissionTotals(referral.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load referral balance"})
+		return
+	}
+
+	// The headline balances are in the default currency; commission earned
+	// in any other currency is only listed per currency
+	var conversions, pending, paid int64
+	for _, total := range totals {
+		conversions += total.Conversions
+		if total.Currency == defaultCurrency {
+			pending = total.Pending
+			paid = total.Paid
+		}
+	}
+
+	var promotion models.Promotion
+	rc.DB.First(&promotion, referral.PromotionID)
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":              referral.Code,
+		"link":              fmt.Sprintf("%s/?ref=%s", rc.FrontendURL, referral.Code),
+		"friendDiscount":    promotion.PercentOff,
+		"conversions":       conversions,
+		"currency":          defaultCurrency,
+		"pendingCommission": pending,
+		"paidCommission":    paid,
+		"commission":        totals,
+	})
+}
+
+// ListConversions lets admins filter referral conversions by referrer and
+// commission status.
+func (rc *ReferralController) ListConversions(c *gin.Context) {
+	query := rc.DB.Model(&models.ReferralConversion{})
+	if userID := c.Query("userId"); userID != "" {
+		query = query.Where("referrer_user_id = ?", userID)
+	}
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	limit := 100
+	if l, err := strconv.Atoi(c.Query("limit")); err == nil && l > 0 && l <= 500 {
+		limit = l
+	}
+
+	var conversions []models.ReferralConversion
+	if err := query.Order("created_at DESC").Limit(limit).Find(&conversions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve referral conversions"})
+		return
+	}
+	c.JSON(http.StatusOK, conversions)
+}
+
+type affiliatePayout struct {
+	UserID      uint   `json:"userId"`
+	Email       string `json:"email"`
+	Code        string `json:"code"`
+	Currency    string `json:"currency"`
+	Conversions int64  `json:"conversions"`
+	Pending     int64  `json:"pendingCommission"`
+	Paid        int64  `json:"paidCommission"`
+}
+
+// payoutReport totals commission per affiliate and currency for conversions
+// made in [from, to). Zero times leave that end of the range open.
+func (rc *ReferralController) payoutReport(from, to time.Time) ([]affiliatePayout, error) {
+	query := rc.DB.Table("referral_conversions").
+		Select(`referral_conversions.referrer_user_id AS user_id, users.email, referral_codes.code,
+			referral_conversions.currency, COUNT(*) AS conversions,
+			COALESCE(SUM(CASE WHEN referral_conversions.status = ? THEN referral_conversions.commission_amount ELSE 0 END), 0) AS pending,
+			COALESCE(SUM(CASE WHEN referral_conversions.status = ? THEN referral_conversions.commission_amount ELSE 0 END), 0) AS paid`,
+			models.CommissionStatusPending, models.CommissionStatusPaid).
+		Joins("JOIN users ON users.id = referral_conversions.referrer_user_id").
+		Joins("JOIN referral_codes ON referral_codes.id = referral_conversions.referral_code_id").
+		Where("referral_conversions.deleted_at IS NULL AND referral_conversions.status <> ?", models.CommissionStatusVoid)
+	if !from.IsZero() {
+		query = query.Where("referral_conversions.created_at >= ?", from)
+	}
+	if !to.IsZero() {
+		query = query.Where("referral_conversions.created_at < ?", to)
+	}
+
+	var rows []affiliatePayout
+	err := query.Group("referral_conversions.referrer_user_id, users.email, referral_codes.code, referral_conversions.currency").
+		Order("pending DESC, users.email").
+		Scan(&rows).Error
+	return rows, err
+}
+
+// reportRange reads the optional from and to query dates (YYYY-MM-DD,
+// inclusive).
+func reportRange(c *gin.Context) (time.Time, time.Time, error) {
+	var from, to time.Time
+	if raw := c.Query("from"); raw != "" {
+		parsed, err := time.Parse("2006-01-02", raw)
+		if err != nil {
+			return from, to, errors.New("Invalid 'from' date, expected YYYY-MM-DD")
+		}
+		from = parsed
+	}
+	if raw := c.Query("to"); raw != "" {
+		parsed, err := time.Parse("2006-01-02", raw)
+		if err != nil {
+			return from, to, errors.New("Invalid 'to' date, expected YYYY-MM-DD")
+		}
+		to = parsed.AddDate(0, 0, 1)
+	}
+	return from, to, nil
+}
+
+func (rc *ReferralController) GetPayoutReport(c *gin.Context) {
+	from, to, err := reportRange(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	rows, err := rc.payoutReport(from, to)
+	if err != nil {
+		log.Printf("Error building referral payout report: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build payout report"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"affiliates": rows})
+}
+
+// ExportPayoutReport returns the payout report as CSV. Amounts are written
+// in major units (pounds) for the spreadsheet it ends up in.
+func (rc *ReferralController) ExportPayoutReport(c *gin.Context) {
+	from, to, err := reportRange(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	rows, err := rc.payoutReport(from, to)
+	if err != nil {
+		log.Printf("Error building referral payout report: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build payout report"})
+		return
+	}
+
+	c.Header("Content-Type", "text/csv")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="referral-payouts-%s.csv"`, time.Now().Format("2006-01-02")))
+	c.Status(http.StatusOK)
+
+	w := csv.NewWriter(c.Writer)
+	w.Write([]string{"user_id", "email", "code", "currency", "conversions", "pending_commission", "paid_commission"})
+	for _, row := range rows {
+		w.Write([]string{
+			strconv.FormatUint(uint64(row.UserID), 10),
+			row.Email,
+			row.Code,
+			strings.ToUpper(row.Currency),
+			strconv.FormatInt(row.Conversions, 10),
+			money.Decimal(row.Pending, row.Currency),
+			money.Decimal(row.Paid, row.Currency),
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		log.Printf("Error writing referral payout CSV: %v", err)
+	}
+}
+
+type RecordPayoutRequest struct {
+	Reference string `json:"reference" binding:"required"`
+	Currency  string `json:"currency"`
+}
+
+// RecordPayout marks an affiliate's pending commission as paid once the
+// money has been sent, keeping the bank or PayPal reference.
+func (rc *ReferralController) RecordPayout(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("userId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	var req RecordPayoutRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	currency := strings.ToLower(strings.TrimSpace(req.Currency))
+	if currency == "" {
+		currency = defaultCurrency
+	}
+
+	// A single conditional update with RETURNING, so two payouts recorded at
+	// once can't both claim the same commission
+	var conversions []models.ReferralConversion
+	err = rc.DB.Model(&conversions).
+		Clauses(clause.Returning{Columns: []clause.Column{{Name: "id"}, {Name: "commission_amount"}}}).
+		Where("referrer_user_id = ? AND status = ? AND currency = ? AND paid_at IS NULL", userID, models.CommissionStatusPending, currency).
+		Updates(map[string]interface{}{
+			"status":           models.CommissionStatusPaid,
+			"paid_at":          time.Now(),
+			"payout_reference": req.Reference,
+		}).Error
+	if err != nil {
+		log.Printf("Error recording referral payout for user %d: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record payout"})
+		return
+	}
+	if len(conversions) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No pending commission for this affiliate"})
+		return
+	}
+
+	var amount int64
+	for _, conversion := range conversions {
+		amount += conversion.CommissionAmount
+	}
+
+	log.Printf("Recorded referral payout %s to user %d: %d %s for %d conversions", req.Reference, userID, amount, currency, len(conversions))
+	c.JSON(http.StatusOK, gin.H{
+		"conversions": len(conversions),
+		"amount":      amount,
+		"currency":    currency,
+		"reference":   req.Reference,
+	})
+}
+
+// referralForPromotion finds the referral code behind a promotion, if any.
+func (pc *PaymentController) referralForPromotion(promo *models.Promotion) (*models.ReferralCode, error) {
+	var referral models.ReferralCode
+	err := pc.DB.Where("promotion_id = ?", promo.ID).First(&referral).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not look up referral for promotion %s: %w", promo.Code, err)
+	}
+	return &referral, nil
+}
+
+// checkReferral stops affiliates earning commission on their own orders.
+func (pc *PaymentController) checkReferral(referral *models.ReferralCode, email string) error {
+	if email == "" {
+		return promotionRejected("Enter your email address to use referral code '%s'", referral.Code)
+	}
+	var referrer models.User
+	if err := pc.DB.First(&referrer, referral.UserID).Error; err != nil {
+		return fmt.Errorf("could not load referrer %d: %w", referral.UserID, err)
+	}
+	if strings.EqualFold(referrer.Email, email) {
+		return promotionRejected("You can't use your own referral code")
+	}
+	return nil
+}
+
+// recordReferralConversion credits the referrer of a paid checkout. It is
+// safe to call more than once for the same session.
+func (pc *PaymentController) recordReferralConversion(checkoutSession *stripe.CheckoutSession, order *models.Order) error {
+	raw := checkoutSession.Metadata[referralMetadataKey]
+	if raw == "" {
+		return nil
+	}
+	referralCodeID, err := strconv.ParseUint(raw, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid referral code ID %q on session %s", raw, checkoutSession.ID)
+	}
+
+	var referral models.ReferralCode
+	if err := pc.DB.First(&referral, referralCodeID).Error; err != nil {
+		return fmt.Errorf("could not load referral code %d: %w", referralCodeID, err)
+	}
+	if order.UserID != nil && *order.UserID == referral.UserID {
+		log.Printf("[WARN] Session %s used its own buyer's referral code %s. No commission.", checkoutSession.ID, referral.Code)
+		return nil
+	}
+
+	conversion := models.ReferralConversion{
+		ReferralCodeID:   referral.ID,
+		ReferrerUserID:   referral.UserID,
+		OrderID:          order.ID,
+		SessionID:        checkoutSession.ID,
+		CustomerEmail:    order.CustomerEmail,
+		Currency:         order.Currency,
+		OrderTotal:       order.TotalAmount,
+		CommissionAmount: (order.TotalAmount*pc.ReferralCommissionPercent + 50) / 100,
+		Status:           models.CommissionStatusPending,
+	}
+	result := pc.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "session_id"}},
+		DoNothing: true,
+	}).Create(&conversion)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected > 0 {
+		log.Printf("Referral %s converted by session %s: %d %s commission for user %d",
+			referral.Code, checkoutSession.ID, conversion.CommissionAmount, conversion.Currency, referral.UserID)
+	}
+	return nil
+}
+
+// voidReferralCommission cancels unpaid commission on a refunded or
+// disputed session. Commission already paid out is left for the admin to
+// settle by hand.
+func voidReferralCommission(tx *gorm.DB, sessionID string) error {
+	var paid int64
+	tx.Model(&models.ReferralConversion{}).
+		Where("session_id = ? AND status = ?", sessionID, models.CommissionStatusPaid).
+		Count(&paid)
+	if paid > 0 {
+		log.Printf("[WARN] Session %s was reversed after its referral commission was paid out", sessionID)
+	}
+	return tx.Model(&models.ReferralConversion{}).
+		Where("session_id = ? AND status = ?", sessionID, models.CommissionStatusPending).
+		Update("status", models.CommissionStatusVoid).Error
+}
+
+func restoreReferralCommission(tx *gorm.DB, sessionIDs []string) error {
+	return tx.Model(&models.ReferralConversion{}).
+		Where("session_id IN ? AND status = ?", sessionIDs, models.CommissionStatusVoid).
+		Update("status", models.CommissionStatusPending).Error
+}
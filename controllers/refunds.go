@@ -0,0 +1,411 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/88warren/lmw-fitness-backend/models"
+	"github.com/stripe/stripe-go/v82"
+	"gorm.io/gorm"
+)
+
+const (
+	RevocationReasonRefund  = "refund"
+	RevocationReasonDispute = "dispute"
+)
+
+func (pc *PaymentController) handleChargeRefunded(event stripe.Event) (string, bool, error) {
+	var charge stripe.Charge
+	if err := json.Unmarshal(event.Data.Raw, &charge); err != nil {
+		log.Printf("Error parsing charge JSON: %v", err)
+		return "", false, errInvalidEventData
+	}
+
+	// Partial refunds are goodwill gestures; the customer keeps what they bought
+	if !charge.Refunded {
+		log.Printf("Charge %s partially refunded (%d of %d). Access is unchanged.", charge.ID, charge.AmountRefunded, charge.Amount)
+		return "Partial refund, access unchanged", true, nil
+	}
+
+	if charge.PaymentIntent == nil || charge.PaymentIntent.ID == "" {
+		log.Printf("Refunded charge %s has no payment intent, cannot find checkout session", charge.ID)
+		return "No payment intent on charge", true, nil
+	}
+
+	detail := fmt.Sprintf("Charge %s refunded (%d %s)", charge.ID, charge.AmountRefunded, charge.Currency)
+	return pc.revokeForPaymentIntent(charge.PaymentIntent.ID, RevocationReasonRefund, charge.ID, detail)
+}
+
+func (pc *PaymentController) handleDisputeCreated(event stripe.Event) (string, bool, error) {
+	var dispute stripe.Dispute
+	if err := json.Unmarshal(event.Data.Raw, &dispute); err != nil {
+		log.Printf("Error parsing dispute JSON: %v", err)
+		return "", false, errInvalidEventData
+	}
+
+	paymentIntentID, err := pc.disputePaymentIntentID(&dispute)
+	if err != nil {
+		return "", false, err
+	}
+	if paymentIntentID == "" {
+		log.Printf("Dispute %s has no payment intent, cannot find checkout session", dispute.ID)
+		return "No payment intent on dispute", true, nil
+	}
+
+	detail := fmt.Sprintf("Dispute %s opened (%s)", dispute.ID, dispute.Reason)
+	return pc.revokeForPaymentIntent(paymentIntentID, RevocationReasonDispute, dispute.ID, detail)
+}
+
+// handleDisputeClosed lifts the suspension placed when a dispute was opened
+// if the dispute was decided in our favour. Lost disputes stay revoked.
+func (pc *PaymentController) handleDisputeClosed(event stripe.Event) (string, bool, error) {
+	var dispute stripe.Dispute
+	if err := json.Unmarshal(event.Data.Raw, &dispute); err != nil {
+		log.Printf("Error parsing dispute JSON: %v", err)
+		return "", false, errInvalidEventData
+	}
+
+	if dispute.Status != stripe.DisputeStatusWon {
+		log.Printf("Dispute %s closed with status %s. Access stays revoked.", dispute.ID, dispute.Status)
+		return "Dispute closed, access stays revoked", true, nil
+	}
+
+	// A disputed gift purchase has a revocation for each redeemed code
+	var revocations []models.EntitlementRevocation
+	err := pc.DB.Where("stripe_object_id = ? AND reason = ? AND restored_at IS NULL", dispute.ID, RevocationReasonDispute).
+		Find(&revocations).Error
+	if err != nil {
+		return "", false, fmt.Errorf("could not load revocations for dispute %s: %w", dispute.ID, err)
+	}
+	for i := range revocations {
+		if err := pc.restoreEntitlements(&revocations[i]); err != nil {
+			return "", false, err
+		}
+	}
+
+	restoredGifts, err := pc.restoreGiftCodes(dispute.ID)
+	if err != nil {
+		return "", false, err
+	}
+
+	if len(revocations) == 0 && restoredGifts == 0 {
+		return "No suspension to lift", true, nil
+	}
+	return "Access restored after dispute won", false, nil
+}
+
+func (pc *PaymentController) handleCheckoutSessionExpired(event stripe.Event) (string, bool, error) {
+	var checkoutSession stripe.CheckoutSession
+	if err := json.Unmarshal(event.Data.Raw, &checkoutSession); err != nil {
+		log.Printf("Error parsing webhook JSON: %v", err)
+		return "", false, errInvalidEventData
+	}
+
+	// An expired session was never paid, so nothing should be fulfilled for it
+	result := pc.DB.Model(&models.Job{}).
+		Where("session_id = ? AND status = ?", checkoutSession.ID, models.JobStatusPending).
+		Update("status", models.JobStatusCancelled)
+	if result.Error != nil {
+		return "", false, fmt.Errorf("could not cancel job for expired session %s: %w", checkoutSession.ID, result.Error)
+	}
+
+	if err := pc.markCheckoutExpired(&checkoutSession); err != nil {
+		return "", false, err
+	}
+	if err := pc.releasePromotionReservation(checkoutSession.ID); err != nil {
+		return "", false, fmt.Errorf("could not release promotion for expired session %s: %w", checkoutSession.ID, err)
+	}
+
+	log.Printf("Checkout session %s expired (%d pending jobs cancelled)", checkoutSession.ID, result.RowsAffected)
+	return "Checkout session expired", false, nil
+}
+
+func (pc *PaymentController) disputePaymentIntentID(dispute *stripe.Dispute) (string, error) {
+	if dispute.PaymentIntent != nil && dispute.PaymentIntent.ID != "" {
+		return dispute.PaymentIntent.ID, nil
+	}
+	if dispute.Charge == nil || dispute.Charge.ID == "" {
+		return "", nil
+	}
+	if dispute.Charge.PaymentIntent != nil && dispute.Charge.PaymentIntent.ID != "" {
+		return dispute.Charge.PaymentIntent.ID, nil
+	}
+
+	charge, err := pc.Gateway.GetCharge(dispute.Charge.ID)
+	if err != nil {
+		return "", fmt.Errorf("error fetching charge %s: %w", dispute.Charge.ID, err)
+	}
+	if charge.PaymentIntent == nil {
+		return "", nil
+	}
+	return charge.PaymentIntent.ID, nil
+}
+
+// revokeForPaymentIntent maps a payment intent back to the checkout session
+// that created it and revokes whatever that session granted.
+func (pc *PaymentController) revokeForPaymentIntent(paymentIntentID, reason, stripeObjectID, detail string) (string, bool, error) {
+	checkoutSession, err := pc.Gateway.FindCheckoutSessionByPaymentIntent(paymentIntentID)
+	if err != nil {
+		return "", false, fmt.Errorf("error finding checkout session for payment intent %s: %w", paymentIntentID, err)
+	}
+	if checkoutSession == nil {
+		log.Printf("No checkout session found for payment intent %s", paymentIntentID)
+		return "No checkout session for payment intent", true, nil
+	}
+
+	if isGiftSession(checkoutSession) {
+		return pc.revokeGiftSession(checkoutSession.ID, reason, stripeObjectID, detail)
+	}
+
+	customerEmail := ""
+	if checkoutSession.CustomerDetails != nil {
+		customerEmail = checkoutSession.CustomerDetails.Email
+	}
+	if customerEmail == "" {
+		log.Printf("Checkout session %s has no customer email, nothing to revoke", checkoutSession.ID)
+		return "No customer email on checkout session", true, nil
+	}
+
+	return pc.revokeSessionEntitlements(checkoutSession.ID, customerEmail, reason, stripeObjectID, detail)
+}
+
+// revokeSessionEntitlements removes the programs granted by a checkout
+// session, burns its unused workout links, stops any pending fulfilment and
+// takes the customer off the product mailing lists. Programs are soft
+// deleted so a won dispute can restore them.
+func (pc *PaymentController) revokeSessionEntitlements(sessionID, email, reason, stripeObjectID, detail string) (string, bool, error) {
+	var existing models.EntitlementRevocation
+	err := pc.DB.Where("session_id = ? AND restored_at IS NULL", sessionID).First(&existing).Error
+	if err == nil {
+		log.Printf("Session %s already revoked (%s), skipping", sessionID, existing.Reason)
+		return "Access already revoked", false, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", false, fmt.Errorf("could not check existing revocation: %w", err)
+	}
+
+	var user models.User
+	if err := pc.DB.Where("email = ?", email).First(&user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			// Fulfilment never ran, so only the pending job needs stopping
+			pc.DB.Model(&models.Job{}).Where("session_id = ? AND status = ?", sessionID, models.JobStatusPending).Update("status", models.JobStatusCancelled)
+			log.Printf("No user for %s, nothing was granted for session %s", email, sessionID)
+			return "No user to revoke", true, nil
+		}
+		return "", false, fmt.Errorf("could not load user %s: %w", email, err)
+	}
+
+	priceIDs, err := pc.sessionPriceIDs(sessionID)
+	if err != nil {
+		return "", false, err
+	}
+	catalog, err := pc.productsByPriceID(priceIDs)
+	if err != nil {
+		return "", false, fmt.Errorf("error loading products for session %s: %w", sessionID, err)
+	}
+
+	programIDs := []uint{}
+	listIDs := []int64{}
+	for _, priceID := range priceIDs {
+		product, ok := catalog[priceID]
+		if !ok {
+			continue
+		}
+		for _, program := range product.Programs {
+			programIDs = append(programIDs, program.ID)
+		}
+		listIDs = mergeUniqueInt64(listIDs, product.BrevoListIDs)
+	}
+
+	// A program also bought in another order stays
+	stillOwned, err := programsStillOwned(pc.DB, &user, sessionID, programIDs)
+	if err != nil {
+		return "", false, fmt.Errorf("could not check other purchases of user %d: %w", user.ID, err)
+	}
+	if len(stillOwned) > 0 {
+		log.Printf("User %d also owns programs %v through other purchases, keeping them", user.ID, stillOwned)
+		programIDs = withoutUints(programIDs, stillOwned)
+	}
+
+	revocation := models.EntitlementRevocation{
+		UserID:         user.ID,
+		SessionID:      sessionID,
+		StripeObjectID: stripeObjectID,
+		Reason:         reason,
+		Detail:         detail,
+		ProgramIDs:     programIDs,
+		BrevoListIDs:   listIDs,
+	}
+
+	err = pc.DB.Transaction(func(tx *gorm.DB) error {
+		if len(programIDs) > 0 {
+			if err := tx.Where("user_id = ? AND program_id IN ?", user.ID, programIDs).Delete(&models.UserProgram{}).Error; err != nil {
+				return fmt.Errorf("could not remove program access: %w", err)
+			}
+		}
+		if err := markSessionRevoked(tx, sessionID, reason); err != nil {
+			return err
+		}
+		return tx.Create(&revocation).Error
+	})
+	if err != nil {
+		return "", false, err
+	}
+	log.Printf("Revoked programs %v for user %d (session %s, %s)", programIDs, user.ID, sessionID, reason)
+
+	if len(listIDs) > 0 {
+		if err := pc.RemoveContactFromBrevoLists(email, listIDs); err != nil {
+			log.Printf("Error removing %s from Brevo lists %v: %v", email, listIDs, err)
+		}
+	}
+
+	return "Access revoked", false, nil
+}
+
+// programsStillOwned returns those of programIDs that the user also has
+// through a paid order or a redeemed gift other than sessionID, which
+// revoking sessionID must leave in place.
+func programsStillOwned(db *gorm.DB, user *models.User, sessionID string, programIDs []uint) ([]uint, error) {
+	owned := []uint{}
+	if len(programIDs) == 0 {
+		return owned, nil
+	}
+
+	// Gift orders grant nothing to the buyer, only to whoever redeems them
+	giftSessions := db.Model(&models.GiftCode{}).Select("session_id")
+	var bought []uint
+	if err := db.Table("orders").
+		Joins("JOIN order_items ON order_items.order_id = orders.id AND order_items.deleted_at IS NULL").
+		Joins("JOIN product_programs ON product_programs.product_id = order_items.product_id").
+		Where("orders.deleted_at IS NULL AND orders.status = ? AND orders.stripe_session_id <> ?", models.OrderStatusPaid, sessionID).
+		Where("orders.user_id = ? OR LOWER(orders.customer_email) = LOWER(?)", user.ID, user.Email).
+		Where("orders.stripe_session_id NOT IN (?)", giftSessions).
+		Where("product_programs.workout_program_id IN ?", programIDs).
+		Distinct().Pluck("product_programs.workout_program_id", &bought).Error; err != nil {
+		return nil, err
+	}
+
+	var gifted []uint
+	if err := db.Table("gift_codes").
+		Joins("JOIN product_programs ON product_programs.product_id = gift_codes.product_id").
+		Where("gift_codes.deleted_at IS NULL AND gift_codes.redeemed_by_user_id = ? AND gift_codes.revoked_at IS NULL AND gift_codes.session_id <> ?", user.ID, sessionID).
+		Where("product_programs.workout_program_id IN ?", programIDs).
+		Distinct().Pluck("product_programs.workout_program_id", &gifted).Error; err != nil {
+		return nil, err
+	}
+
+	seen := map[uint]bool{}
+	for _, id := range append(bought, gifted...) {
+		if !seen[id] {
+			seen[id] = true
+			owned = append(owned, id)
+		}
+	}
+	return owned, nil
+}
+
+func withoutUints(ids, remove []uint) []uint {
+	removed := map[uint]bool{}
+	for _, id := range remove {
+		removed[id] = true
+	}
+	kept := []uint{}
+	for _, id := range ids {
+		if !removed[id] {
+			kept = append(kept, id)
+		}
+	}
+	return kept
+}
+
+// markSessionRevoked burns the session's unused workout links, stops any
+// pending fulfilment and marks its order refunded or disputed.
+func markSessionRevoked(tx *gorm.DB, sessionID, reason string) error {
+	if err := tx.Model(&models.AuthToken{}).
+		Where("session_id = ? AND is_used = ?", sessionID, false).
+		Update("is_used", true).Error; err != nil {
+		return fmt.Errorf("could not invalidate workout links: %w", err)
+	}
+	if err := tx.Model(&models.Job{}).
+		Where("session_id = ? AND status = ?", sessionID, models.JobStatusPending).
+		Update("status", models.JobStatusCancelled).Error; err != nil {
+		return fmt.Errorf("could not cancel pending job: %w", err)
+	}
+	orderStatus := models.OrderStatusRefunded
+	if reason == RevocationReasonDispute {
+		orderStatus = models.OrderStatusDisputed
+	}
+	if err := tx.Model(&models.Order{}).
+		Where("stripe_session_id = ?", sessionID).
+		Update("status", orderStatus).Error; err != nil {
+		return fmt.Errorf("could not update order status: %w", err)
+	}
+	if err := voidReferralCommission(tx, sessionID); err != nil {
+		return fmt.Errorf("could not void referral commission: %w", err)
+	}
+	return nil
+}
+
+func (pc *PaymentController) restoreEntitlements(revocation *models.EntitlementRevocation) error {
+	now := time.Now()
+	err := pc.DB.Transaction(func(tx *gorm.DB) error {
+		if len(revocation.ProgramIDs) > 0 {
+			if err := tx.Unscoped().Model(&models.UserProgram{}).
+				Where("user_id = ? AND program_id IN ? AND deleted_at IS NOT NULL", revocation.UserID, revocation.ProgramIDs).
+				Update("deleted_at", nil).Error; err != nil {
+				return fmt.Errorf("could not restore program access: %w", err)
+			}
+		}
+		if err := tx.Model(&models.Order{}).
+			Where("stripe_session_id = ?", revocation.SessionID).
+			Update("status", models.OrderStatusPaid).Error; err != nil {
+			return fmt.Errorf("could not update order status: %w", err)
+		}
+		if err := restoreReferralCommission(tx, []string{revocation.SessionID}); err != nil {
+			return fmt.Errorf("could not restore referral commission: %w", err)
+		}
+		return tx.Model(revocation).Update("restored_at", now).Error
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Restored programs %v for user %d (session %s)", revocation.ProgramIDs, revocation.UserID, revocation.SessionID)
+
+	if len(revocation.BrevoListIDs) > 0 {
+		var user models.User
+		if err := pc.DB.First(&user, revocation.UserID).Error; err == nil {
+			if err := pc.AddContactToBrevo(user.Email, revocation.BrevoListIDs); err != nil {
+				log.Printf("Error re-adding %s to Brevo lists %v: %v", user.Email, revocation.BrevoListIDs, err)
+			}
+		}
+	}
+	return nil
+}
+
+// isSessionRevoked reports whether a checkout session has outstanding
+// revoked access, in which case fulfilment must not grant it again.
+func (pc *PaymentController) isSessionRevoked(sessionID string) (bool, error) {
+	var count int64
+	err := pc.DB.Model(&models.EntitlementRevocation{}).
+		Where("session_id = ? AND restored_at IS NULL", sessionID).
+		Count(&count).Error
+	return count > 0, err
+}
+
+func (pc *PaymentController) sessionPriceIDs(sessionID string) ([]string, error) {
+	lineItems, err := pc.Gateway.ListLineItems(sessionID)
+	if err != nil {
+		return nil, fmt.Errorf("error listing line items for session %s: %w", sessionID, err)
+	}
+
+	priceIDs := []string{}
+	for _, li := range lineItems {
+		if li.Price != nil {
+			priceIDs = append(priceIDs, li.Price.ID)
+		}
+	}
+	return priceIDs, nil
+}
@@ -0,0 +1,258 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/88warren/lmw-fitness-backend/audit"
+	"github.com/88warren/lmw-fitness-backend/models"
+	"github.com/88warren/lmw-fitness-backend/rbac"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+var errUnknownPermission = errors.New("unknown permission")
+
+type RoleRequest struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+}
+
+// callerCan reports whether the signed-in staff member has permission.
+// RequirePermission or StaffMiddleware must have run first.
+func callerCan(c *gin.Context, permission string) bool {
+	granted, ok := c.Get("permissions")
+	if !ok {
+		return false
+	}
+	set, ok := granted.(rbac.Set)
+	return ok && set.Has(permission)
+}
+
+// canManageAccount checks the caller may act on target's account. users:write
+// covers customers; a staff account also needs roles:manage, or every
+// permission its role has, so nobody can lock out someone above them. It
+// responds and returns false when not.
+func (ac *AdminController) canManageAccount(c *gin.Context, target *models.User) bool {
+	targetPermissions, err := rbac.Permissions(ac.DB, target.Role)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check permissions"})
+		return false
+	}
+	if len(targetPermissions) == 0 || callerCan(c, models.PermissionRolesManage) {
+		return true
+	}
+	for permission := range targetPermissions {
+		if !callerCan(c, permission) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden: you don't have permission to manage this staff account", "permission": models.PermissionRolesManage})
+			return false
+		}
+	}
+	return true
+}
+
+func (ac *AdminController) findPermissions(names []string) ([]models.Permission, error) {
+	permissions := []models.Permission{}
+	if len(names) == 0 {
+		return permissions, nil
+	}
+	if err := ac.DB.Where("name IN ?", names).Find(&permissions).Error; err != nil {
+		return nil, err
+	}
+	if len(permissions) != len(names) {
+		return nil, errUnknownPermission
+	}
+	return permissions, nil
+}
+
+func roleSnapshot(role *models.Role) map[string]interface{} {
+	return map[string]interface{}{
+		"name":        role.Name,
+		"description": role.Description,
+		"permissions": role.PermissionNames(),
+	}
+}
+
+// ListPermissions lists every permission a role can be given.
+func (ac *AdminController) ListPermissions(c *gin.Context) {
+	var permissions []models.Permission
+	if err := ac.DB.Order("name").Find(&permissions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve permissions"})
+		return
+	}
+	c.JSON(http.StatusOK, permissions)
+}
+
+func (ac *AdminController) ListRoles(c *gin.Context) {
+	var roles []models.Role
+	if err := ac.DB.Preload("Permissions").Order("name").Find(&roles).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve roles"})
+		return
+	}
+	c.JSON(http.StatusOK, roles)
+}
+
+func (ac *AdminController) CreateRole(c *gin.Context) {
+	var req RoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.Name = strings.ToLower(strings.TrimSpace(req.Name))
+	if req.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Role name is required"})
+		return
+	}
+	if exists, err := rbac.RoleExists(ac.DB, req.Name); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check role"})
+		return
+	} else if exists {
+		c.JSON(http.StatusConflict, gin.H{"error": "A role with that name already exists"})
+		return
+	}
+
+	permissions, err := ac.findPermissions(req.Permissions)
+	if errors.Is(err, errUnknownPermission) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown permission"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve permissions"})
+		return
+	}
+
+	role := models.Role{Name: req.Name, Description: req.Description, Permissions: permissions}
+	if err := ac.DB.Create(&role).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create role"})
+		return
+	}
+	rbac.Invalidate()
+	log.Printf("Role %s created with permissions %v", role.Name, role.PermissionNames())
+	audit.Record(ac.DB, c, audit.Entry{
+		Action:     audit.ActionRoleCreated,
+		TargetType: audit.TargetRole,
+		TargetID:   role.ID,
+		After:      roleSnapshot(&role),
+	})
+	c.JSON(http.StatusCreated, role)
+}
+
+// UpdateRole changes a role's description and permissions. Its name can't
+// change because users refer to it by name.
+func (ac *AdminController) UpdateRole(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role ID"})
+		return
+	}
+	var req RoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var role models.Role
+	if err := ac.DB.First(&role, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Role not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve role"})
+		return
+	}
+	if role.Name == models.RoleAdmin {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The admin role always has every permission"})
+		return
+	}
+
+	permissions, err := ac.findPermissions(req.Permissions)
+	if errors.Is(err, errUnknownPermission) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown permission"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve permissions"})
+		return
+	}
+
+	if err := ac.DB.Model(&role).Association("Permissions").Find(&role.Permissions); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve role"})
+		return
+	}
+	before := roleSnapshot(&role)
+	err = ac.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&role).Update("description", req.Description).Error; err != nil {
+			return err
+		}
+		return tx.Model(&role).Association("Permissions").Replace(permissions)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update role"})
+		return
+	}
+	rbac.Invalidate()
+	log.Printf("Role %s now has permissions %v", role.Name, role.PermissionNames())
+	audit.Record(ac.DB, c, audit.Entry{
+		Action:     audit.ActionRoleUpdated,
+		TargetType: audit.TargetRole,
+		TargetID:   role.ID,
+		Before:     before,
+		After:      roleSnapshot(&role),
+	})
+	c.JSON(http.StatusOK, role)
+}
+
+// DeleteRole removes a custom role nobody has.
+func (ac *AdminController) DeleteRole(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role ID"})
+		return
+	}
+
+	var role models.Role
+	if err := ac.DB.First(&role, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Role not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve role"})
+		return
+	}
+	if _, builtIn := models.DefaultRolePermissions[role.Name]; builtIn {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Built-in roles can't be deleted"})
+		return
+	}
+	var holders int64
+	if err := ac.DB.Model(&models.User{}).Where("role = ?", role.Name).Count(&holders).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check role"})
+		return
+	}
+	if holders > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Move the users with this role to another role first", "users": holders})
+		return
+	}
+
+	err = ac.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&role).Association("Permissions").Clear(); err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(&role).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete role"})
+		return
+	}
+	rbac.Invalidate()
+	audit.Record(ac.DB, c, audit.Entry{
+		Action:     audit.ActionRoleDeleted,
+		TargetType: audit.TargetRole,
+		TargetID:   role.ID,
+		Before:     map[string]interface{}{"name": role.Name, "description": role.Description},
+	})
+	c.JSON(http.StatusOK, gin.H{"message": "Role deleted"})
+}
@@ -0,0 +1,379 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/88warren/lmw-fitness-backend/audit"
+	"github.com/88warren/lmw-fitness-backend/models"
+	"github.com/88warren/lmw-fitness-backend/utils/auth"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Why a session was revoked
+const (
+	SessionRevokedLogout          = "logout"
+	SessionRevokedByUser          = "signed_out_remotely"
+	SessionRevokedTokenReuse      = "refresh_token_reused"
+	SessionRevokedPasswordChanged = "password_changed"
+	// The account's unverified email was used for a purchase
+	SessionRevokedUnverifiedPurchase = "unverified_purchase"
+	// The account's unverified email was claimed through a social login
+	SessionRevokedUnverifiedOIDCLink = "unverified_oidc_link"
+)
+
+var (
+	errInvalidRefreshToken = errors.New("invalid or expired refresh token")
+	errRefreshTokenReused  = errors.New("refresh token has already been used")
+)
+
+// SessionTokens is what a client gets when it signs in or refreshes.
+// Token is the short-lived access token; RefreshToken can be swapped once
+// for a new pair.
+type SessionTokens struct {
+	Token                 string    `json:"token"`
+	ExpiresAt             time.Time `json:"expiresAt"`
+	RefreshToken          string    `json:"refreshToken"`
+	RefreshTokenExpiresAt time.Time `json:"refreshTokenExpiresAt"`
+}
+
+// startSession signs the user in on a new device.
+func startSession(db *gorm.DB, c *gin.Context, user *models.User) (*SessionTokens, error) {
+	return openSession(db, c, user, false)
+}
+
+// openSession is startSession for a login that may have passed a
+// two-factor check.
+func openSession(db *gorm.DB, c *gin.Context, user *models.User, mfaVerified bool) (*SessionTokens, error) {
+	now := time.Now()
+	refreshToken, refreshHash, err := auth.NewRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+
+	session := models.UserSession{
+		UserID:     user.ID,
+		UserAgent:  truncate(c.Request.UserAgent(), 255),
+		IPAddress:  c.ClientIP(),
+		LastUsedAt: now,
+		ExpiresAt:  now.Add(auth.RefreshTokenTTL),
+	}
+	if mfaVerified {
+		session.MFAVerifiedAt = &now
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&session).Error; err != nil {
+			return err
+		}
+		return tx.Create(&models.RefreshToken{
+			SessionID: session.ID,
+			TokenHash: refreshHash,
+			ExpiresAt: session.ExpiresAt,
+		}).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not start session: %w", err)
+	}
+	audit.Record(db, c, audit.Entry{
+		Action:     audit.ActionLogin,
+		ActorID:    user.ID,
+		ActorEmail: user.Email,
+		TargetType: audit.TargetUser,
+		TargetID:   user.ID,
+		Metadata:   map[string]interface{}{"via": c.FullPath(), "sessionId": session.ID, "mfa": mfaVerified},
+	})
+
+	accessToken, accessExpiresAt, err := auth.IssueAccessToken(user.ID, user.Email, user.Role, session.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &SessionTokens{
+		Token:                 accessToken,
+		ExpiresAt:             accessExpiresAt,
+		RefreshToken:          refreshToken,
+		RefreshTokenExpiresAt: session.ExpiresAt,
+	}, nil
+}
+
+// rotateRefreshToken swaps a refresh token for a new pair. A token that
+// has been used before revokes its session: either the client or whoever
+// copied the token is replaying it, and we can't tell which.
+func rotateRefreshToken(db *gorm.DB, presented string) (*SessionTokens, *models.User, error) {
+	now := time.Now()
+	var stored models.RefreshToken
+	if err := db.Where("token_hash = ?", auth.HashToken(presented)).First(&stored).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, errInvalidRefreshToken
+		}
+		return nil, nil, err
+	}
+
+	var session models.UserSession
+	if err := db.First(&session, stored.SessionID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, errInvalidRefreshToken
+		}
+		return nil, nil, err
+	}
+	if !session.Active(now) || now.After(stored.ExpiresAt) {
+		return nil, nil, errInvalidRefreshToken
+	}
+
+	// Claim the token; only one request can do so
+	claimed := db.Model(&models.RefreshToken{}).
+		Where("id = ? AND used_at IS NULL", stored.ID).
+		Update("used_at", now)
+	if claimed.Error != nil {
+		return nil, nil, claimed.Error
+	}
+	if claimed.RowsAffected == 0 {
+		log.Printf("Refresh token reuse detected for session %d (user %d), revoking it", session.ID, session.UserID)
+		if err := revokeSession(db, &session, SessionRevokedTokenReuse); err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, errRefreshTokenReused
+	}
+
+	var user models.User
+	if err := db.Preload("UserPrograms.WorkoutProgram").First(&user, session.UserID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, errInvalidRefreshToken
+		}
+		return nil, nil, err
+	}
+
+	refreshToken, refreshHash, err := auth.NewRefreshToken()
+	if err != nil {
+		return nil, nil, err
+	}
+	session.LastUsedAt = now
+	session.ExpiresAt = now.Add(auth.RefreshTokenTTL)
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&session).Updates(map[string]interface{}{
+			"last_used_at": session.LastUsedAt,
+			"expires_at":   session.ExpiresAt,
+		}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&models.RefreshToken{
+			SessionID: session.ID,
+			TokenHash: refreshHash,
+			ExpiresAt: session.ExpiresAt,
+		}).Error
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not rotate refresh token: %w", err)
+	}
+
+	accessToken, accessExpiresAt, err := auth.IssueAccessToken(user.ID, user.Email, user.Role, session.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &SessionTokens{
+		Token:                 accessToken,
+		ExpiresAt:             accessExpiresAt,
+		RefreshToken:          refreshToken,
+		RefreshTokenExpiresAt: session.ExpiresAt,
+	}, &user, nil
+}
+
+func revokeSession(db *gorm.DB, session *models.UserSession, reason string) error {
+	now := time.Now()
+	return db.Model(&models.UserSession{}).
+		Where("id = ? AND revoked_at IS NULL", session.ID).
+		Updates(map[string]interface{}{"revoked_at": now, "revoked_reason": reason}).Error
+}
+
+// revokeUserSessions signs the user out everywhere except keepSessionID,
+// which may be zero.
+func revokeUserSessions(db *gorm.DB, userID, keepSessionID uint, reason string) (int64, error) {
+	result := db.Model(&models.UserSession{}).
+		Where("user_id = ? AND id <> ? AND revoked_at IS NULL", userID, keepSessionID).
+		Updates(map[string]interface{}{"revoked_at": time.Now(), "revoked_reason": reason})
+	return result.RowsAffected, result.Error
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
+
+func sessionIDFromContext(ctx *gin.Context) uint {
+	if sessionID, ok := ctx.Get("sessionID"); ok {
+		if id, ok := sessionID.(uint); ok {
+			return id
+		}
+	}
+	return 0
+}
+
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refreshToken" binding:"required"`
+}
+
+// RefreshToken swaps a refresh token for a new access token and refresh
+// token.
+func (uc *UserController) RefreshToken(ctx *gin.Context) {
+	var req RefreshTokenRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "refreshToken is required"})
+		return
+	}
+
+	tokens, user, err := rotateRefreshToken(uc.DB, req.RefreshToken)
+	if errors.Is(err, errInvalidRefreshToken) || errors.Is(err, errRefreshTokenReused) {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Your session has expired. Please log in again."})
+		return
+	}
+	if err != nil {
+		log.Printf("Error refreshing token: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refresh token"})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"message":               "Token refreshed successfully",
+		"token":                 tokens.Token,
+		"expiresAt":             tokens.ExpiresAt,
+		"refreshToken":          tokens.RefreshToken,
+		"refreshTokenExpiresAt": tokens.RefreshTokenExpiresAt,
+		"user": models.UserResponse{
+			ID:                 user.ID,
+			Email:              user.Email,
+			Role:               user.Role,
+			MustChangePassword: user.MustChangePassword,
+			PurchasedPrograms:  purchasedProgramNames(user),
+			TwoFactorEnabled:   user.TwoFactorEnabled(),
+			EmailVerified:      user.EmailVerified(),
+		},
+	})
+}
+
+type LogoutRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// Logout ends the session named by the refresh token, or by the access
+// token when no refresh token is sent. It succeeds for sessions that have
+// already ended.
+func (uc *UserController) Logout(ctx *gin.Context) {
+	var req LogoutRequest
+	_ = ctx.ShouldBindJSON(&req)
+
+	var sessionID uint
+	if req.RefreshToken != "" {
+		var stored models.RefreshToken
+		err := uc.DB.Where("token_hash = ?", auth.HashToken(req.RefreshToken)).First(&stored).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Printf("Error looking up refresh token for logout: %v", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+			return
+		}
+		sessionID = stored.SessionID
+	} else if header := ctx.GetHeader("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		// An expired access token still identifies the session to end
+		claims, err := auth.ParseAccessTokenAllowExpired(strings.TrimPrefix(header, "Bearer "))
+		if err == nil {
+			sessionID = claims.SessionID
+		}
+	} else {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "refreshToken is required"})
+		return
+	}
+
+	if sessionID != 0 {
+		if err := revokeSession(uc.DB, &models.UserSession{Model: gorm.Model{ID: sessionID}}, SessionRevokedLogout); err != nil {
+			log.Printf("Error revoking session %d: %v", sessionID, err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+			return
+		}
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "Logged out"})
+}
+
+type SessionResponse struct {
+	models.UserSession
+	Current bool `json:"current"`
+}
+
+// ListSessions shows the devices the user is signed in on.
+func (uc *UserController) ListSessions(ctx *gin.Context) {
+	userID := ctx.GetUint("userID")
+	var sessions []models.UserSession
+	if err := uc.DB.Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", userID, time.Now()).
+		Order("last_used_at DESC").Find(&sessions).Error; err != nil {
+		log.Printf("Error listing sessions for user %d: %v", userID, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve sessions"})
+		return
+	}
+
+	current := sessionIDFromContext(ctx)
+	response := make([]SessionResponse, 0, len(sessions))
+	for _, session := range sessions {
+		response = append(response, SessionResponse{UserSession: session, Current: session.ID == current})
+	}
+	ctx.JSON(http.StatusOK, gin.H{"sessions": response})
+}
+
+// RevokeSession signs one of the user's devices out.
+func (uc *UserController) RevokeSession(ctx *gin.Context) {
+	id, err := strconv.ParseUint(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid session ID"})
+		return
+	}
+
+	var session models.UserSession
+	if err := uc.DB.Where("id = ? AND user_id = ?", id, ctx.GetUint("userID")).First(&session).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to find session"})
+		return
+	}
+
+	reason := SessionRevokedByUser
+	if session.ID == sessionIDFromContext(ctx) {
+		reason = SessionRevokedLogout
+	}
+	if err := revokeSession(uc.DB, &session, reason); err != nil {
+		log.Printf("Error revoking session %d: %v", session.ID, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke session"})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "Session revoked"})
+}
+
+// RevokeOtherSessions signs the user out everywhere except this device.
+func (uc *UserController) RevokeOtherSessions(ctx *gin.Context) {
+	userID := ctx.GetUint("userID")
+	revoked, err := revokeUserSessions(uc.DB, userID, sessionIDFromContext(ctx), SessionRevokedByUser)
+	if err != nil {
+		log.Printf("Error revoking sessions for user %d: %v", userID, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke sessions"})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "Signed out of other sessions", "revoked": revoked})
+}
+
+// JWKS publishes the public keys that access tokens can be verified with.
+// It is empty while only HS256 keys are in use.
+func (uc *UserController) JWKS(ctx *gin.Context) {
+	ring, err := auth.Keys()
+	if err != nil {
+		log.Printf("Error loading JWT keys: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Signing keys are not configured"})
+		return
+	}
+	ctx.Header("Cache-Control", "public, max-age=300")
+	ctx.JSON(http.StatusOK, ring.JWKS())
+}
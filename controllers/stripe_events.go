@@ -0,0 +1,179 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/88warren/lmw-fitness-backend/models"
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v82"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	StripeEventStatusReceived  = "received"
+	StripeEventStatusProcessed = "processed"
+	StripeEventStatusIgnored   = "ignored"
+	StripeEventStatusFailed    = "failed"
+)
+
+// stripeEventLease is how long a delivery has to handle an event before a
+// redelivery may assume it crashed and take the event over.
+const stripeEventLease = 5 * time.Minute
+
+var errInvalidEventData = errors.New("invalid event data")
+
+// recordStripeEvent stores a verified event in the ledger. When the event ID
+// has been seen before, the existing row is returned with duplicate set.
+func (pc *PaymentController) recordStripeEvent(event stripe.Event, payload []byte) (models.StripeEvent, bool, error) {
+	stripeEvent := models.StripeEvent{
+		EventID: event.ID,
+		Type:    string(event.Type),
+		Status:  StripeEventStatusReceived,
+		Payload: string(payload),
+	}
+
+	result := pc.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "event_id"}},
+		DoNothing: true,
+	}).Create(&stripeEvent)
+	if result.Error != nil {
+		return stripeEvent, false, result.Error
+	}
+	if result.RowsAffected == 1 {
+		return stripeEvent, false, nil
+	}
+
+	var existing models.StripeEvent
+	if err := pc.DB.Where("event_id = ?", event.ID).First(&existing).Error; err != nil {
+		return existing, true, err
+	}
+	return existing, true, nil
+}
+
+// claimStripeEvent takes a redelivered event over for handling: one that
+// failed, or one still "received" whose delivery has held it longer than
+// stripeEventLease. It reports false if the event is done or another
+// delivery is still working on it.
+func (pc *PaymentController) claimStripeEvent(stripeEvent *models.StripeEvent) (bool, error) {
+	if stripeEvent.Status != StripeEventStatusFailed && stripeEvent.Status != StripeEventStatusReceived {
+		return false, nil
+	}
+	result := pc.DB.Model(&models.StripeEvent{}).
+		Where("id = ?", stripeEvent.ID).
+		Where("status = ? OR (status = ? AND updated_at < ?)", StripeEventStatusFailed, StripeEventStatusReceived, time.Now().Add(-stripeEventLease)).
+		Updates(map[string]interface{}{"status": StripeEventStatusReceived, "updated_at": time.Now()})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// processStripeEvent runs the handler for a ledger entry and stores the outcome.
+func (pc *PaymentController) processStripeEvent(stripeEvent models.StripeEvent, event stripe.Event) (string, error) {
+	message, ignored, handleErr := pc.handleStripeEvent(event)
+
+	now := time.Now()
+	updates := map[string]interface{}{
+		"attempts":     gorm.Expr("attempts + 1"),
+		"processed_at": now,
+		"error":        "",
+	}
+	switch {
+	case handleErr != nil:
+		updates["status"] = StripeEventStatusFailed
+		updates["error"] = handleErr.Error()
+	case ignored:
+		updates["status"] = StripeEventStatusIgnored
+	default:
+		updates["status"] = StripeEventStatusProcessed
+	}
+
+	if err := pc.DB.Model(&models.StripeEvent{}).Where("id = ?", stripeEvent.ID).Updates(updates).Error; err != nil {
+		log.Printf("Failed to update status of Stripe event %s: %v", stripeEvent.EventID, err)
+	}
+
+	return message, handleErr
+}
+
+func (pc *PaymentController) ListStripeEvents(c *gin.Context) {
+	query := pc.DB.Model(&models.StripeEvent{}).Omit("payload")
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if eventType := c.Query("type"); eventType != "" {
+		query = query.Where("type = ?", eventType)
+	}
+
+	limit := 100
+	if l, err := strconv.Atoi(c.Query("limit")); err == nil && l > 0 && l <= 500 {
+		limit = l
+	}
+
+	var events []models.StripeEvent
+	if err := query.Order("created_at DESC").Limit(limit).Find(&events).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve Stripe events"})
+		return
+	}
+	c.JSON(http.StatusOK, events)
+}
+
+func (pc *PaymentController) GetStripeEvent(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid event ID"})
+		return
+	}
+
+	var stripeEvent models.StripeEvent
+	if err := pc.DB.First(&stripeEvent, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Stripe event not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve Stripe event"})
+		return
+	}
+	c.JSON(http.StatusOK, stripeEvent)
+}
+
+// ReplayStripeEvent runs a stored event through the webhook handlers again.
+// Handlers are idempotent, so replaying a processed event is safe.
+func (pc *PaymentController) ReplayStripeEvent(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid event ID"})
+		return
+	}
+
+	var stripeEvent models.StripeEvent
+	if err := pc.DB.First(&stripeEvent, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Stripe event not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve Stripe event"})
+		return
+	}
+
+	var event stripe.Event
+	if err := json.Unmarshal([]byte(stripeEvent.Payload), &event); err != nil || event.Data == nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Stored payload is not a valid Stripe event"})
+		return
+	}
+
+	log.Printf("Replaying Stripe event %s (%s)", stripeEvent.EventID, stripeEvent.Type)
+	message, err := pc.processStripeEvent(stripeEvent, event)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	pc.DB.First(&stripeEvent, id)
+	c.JSON(http.StatusOK, gin.H{"message": message, "event": stripeEvent})
+}
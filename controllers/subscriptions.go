@@ -0,0 +1,291 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/88warren/lmw-fitness-backend/models"
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v82"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Renewal webhooks can arrive a little after the period ends, so access
+// runs slightly past it rather than lapsing between renewal and webhook.
+const subscriptionAccessGrace = 24 * time.Hour
+
+func subscriptionGrantsAccess(status string) bool {
+	switch stripe.SubscriptionStatus(status) {
+	case stripe.SubscriptionStatusActive, stripe.SubscriptionStatusTrialing, stripe.SubscriptionStatusPastDue:
+		return true
+	}
+	return false
+}
+
+func subscriptionPeriodEnd(sub *stripe.Subscription) time.Time {
+	var end int64
+	if sub.Items != nil {
+		for _, item := range sub.Items.Data {
+			if item.CurrentPeriodEnd > end {
+				end = item.CurrentPeriodEnd
+			}
+		}
+	}
+	if end == 0 {
+		return time.Time{}
+	}
+	return time.Unix(end, 0)
+}
+
+func subscriptionPriceID(sub *stripe.Subscription) string {
+	if sub.Items == nil {
+		return ""
+	}
+	for _, item := range sub.Items.Data {
+		if item.Price != nil {
+			return item.Price.ID
+		}
+	}
+	return ""
+}
+
+func unixTimePtr(ts int64) *time.Time {
+	if ts == 0 {
+		return nil
+	}
+	t := time.Unix(ts, 0)
+	return &t
+}
+
+func (pc *PaymentController) handleSubscriptionEvent(event stripe.Event) (string, bool, error) {
+	var sub stripe.Subscription
+	if err := json.Unmarshal(event.Data.Raw, &sub); err != nil {
+		log.Printf("Error parsing subscription JSON: %v", err)
+		return "", false, errInvalidEventData
+	}
+
+	local, err := pc.syncSubscription(&sub, nil)
+	if err != nil {
+		return "", false, err
+	}
+	if local.UserID == nil {
+		// Fulfilment of the checkout session links the user later
+		return "Subscription recorded, awaiting checkout fulfilment", false, nil
+	}
+	return fmt.Sprintf("Subscription %s", local.Status), false, nil
+}
+
+func (pc *PaymentController) handleInvoicePaymentFailed(event stripe.Event) (string, bool, error) {
+	var invoice stripe.Invoice
+	if err := json.Unmarshal(event.Data.Raw, &invoice); err != nil {
+		log.Printf("Error parsing invoice JSON: %v", err)
+		return "", false, errInvalidEventData
+	}
+
+	if invoice.Parent == nil || invoice.Parent.SubscriptionDetails == nil || invoice.Parent.SubscriptionDetails.Subscription == nil {
+		log.Printf("Invoice %s payment failed but it is not for a subscription", invoice.ID)
+		return "Invoice is not for a subscription", true, nil
+	}
+	subscriptionID := invoice.Parent.SubscriptionDetails.Subscription.ID
+
+	// The invoice does not carry the subscription's new status, so fetch it
+	sub, err := pc.Gateway.GetSubscription(subscriptionID)
+	if err != nil {
+		return "", false, fmt.Errorf("error fetching subscription %s: %w", subscriptionID, err)
+	}
+	local, err := pc.syncSubscription(sub, nil)
+	if err != nil {
+		return "", false, err
+	}
+
+	now := time.Now()
+	if err := pc.DB.Model(local).Update("last_payment_failed_at", now).Error; err != nil {
+		log.Printf("Error recording failed payment for subscription %s: %v", subscriptionID, err)
+	}
+
+	log.Printf("Payment failed for subscription %s (attempt %d, status now %s)", subscriptionID, invoice.AttemptCount, local.Status)
+	return "Subscription payment failure recorded", false, nil
+}
+
+// syncSubscription stores the latest state of a Stripe subscription and
+// grants or removes the programs of its product to match. userID links the
+// subscription to a user when the caller knows who it belongs to; otherwise
+// the user is found through their Stripe customer ID.
+func (pc *PaymentController) syncSubscription(sub *stripe.Subscription, userID *uint) (*models.Subscription, error) {
+	var local models.Subscription
+	err := pc.DB.Where("stripe_subscription_id = ?", sub.ID).First(&local).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("could not load subscription %s: %w", sub.ID, err)
+	}
+
+	local.StripeSubscriptionID = sub.ID
+	local.Status = string(sub.Status)
+	local.CurrentPeriodEnd = subscriptionPeriodEnd(sub)
+	local.CancelAtPeriodEnd = sub.CancelAtPeriodEnd
+	local.CanceledAt = unixTimePtr(sub.CanceledAt)
+	local.EndedAt = unixTimePtr(sub.EndedAt)
+	if priceID := subscriptionPriceID(sub); priceID != "" {
+		local.StripePriceID = priceID
+	}
+	if sub.Customer != nil && sub.Customer.ID != "" {
+		local.StripeCustomerID = sub.Customer.ID
+	}
+
+	if userID != nil {
+		local.UserID = userID
+	} else if local.UserID == nil && local.StripeCustomerID != "" {
+		var user models.User
+		if err := pc.DB.Where("stripe_customer_id = ?", local.StripeCustomerID).First(&user).Error; err == nil {
+			local.UserID = &user.ID
+		}
+	}
+
+	var product *models.Product
+	if local.StripePriceID != "" {
+		catalog, err := pc.productsByPriceID([]string{local.StripePriceID})
+		if err != nil {
+			return nil, fmt.Errorf("error loading product for subscription %s: %w", sub.ID, err)
+		}
+		if p, ok := catalog[local.StripePriceID]; ok {
+			product = &p
+			local.ProductID = &p.ID
+		}
+	}
+
+	if local.ID == 0 {
+		// The webhook and checkout fulfilment can both create the row
+		err = pc.DB.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "stripe_subscription_id"}},
+			UpdateAll: true,
+		}).Create(&local).Error
+		if err == nil && local.ID == 0 {
+			err = pc.DB.Where("stripe_subscription_id = ?", sub.ID).First(&local).Error
+		}
+	} else {
+		err = pc.DB.Save(&local).Error
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not save subscription %s: %w", sub.ID, err)
+	}
+
+	if err := pc.applySubscriptionAccess(&local, product); err != nil {
+		return nil, err
+	}
+	return &local, nil
+}
+
+// applySubscriptionAccess extends the user's programs to the end of the
+// paid period while the subscription is in good standing, and ends them
+// as soon as it lapses.
+func (pc *PaymentController) applySubscriptionAccess(local *models.Subscription, product *models.Product) error {
+	if local.UserID == nil || product == nil {
+		return nil
+	}
+
+	if subscriptionGrantsAccess(local.Status) {
+		expiresAt := local.CurrentPeriodEnd.Add(subscriptionAccessGrace)
+		for _, program := range product.Programs {
+			if err := extendSubscriptionAccess(pc.DB, *local.UserID, program.ID, local.ID, expiresAt); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	now := time.Now()
+	var ended int64
+	err := pc.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.UserProgram{}).
+			Where("subscription_id = ?", local.ID).
+			Update("expires_at", now).Error; err != nil {
+			return err
+		}
+		result := tx.Where("subscription_id = ?", local.ID).Delete(&models.UserProgram{})
+		ended = result.RowsAffected
+		return result.Error
+	})
+	if err != nil {
+		return fmt.Errorf("could not end access for subscription %s: %w", local.StripeSubscriptionID, err)
+	}
+	if ended == 0 {
+		return nil
+	}
+	log.Printf("Subscription %s is %s, ended access to %d programs for user %d", local.StripeSubscriptionID, local.Status, ended, *local.UserID)
+
+	if len(product.BrevoListIDs) > 0 {
+		var user models.User
+		if err := pc.DB.First(&user, *local.UserID).Error; err == nil {
+			if err := pc.RemoveContactFromBrevoLists(user.Email, product.BrevoListIDs); err != nil {
+				log.Printf("Error removing %s from Brevo lists %v: %v", user.Email, product.BrevoListIDs, err)
+			}
+		}
+	}
+	return nil
+}
+
+// linkCheckoutSubscription is called during fulfilment of a subscription
+// checkout. It records the customer against the user, so the billing portal
+// and later subscription events can find them, and grants the first period.
+func (pc *PaymentController) linkCheckoutSubscription(checkoutSession *stripe.CheckoutSession, userID uint) error {
+	if checkoutSession.Customer != nil && checkoutSession.Customer.ID != "" {
+		if err := pc.DB.Model(&models.User{}).Where("id = ?", userID).
+			Update("stripe_customer_id", checkoutSession.Customer.ID).Error; err != nil {
+			return fmt.Errorf("could not save Stripe customer for user %d: %w", userID, err)
+		}
+	}
+
+	sub, err := pc.Gateway.GetSubscription(checkoutSession.Subscription.ID)
+	if err != nil {
+		return fmt.Errorf("error fetching subscription %s: %w", checkoutSession.Subscription.ID, err)
+	}
+	_, err = pc.syncSubscription(sub, &userID)
+	return err
+}
+
+func (pc *PaymentController) GetMySubscriptions(ctx *gin.Context) {
+	userID, exists := ctx.Get("userID")
+	if !exists {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var subscriptions []models.Subscription
+	if err := pc.DB.Where("user_id = ?", userID).Order("created_at DESC").Find(&subscriptions).Error; err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve subscriptions"})
+		return
+	}
+	ctx.JSON(http.StatusOK, subscriptions)
+}
+
+// CreateBillingPortalSession returns a Stripe billing portal link where the
+// user can update their card, switch plan or cancel.
+func (pc *PaymentController) CreateBillingPortalSession(ctx *gin.Context) {
+	userID, exists := ctx.Get("userID")
+	if !exists {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var user models.User
+	if err := pc.DB.First(&user, userID).Error; err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if user.StripeCustomerID == "" {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "No billing account found for this user"})
+		return
+	}
+
+	portal, err := pc.Gateway.CreateBillingPortalSession(user.StripeCustomerID, pc.FrontendURL+"/profile")
+	if err != nil {
+		log.Printf("Error creating billing portal session for user %d: %v", user.ID, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Could not open billing portal"})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"url": portal.URL})
+}
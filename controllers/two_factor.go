@@ -0,0 +1,422 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/88warren/lmw-fitness-backend/audit"
+	"github.com/88warren/lmw-fitness-backend/lockout"
+	"github.com/88warren/lmw-fitness-backend/models"
+	"github.com/88warren/lmw-fitness-backend/utils/auth"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+const (
+	// mfaChallengeTTL is how long after the password the code must be given
+	mfaChallengeTTL   = 5 * time.Minute
+	recoveryCodeCount = 10
+)
+
+var errTwoFactorNotEnabled = errors.New("two-factor authentication is not enabled")
+
+// beginMFAChallenge answers a correct password or login link for an
+// account with two-factor on. The client swaps mfaToken and a code for a
+// session at /api/login/2fa.
+func (uc *UserController) beginMFAChallenge(ctx *gin.Context, user *models.User) {
+	token, err := issueAuthToken(uc.DB, models.AuthToken{UserID: user.ID, Purpose: models.AuthTokenPurposeMFA}, mfaChallengeTTL)
+	if err != nil {
+		log.Printf("Error creating two-factor challenge for user %d: %v", user.ID, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start two-factor login"})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"message":      "Enter the code from your authenticator app",
+		"mfaRequired":  true,
+		"mfaToken":     token,
+		"mfaExpiresAt": time.Now().Add(mfaChallengeTTL),
+	})
+}
+
+// checkSecondFactor accepts a current authenticator code or an unused
+// recovery code. Either works once.
+func checkSecondFactor(db *gorm.DB, user *models.User, code string) (bool, error) {
+	if !user.TwoFactorEnabled() {
+		return false, errTwoFactorNotEnabled
+	}
+	code = strings.TrimSpace(code)
+	if len(strings.ReplaceAll(code, " ", "")) == auth.TOTPDigits {
+		return useTOTPCode(db, user, code)
+	}
+
+	now := time.Now()
+	used := db.Model(&models.RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", user.ID, auth.HashToken(auth.NormaliseRecoveryCode(code))).
+		Update("used_at", now)
+	if used.Error != nil {
+		return false, used.Error
+	}
+	if used.RowsAffected == 1 {
+		log.Printf("User %d logged in with a recovery code", user.ID)
+	}
+	return used.RowsAffected == 1, nil
+}
+
+// useTOTPCode checks code against secret and records its time step so the
+// same code can't be replayed.
+func useTOTPCode(db *gorm.DB, user *models.User, code string) (bool, error) {
+	counter, ok := auth.VerifyTOTP(user.TOTPSecret, code, time.Now(), user.TOTPLastCounter)
+	if !ok {
+		return false, nil
+	}
+	claimed := db.Model(&models.User{}).
+		Where("id = ? AND totp_last_counter < ?", user.ID, counter).
+		Update("totp_last_counter", counter)
+	if claimed.Error != nil {
+		return false, claimed.Error
+	}
+	user.TOTPLastCounter = counter
+	return claimed.RowsAffected == 1, nil
+}
+
+// newRecoveryCodes replaces the user's recovery codes and returns the new
+// ones. They are shown once and only their hashes are kept.
+func newRecoveryCodes(tx *gorm.DB, userID uint) ([]string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	rows := make([]models.RecoveryCode, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := auth.NewRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+		rows = append(rows, models.RecoveryCode{UserID: userID, CodeHash: auth.HashToken(code)})
+	}
+	if err := tx.Unscoped().Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Create(&rows).Error; err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// markSessionMFAVerified records a two-factor check on the current device.
+func markSessionMFAVerified(db *gorm.DB, sessionID uint) {
+	if sessionID == 0 {
+		return
+	}
+	if err := db.Model(&models.UserSession{}).Where("id = ?", sessionID).Update("mfa_verified_at", time.Now()).Error; err != nil {
+		log.Printf("Error marking session %d as two-factor verified: %v", sessionID, err)
+	}
+}
+
+func (uc *UserController) currentUser(ctx *gin.Context) (*models.User, bool) {
+	var user models.User
+	if err := uc.DB.First(&user, ctx.GetUint("userID")).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return nil, false
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user"})
+		return nil, false
+	}
+	return &user, true
+}
+
+type LoginTwoFactorRequest struct {
+	MFAToken string `json:"mfaToken" binding:"required"`
+	// Code is from the authenticator app, or a recovery code
+	Code string `json:"code" binding:"required"`
+}
+
+// LoginTwoFactor finishes a login on an account with two-factor on.
+func (uc *UserController) LoginTwoFactor(ctx *gin.Context) {
+	var req LoginTwoFactorRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	challenge, err := findAuthToken(uc.DB, req.MFAToken, models.AuthTokenPurposeMFA)
+	if errors.Is(err, errAuthTokenInvalid) {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Your login has expired. Please log in again."})
+		return
+	}
+	if err != nil {
+		log.Printf("Database error finding two-factor challenge: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	var user models.User
+	if err := uc.DB.Preload("UserPrograms.WorkoutProgram").First(&user, challenge.UserID).Error; err != nil {
+		log.Printf("Error finding user %d for two-factor login: %v", challenge.UserID, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "User not found"})
+		return
+	}
+	if uc.throttled(ctx, lockout.ScopeMFA, user.Email) {
+		return
+	}
+
+	ok, err := checkSecondFactor(uc.DB, &user, req.Code)
+	if err != nil && !errors.Is(err, errTwoFactorNotEnabled) {
+		log.Printf("Error checking two-factor code for user %d: %v", user.ID, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check code"})
+		return
+	}
+	if !ok {
+		uc.recordFailure(ctx, lockout.ScopeMFA, user.Email, &user)
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+		return
+	}
+	if err := claimAuthToken(uc.DB, challenge); err != nil {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Your login has expired. Please log in again."})
+		return
+	}
+	if err := uc.Lockout.Succeed(lockout.ScopeMFA, user.Email); err != nil {
+		log.Printf("Error clearing failed codes for user %d: %v", user.ID, err)
+	}
+
+	tokens, err := openSession(uc.DB, ctx, &user, true)
+	if err != nil {
+		log.Printf("Error starting session for user %d: %v", user.ID, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"message":               "Login successful",
+		"token":                 tokens.Token,
+		"expiresAt":             tokens.ExpiresAt,
+		"refreshToken":          tokens.RefreshToken,
+		"refreshTokenExpiresAt": tokens.RefreshTokenExpiresAt,
+		"user": models.UserResponse{
+			ID:                 user.ID,
+			Email:              user.Email,
+			Role:               user.Role,
+			MustChangePassword: user.MustChangePassword,
+			PurchasedPrograms:  purchasedProgramNames(&user),
+			TwoFactorEnabled:   true,
+			EmailVerified:      user.EmailVerified(),
+		},
+	})
+}
+
+// GetTwoFactorStatus says whether two-factor is on and how many recovery
+// codes are left.
+func (uc *UserController) GetTwoFactorStatus(ctx *gin.Context) {
+	user, ok := uc.currentUser(ctx)
+	if !ok {
+		return
+	}
+	var remaining int64
+	if user.TwoFactorEnabled() {
+		uc.DB.Model(&models.RecoveryCode{}).Where("user_id = ? AND used_at IS NULL", user.ID).Count(&remaining)
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"enabled":                user.TwoFactorEnabled(),
+		"enabledAt":              user.TOTPEnabledAt,
+		"recoveryCodesRemaining": remaining,
+	})
+}
+
+// SetupTwoFactor starts enrolment: it makes a new secret and returns the
+// otpauth:// URI for the authenticator app's QR scanner. Two-factor stays
+// off until EnableTwoFactor confirms a code.
+func (uc *UserController) SetupTwoFactor(ctx *gin.Context) {
+	user, ok := uc.currentUser(ctx)
+	if !ok {
+		return
+	}
+	if user.TwoFactorEnabled() {
+		ctx.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+		return
+	}
+
+	secret, err := auth.NewTOTPSecret()
+	if err != nil {
+		log.Printf("Error generating TOTP secret: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start two-factor setup"})
+		return
+	}
+	if err := uc.DB.Model(user).Updates(map[string]interface{}{"totp_secret": secret, "totp_last_counter": 0}).Error; err != nil {
+		log.Printf("Error saving TOTP secret for user %d: %v", user.ID, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start two-factor setup"})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"secret":          secret,
+		"provisioningUri": auth.TOTPProvisioningURI(user.Email, secret),
+	})
+}
+
+type TwoFactorCodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// EnableTwoFactor turns two-factor on once the user proves their app
+// produces the right codes, and returns their recovery codes.
+func (uc *UserController) EnableTwoFactor(ctx *gin.Context) {
+	var req TwoFactorCodeRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	user, ok := uc.currentUser(ctx)
+	if !ok {
+		return
+	}
+	if user.TwoFactorEnabled() {
+		ctx.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+		return
+	}
+	if user.TOTPSecret == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Start two-factor setup first"})
+		return
+	}
+
+	counter, valid := auth.VerifyTOTP(user.TOTPSecret, req.Code, time.Now(), user.TOTPLastCounter)
+	if !valid {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	var codes []string
+	err := uc.DB.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		if err := tx.Model(user).Updates(map[string]interface{}{"totp_enabled_at": now, "totp_last_counter": counter}).Error; err != nil {
+			return err
+		}
+		var err error
+		codes, err = newRecoveryCodes(tx, user.ID)
+		return err
+	})
+	if err != nil {
+		log.Printf("Error enabling two-factor for user %d: %v", user.ID, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to enable two-factor authentication"})
+		return
+	}
+	markSessionMFAVerified(uc.DB, sessionIDFromContext(ctx))
+	log.Printf("User %d enabled two-factor authentication", user.ID)
+	audit.Record(uc.DB, ctx, audit.Entry{Action: audit.ActionTwoFactorEnabled, TargetType: audit.TargetUser, TargetID: user.ID})
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"message":       "Two-factor authentication enabled. Keep your recovery codes somewhere safe.",
+		"recoveryCodes": codes,
+	})
+}
+
+// VerifyTwoFactor re-checks a code on the current device, e.g. before an
+// admin action that needs a recent two-factor check.
+func (uc *UserController) VerifyTwoFactor(ctx *gin.Context) {
+	var req TwoFactorCodeRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	user, ok := uc.currentUser(ctx)
+	if !ok {
+		return
+	}
+	if !uc.secondFactorOK(ctx, user, req.Code) {
+		return
+	}
+	markSessionMFAVerified(uc.DB, sessionIDFromContext(ctx))
+	ctx.JSON(http.StatusOK, gin.H{"message": "Code verified"})
+}
+
+// secondFactorOK checks a code for a signed-in user, answering the request
+// when it isn't accepted.
+func (uc *UserController) secondFactorOK(ctx *gin.Context, user *models.User, code string) bool {
+	if uc.throttled(ctx, lockout.ScopeMFA, user.Email) {
+		return false
+	}
+	ok, err := checkSecondFactor(uc.DB, user, code)
+	if errors.Is(err, errTwoFactorNotEnabled) {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Two-factor authentication is not enabled"})
+		return false
+	}
+	if err != nil {
+		log.Printf("Error checking two-factor code for user %d: %v", user.ID, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check code"})
+		return false
+	}
+	if !ok {
+		uc.recordFailure(ctx, lockout.ScopeMFA, user.Email, user)
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+		return false
+	}
+	if err := uc.Lockout.Succeed(lockout.ScopeMFA, user.Email); err != nil {
+		log.Printf("Error clearing failed codes for user %d: %v", user.ID, err)
+	}
+	return true
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes, e.g. when they are
+// running out or may have been seen.
+func (uc *UserController) RegenerateRecoveryCodes(ctx *gin.Context) {
+	var req TwoFactorCodeRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	user, ok := uc.currentUser(ctx)
+	if !ok || !uc.secondFactorOK(ctx, user, req.Code) {
+		return
+	}
+
+	codes, err := newRecoveryCodes(uc.DB, user.ID)
+	if err != nil {
+		log.Printf("Error regenerating recovery codes for user %d: %v", user.ID, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create recovery codes"})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"recoveryCodes": codes})
+}
+
+type DisableTwoFactorRequest struct {
+	Password string `json:"password" binding:"required"`
+	Code     string `json:"code" binding:"required"`
+}
+
+// DisableTwoFactor turns two-factor off. It needs both the password and a
+// code so a stolen session alone can't do it.
+func (uc *UserController) DisableTwoFactor(ctx *gin.Context) {
+	var req DisableTwoFactorRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	user, ok := uc.currentUser(ctx)
+	if !ok {
+		return
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)); err != nil {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Incorrect password"})
+		return
+	}
+	if !uc.secondFactorOK(ctx, user, req.Code) {
+		return
+	}
+
+	err := uc.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(user).Updates(map[string]interface{}{"totp_secret": "", "totp_enabled_at": nil, "totp_last_counter": 0}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Where("user_id = ?", user.ID).Delete(&models.RecoveryCode{}).Error
+	})
+	if err != nil {
+		log.Printf("Error disabling two-factor for user %d: %v", user.ID, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to disable two-factor authentication"})
+		return
+	}
+	log.Printf("User %d disabled two-factor authentication", user.ID)
+	audit.Record(uc.DB, ctx, audit.Entry{Action: audit.ActionTwoFactorDisabled, TargetType: audit.TargetUser, TargetID: user.ID})
+	ctx.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication disabled"})
+}
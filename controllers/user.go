@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -12,11 +13,13 @@ import (
 	"strings"
 	"time"
 
+	"github.com/88warren/lmw-fitness-backend/audit"
+	"github.com/88warren/lmw-fitness-backend/lockout"
 	"github.com/88warren/lmw-fitness-backend/models"
+	"github.com/88warren/lmw-fitness-backend/oidc"
 	"github.com/88warren/lmw-fitness-backend/utils/email"
 	"github.com/88warren/lmw-fitness-backend/utils/emailtemplates"
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v5"
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -26,10 +29,20 @@ import (
 
 type UserController struct {
 	DB *gorm.DB
+	// SendEmail delivers login links and warnings; tests swap it out
+	SendEmail func(to, subject, body string) error
+	Lockout   *lockout.Limiter
+	// OIDC holds the social login providers by name
+	OIDC map[string]*oidc.Provider
 }
 
 func NewUserController(db *gorm.DB) *UserController {
-	return &UserController{DB: db}
+	return &UserController{
+		DB:        db,
+		SendEmail: sendSMTPEmail,
+		Lockout:   lockout.New(lockout.NewStore(db)),
+		OIDC:      loadOIDCProviders(),
+	}
 }
 
 type VerifyTokenRequest struct {
@@ -96,21 +109,30 @@ func (uc *UserController) RegisterUser(ctx *gin.Context) {
 	// Don't initialize program access for manual registrations - users only get calorie calculator
 	// Program access will be granted when they purchase programs
 
-	token, err := uc.GenerateJWT(user.ID, user.Email, user.Role)
+	if err := uc.sendVerificationEmail(&user); err != nil {
+		log.Printf("Error sending verification email to user %d: %v", user.ID, err)
+	}
+
+	tokens, err := startSession(uc.DB, ctx, &user)
 	if err != nil {
+		log.Printf("Error starting session for user %d: %v", user.ID, err)
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
 		return
 	}
 
 	ctx.JSON(http.StatusCreated, gin.H{
-		"message": "User registered successfully",
-		"token":   token,
+		"message":               "User registered successfully",
+		"token":                 tokens.Token,
+		"expiresAt":             tokens.ExpiresAt,
+		"refreshToken":          tokens.RefreshToken,
+		"refreshTokenExpiresAt": tokens.RefreshTokenExpiresAt,
 		"user": models.UserResponse{
 			ID:                 user.ID,
 			Email:              user.Email,
 			Role:               user.Role,
 			MustChangePassword: user.MustChangePassword,
 			PurchasedPrograms:  []string{}, // New users have no programs
+			EmailVerified:      false,
 		},
 	})
 }
@@ -125,9 +147,14 @@ func (uc *UserController) LoginUser(ctx *gin.Context) {
 	// Normalize email to be case-insensitive for login
 	normalizedEmail := strings.ToLower(strings.TrimSpace(req.Email))
 
+	if uc.throttled(ctx, lockout.ScopeLogin, normalizedEmail) {
+		return
+	}
+
 	var user models.User
 	if result := uc.DB.Preload("AuthTokens").Preload("UserPrograms.WorkoutProgram").Where("LOWER(email) = ?", normalizedEmail).First(&user); result.Error != nil {
 		if result.Error == gorm.ErrRecordNotFound {
+			uc.recordFailure(ctx, lockout.ScopeLogin, normalizedEmail, nil)
 			ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
 			return
 		}
@@ -139,131 +166,56 @@ func (uc *UserController) LoginUser(ctx *gin.Context) {
 	// log.Printf("Login attempt plaintext password: %s", req.Password)
 
 	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)); err != nil {
+		uc.recordFailure(ctx, lockout.ScopeLogin, normalizedEmail, &user)
 		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
 		return
 	}
-
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"user_id": user.ID,
-		"email":   user.Email,
-		"role":    user.Role,
-		"exp":     time.Now().Add(time.Hour * 24 * 30).Unix(), // 30 days instead of 1 day
-	})
-
-	jwtSecret := os.Getenv("JWT_SECRET")
-	if jwtSecret == "" {
-		jwtSecret = "supersecretjwtkey"
+	if err := uc.Lockout.Succeed(lockout.ScopeLogin, normalizedEmail); err != nil {
+		log.Printf("Error clearing failed logins for user %d: %v", user.ID, err)
+	}
+	if user.TwoFactorEnabled() {
+		uc.beginMFAChallenge(ctx, &user)
+		return
 	}
 
-	tokenString, err := token.SignedString([]byte(jwtSecret))
+	tokens, err := startSession(uc.DB, ctx, &user)
 	if err != nil {
+		log.Printf("Error starting session for user %d: %v", user.ID, err)
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
 		return
 	}
 
 	// log.Printf("Login successful for user: %s", req.Email)
 
-	// Get purchased programs from UserPrograms (consistent with profile)
-	purchasedPrograms := make(map[string]bool)
-	for _, userProgram := range user.UserPrograms {
-		if userProgram.WorkoutProgram.Name != "" {
-			purchasedPrograms[userProgram.WorkoutProgram.Name] = true
-		}
-	}
-
-	programList := make([]string, 0, len(purchasedPrograms))
-	for program := range purchasedPrograms {
-		programList = append(programList, program)
-	}
-
-	// log.Printf("AuthTokens found: %d", len(user.AuthTokens))
-	// for _, authToken := range user.AuthTokens {
-	// 	log.Printf("  - Program: %s, Used: %v", authToken.ProgramName, authToken.IsUsed)
-	// }
-	// log.Printf("Final program list: %v", programList)
-
 	ctx.JSON(http.StatusOK, gin.H{
-		"message": "Login successful",
-		"token":   tokenString,
+		"message":               "Login successful",
+		"token":                 tokens.Token,
+		"expiresAt":             tokens.ExpiresAt,
+		"refreshToken":          tokens.RefreshToken,
+		"refreshTokenExpiresAt": tokens.RefreshTokenExpiresAt,
 		"user": models.UserResponse{
 			ID:                 user.ID,
 			Email:              user.Email,
 			Role:               user.Role,
 			MustChangePassword: user.MustChangePassword,
-			PurchasedPrograms:  programList,
+			PurchasedPrograms:  purchasedProgramNames(&user),
+			EmailVerified:      user.EmailVerified(),
 		},
 	})
 }
 
-func (uc *UserController) RefreshToken(ctx *gin.Context) {
-	userID, exists := ctx.Get("userID")
-	if !exists {
-		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "User ID not found in token"})
-		return
-	}
-
-	userEmail, exists := ctx.Get("userEmail")
-	if !exists {
-		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "User email not found in token"})
-		return
-	}
-
-	userRole, exists := ctx.Get("userRole")
-	if !exists {
-		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "User role not found in token"})
-		return
-	}
-
-	// Generate new token
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"user_id": userID,
-		"email":   userEmail,
-		"role":    userRole,
-		"exp":     time.Now().Add(time.Hour * 24 * 30).Unix(), // 30 days
-	})
-
-	jwtSecret := os.Getenv("JWT_SECRET")
-	if jwtSecret == "" {
-		jwtSecret = "supersecretjwtkey"
-	}
-
-	tokenString, err := token.SignedString([]byte(jwtSecret))
-	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
-		return
-	}
-
-	// Get fresh user data
-	var user models.User
-	if err := uc.DB.Preload("UserPrograms.WorkoutProgram").First(&user, userID).Error; err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user data"})
-		return
-	}
-
-	// Get purchased programs from UserPrograms (consistent with profile)
-	purchasedPrograms := make(map[string]bool)
+// purchasedProgramNames lists each program the user has access to once.
+func purchasedProgramNames(user *models.User) []string {
+	seen := make(map[string]bool)
+	programList := make([]string, 0, len(user.UserPrograms))
 	for _, userProgram := range user.UserPrograms {
-		if userProgram.WorkoutProgram.Name != "" {
-			purchasedPrograms[userProgram.WorkoutProgram.Name] = true
+		name := userProgram.WorkoutProgram.Name
+		if name != "" && !seen[name] {
+			seen[name] = true
+			programList = append(programList, name)
 		}
 	}
-
-	programList := make([]string, 0, len(purchasedPrograms))
-	for program := range purchasedPrograms {
-		programList = append(programList, program)
-	}
-
-	ctx.JSON(http.StatusOK, gin.H{
-		"message": "Token refreshed successfully",
-		"token":   tokenString,
-		"user": models.UserResponse{
-			ID:                 user.ID,
-			Email:              user.Email,
-			Role:               user.Role,
-			MustChangePassword: user.MustChangePassword,
-			PurchasedPrograms:  programList,
-		},
-	})
+	return programList
 }
 
 func (uc *UserController) GetProfile(ctx *gin.Context) {
@@ -332,6 +284,8 @@ func (uc *UserController) GetProfile(ctx *gin.Context) {
 		CurrentStreak:      user.CurrentStreak,
 		LongestStreak:      user.LongestStreak,
 		ReminderOptOut:     user.ReminderOptOut,
+		TwoFactorEnabled:   user.TwoFactorEnabled(),
+		EmailVerified:      user.EmailVerified(),
 	}
 
 	ctx.JSON(http.StatusOK, userResponse)
@@ -443,30 +397,12 @@ func (uc *UserController) ChangePassword(ctx *gin.Context) {
 		return
 	}
 
-	ctx.JSON(http.StatusOK, gin.H{"message": "Password changed successfully!"})
-}
-
-func (uc *UserController) GenerateJWT(userID uint, email, role string) (string, error) {
-	jwtSecret := os.Getenv("JWT_SECRET")
-	if jwtSecret == "" {
-		log.Println("JWT_SECRET environment variable not set. Using a default (NOT SECURE FOR PRODUCTION!).")
-		jwtSecret = "supersecretjwtkey"
-	}
-
-	claims := jwt.MapClaims{
-		"authorized": true,
-		"user_id":    userID,
-		"email":      email,
-		"role":       role,
-		"exp":        time.Now().Add(time.Hour * 24).Unix(),
+	if _, err := revokeUserSessions(uc.DB, user.ID, sessionIDFromContext(ctx), SessionRevokedPasswordChanged); err != nil {
+		log.Printf("Error signing user %d out of other sessions: %v", user.ID, err)
 	}
+	audit.Record(uc.DB, ctx, audit.Entry{Action: audit.ActionPasswordChanged, TargetType: audit.TargetUser, TargetID: user.ID})
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString([]byte(jwtSecret))
-	if err != nil {
-		return "", err
-	}
-	return tokenString, nil
+	ctx.JSON(http.StatusOK, gin.H{"message": "Password changed successfully!"})
 }
 
 func (uc *UserController) RequestPasswordReset(ctx *gin.Context) {
@@ -481,6 +417,13 @@ func (uc *UserController) RequestPasswordReset(ctx *gin.Context) {
 	// Normalize incoming email and perform case-insensitive lookup
 	req.Email = strings.ToLower(strings.TrimSpace(req.Email))
 
+	// Every request counts, whether or not the account exists, so the
+	// limit says nothing about which emails are registered
+	if uc.throttled(ctx, lockout.ScopeResetRequest, req.Email) {
+		return
+	}
+	uc.recordFailure(ctx, lockout.ScopeResetRequest, req.Email, nil)
+
 	var user models.User
 	if result := uc.DB.Where("LOWER(email) = ?", req.Email).First(&user); result.Error != nil {
 		if result.Error == gorm.ErrRecordNotFound {
@@ -513,21 +456,11 @@ func (uc *UserController) RequestPasswordReset(ctx *gin.Context) {
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save reset token."})
 		return
 	}
+	audit.Record(uc.DB, ctx, audit.Entry{Action: audit.ActionPasswordResetRequested, TargetType: audit.TargetUser, TargetID: user.ID})
 
-	// Use FRONTEND_URL if available, otherwise fall back to ALLOWED_ORIGIN
-	frontendURL := os.Getenv("FRONTEND_URL")
-	if frontendURL == "" {
-		allowedOrigin := os.Getenv("ALLOWED_ORIGIN")
-		if allowedOrigin != "" {
-			origins := strings.Split(allowedOrigin, ",")
-			frontendURL = strings.TrimSpace(origins[0]) // Use the first origin
-		} else {
-			frontendURL = "https://www.lmwfitness.co.uk"
-		}
-	}
+	frontendURL := frontendBaseURL()
 
 	resetLink := fmt.Sprintf("%s/reset-password/%s", frontendURL, token)
-	log.Printf("Generated password reset link: %s", resetLink)
 	log.Printf("FRONTEND_URL env var: %s", os.Getenv("FRONTEND_URL"))
 	log.Printf("ALLOWED_ORIGIN env var: %s", os.Getenv("ALLOWED_ORIGIN"))
 	log.Printf("Using frontend URL: %s", frontendURL)
@@ -578,9 +511,14 @@ func (uc *UserController) VerifyResetToken(ctx *gin.Context) {
 		return
 	}
 
+	if uc.throttled(ctx, lockout.ScopeResetToken, "") {
+		return
+	}
+
 	var resetToken models.PasswordResetToken
 	if result := uc.DB.Where("token = ?", req.Token).First(&resetToken); result.Error != nil {
 		if result.Error == gorm.ErrRecordNotFound {
+			uc.recordFailure(ctx, lockout.ScopeResetToken, "", nil)
 			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired reset token."})
 			return
 		}
@@ -628,9 +566,14 @@ func (uc *UserController) ResetPassword(ctx *gin.Context) {
 		return
 	}
 
+	if uc.throttled(ctx, lockout.ScopeResetToken, "") {
+		return
+	}
+
 	var resetToken models.PasswordResetToken
 	if result := uc.DB.Where("token = ?", req.Token).First(&resetToken); result.Error != nil {
 		if result.Error == gorm.ErrRecordNotFound {
+			uc.recordFailure(ctx, lockout.ScopeResetToken, "", nil)
 			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired password reset link."})
 			return
 		}
@@ -680,6 +623,18 @@ func (uc *UserController) ResetPassword(ctx *gin.Context) {
 
 	uc.DB.Delete(&resetToken)
 
+	if _, err := revokeUserSessions(uc.DB, user.ID, 0, SessionRevokedPasswordChanged); err != nil {
+		log.Printf("Error signing user %d out after password reset: %v", user.ID, err)
+	}
+	// Whoever reset the password owns the inbox, so lift any lockout
+	if err := uc.Lockout.Unlock(user.Email); err != nil {
+		log.Printf("Error unlocking user %d after password reset: %v", user.ID, err)
+	}
+	if err := markEmailVerified(uc.DB, &user); err != nil {
+		log.Printf("Error marking email verified for user %d: %v", user.ID, err)
+	}
+	audit.Record(uc.DB, ctx, audit.Entry{Action: audit.ActionPasswordReset, TargetType: audit.TargetUser, TargetID: user.ID, ActorID: user.ID, ActorEmail: user.Email})
+
 	ctx.JSON(http.StatusOK, gin.H{"message": "Your password has been reset successfully!"})
 }
 
@@ -761,30 +716,33 @@ func (uc *UserController) VerifyWorkoutToken(ctx *gin.Context) {
 		return
 	}
 
-	// log.Printf("Token being verified: %s", req.Token)
-
-	var authToken models.AuthToken
-	if err := uc.DB.Where("token = ? AND is_used = ?", req.Token, false).First(&authToken).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
-			return
-		}
-		log.Printf("Database error finding token: %v", err)
+	authToken, err := redeemAuthToken(uc.DB, req.Token, models.AuthTokenPurposePurchase, models.AuthTokenPurposeSuccessPage, models.AuthTokenPurposeLogin)
+	if errors.Is(err, errAuthTokenInvalid) {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
+		return
+	}
+	if err != nil {
+		log.Printf("Database error redeeming token: %v", err)
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 		return
 	}
 
-	// log.Printf("Found valid unused token for user ID: %d", authToken.UserID)
-
-	authToken.IsUsed = true
-	uc.DB.Save(&authToken)
-
 	var user models.User
 	if err := uc.DB.Preload("UserPrograms.WorkoutProgram").First(&user, authToken.UserID).Error; err != nil {
 		log.Printf("Error finding user %d: %v", authToken.UserID, err)
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "User not found"})
 		return
 	}
+	// The link was emailed, so whoever followed it reads that inbox
+	if err := markEmailVerified(uc.DB, &user); err != nil {
+		log.Printf("Error marking email verified for user %d: %v", user.ID, err)
+	}
+
+	// A link stands in for the password, not the second factor
+	if user.TwoFactorEnabled() {
+		uc.beginMFAChallenge(ctx, &user)
+		return
+	}
 
 	purchasedPrograms := make(map[string]bool)
 	for _, userProgram := range user.UserPrograms {
@@ -800,7 +758,7 @@ func (uc *UserController) VerifyWorkoutToken(ctx *gin.Context) {
 
 	// log.Printf("Program list being sent: %v", programList)
 
-	tokenString, err := uc.GenerateJWT(user.ID, user.Email, user.Role)
+	tokens, err := startSession(uc.DB, ctx, &user)
 	if err != nil {
 		log.Printf("Failed to generate JWT for user %d: %v", user.ID, err)
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
@@ -813,14 +771,19 @@ func (uc *UserController) VerifyWorkoutToken(ctx *gin.Context) {
 		Role:               user.Role,
 		MustChangePassword: user.MustChangePassword,
 		PurchasedPrograms:  programList,
+		EmailVerified:      user.EmailVerified(),
 	}
 
 	// log.Printf("Sending successful response for user %s with programs: %v", user.Email, programList)
 
 	ctx.JSON(http.StatusOK, gin.H{
-		"message": "Token verified, user authenticated",
-		"user":    userResponse,
-		"jwt":     tokenString,
+		"message":               "Token verified, user authenticated",
+		"purpose":               authToken.Purpose,
+		"user":                  userResponse,
+		"jwt":                   tokens.Token,
+		"expiresAt":             tokens.ExpiresAt,
+		"refreshToken":          tokens.RefreshToken,
+		"refreshTokenExpiresAt": tokens.RefreshTokenExpiresAt,
 	})
 }
 
@@ -883,6 +846,7 @@ func (uc *UserController) SetFirstTimePassword(ctx *gin.Context) {
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update password."})
 		return
 	}
+	audit.Record(uc.DB, ctx, audit.Entry{Action: audit.ActionPasswordChanged, TargetType: audit.TargetUser, TargetID: user.ID, Metadata: map[string]interface{}{"firstTime": true}})
 
 	var updatedUser models.User
 	if result := uc.DB.Preload("UserPrograms.WorkoutProgram").First(&updatedUser, user.ID); result.Error != nil {
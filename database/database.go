@@ -81,6 +81,7 @@ func MigrateDB() {
 	err := DB.AutoMigrate(
 		&models.AuthToken{},
 		&models.Job{},
+		&models.JobAttempt{},
 		&models.Blog{},
 		&models.User{},
 		&models.UserProgram{},
@@ -93,11 +94,44 @@ func MigrateDB() {
 		&models.UserWorkoutSession{},
 		&models.FitnessAssessment{},
 		&models.AMRAPScore{},
+		&models.Product{},
+		&models.StripeEvent{},
+		&models.EntitlementRevocation{},
+		&models.Order{},
+		&models.OrderItem{},
+		&models.Subscription{},
+		&models.GiftCode{},
+		&models.Promotion{},
+		&models.PromotionRedemption{},
+		&models.CheckoutRecord{},
+		&models.ReferralCode{},
+		&models.ReferralConversion{},
+		&models.Invoice{},
+		&models.InvoiceSequence{},
+		&models.ProductPrice{},
+		&models.UserSession{},
+		&models.RefreshToken{},
+		&models.LoginAttempt{},
+		&models.RecoveryCode{},
+		&models.Permission{},
+		&models.Role{},
+		&models.APIKey{},
+		&models.UserIdentity{},
+		&models.OIDCLoginState{},
+		&models.AuditEvent{},
 	)
 
 	if err != nil {
 		log.Fatalf("Failed to migrate database: %v", err)
 	}
 
+	// Gift codes used to be unique per product in a session, which allowed
+	// only one code however many were bought
+	if DB.Migrator().HasIndex(&models.GiftCode{}, "idx_gift_codes_session_product") {
+		if err := DB.Migrator().DropIndex(&models.GiftCode{}, "idx_gift_codes_session_product"); err != nil {
+			log.Fatalf("Failed to drop old gift code index: %v", err)
+		}
+	}
+
 	log.Println("Database migration completed successfully")
 }
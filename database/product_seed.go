@@ -0,0 +1,103 @@
+package database
+
+import (
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/88warren/lmw-fitness-backend/models"
+	"gorm.io/gorm"
+)
+
+type productSeedConfig struct {
+	Name          string
+	PriceEnv      string
+	ProgramNames  []string
+	ListIDEnv     string
+	TemplateIDEnv string
+	Recurring     bool
+}
+
+// ProductSeed creates catalog entries for the price IDs that used to be
+// configured through environment variables, so existing deployments keep
+// fulfilling orders after the move to the product table. Products that
+// already exist are left untouched, so admin edits are never overwritten.
+func ProductSeed(db *gorm.DB) {
+	configs := []productSeedConfig{
+		{
+			Name:          "Beginner Program",
+			PriceEnv:      "BEGINNER_PRICE_ID",
+			ProgramNames:  []string{"beginner-program"},
+			ListIDEnv:     "BREVO_BEGINNER_LIST_ID",
+			TemplateIDEnv: "BREVO_BEGINNER_PROGRAM_TEMPLATE_ID",
+		},
+		{
+			Name:          "Advanced Program",
+			PriceEnv:      "ADVANCED_PRICE_ID",
+			ProgramNames:  []string{"advanced-program"},
+			ListIDEnv:     "BREVO_ADVANCED_LIST_ID",
+			TemplateIDEnv: "BREVO_ADVANCED_PROGRAM_TEMPLATE_ID",
+		},
+		{
+			Name:          "Ultimate Habit & Mindset Package",
+			PriceEnv:      "ULTIMATE_MINDSET_PACKAGE_PRICE_ID",
+			ListIDEnv:     "BREVO_MINDSET_LIST_ID",
+			TemplateIDEnv: "BREVO_MINDSET_PACKAGE_TEMPLATE_ID",
+		},
+		{
+			Name:          "Tailored Coaching",
+			PriceEnv:      "TAILORED_COACHING_PRICE_ID",
+			ListIDEnv:     "BREVO_TAILORED_COACHING_LIST_ID",
+			TemplateIDEnv: "BREVO_TAILORED_COACHING_TEMPLATE_ID",
+			Recurring:     true,
+		},
+	}
+
+	for _, cfg := range configs {
+		priceID := os.Getenv(cfg.PriceEnv)
+		if priceID == "" {
+			continue
+		}
+
+		var existing models.Product
+		if err := db.Unscoped().Where("stripe_price_id = ?", priceID).First(&existing).Error; err == nil {
+			continue
+		}
+
+		product := models.Product{
+			Name:             cfg.Name,
+			StripePriceID:    priceID,
+			BrevoListIDs:     int64FromEnv(cfg.ListIDEnv),
+			BrevoTemplateIDs: int64FromEnv(cfg.TemplateIDEnv),
+			IsActive:         true,
+			Recurring:        cfg.Recurring,
+		}
+
+		// A program product without its programs would take payment and
+		// grant nothing, so wait for a later start once they're seeded
+		if len(cfg.ProgramNames) > 0 {
+			if err := db.Where("name IN ?", cfg.ProgramNames).Find(&product.Programs).Error; err != nil {
+				log.Printf("Failed to load programs for product '%s', not creating it: %v", cfg.Name, err)
+				continue
+			}
+			if len(product.Programs) != len(cfg.ProgramNames) {
+				log.Printf("Programs %v for product '%s' not found, not creating it", cfg.ProgramNames, cfg.Name)
+				continue
+			}
+		}
+
+		if err := db.Create(&product).Error; err != nil {
+			log.Printf("Failed to create product '%s': %v", cfg.Name, err)
+		} else {
+			log.Printf("Successfully created product '%s' for price %s.", cfg.Name, priceID)
+		}
+	}
+}
+
+func int64FromEnv(key string) []int64 {
+	value, err := strconv.ParseInt(os.Getenv(key), 10, 64)
+	if err != nil || value == 0 {
+		return []int64{}
+	}
+	return []int64{value}
+}
@@ -0,0 +1,57 @@
+package database
+
+import (
+	"errors"
+	"log"
+	"os"
+
+	"github.com/88warren/lmw-fitness-backend/models"
+	"gorm.io/gorm"
+)
+
+const mindsetBundleCode = "MINDSETBUNDLE"
+
+// PromotionSeed creates the mindset package bundle deal, which used to be
+// worked out at checkout from a flag the client sent: £10 off the package
+// when it is bought with another product. It is created once; after that
+// it is managed like any other promotion and is never recreated, even if
+// it is deleted.
+func PromotionSeed(db *gorm.DB) {
+	priceID := os.Getenv("ULTIMATE_MINDSET_PACKAGE_PRICE_ID")
+	if priceID == "" {
+		return
+	}
+
+	var existing models.Promotion
+	err := db.Unscoped().Where("code = ?", mindsetBundleCode).First(&existing).Error
+	if err == nil {
+		return
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		log.Printf("Failed to look up promotion %s: %v", mindsetBundleCode, err)
+		return
+	}
+
+	var product models.Product
+	if err := db.Where("stripe_price_id = ?", priceID).First(&product).Error; err != nil {
+		log.Printf("Mindset package for price %s not found, not creating promotion %s: %v", priceID, mindsetBundleCode, err)
+		return
+	}
+
+	promo := models.Promotion{
+		Code:                 mindsetBundleCode,
+		Description:          "£10 off the Ultimate Habit & Mindset Package when bought with another package",
+		DiscountType:         models.PromotionTypeAmount,
+		AmountOff:            1000,
+		Currency:             "gbp",
+		ProductIDs:           []uint{product.ID},
+		RequiresOtherProduct: true,
+		Automatic:            true,
+		IsActive:             true,
+	}
+	if err := db.Create(&promo).Error; err != nil {
+		log.Printf("Failed to create promotion %s: %v", mindsetBundleCode, err)
+	} else {
+		log.Printf("Successfully created promotion %s.", mindsetBundleCode)
+	}
+}
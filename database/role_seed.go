@@ -0,0 +1,58 @@
+package database
+
+import (
+	"log"
+
+	"github.com/88warren/lmw-fitness-backend/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// RoleSeed makes sure every permission and built-in role exists. Roles
+// edited through the admin API keep their permissions, except that admin
+// always gets every permission, including ones added since it was seeded.
+func RoleSeed(db *gorm.DB) {
+	for _, permission := range models.AllPermissions {
+		permission := permission
+		err := db.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "name"}},
+			DoUpdates: clause.AssignmentColumns([]string{"description"}),
+		}).Create(&permission).Error
+		if err != nil {
+			log.Printf("Failed to seed permission %s: %v", permission.Name, err)
+			return
+		}
+	}
+
+	for name, permissionNames := range models.DefaultRolePermissions {
+		var role models.Role
+		err := db.Where("name = ?", name).First(&role).Error
+		if err == nil && name != models.RoleAdmin {
+			continue
+		}
+		if err != nil && err != gorm.ErrRecordNotFound {
+			log.Printf("Failed to load role %s: %v", name, err)
+			continue
+		}
+
+		var permissions []models.Permission
+		if len(permissionNames) > 0 {
+			if err := db.Where("name IN ?", permissionNames).Find(&permissions).Error; err != nil {
+				log.Printf("Failed to load permissions for role %s: %v", name, err)
+				continue
+			}
+		}
+
+		if role.ID == 0 {
+			role = models.Role{Name: name, Description: "Built-in " + name + " role"}
+			if err := db.Create(&role).Error; err != nil {
+				log.Printf("Failed to create role %s: %v", name, err)
+				continue
+			}
+			log.Printf("Created role %s", name)
+		}
+		if err := db.Model(&role).Association("Permissions").Replace(permissions); err != nil {
+			log.Printf("Failed to set permissions of role %s: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,620 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stripe/stripe-go/v82"
+	"github.com/stripe/stripe-go/v82/webhook"
+)
+
+// Fake is an in-memory PaymentGateway for tests. IDs are generated from a
+// counter under a prefix unique to the fake (cs_test_<run>_1, ...), so tests
+// sharing a database never see each other's sessions or events, and webhook
+// payloads are signed with WebhookSecret exactly as Stripe signs them.
+type Fake struct {
+	WebhookSecret string
+
+	mu             sync.Mutex
+	run            int64
+	seq            int
+	prices         map[string]*stripe.Price
+	coupons        map[string]*stripe.Coupon
+	promotionCodes map[string]*stripe.PromotionCode
+	sessions       map[string]*stripe.CheckoutSession
+	lineItems      map[string][]*stripe.LineItem
+	charges        map[string]*stripe.Charge
+	subscriptions  map[string]*stripe.Subscription
+}
+
+func NewFake() *Fake {
+	return &Fake{
+		WebhookSecret:  "whsec_fake",
+		run:            time.Now().UnixNano(),
+		prices:         map[string]*stripe.Price{},
+		coupons:        map[string]*stripe.Coupon{},
+		promotionCodes: map[string]*stripe.PromotionCode{},
+		sessions:       map[string]*stripe.CheckoutSession{},
+		lineItems:      map[string][]*stripe.LineItem{},
+		charges:        map[string]*stripe.Charge{},
+		subscriptions:  map[string]*stripe.Subscription{},
+	}
+}
+
+func (f *Fake) nextID(prefix string) string {
+	f.seq++
+	return fmt.Sprintf("%s_test_%d_%d", prefix, f.run, f.seq)
+}
+
+// AddPrice registers a one-off price for a product.
+func (f *Fake) AddPrice(priceID, productName string, unitAmount int64, currency string) *stripe.Price {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	price := &stripe.Price{
+		ID:         priceID,
+		Active:     true,
+		Currency:   stripe.Currency(currency),
+		UnitAmount: unitAmount,
+		Type:       stripe.PriceTypeOneTime,
+		Product:    &stripe.Product{ID: f.nextID("prod"), Name: productName},
+	}
+	f.prices[priceID] = price
+	return price
+}
+
+// AddCoupon registers a coupon. A coupon with neither AmountOff nor
+// PercentOff set is stored as given, which is useful for testing invalid
+// configurations.
+func (f *Fake) AddCoupon(coupon *stripe.Coupon) *stripe.Coupon {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if coupon.ID == "" {
+		coupon.ID = f.nextID("coupon")
+	}
+	f.coupons[coupon.ID] = coupon
+	return coupon
+}
+
+// AddPromotionCode registers a customer facing code for a coupon.
+func (f *Fake) AddPromotionCode(code string, coupon *stripe.Coupon, active bool) *stripe.PromotionCode {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	promo := &stripe.PromotionCode{
+		ID:     f.nextID("promo"),
+		Code:   code,
+		Active: active,
+		Coupon: coupon,
+	}
+	f.promotionCodes[strings.ToLower(code)] = promo
+	return promo
+}
+
+func (f *Fake) CreateCheckoutSession(params *stripe.CheckoutSessionParams) (*stripe.CheckoutSession, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	session := &stripe.CheckoutSession{
+		ID:            f.nextID("cs"),
+		Object:        "checkout.session",
+		Created:       time.Now().Unix(),
+		Status:        stripe.CheckoutSessionStatusOpen,
+		PaymentStatus: stripe.CheckoutSessionPaymentStatusUnpaid,
+		Metadata:      params.Metadata,
+		TotalDetails:  &stripe.CheckoutSessionTotalDetails{},
+	}
+	session.URL = "https://checkout.stripe.test/" + session.ID
+	if params.Mode != nil {
+		session.Mode = stripe.CheckoutSessionMode(*params.Mode)
+	}
+	if params.CustomerEmail != nil {
+		session.CustomerEmail = *params.CustomerEmail
+	}
+
+	items := []*stripe.LineItem{}
+	for _, lp := range params.LineItems {
+		quantity := int64(1)
+		if lp.Quantity != nil {
+			quantity = *lp.Quantity
+		}
+
+		var price *stripe.Price
+		switch {
+		case lp.Price != nil:
+			price = f.prices[*lp.Price]
+			if price == nil {
+				return nil, fmt.Errorf("no such price: '%s'", *lp.Price)
+			}
+		case lp.PriceData != nil:
+			price = &stripe.Price{
+				ID:         f.nextID("price"),
+				Currency:   stripe.Currency(stripe.StringValue(lp.PriceData.Currency)),
+				UnitAmount: stripe.Int64Value(lp.PriceData.UnitAmount),
+				Product:    &stripe.Product{ID: f.nextID("prod")},
+			}
+			if lp.PriceData.ProductData != nil {
+				price.Product.Name = stripe.StringValue(lp.PriceData.ProductData.Name)
+			}
+		default:
+			return nil, fmt.Errorf("line item needs a price or price_data")
+		}
+
+		amount := price.UnitAmount * quantity
+		items = append(items, &stripe.LineItem{
+			ID:             f.nextID("li"),
+			Object:         "item",
+			Currency:       price.Currency,
+			Description:    price.Product.Name,
+			Price:          price,
+			Quantity:       quantity,
+			AmountSubtotal: amount,
+			AmountTotal:    amount,
+		})
+		session.Currency = price.Currency
+		session.AmountSubtotal += amount
+	}
+
+	for _, dp := range params.Discounts {
+		var coupon *stripe.Coupon
+		discount := &stripe.CheckoutSessionDiscount{}
+		if dp.PromotionCode != nil {
+			for _, promo := range f.promotionCodes {
+				if promo.ID == *dp.PromotionCode {
+					coupon = promo.Coupon
+					discount.PromotionCode = promo
+				}
+			}
+		} else if dp.Coupon != nil {
+			coupon = f.coupons[*dp.Coupon]
+		}
+		if coupon == nil {
+			return nil, fmt.Errorf("no such discount")
+		}
+		discount.Coupon = coupon
+		session.Discounts = append(session.Discounts, discount)
+		session.TotalDetails.AmountDiscount += discountAmount(coupon, discountableAmount(coupon, items)-session.TotalDetails.AmountDiscount)
+	}
+
+	// Spread the discount over the line items in order, as far as each goes
+	remaining := session.TotalDetails.AmountDiscount
+	for _, item := range items {
+		if !couponAppliesTo(session.Discounts, item) {
+			continue
+		}
+		off := remaining
+		if off > item.AmountSubtotal {
+			off = item.AmountSubtotal
+		}
+		item.AmountDiscount = off
+		item.AmountTotal = item.AmountSubtotal - off
+		remaining -= off
+	}
+
+	session.AmountTotal = session.AmountSubtotal - session.TotalDetails.AmountDiscount
+	f.sessions[session.ID] = session
+	f.lineItems[session.ID] = items
+	return copySession(session), nil
+}
+
+// discountableAmount is the part of the basket a coupon can take money off:
+// everything, unless the coupon is restricted to certain products.
+func discountableAmount(coupon *stripe.Coupon, items []*stripe.LineItem) int64 {
+	var amount int64
+	for _, item := range items {
+		if couponCovers(coupon, item) {
+			amount += item.AmountSubtotal
+		}
+	}
+	return amount
+}
+
+func couponCovers(coupon *stripe.Coupon, item *stripe.LineItem) bool {
+	if coupon.AppliesTo == nil || len(coupon.AppliesTo.Products) == 0 {
+		return true
+	}
+	for _, productID := range coupon.AppliesTo.Products {
+		if item.Price.Product != nil && item.Price.Product.ID == productID {
+			return true
+		}
+	}
+	return false
+}
+
+func couponAppliesTo(discounts []*stripe.CheckoutSessionDiscount, item *stripe.LineItem) bool {
+	for _, discount := range discounts {
+		if couponCovers(discount.Coupon, item) {
+			return true
+		}
+	}
+	return false
+}
+
+func discountAmount(coupon *stripe.Coupon, amount int64) int64 {
+	var off int64
+	if coupon.AmountOff > 0 {
+		off = coupon.AmountOff
+	} else if coupon.PercentOff > 0 {
+		off = int64(float64(amount)*coupon.PercentOff/100 + 0.5)
+	}
+	if off > amount {
+		off = amount
+	}
+	return off
+}
+
+// CompleteCheckoutSession pays a session as the customer would on the
+// Stripe hosted page, creating its payment intent and charge.
+func (f *Fake) CompleteCheckoutSession(sessionID, email string) (*stripe.CheckoutSession, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	session, ok := f.sessions[sessionID]
+	if !ok {
+		return nil, fmt.Errorf("no such checkout session: '%s'", sessionID)
+	}
+	if email == "" {
+		email = session.CustomerEmail
+	}
+
+	paymentIntent := &stripe.PaymentIntent{ID: f.nextID("pi")}
+	session.Status = stripe.CheckoutSessionStatusComplete
+	session.PaymentStatus = stripe.CheckoutSessionPaymentStatusPaid
+	session.CustomerDetails = &stripe.CheckoutSessionCustomerDetails{Email: email}
+	session.PaymentIntent = paymentIntent
+
+	if session.Mode == stripe.CheckoutSessionModeSubscription {
+		customer := &stripe.Customer{ID: f.nextID("cus"), Email: email}
+		subscription := &stripe.Subscription{
+			ID:       f.nextID("sub"),
+			Object:   "subscription",
+			Customer: customer,
+			Status:   stripe.SubscriptionStatusActive,
+			Items:    &stripe.SubscriptionItemList{},
+		}
+		periodEnd := time.Now().AddDate(0, 1, 0).Unix()
+		for _, item := range f.lineItems[sessionID] {
+			subscription.Items.Data = append(subscription.Items.Data, &stripe.SubscriptionItem{
+				ID:               f.nextID("si"),
+				Price:            item.Price,
+				Quantity:         item.Quantity,
+				CurrentPeriodEnd: periodEnd,
+			})
+		}
+		f.subscriptions[subscription.ID] = subscription
+		session.Customer = customer
+		session.Subscription = &stripe.Subscription{ID: subscription.ID}
+	}
+
+	charge := &stripe.Charge{
+		ID:            f.nextID("ch"),
+		Object:        "charge",
+		Amount:        session.AmountTotal,
+		Currency:      session.Currency,
+		Paid:          true,
+		Status:        stripe.ChargeStatusSucceeded,
+		PaymentIntent: paymentIntent,
+	}
+	f.charges[charge.ID] = charge
+	return copySession(session), nil
+}
+
+// ChargeForSession returns the charge created when a session was completed.
+func (f *Fake) ChargeForSession(sessionID string) (*stripe.Charge, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	session, ok := f.sessions[sessionID]
+	if !ok || session.PaymentIntent == nil {
+		return nil, fmt.Errorf("checkout session '%s' has not been paid", sessionID)
+	}
+	for _, charge := range f.charges {
+		if charge.PaymentIntent != nil && charge.PaymentIntent.ID == session.PaymentIntent.ID {
+			c := *charge
+			return &c, nil
+		}
+	}
+	return nil, fmt.Errorf("no charge for checkout session '%s'", sessionID)
+}
+
+// RefundCharge refunds amount of a charge, or all of it when amount is 0.
+func (f *Fake) RefundCharge(chargeID string, amount int64) (*stripe.Charge, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	charge, ok := f.charges[chargeID]
+	if !ok {
+		return nil, fmt.Errorf("no such charge: '%s'", chargeID)
+	}
+	if amount == 0 || charge.AmountRefunded+amount >= charge.Amount {
+		charge.AmountRefunded = charge.Amount
+		charge.Refunded = true
+	} else {
+		charge.AmountRefunded += amount
+	}
+	c := *charge
+	return &c, nil
+}
+
+func (f *Fake) GetCheckoutSession(sessionID string) (*stripe.CheckoutSession, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	session, ok := f.sessions[sessionID]
+	if !ok {
+		return nil, fmt.Errorf("no such checkout session: '%s'", sessionID)
+	}
+	return copySession(session), nil
+}
+
+func (f *Fake) FindCheckoutSessionByPaymentIntent(paymentIntentID string) (*stripe.CheckoutSession, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, session := range f.sessions {
+		if session.PaymentIntent != nil && session.PaymentIntent.ID == paymentIntentID {
+			return copySession(session), nil
+		}
+	}
+	return nil, nil
+}
+
+func (f *Fake) ListCompletedCheckoutSessions(from, to time.Time) ([]*stripe.CheckoutSession, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sessions := []*stripe.CheckoutSession{}
+	for _, session := range f.sessions {
+		if session.Status == stripe.CheckoutSessionStatusComplete &&
+			session.Created >= from.Unix() && session.Created < to.Unix() {
+			sessions = append(sessions, copySession(session))
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].Created == sessions[j].Created {
+			return sessions[i].ID < sessions[j].ID
+		}
+		return sessions[i].Created < sessions[j].Created
+	})
+	return sessions, nil
+}
+
+func (f *Fake) ListLineItems(sessionID string) ([]*stripe.LineItem, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	items, ok := f.lineItems[sessionID]
+	if !ok {
+		return nil, fmt.Errorf("no such checkout session: '%s'", sessionID)
+	}
+	copied := make([]*stripe.LineItem, len(items))
+	for i, item := range items {
+		li := *item
+		copied[i] = &li
+	}
+	return copied, nil
+}
+
+func (f *Fake) GetPrice(priceID string) (*stripe.Price, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	price, ok := f.prices[priceID]
+	if !ok {
+		return nil, fmt.Errorf("no such price: '%s'", priceID)
+	}
+	p := *price
+	return &p, nil
+}
+
+func (f *Fake) GetCharge(chargeID string) (*stripe.Charge, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	charge, ok := f.charges[chargeID]
+	if !ok {
+		return nil, fmt.Errorf("no such charge: '%s'", chargeID)
+	}
+	c := *charge
+	return &c, nil
+}
+
+func (f *Fake) GetCoupon(couponID string) (*stripe.Coupon, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	coupon, ok := f.coupons[couponID]
+	if !ok {
+		return nil, fmt.Errorf("no such coupon: '%s'", couponID)
+	}
+	c := *coupon
+	return &c, nil
+}
+
+func (f *Fake) FindPromotionCode(code string) (*stripe.PromotionCode, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	promo, ok := f.promotionCodes[strings.ToLower(code)]
+	if !ok {
+		return nil, nil
+	}
+	p := *promo
+	return &p, nil
+}
+
+func (f *Fake) CreateCoupon(params *stripe.CouponParams) (*stripe.Coupon, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	coupon := &stripe.Coupon{
+		ID:        f.nextID("coupon"),
+		Name:      stripe.StringValue(params.Name),
+		AmountOff: stripe.Int64Value(params.AmountOff),
+		Currency:  stripe.Currency(stripe.StringValue(params.Currency)),
+		Duration:  stripe.CouponDuration(stripe.StringValue(params.Duration)),
+		Metadata:  params.Metadata,
+		Valid:     true,
+	}
+	if params.PercentOff != nil {
+		coupon.PercentOff = *params.PercentOff
+	}
+	if params.AmountOff == nil && params.PercentOff == nil {
+		return nil, fmt.Errorf("coupon needs amount_off or percent_off")
+	}
+	if params.AppliesTo != nil {
+		coupon.AppliesTo = &stripe.CouponAppliesTo{}
+		for _, productID := range params.AppliesTo.Products {
+			coupon.AppliesTo.Products = append(coupon.AppliesTo.Products, stripe.StringValue(productID))
+		}
+	}
+	f.coupons[coupon.ID] = coupon
+	return coupon, nil
+}
+
+func (f *Fake) CreatePromotionCode(params *stripe.PromotionCodeParams) (*stripe.PromotionCode, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	code := stripe.StringValue(params.Code)
+	if existing, ok := f.promotionCodes[strings.ToLower(code)]; ok && existing.Active {
+		return nil, fmt.Errorf("an active promotion code with code: %s already exists", code)
+	}
+	coupon, ok := f.coupons[stripe.StringValue(params.Coupon)]
+	if !ok {
+		return nil, fmt.Errorf("no such coupon: '%s'", stripe.StringValue(params.Coupon))
+	}
+
+	promo := &stripe.PromotionCode{
+		ID:             f.nextID("promo"),
+		Code:           code,
+		Active:         true,
+		Coupon:         coupon,
+		ExpiresAt:      stripe.Int64Value(params.ExpiresAt),
+		MaxRedemptions: stripe.Int64Value(params.MaxRedemptions),
+	}
+	f.promotionCodes[strings.ToLower(code)] = promo
+	return promo, nil
+}
+
+func (f *Fake) DeactivatePromotionCode(promotionCodeID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, promo := range f.promotionCodes {
+		if promo.ID == promotionCodeID {
+			promo.Active = false
+			return nil
+		}
+	}
+	return fmt.Errorf("no such promotion code: '%s'", promotionCodeID)
+}
+
+// UpdateSubscription changes a subscription's status and, when periodEnd
+// is not zero, the end of its current period. The updated subscription is
+// returned for use in a customer.subscription.* event.
+func (f *Fake) UpdateSubscription(subscriptionID string, status stripe.SubscriptionStatus, periodEnd time.Time) (*stripe.Subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	subscription, ok := f.subscriptions[subscriptionID]
+	if !ok {
+		return nil, fmt.Errorf("no such subscription: '%s'", subscriptionID)
+	}
+	subscription.Status = status
+	if status == stripe.SubscriptionStatusCanceled {
+		subscription.CanceledAt = time.Now().Unix()
+		subscription.EndedAt = time.Now().Unix()
+	}
+	if !periodEnd.IsZero() {
+		for _, item := range subscription.Items.Data {
+			item.CurrentPeriodEnd = periodEnd.Unix()
+		}
+	}
+	return copySubscription(subscription), nil
+}
+
+func (f *Fake) GetSubscription(subscriptionID string) (*stripe.Subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	subscription, ok := f.subscriptions[subscriptionID]
+	if !ok {
+		return nil, fmt.Errorf("no such subscription: '%s'", subscriptionID)
+	}
+	return copySubscription(subscription), nil
+}
+
+func (f *Fake) CreateBillingPortalSession(customerID string, returnURL string) (*stripe.BillingPortalSession, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id := f.nextID("bps")
+	return &stripe.BillingPortalSession{
+		ID:        id,
+		Customer:  customerID,
+		ReturnURL: returnURL,
+		URL:       "https://billing.stripe.test/" + id,
+	}, nil
+}
+
+func (f *Fake) ConstructEvent(payload []byte, signature string, secret string) (stripe.Event, error) {
+	return webhook.ConstructEvent(payload, signature, secret)
+}
+
+// SignedEvent builds a webhook payload for object and signs it with
+// WebhookSecret. The result can be posted to the webhook endpoint with the
+// signature in the Stripe-Signature header.
+func (f *Fake) SignedEvent(eventType string, object interface{}) (payload []byte, signature string, err error) {
+	raw, err := json.Marshal(object)
+	if err != nil {
+		return nil, "", err
+	}
+
+	f.mu.Lock()
+	eventID := f.nextID("evt")
+	f.mu.Unlock()
+
+	event := stripe.Event{
+		ID:         eventID,
+		Object:     "event",
+		APIVersion: stripe.APIVersion,
+		Created:    time.Now().Unix(),
+		Type:       stripe.EventType(eventType),
+		Data:       &stripe.EventData{Raw: raw},
+	}
+	payload, err = json.Marshal(event)
+	if err != nil {
+		return nil, "", err
+	}
+
+	signed := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{
+		Payload:   payload,
+		Secret:    f.WebhookSecret,
+		Timestamp: time.Now(),
+	})
+	return signed.Payload, signed.Header, nil
+}
+
+func copySubscription(subscription *stripe.Subscription) *stripe.Subscription {
+	s := *subscription
+	items := &stripe.SubscriptionItemList{}
+	for _, item := range subscription.Items.Data {
+		i := *item
+		items.Data = append(items.Data, &i)
+	}
+	s.Items = items
+	return &s
+}
+
+func copySession(session *stripe.CheckoutSession) *stripe.CheckoutSession {
+	s := *session
+	return &s
+}
+
+var _ PaymentGateway = (*Fake)(nil)
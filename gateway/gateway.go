@@ -0,0 +1,45 @@
+// Package gateway hides the payment provider behind an interface so the
+// purchase flow can run against Stripe in production and an in-memory fake
+// in tests.
+package gateway
+
+import (
+	"time"
+
+	"github.com/stripe/stripe-go/v82"
+)
+
+// PaymentGateway is the subset of Stripe the backend depends on. Stripe's
+// own types are used for requests and responses so handlers read the same
+// either way.
+type PaymentGateway interface {
+	CreateCheckoutSession(params *stripe.CheckoutSessionParams) (*stripe.CheckoutSession, error)
+	// GetCheckoutSession returns a session with its discounts' promotion
+	// codes expanded.
+	GetCheckoutSession(sessionID string) (*stripe.CheckoutSession, error)
+	// FindCheckoutSessionByPaymentIntent returns nil when no session created
+	// the payment intent.
+	FindCheckoutSessionByPaymentIntent(paymentIntentID string) (*stripe.CheckoutSession, error)
+	// ListCompletedCheckoutSessions returns the sessions created in
+	// [from, to) that the customer finished, oldest first.
+	ListCompletedCheckoutSessions(from, to time.Time) ([]*stripe.CheckoutSession, error)
+	// ListLineItems returns every line item of a session with the price's
+	// product expanded.
+	ListLineItems(sessionID string) ([]*stripe.LineItem, error)
+	GetPrice(priceID string) (*stripe.Price, error)
+	GetCharge(chargeID string) (*stripe.Charge, error)
+	GetCoupon(couponID string) (*stripe.Coupon, error)
+	// FindPromotionCode matches a customer facing code case-insensitively
+	// and returns nil when there is no such code. The coupon is expanded.
+	FindPromotionCode(code string) (*stripe.PromotionCode, error)
+	CreateCoupon(params *stripe.CouponParams) (*stripe.Coupon, error)
+	CreatePromotionCode(params *stripe.PromotionCodeParams) (*stripe.PromotionCode, error)
+	DeactivatePromotionCode(promotionCodeID string) error
+	// GetSubscription returns a subscription with its items.
+	GetSubscription(subscriptionID string) (*stripe.Subscription, error)
+	// CreateBillingPortalSession opens the Stripe hosted page where a
+	// customer manages their subscriptions and payment methods.
+	CreateBillingPortalSession(customerID string, returnURL string) (*stripe.BillingPortalSession, error)
+	// ConstructEvent verifies a webhook signature and parses the event.
+	ConstructEvent(payload []byte, signature string, secret string) (stripe.Event, error)
+}
@@ -0,0 +1,141 @@
+package gateway
+
+import (
+	"strings"
+	"time"
+
+	"github.com/stripe/stripe-go/v82"
+	"github.com/stripe/stripe-go/v82/client"
+	"github.com/stripe/stripe-go/v82/webhook"
+)
+
+// StripeGateway talks to the real Stripe API.
+type StripeGateway struct {
+	Client *client.API
+}
+
+func NewStripeGateway(secretKey string) *StripeGateway {
+	sc := &client.API{}
+	sc.Init(secretKey, nil)
+	return &StripeGateway{Client: sc}
+}
+
+func (g *StripeGateway) CreateCheckoutSession(params *stripe.CheckoutSessionParams) (*stripe.CheckoutSession, error) {
+	return g.Client.CheckoutSessions.New(params)
+}
+
+func (g *StripeGateway) GetCheckoutSession(sessionID string) (*stripe.CheckoutSession, error) {
+	params := &stripe.CheckoutSessionParams{}
+	params.AddExpand("discounts.promotion_code")
+	return g.Client.CheckoutSessions.Get(sessionID, params)
+}
+
+func (g *StripeGateway) FindCheckoutSessionByPaymentIntent(paymentIntentID string) (*stripe.CheckoutSession, error) {
+	params := &stripe.CheckoutSessionListParams{PaymentIntent: stripe.String(paymentIntentID)}
+	iter := g.Client.CheckoutSessions.List(params)
+
+	var checkoutSession *stripe.CheckoutSession
+	if iter.Next() {
+		checkoutSession = iter.CheckoutSession()
+	}
+	return checkoutSession, iter.Err()
+}
+
+func (g *StripeGateway) ListCompletedCheckoutSessions(from, to time.Time) ([]*stripe.CheckoutSession, error) {
+	params := &stripe.CheckoutSessionListParams{
+		CreatedRange: &stripe.RangeQueryParams{
+			GreaterThanOrEqual: from.Unix(),
+			LesserThan:         to.Unix(),
+		},
+		Status: stripe.String(string(stripe.CheckoutSessionStatusComplete)),
+	}
+	iter := g.Client.CheckoutSessions.List(params)
+
+	sessions := []*stripe.CheckoutSession{}
+	for iter.Next() {
+		sessions = append(sessions, iter.CheckoutSession())
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	// Stripe lists newest first
+	for i, j := 0, len(sessions)-1; i < j; i, j = i+1, j-1 {
+		sessions[i], sessions[j] = sessions[j], sessions[i]
+	}
+	return sessions, nil
+}
+
+func (g *StripeGateway) ListLineItems(sessionID string) ([]*stripe.LineItem, error) {
+	params := &stripe.CheckoutSessionListLineItemsParams{
+		Session: stripe.String(sessionID),
+	}
+	params.Expand = []*string{stripe.String("data.price.product")}
+	iter := g.Client.CheckoutSessions.ListLineItems(params)
+
+	lineItems := []*stripe.LineItem{}
+	for iter.Next() {
+		lineItems = append(lineItems, iter.LineItem())
+	}
+	return lineItems, iter.Err()
+}
+
+func (g *StripeGateway) GetPrice(priceID string) (*stripe.Price, error) {
+	return g.Client.Prices.Get(priceID, nil)
+}
+
+func (g *StripeGateway) GetCharge(chargeID string) (*stripe.Charge, error) {
+	return g.Client.Charges.Get(chargeID, nil)
+}
+
+func (g *StripeGateway) GetCoupon(couponID string) (*stripe.Coupon, error) {
+	return g.Client.Coupons.Get(couponID, nil)
+}
+
+func (g *StripeGateway) FindPromotionCode(code string) (*stripe.PromotionCode, error) {
+	params := &stripe.PromotionCodeListParams{
+		Code: stripe.String(code),
+	}
+	params.AddExpand("data.coupon")
+	iter := g.Client.PromotionCodes.List(params)
+
+	for iter.Next() {
+		promo := iter.PromotionCode()
+		if strings.EqualFold(promo.Code, code) {
+			return promo, nil
+		}
+	}
+	return nil, iter.Err()
+}
+
+func (g *StripeGateway) CreateCoupon(params *stripe.CouponParams) (*stripe.Coupon, error) {
+	return g.Client.Coupons.New(params)
+}
+
+func (g *StripeGateway) CreatePromotionCode(params *stripe.PromotionCodeParams) (*stripe.PromotionCode, error) {
+	return g.Client.PromotionCodes.New(params)
+}
+
+func (g *StripeGateway) DeactivatePromotionCode(promotionCodeID string) error {
+	_, err := g.Client.PromotionCodes.Update(promotionCodeID, &stripe.PromotionCodeParams{
+		Active: stripe.Bool(false),
+	})
+	return err
+}
+
+func (g *StripeGateway) GetSubscription(subscriptionID string) (*stripe.Subscription, error) {
+	return g.Client.Subscriptions.Get(subscriptionID, nil)
+}
+
+func (g *StripeGateway) CreateBillingPortalSession(customerID string, returnURL string) (*stripe.BillingPortalSession, error) {
+	params := &stripe.BillingPortalSessionParams{
+		Customer:  stripe.String(customerID),
+		ReturnURL: stripe.String(returnURL),
+	}
+	return g.Client.BillingPortalSessions.New(params)
+}
+
+func (g *StripeGateway) ConstructEvent(payload []byte, signature string, secret string) (stripe.Event, error) {
+	return webhook.ConstructEvent(payload, signature, secret)
+}
+
+var _ PaymentGateway = (*StripeGateway)(nil)
@@ -0,0 +1,214 @@
+// Package lockout slows down and then blocks repeated failed attempts at
+// logging in or resetting a password. Failures are counted per account and
+// per client IP in a Store: Postgres in production, memory in tests.
+package lockout
+
+import (
+	"strings"
+	"time"
+)
+
+// What is being attempted. Each scope keeps its own counts, so strangers
+// asking for password resets cannot lock an account out of logging in.
+const (
+	ScopeLogin        = "login"
+	ScopeResetRequest = "reset-request"
+	ScopeResetToken   = "reset-token"
+	ScopeMFA          = "mfa"
+)
+
+var scopes = []string{ScopeLogin, ScopeResetRequest, ScopeResetToken, ScopeMFA}
+
+// Policy sets how hard a key is throttled as its failures add up.
+type Policy struct {
+	// Window is how long since the last failure before the count starts
+	// again
+	Window time.Duration
+	// DelayAfter failures, each attempt must wait BaseDelay, doubling with
+	// every further failure up to MaxDelay
+	DelayAfter int
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+	// LockAfter failures the key is refused outright for LockDuration
+	LockAfter    int
+	LockDuration time.Duration
+	// NotifyAfter failures the account holder is emailed. Zero never emails.
+	NotifyAfter int
+}
+
+// DefaultAccountPolicy applies to a single email address.
+var DefaultAccountPolicy = Policy{
+	Window:       time.Hour,
+	DelayAfter:   3,
+	BaseDelay:    time.Second,
+	MaxDelay:     30 * time.Second,
+	LockAfter:    10,
+	LockDuration: 15 * time.Minute,
+	NotifyAfter:  5,
+}
+
+// DefaultIPPolicy applies to a client IP. It is looser than the account
+// policy because many people can share an address.
+var DefaultIPPolicy = Policy{
+	Window:       time.Hour,
+	DelayAfter:   10,
+	BaseDelay:    time.Second,
+	MaxDelay:     time.Minute,
+	LockAfter:    50,
+	LockDuration: time.Hour,
+}
+
+// delay is how long after the last of failures the next attempt may come.
+func (p Policy) delay(failures int) time.Duration {
+	if p.DelayAfter <= 0 || failures < p.DelayAfter {
+		return 0
+	}
+	delay := p.BaseDelay
+	for i := p.DelayAfter; i < failures && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay
+}
+
+// Limiter applies the account and IP policies to attempts in each scope.
+type Limiter struct {
+	Store   Store
+	Account Policy
+	IP      Policy
+	Now     func() time.Time
+}
+
+func New(store Store) *Limiter {
+	return &Limiter{
+		Store:   store,
+		Account: DefaultAccountPolicy,
+		IP:      DefaultIPPolicy,
+		Now:     time.Now,
+	}
+}
+
+// Failure describes the account after a failed attempt.
+type Failure struct {
+	Failures int
+	// Locked is set on the failure that locked the account
+	Locked      bool
+	LockedUntil time.Time
+	// Notify is set when the account holder should be told
+	Notify bool
+}
+
+func accountKey(scope, account string) string {
+	return scope + ":account:" + strings.ToLower(strings.TrimSpace(account))
+}
+
+func ipKey(scope, ip string) string {
+	return scope + ":ip:" + ip
+}
+
+// keys skips an empty account or IP, e.g. reset tokens belong to no known
+// account.
+func keys(scope, account, ip string) []string {
+	var ks []string
+	if account != "" {
+		ks = append(ks, accountKey(scope, account))
+	}
+	if ip != "" {
+		ks = append(ks, ipKey(scope, ip))
+	}
+	return ks
+}
+
+func (l *Limiter) policy(key string) Policy {
+	if strings.Contains(key, ":ip:") {
+		return l.IP
+	}
+	return l.Account
+}
+
+// Wait returns how long the caller must wait before attempting again, or
+// zero when the attempt may go ahead.
+func (l *Limiter) Wait(scope, account, ip string) (time.Duration, error) {
+	now := l.Now()
+	var wait time.Duration
+	for _, key := range keys(scope, account, ip) {
+		record, err := l.Store.Get(key)
+		if err != nil {
+			return 0, err
+		}
+		if record.Failures == 0 {
+			continue
+		}
+		policy := l.policy(key)
+		if now.Sub(record.LastFailureAt) > policy.Window && now.After(record.LockedUntil) {
+			continue
+		}
+		if until := record.LockedUntil.Sub(now); until > wait {
+			wait = until
+		}
+		if until := record.LastFailureAt.Add(policy.delay(record.Failures)).Sub(now); until > wait {
+			wait = until
+		}
+	}
+	return wait, nil
+}
+
+// Fail counts a failed attempt against the account and the IP, locking
+// either once it reaches its policy's limit.
+func (l *Limiter) Fail(scope, account, ip string) (Failure, error) {
+	now := l.Now()
+	var failure Failure
+	for _, key := range keys(scope, account, ip) {
+		policy := l.policy(key)
+		record, err := l.Store.AddFailure(key, now, policy.Window)
+		if err != nil {
+			return failure, err
+		}
+		locked := false
+		if policy.LockAfter > 0 && record.Failures >= policy.LockAfter && !now.Before(record.LockedUntil) {
+			record.LockedUntil = now.Add(policy.LockDuration)
+			if err := l.Store.Lock(key, record.LockedUntil); err != nil {
+				return failure, err
+			}
+			locked = true
+		}
+		if account != "" && key == accountKey(scope, account) {
+			failure = Failure{
+				Failures:    record.Failures,
+				Locked:      locked,
+				LockedUntil: record.LockedUntil,
+				Notify:      locked || (policy.NotifyAfter > 0 && record.Failures == policy.NotifyAfter),
+			}
+		}
+	}
+	return failure, nil
+}
+
+// Succeed clears the account's failures after a successful attempt. The IP
+// count is left alone so an attacker can't reset it by logging into their
+// own account.
+func (l *Limiter) Succeed(scope, account string) error {
+	return l.Store.Reset(accountKey(scope, account))
+}
+
+// Unlock clears an account's failures and locks in every scope.
+func (l *Limiter) Unlock(account string) error {
+	for _, scope := range scopes {
+		if err := l.Store.Reset(accountKey(scope, account)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LockedUntil reports when an account's login lock ends, or the zero time
+// when it isn't locked.
+func (l *Limiter) LockedUntil(account string) (time.Time, error) {
+	record, err := l.Store.Get(accountKey(ScopeLogin, account))
+	if err != nil || !l.Now().Before(record.LockedUntil) {
+		return time.Time{}, err
+	}
+	return record.LockedUntil, nil
+}
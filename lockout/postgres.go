@@ -0,0 +1,64 @@
+package lockout
+
+import (
+	"errors"
+	"time"
+
+	"github.com/88warren/lmw-fitness-backend/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// PostgresStore keeps counts in the login_attempts table so every replica
+// sees the same failures and they survive a restart.
+type PostgresStore struct {
+	DB *gorm.DB
+}
+
+func NewPostgresStore(db *gorm.DB) *PostgresStore {
+	return &PostgresStore{DB: db}
+}
+
+func (s *PostgresStore) Get(key string) (Record, error) {
+	var attempt models.LoginAttempt
+	err := s.DB.Where("key = ?", key).First(&attempt).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return Record{}, nil
+	}
+	if err != nil {
+		return Record{}, err
+	}
+	return toRecord(attempt), nil
+}
+
+func (s *PostgresStore) AddFailure(key string, now time.Time, window time.Duration) (Record, error) {
+	attempt := models.LoginAttempt{Key: key, Failures: 1, LastFailureAt: now}
+	err := s.DB.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "key"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"failures":        gorm.Expr("CASE WHEN login_attempts.last_failure_at < ? THEN 1 ELSE login_attempts.failures + 1 END", now.Add(-window)),
+			"last_failure_at": now,
+			"updated_at":      now,
+		}),
+	}).Create(&attempt).Error
+	if err != nil {
+		return Record{}, err
+	}
+	return s.Get(key)
+}
+
+func (s *PostgresStore) Lock(key string, until time.Time) error {
+	return s.DB.Model(&models.LoginAttempt{}).Where("key = ?", key).Update("locked_until", until).Error
+}
+
+func (s *PostgresStore) Reset(key string) error {
+	return s.DB.Where("key = ?", key).Delete(&models.LoginAttempt{}).Error
+}
+
+func toRecord(attempt models.LoginAttempt) Record {
+	record := Record{Failures: attempt.Failures, LastFailureAt: attempt.LastFailureAt}
+	if attempt.LockedUntil != nil {
+		record.LockedUntil = *attempt.LockedUntil
+	}
+	return record
+}
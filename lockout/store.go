@@ -0,0 +1,84 @@
+package lockout
+
+import (
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Record is the failure history of one key.
+type Record struct {
+	Failures      int
+	LastFailureAt time.Time
+	LockedUntil   time.Time
+}
+
+// Store keeps failure counts. Keys look like "login:account:a@b.com" or
+// "login:ip:203.0.113.7".
+type Store interface {
+	// Get returns the zero Record for a key with no failures.
+	Get(key string) (Record, error)
+	// AddFailure counts a failure at now and returns the updated record.
+	// When the last failure is more than window old the count restarts.
+	// Concurrent calls for one key must all be counted.
+	AddFailure(key string, now time.Time, window time.Duration) (Record, error)
+	Lock(key string, until time.Time) error
+	// Reset forgets the key's failures and any lock.
+	Reset(key string) error
+}
+
+// NewStore returns the Postgres store, or a memory store when there is no
+// database.
+func NewStore(db *gorm.DB) Store {
+	if db == nil {
+		return NewMemoryStore()
+	}
+	return NewPostgresStore(db)
+}
+
+// MemoryStore keeps counts in the process. It is meant for tests; counts are
+// lost on restart and not shared between replicas.
+type MemoryStore struct {
+	mu      sync.Mutex
+	records map[string]Record
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{records: map[string]Record{}}
+}
+
+func (s *MemoryStore) Get(key string) (Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.records[key], nil
+}
+
+func (s *MemoryStore) AddFailure(key string, now time.Time, window time.Duration) (Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record := s.records[key]
+	if now.Sub(record.LastFailureAt) > window {
+		record.Failures = 0
+	}
+	record.Failures++
+	record.LastFailureAt = now
+	s.records[key] = record
+	return record, nil
+}
+
+func (s *MemoryStore) Lock(key string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record := s.records[key]
+	record.LockedUntil = until
+	s.records[key] = record
+	return nil
+}
+
+func (s *MemoryStore) Reset(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, key)
+	return nil
+}
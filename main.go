@@ -6,6 +6,7 @@ import (
 
 	"github.com/88warren/lmw-fitness-backend/config"
 	"github.com/88warren/lmw-fitness-backend/database"
+	"github.com/88warren/lmw-fitness-backend/utils/auth"
 	"go.uber.org/zap"
 )
 
@@ -18,6 +19,16 @@ func main() {
 	database.InitLogger()
 	defer database.SyncLogger()
 
+	if len(os.Args) > 1 && os.Args[1] == "reconcile" {
+		code := runReconcile(os.Args[2:])
+		database.SyncLogger()
+		os.Exit(code)
+	}
+
+	if err := auth.Init(); err != nil {
+		log.Fatalf("Refusing to start: %v", err)
+	}
+
 	// Debug: Print environment variables
 	log.Printf("GO_ENV: %s", os.Getenv("GO_ENV"))
 	log.Printf("ALLOWED_ORIGIN: %s", os.Getenv("ALLOWED_ORIGIN"))
@@ -26,6 +37,9 @@ func main() {
 	database.ConnectToDB()
 	database.MigrateDB()
 	db := database.GetDB()
+	database.ProductSeed(db)
+	database.PromotionSeed(db)
+	database.RoleSeed(db)
 
 	router := config.SetupServer()
 
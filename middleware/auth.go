@@ -1,16 +1,34 @@
 package middleware
 
 import (
+	"errors"
 	"log"
 	"net/http"
-	"os"
 	"strings"
+	"time"
 
+	"github.com/88warren/lmw-fitness-backend/database"
+	"github.com/88warren/lmw-fitness-backend/models"
+	"github.com/88warren/lmw-fitness-backend/rbac"
+	"github.com/88warren/lmw-fitness-backend/utils/auth"
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
 )
 
-func AuthMiddleware() gin.HandlerFunc {
+type authOptions struct {
+	allowAPIKeys bool
+}
+
+type AuthOption func(*authOptions)
+
+// AuthMiddleware signs the request in from a Bearer access token. API keys
+// are refused unless the route opts in with AllowAPIKeys.
+func AuthMiddleware(opts ...AuthOption) gin.HandlerFunc {
+	var options authOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
 	return func(ctx *gin.Context) {
 		tokenString := ctx.GetHeader("Authorization")
 		if tokenString == "" {
@@ -25,20 +43,19 @@ func AuthMiddleware() gin.HandlerFunc {
 		}
 
 		tokenString = strings.TrimPrefix(tokenString, "Bearer ")
-
-		jwtSecret := os.Getenv("JWT_SECRET")
-		if jwtSecret == "" {
-			// log.Println("JWT_SECRET environment variable not set. Using a default (NOT SECURE FOR PRODUCTION!).")
-			jwtSecret = "supersecretjwtkey"
-		}
-
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, jwt.ErrSignatureInvalid
+		if auth.IsAPIKey(tokenString) {
+			if !options.allowAPIKeys {
+				ctx.JSON(http.StatusForbidden, gin.H{"error": "API keys can't be used here"})
+				ctx.Abort()
+				return
 			}
-			return []byte(jwtSecret), nil
-		})
+			if authenticateAPIKey(ctx, tokenString) {
+				ctx.Next()
+			}
+			return
+		}
 
+		claims, err := auth.ParseAccessToken(tokenString)
 		if err != nil {
 			log.Printf("Token validation error: %v", err)
 			ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
@@ -46,65 +63,185 @@ func AuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
-		if !token.Valid {
-			ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+		session, active := activeSession(claims.SessionID)
+		if !active {
+			ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Your session has ended. Please log in again."})
 			ctx.Abort()
 			return
 		}
+		if session != nil && session.MFAVerifiedAt != nil {
+			ctx.Set("mfaVerifiedAt", *session.MFAVerifiedAt)
+		}
 
-		claims, ok := token.Claims.(jwt.MapClaims)
-		if !ok || !token.Valid {
-			ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token claims"})
-			ctx.Abort()
-			return
+		ctx.Set("userID", claims.UserID)
+		ctx.Set("userEmail", claims.Email)
+		ctx.Set("userRole", claims.Role)
+		ctx.Set("sessionID", claims.SessionID)
+
+		ctx.Next()
+	}
+}
+
+// activeSession checks the session behind an access token hasn't been
+// revoked, so signing a device out takes effect before its token expires.
+// The session is nil when there is no database to check.
+func activeSession(sessionID uint) (*models.UserSession, bool) {
+	db := database.GetDB()
+	if db == nil {
+		return nil, true
+	}
+	var session models.UserSession
+	if err := db.Select("id", "revoked_at", "mfa_verified_at").First(&session, sessionID).Error; err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Printf("Error checking session %d: %v", sessionID, err)
 		}
+		return nil, false
+	}
+	return &session, session.RevokedAt == nil
+}
 
-		userID, ok := claims["user_id"].(float64)
-		if !ok {
-			ctx.JSON(http.StatusUnauthorized, gin.H{"error": "User ID not found in token"})
-			ctx.Abort()
+// RequireVerifiedEmail keeps accounts that haven't confirmed their email
+// away from sensitive actions. It must come after AuthMiddleware.
+func RequireVerifiedEmail() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		db := database.GetDB()
+		if db == nil {
+			ctx.Next()
 			return
 		}
-		email, ok := claims["email"].(string)
-		if !ok {
-			ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Email not found in token"})
+		var user models.User
+		if err := db.Select("id", "email_verified_at").First(&user, ctx.GetUint("userID")).Error; err != nil {
+			log.Printf("Error checking email verification for user %d: %v", ctx.GetUint("userID"), err)
+			ctx.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
 			ctx.Abort()
 			return
 		}
-		role, ok := claims["role"].(string)
-		if !ok {
-			ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Role not found in token"})
+		if !user.EmailVerified() {
+			ctx.JSON(http.StatusForbidden, gin.H{
+				"error": "Please verify your email address first",
+				"code":  "email_unverified",
+			})
 			ctx.Abort()
 			return
 		}
+		ctx.Next()
+	}
+}
 
-		ctx.Set("userID", uint(userID))
-		ctx.Set("userEmail", email)
-		ctx.Set("userRole", role)
+// permissionsFor resolves the user's permissions once per request. The
+// role is read from the database rather than the token, so a demotion
+// applies before the token expires.
+func permissionsFor(ctx *gin.Context) (rbac.Set, bool) {
+	if cached, ok := ctx.Get("permissions"); ok {
+		return cached.(rbac.Set), true
+	}
 
-		ctx.Next()
+	role := ctx.GetString("userRole")
+	db := database.GetDB()
+	if db != nil {
+		var user models.User
+		if err := db.Select("id", "role").First(&user, ctx.GetUint("userID")).Error; err != nil {
+			log.Printf("Error loading role of user %d: %v", ctx.GetUint("userID"), err)
+			ctx.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+			ctx.Abort()
+			return nil, false
+		}
+		role = user.Role
+	}
+
+	permissions, err := rbac.Permissions(db, role)
+	if err != nil {
+		log.Printf("Error loading permissions of role %q: %v", role, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check permissions"})
+		ctx.Abort()
+		return nil, false
 	}
+	ctx.Set("permissions", permissions)
+	return permissions, true
 }
 
-func RoleMiddleware(requiredRole string) gin.HandlerFunc {
+// RequirePermission only lets through users whose role has every one of
+// permissions. It must come after AuthMiddleware.
+func RequirePermission(permissions ...string) gin.HandlerFunc {
 	return func(ctx *gin.Context) {
-		userRole, exists := ctx.Get("userRole")
-		if !exists {
-			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "User role not found in context. AuthMiddleware might be missing."})
-			ctx.Abort()
+		granted, ok := permissionsFor(ctx)
+		if !ok {
 			return
 		}
+		for _, permission := range permissions {
+			if !granted.Has(permission) {
+				ctx.JSON(http.StatusForbidden, gin.H{
+					"error":      "Forbidden: you don't have permission to do this",
+					"permission": permission,
+				})
+				ctx.Abort()
+				return
+			}
+		}
+		ctx.Next()
+	}
+}
 
-		if userRole != requiredRole {
+// StaffMiddleware guards the admin API as a whole: it lets through users
+// with at least one permission, leaving RequirePermission on each route to
+// decide the rest. RequireRecentMFA also holds staff to a recent two-factor
+// check.
+func StaffMiddleware(opts ...AdminOption) gin.HandlerFunc {
+	var options adminOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	return func(ctx *gin.Context) {
+		granted, ok := permissionsFor(ctx)
+		if !ok {
+			return
+		}
+		if len(granted) == 0 {
 			ctx.JSON(http.StatusForbidden, gin.H{"error": "Forbidden: Insufficient role permissions"})
 			ctx.Abort()
 			return
 		}
-
+		if !recentMFA(ctx, options) {
+			return
+		}
 		ctx.Next()
 	}
 }
 
-func AdminMiddleware() gin.HandlerFunc {
-	return RoleMiddleware("admin")
+type adminOptions struct {
+	mfaMaxAge time.Duration
+}
+
+type AdminOption func(*adminOptions)
+
+// RequireRecentMFA only lets staff through whose session passed a
+// two-factor check within maxAge. Others get 403 with code
+// "mfa_required" and can re-verify at /api/2fa/verify.
+func RequireRecentMFA(maxAge time.Duration) AdminOption {
+	return func(o *adminOptions) {
+		o.mfaMaxAge = maxAge
+	}
+}
+
+// recentMFA enforces RequireRecentMFA, aborting the request when the
+// session's last two-factor check is missing or too old.
+func recentMFA(ctx *gin.Context, options adminOptions) bool {
+	if options.mfaMaxAge <= 0 {
+		return true
+	}
+	// API keys have no session to check; creating one was held to this check
+	if _, viaKey := ctx.Get("apiKeyID"); viaKey {
+		return true
+	}
+	verifiedAt := ctx.GetTime("mfaVerifiedAt")
+	if verifiedAt.IsZero() || time.Since(verifiedAt) > options.mfaMaxAge {
+		ctx.JSON(http.StatusForbidden, gin.H{
+			"error": "Please confirm it's you with your authenticator app",
+			"code":  "mfa_required",
+		})
+		ctx.Abort()
+		return false
+	}
+	return true
 }
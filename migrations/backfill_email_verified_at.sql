@@ -0,0 +1,6 @@
+-- Accounts created before email verification existed are treated as verified,
+-- so nobody loses access to password changes or gift codes on deploy.
+-- Run once, right after the release that adds users.email_verified_at.
+UPDATE users
+SET email_verified_at = created_at
+WHERE email_verified_at IS NULL;
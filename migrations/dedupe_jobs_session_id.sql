@@ -0,0 +1,15 @@
+-- Remove duplicate payment jobs so the unique index on jobs.session_id can be created.
+-- For each session the most advanced job is kept (completed first, then the newest).
+
+DELETE FROM jobs
+WHERE id IN (
+    SELECT id FROM (
+        SELECT id,
+               ROW_NUMBER() OVER (
+                   PARTITION BY session_id
+                   ORDER BY (status = 'completed') DESC, id DESC
+               ) AS row_num
+        FROM jobs
+    ) ranked
+    WHERE ranked.row_num > 1
+);
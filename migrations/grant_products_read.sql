@@ -0,0 +1,11 @@
+-- Viewing the product catalogue now needs products:read rather than
+-- products:write. Roles that could manage products keep seeing them.
+-- Run once, after the release that adds products:read has started (the
+-- server seeds the permission on startup).
+INSERT INTO role_permissions (role_id, permission_id)
+SELECT rp.role_id, reader.id
+FROM role_permissions rp
+JOIN permissions writer ON writer.id = rp.permission_id AND writer.name = 'products:write'
+CROSS JOIN permissions reader
+WHERE reader.name = 'products:read'
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,33 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// APIKey lets a script call the API as its owner, limited to Scopes. Only
+// the SHA-256 hash of the key is stored; Prefix identifies it in lists and
+// logs.
+type APIKey struct {
+	gorm.Model
+	UserID uint   `gorm:"index;not null" json:"userId"`
+	User   User   `gorm:"foreignKey:UserID" json:"-"`
+	Name   string `gorm:"size:100;not null" json:"name"`
+	Prefix string `gorm:"size:16;uniqueIndex;not null" json:"prefix"`
+	// KeyHash is compared in constant time after looking the key up by
+	// Prefix
+	KeyHash string `gorm:"size:64;not null" json:"-"`
+	// Scopes are permission names. A key can do what both its scopes and
+	// its owner's current role allow.
+	Scopes     []string   `gorm:"serializer:json" json:"scopes"`
+	ExpiresAt  time.Time  `gorm:"not null" json:"expiresAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+	LastUsedIP string     `gorm:"size:45" json:"lastUsedIp"`
+	RevokedAt  *time.Time `gorm:"index" json:"revokedAt"`
+}
+
+// Usable reports whether the key can still authenticate at now.
+func (k *APIKey) Usable(now time.Time) bool {
+	return k.RevokedAt == nil && now.Before(k.ExpiresAt)
+}
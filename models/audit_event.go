@@ -0,0 +1,40 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var ErrAuditEventImmutable = errors.New("audit events can't be changed or deleted")
+
+// AuditEvent records a security-relevant action: who did it, to what, and
+// what changed. Rows are only ever inserted; the hooks below stop GORM
+// changing them, and migrations/audit_events_append_only.sql stops anyone
+// else.
+type AuditEvent struct {
+	ID         uint      `gorm:"primarykey" json:"id"`
+	CreatedAt  time.Time `gorm:"index;not null" json:"createdAt"`
+	Action     string    `gorm:"size:64;index;not null" json:"action"`
+	ActorID    *uint     `gorm:"index" json:"actorId"`
+	ActorEmail string    `json:"actorEmail"`
+	// ActorAPIKeyID is set when the actor used an API key
+	ActorAPIKeyID *uint  `json:"actorApiKeyId,omitempty"`
+	TargetType    string `gorm:"size:32;index:idx_audit_events_target" json:"targetType"`
+	TargetID      *uint  `gorm:"index:idx_audit_events_target" json:"targetId"`
+	// Before and After hold only the fields that changed
+	Before    map[string]interface{} `gorm:"serializer:json" json:"before,omitempty"`
+	After     map[string]interface{} `gorm:"serializer:json" json:"after,omitempty"`
+	Metadata  map[string]interface{} `gorm:"serializer:json" json:"metadata,omitempty"`
+	IPAddress string                 `gorm:"size:45" json:"ipAddress"`
+	UserAgent string                 `json:"userAgent"`
+}
+
+func (e *AuditEvent) BeforeUpdate(tx *gorm.DB) error {
+	return ErrAuditEventImmutable
+}
+
+func (e *AuditEvent) BeforeDelete(tx *gorm.DB) error {
+	return ErrAuditEventImmutable
+}
@@ -1,14 +1,42 @@
 package models
 
-import "gorm.io/gorm"
+import (
+	"time"
 
+	"gorm.io/gorm"
+)
+
+// What an AuthToken link was sent for
+const (
+	AuthTokenPurposePurchase = "purchase"
+	AuthTokenPurposeLogin    = "login"
+	// AuthTokenPurposeSuccessPage is the one link the payment success page
+	// may show, alongside the purchase links that were emailed
+	AuthTokenPurposeSuccessPage = "success-page"
+	// AuthTokenPurposeMFA tokens are handed out after the password, to be
+	// exchanged with an authenticator code for a session
+	AuthTokenPurposeMFA = "mfa"
+	// AuthTokenPurposeVerifyEmail tokens confirm a self-registered address
+	AuthTokenPurposeVerifyEmail = "verify-email"
+)
+
+// AuthToken is a one-time login link, sent after a purchase or asked for
+// from the login page. Token holds the SHA-256 hash of what was emailed;
+// links created before hashing have Hashed false and the token in plain
+// text.
 type AuthToken struct {
 	gorm.Model
-	UserID      uint   `gorm:"index"`
-	Token       string `gorm:"unique;size:64"`
-	ProgramName string `json:"program_name"`
-	DayNumber   int    `json:"day_number"`
-	IsUsed      bool   `gorm:"default:false"`
-	User        User   `gorm:"foreignKey:UserID"`
-	SessionID   string `json:"session_id"`
+	UserID      uint       `gorm:"index"`
+	Token       string     `gorm:"unique;size:64"`
+	Hashed      bool       `gorm:"not null;default:false"`
+	Purpose     string     `gorm:"size:20;not null;default:'purchase';index"`
+	ProgramName string     `json:"program_name"`
+	DayNumber   int        `json:"day_number"`
+	IsUsed      bool       `gorm:"default:false"`
+	UsedAt      *time.Time `json:"used_at"`
+	// ExpiresAt is nil for links created before they expired; those are
+	// treated as expiring a purchase link's lifetime after CreatedAt
+	ExpiresAt *time.Time `gorm:"index" json:"expires_at"`
+	User      User       `gorm:"foreignKey:UserID"`
+	SessionID string     `json:"session_id"`
 }
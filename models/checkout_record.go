@@ -0,0 +1,35 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	CheckoutStatusOpen      = "open"
+	CheckoutStatusCompleted = "completed"
+	CheckoutStatusExpired   = "expired"
+)
+
+// CheckoutRecord is a Stripe checkout session created by the site, kept so
+// baskets that are never paid can be followed up. Each abandoned session
+// gets at most one recovery email, and ConvertedAt is set when the customer
+// goes on to buy after receiving it.
+type CheckoutRecord struct {
+	gorm.Model
+	SessionID           string     `gorm:"uniqueIndex;not null" json:"sessionId"`
+	CustomerEmail       string     `gorm:"index;not null" json:"customerEmail"`
+	Status              string     `gorm:"index;not null" json:"status"`
+	PriceIDs            []string   `gorm:"serializer:json" json:"priceIds"`
+	ProductNames        []string   `gorm:"serializer:json" json:"productNames"`
+	AmountTotal         int64      `json:"amountTotal"`
+	Currency            string     `json:"currency"`
+	CouponCode          string     `json:"couponCode"`
+	ExpiredAt           *time.Time `json:"expiredAt"`
+	CompletedAt         *time.Time `json:"completedAt"`
+	RecoveryEmailSentAt *time.Time `gorm:"index" json:"recoveryEmailSentAt"`
+	RecoveryPromotionID *uint      `json:"recoveryPromotionId"`
+	ConvertedAt         *time.Time `json:"convertedAt"`
+	ConvertedSessionID  string     `json:"convertedSessionId"`
+}
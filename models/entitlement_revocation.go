@@ -0,0 +1,22 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// EntitlementRevocation records access removed after a refund or dispute,
+// so support can see why a customer lost a program. A suspension that is
+// later lifted (a dispute won) keeps its row with RestoredAt set.
+type EntitlementRevocation struct {
+	gorm.Model
+	UserID         uint       `gorm:"index;not null" json:"userId"`
+	SessionID      string     `gorm:"index;not null" json:"sessionId"`
+	StripeObjectID string     `gorm:"index" json:"stripeObjectId"`
+	Reason         string     `gorm:"not null" json:"reason"`
+	Detail         string     `json:"detail"`
+	ProgramIDs     []uint     `gorm:"serializer:json" json:"programIds"`
+	BrevoListIDs   []int64    `gorm:"serializer:json" json:"brevoListIds"`
+	RestoredAt     *time.Time `json:"restoredAt"`
+}
@@ -0,0 +1,29 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// GiftCode is a single-use code for a product bought as a gift. Whoever
+// redeems it is given the product's programs. Buying several of a product
+// gives a code per unit, numbered from 1. A code is void once it has
+// expired or been revoked because the purchase was refunded or disputed.
+type GiftCode struct {
+	gorm.Model
+	Code             string     `gorm:"uniqueIndex;not null" json:"code"`
+	ProductID        uint       `gorm:"not null;uniqueIndex:idx_gift_codes_session_product_unit" json:"productId"`
+	Product          Product    `gorm:"foreignKey:ProductID" json:"product,omitempty"`
+	SessionID        string     `gorm:"not null;uniqueIndex:idx_gift_codes_session_product_unit" json:"sessionId"`
+	Unit             int        `gorm:"not null;default:1;uniqueIndex:idx_gift_codes_session_product_unit" json:"unit"`
+	PurchaserEmail   string     `gorm:"index;not null" json:"purchaserEmail"`
+	RecipientEmail   string     `gorm:"index;not null" json:"recipientEmail"`
+	Message          string     `gorm:"type:text" json:"message"`
+	ExpiresAt        time.Time  `gorm:"not null" json:"expiresAt"`
+	EmailedAt        *time.Time `json:"emailedAt"`
+	RedeemedAt       *time.Time `json:"redeemedAt"`
+	RedeemedByUserID *uint      `gorm:"index" json:"redeemedByUserId"`
+	RevokedAt        *time.Time `json:"revokedAt"`
+	RevokedBy        string     `gorm:"index" json:"revokedBy"`
+}
@@ -0,0 +1,49 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Invoice is the VAT invoice issued for an order. It is a snapshot: the
+// lines, totals and seller details are copied at issue time so a later
+// change to products or business details doesn't alter an issued invoice.
+// Prices are VAT inclusive; VATRate is in basis points (2000 = 20%).
+type Invoice struct {
+	gorm.Model
+	OrderID         uint          `gorm:"uniqueIndex;not null" json:"orderId"`
+	Sequence        int64         `gorm:"uniqueIndex;not null" json:"sequence"`
+	Number          string        `gorm:"uniqueIndex;not null" json:"number"`
+	IssuedAt        time.Time     `gorm:"not null" json:"issuedAt"`
+	CustomerEmail   string        `gorm:"index;not null" json:"customerEmail"`
+	Currency        string        `gorm:"size:3;not null" json:"currency"`
+	VATRate         int64         `json:"vatRate"`
+	NetAmount       int64         `json:"netAmount"`
+	VATAmount       int64         `json:"vatAmount"`
+	DiscountAmount  int64         `json:"discountAmount"`
+	TotalAmount     int64         `json:"totalAmount"`
+	Lines           []InvoiceLine `gorm:"serializer:json" json:"lines"`
+	SellerName      string        `json:"sellerName"`
+	SellerAddress   string        `json:"sellerAddress"`
+	SellerEmail     string        `json:"sellerEmail"`
+	SellerVATNumber string        `json:"sellerVatNumber"`
+}
+
+// InvoiceLine amounts are for the whole line, after any discount.
+type InvoiceLine struct {
+	Description    string `json:"description"`
+	Quantity       int64  `json:"quantity"`
+	UnitAmount     int64  `json:"unitAmount"`
+	DiscountAmount int64  `json:"discountAmount"`
+	NetAmount      int64  `json:"netAmount"`
+	VATAmount      int64  `json:"vatAmount"`
+	TotalAmount    int64  `json:"totalAmount"`
+}
+
+// InvoiceSequence hands out invoice numbers. The row is locked while an
+// invoice is created in the same transaction, so numbers have no gaps.
+type InvoiceSequence struct {
+	Name       string `gorm:"primaryKey"`
+	LastNumber int64  `gorm:"not null"`
+}
@@ -7,11 +7,28 @@ import (
 	"gorm.io/gorm"
 )
 
+const (
+	JobStatusPending    = "pending"
+	JobStatusProcessing = "processing"
+	JobStatusCompleted  = "completed"
+	JobStatusDead       = "dead"
+	JobStatusCancelled  = "cancelled"
+)
+
+// Job is a unit of payment fulfilment. A worker claims a job by taking a
+// lease on it; if the worker dies, the lease expires and another worker
+// picks the job up. Failed attempts are retried from NextRunAt until the
+// job runs out of attempts and is marked dead.
 type Job struct {
 	gorm.Model
-	SessionID     string
-	CustomerEmail string
-	Status        string
-	Attempts      int
-	LastAttempt   time.Time
+	SessionID      string       `gorm:"uniqueIndex" json:"sessionId"`
+	CustomerEmail  string       `json:"customerEmail"`
+	Status         string       `gorm:"index" json:"status"`
+	Attempts       int          `json:"attempts"`
+	LastAttempt    time.Time    `json:"lastAttempt"`
+	NextRunAt      time.Time    `gorm:"index;not null;default:now()" json:"nextRunAt"`
+	LeaseOwner     string       `gorm:"size:255" json:"leaseOwner"`
+	LeaseExpiresAt *time.Time   `gorm:"index" json:"leaseExpiresAt"`
+	LastError      string       `gorm:"type:text" json:"lastError"`
+	AttemptHistory []JobAttempt `gorm:"foreignKey:JobID" json:"attemptHistory,omitempty"`
 }
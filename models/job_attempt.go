@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+// JobAttempt is one run of a Job, kept so admins can see why a job failed
+// on each try and not just the last error.
+type JobAttempt struct {
+	ID         uint       `gorm:"primarykey" json:"id"`
+	JobID      uint       `gorm:"index;not null" json:"jobId"`
+	Attempt    int        `json:"attempt"`
+	WorkerID   string     `json:"workerId"`
+	StartedAt  time.Time  `json:"startedAt"`
+	FinishedAt *time.Time `json:"finishedAt"`
+	Succeeded  bool       `json:"succeeded"`
+	Error      string     `gorm:"type:text" json:"error"`
+}
@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+// LoginAttempt counts recent failed attempts for one account or IP address
+// in one scope (login, reset request, ...). Key is e.g.
+// "login:account:a@b.com". A row is deleted when the count is reset.
+type LoginAttempt struct {
+	ID            uint       `gorm:"primarykey" json:"id"`
+	Key           string     `gorm:"size:320;uniqueIndex;not null" json:"key"`
+	Failures      int        `gorm:"not null;default:0" json:"failures"`
+	LastFailureAt time.Time  `json:"lastFailureAt"`
+	LockedUntil   *time.Time `json:"lockedUntil,omitempty"`
+	CreatedAt     time.Time  `json:"createdAt"`
+	UpdatedAt     time.Time  `json:"updatedAt"`
+}
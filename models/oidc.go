@@ -0,0 +1,32 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// UserIdentity links a user to their account at an OpenID provider. Once
+// linked, the provider's subject identifies them even if either email
+// changes.
+type UserIdentity struct {
+	gorm.Model
+	UserID   uint   `gorm:"index;not null" json:"userId"`
+	Provider string `gorm:"size:50;not null;uniqueIndex:idx_user_identities_provider_subject" json:"provider"`
+	Subject  string `gorm:"size:255;not null;uniqueIndex:idx_user_identities_provider_subject" json:"-"`
+	// Email is what the provider said when the identity was linked
+	Email      string     `json:"email"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+}
+
+// OIDCLoginState remembers a sign-in sent to a provider until it comes
+// back. StateHash is the SHA-256 hash of the state parameter.
+type OIDCLoginState struct {
+	gorm.Model
+	StateHash    string    `gorm:"size:64;uniqueIndex;not null"`
+	Provider     string    `gorm:"size:50;not null"`
+	Nonce        string    `gorm:"not null"`
+	CodeVerifier string    `gorm:"not null"`
+	ExpiresAt    time.Time `gorm:"index;not null"`
+	UsedAt       *time.Time
+}
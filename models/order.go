@@ -0,0 +1,46 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	OrderStatusPaid     = "paid"
+	OrderStatusRefunded = "refunded"
+	OrderStatusDisputed = "disputed"
+)
+
+// Order is the local record of a completed checkout session. Amounts are in
+// the smallest unit of Currency (pence for GBP), as Stripe reports them.
+type Order struct {
+	gorm.Model
+	UserID                *uint  `gorm:"index" json:"userId"`
+	CustomerEmail         string `gorm:"index;not null" json:"customerEmail"`
+	StripeSessionID       string `gorm:"uniqueIndex;not null" json:"stripeSessionId"`
+	StripePaymentIntentID string `gorm:"index" json:"stripePaymentIntentId"`
+	Status                string `gorm:"index;not null;default:'paid'" json:"status"`
+	Currency              string `gorm:"size:3;not null" json:"currency"`
+	SubtotalAmount        int64  `json:"subtotalAmount"`
+	DiscountAmount        int64  `json:"discountAmount"`
+	TotalAmount           int64  `json:"totalAmount"`
+	CouponCode            string `json:"couponCode"`
+	// FulfilledAt is set once access was granted and the purchase emails
+	// sent, so a retried job doesn't send them again
+	FulfilledAt *time.Time  `json:"fulfilledAt,omitempty"`
+	Items       []OrderItem `gorm:"foreignKey:OrderID" json:"items"`
+}
+
+type OrderItem struct {
+	gorm.Model
+	OrderID        uint   `gorm:"index;not null" json:"orderId"`
+	ProductID      *uint  `gorm:"index" json:"productId"`
+	StripePriceID  string `gorm:"index" json:"stripePriceId"`
+	Description    string `json:"description"`
+	Quantity       int64  `json:"quantity"`
+	UnitAmount     int64  `json:"unitAmount"`
+	SubtotalAmount int64  `json:"subtotalAmount"`
+	DiscountAmount int64  `json:"discountAmount"`
+	TotalAmount    int64  `json:"totalAmount"`
+}
@@ -0,0 +1,21 @@
+package models
+
+import "gorm.io/gorm"
+
+// Product maps a Stripe price to what a purchase of it unlocks.
+type Product struct {
+	gorm.Model
+	Name             string           `gorm:"not null" json:"name"`
+	StripePriceID    string           `gorm:"uniqueIndex;not null" json:"stripePriceId"`
+	Programs         []WorkoutProgram `gorm:"many2many:product_programs;" json:"programs"`
+	BrevoListIDs     []int64          `gorm:"serializer:json" json:"brevoListIds"`
+	BrevoTemplateIDs []int64          `gorm:"serializer:json" json:"brevoTemplateIds"`
+	IsActive         bool             `gorm:"default:true" json:"isActive"`
+	// Recurring products are sold as Stripe subscriptions and the programs
+	// they unlock expire when the subscription lapses
+	Recurring bool `gorm:"default:false" json:"recurring"`
+	// Currency of StripePriceID. Prices holds the product's prices in
+	// other currencies.
+	Currency string         `gorm:"size:3;not null;default:'gbp'" json:"currency"`
+	Prices   []ProductPrice `gorm:"foreignKey:ProductID" json:"prices"`
+}
@@ -0,0 +1,13 @@
+package models
+
+import "gorm.io/gorm"
+
+// ProductPrice is a Stripe price for a product in a currency other than
+// its default. Checkout picks the one matching the customer's currency and
+// falls back to Product.StripePriceID.
+type ProductPrice struct {
+	gorm.Model
+	ProductID     uint   `gorm:"not null;uniqueIndex:idx_product_prices_currency" json:"productId"`
+	Currency      string `gorm:"size:3;not null;uniqueIndex:idx_product_prices_currency" json:"currency"`
+	StripePriceID string `gorm:"uniqueIndex;not null" json:"stripePriceId"`
+}
@@ -0,0 +1,57 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	PromotionTypePercent = "percent"
+	PromotionTypeAmount  = "amount"
+)
+
+// Promotion is a discount code whose rules are enforced by the backend.
+// AmountOff is in pence. At checkout the promotion is mirrored to a Stripe
+// coupon and promotion code so the hosted payment page takes off the same
+// discount; StripeSyncedAt tells whether that copy is older than the rules.
+//
+// A promotion with RequiresOtherProduct is a bundle deal: it only applies
+// when the basket also holds a product it doesn't cover. An Automatic
+// promotion is applied at checkout without its code, to baskets it fits,
+// when the customer hasn't entered a code of their own.
+type Promotion struct {
+	gorm.Model
+	Code                  string     `gorm:"uniqueIndex;not null" json:"code"`
+	Description           string     `json:"description"`
+	DiscountType          string     `gorm:"not null" json:"discountType"`
+	PercentOff            int64      `json:"percentOff"`
+	AmountOff             int64      `json:"amountOff"`
+	Currency              string     `gorm:"size:3;not null" json:"currency"`
+	ProductIDs            []uint     `gorm:"serializer:json" json:"productIds"`
+	MaxRedemptions        int64      `json:"maxRedemptions"`
+	MaxRedemptionsPerUser int64      `json:"maxRedemptionsPerUser"`
+	StartsAt              *time.Time `json:"startsAt"`
+	EndsAt                *time.Time `json:"endsAt"`
+	FirstPurchaseOnly     bool       `json:"firstPurchaseOnly"`
+	RequiresOtherProduct  bool       `json:"requiresOtherProduct"`
+	Automatic             bool       `gorm:"index" json:"automatic"`
+	IsActive              bool       `gorm:"not null" json:"isActive"`
+	StripeCouponID        string     `json:"stripeCouponId"`
+	StripePromotionCodeID string     `json:"stripePromotionCodeId"`
+	StripeSyncedAt        *time.Time `json:"stripeSyncedAt"`
+}
+
+// PromotionRedemption is a checkout's use of a promotion. It is reserved,
+// with ReservedUntil set, when the checkout is created and confirmed when
+// the checkout is paid; an expired checkout's reservation is deleted.
+// Redemption limits are counted from confirmed rows and live reservations.
+type PromotionRedemption struct {
+	gorm.Model
+	PromotionID    uint       `gorm:"not null;uniqueIndex:idx_promotion_redemptions_session" json:"promotionId"`
+	SessionID      string     `gorm:"not null;uniqueIndex:idx_promotion_redemptions_session" json:"sessionId"`
+	CustomerEmail  string     `gorm:"index;not null" json:"customerEmail"`
+	UserID         *uint      `gorm:"index" json:"userId"`
+	DiscountAmount int64      `json:"discountAmount"`
+	ReservedUntil  *time.Time `gorm:"index" json:"reservedUntil"`
+}
@@ -0,0 +1,43 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	CommissionStatusPending = "pending"
+	CommissionStatusPaid    = "paid"
+	CommissionStatusVoid    = "void"
+)
+
+// ReferralCode is a user's personal code for referring friends. The friend's
+// discount comes from the linked Promotion, so it is checked and mirrored to
+// Stripe like any other code.
+type ReferralCode struct {
+	gorm.Model
+	UserID      uint      `gorm:"uniqueIndex;not null" json:"userId"`
+	Code        string    `gorm:"uniqueIndex;not null" json:"code"`
+	PromotionID uint      `gorm:"index;not null" json:"promotionId"`
+	Promotion   Promotion `gorm:"foreignKey:PromotionID" json:"-"`
+}
+
+// ReferralConversion is a paid order placed with someone's referral code.
+// The commission is pending until an admin records it as paid out, and is
+// voided if the order is refunded or disputed before then. Amounts are in
+// the smallest unit of Currency.
+type ReferralConversion struct {
+	gorm.Model
+	ReferralCodeID   uint       `gorm:"index;not null" json:"referralCodeId"`
+	ReferrerUserID   uint       `gorm:"index;not null" json:"referrerUserId"`
+	OrderID          uint       `gorm:"index;not null" json:"orderId"`
+	SessionID        string     `gorm:"uniqueIndex;not null" json:"sessionId"`
+	CustomerEmail    string     `gorm:"index;not null" json:"customerEmail"`
+	Currency         string     `gorm:"size:3;not null" json:"currency"`
+	OrderTotal       int64      `json:"orderTotal"`
+	CommissionAmount int64      `json:"commissionAmount"`
+	Status           string     `gorm:"index;not null" json:"status"`
+	PaidAt           *time.Time `json:"paidAt"`
+	PayoutReference  string     `json:"payoutReference"`
+}
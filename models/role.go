@@ -0,0 +1,92 @@
+package models
+
+import "gorm.io/gorm"
+
+// Permissions guard the admin API. A user's User.Role names a Role, and the
+// role's permissions decide what they can do.
+const (
+	PermissionAnalyticsRead = "analytics:read"
+	PermissionProgramsRead  = "programs:read"
+	PermissionProgramsWrite = "programs:write"
+	PermissionProductsRead  = "products:read"
+	PermissionProductsWrite = "products:write"
+	PermissionUsersRead     = "users:read"
+	PermissionUsersWrite    = "users:write"
+	PermissionBlogPublish   = "blog:publish"
+	// PermissionCoachingClients lets a coach see their clients' progress
+	PermissionCoachingClients = "coaching:clients"
+	PermissionOrdersRead      = "orders:read"
+	// PermissionPaymentsManage covers Stripe events, fulfilment jobs and
+	// reconciliation
+	PermissionPaymentsManage  = "payments:manage"
+	PermissionPromotionsWrite = "promotions:write"
+	PermissionReferralsManage = "referrals:manage"
+	PermissionRolesManage     = "roles:manage"
+	PermissionAuditRead       = "audit:read"
+)
+
+// Built-in roles
+const (
+	RoleAdmin = "admin"
+	RoleCoach = "coach"
+	RoleUser  = "user"
+)
+
+// AllPermissions lists every permission with what it allows.
+var AllPermissions = []Permission{
+	{Name: PermissionAnalyticsRead, Description: "View the analytics dashboard"},
+	{Name: PermissionProgramsRead, Description: "View exercises and programs"},
+	{Name: PermissionProgramsWrite, Description: "Create, edit and delete exercises, programs and workouts"},
+	{Name: PermissionProductsRead, Description: "View the product catalogue and prices"},
+	{Name: PermissionProductsWrite, Description: "Manage the product catalogue and prices"},
+	{Name: PermissionUsersRead, Description: "View user accounts"},
+	{Name: PermissionUsersWrite, Description: "Edit, delete, unlock and reset the password of user accounts"},
+	{Name: PermissionBlogPublish, Description: "Write, edit and delete blog posts"},
+	{Name: PermissionCoachingClients, Description: "View coaching clients' assessments and progress"},
+	{Name: PermissionOrdersRead, Description: "Search orders and download invoices"},
+	{Name: PermissionPaymentsManage, Description: "Replay Stripe events, manage fulfilment jobs and reconcile payments"},
+	{Name: PermissionPromotionsWrite, Description: "Manage promotion codes"},
+	{Name: PermissionReferralsManage, Description: "View referrals and record payouts"},
+	{Name: PermissionRolesManage, Description: "Manage roles and assign them to users"},
+	{Name: PermissionAuditRead, Description: "View and export the security audit log"},
+}
+
+// DefaultRolePermissions are the built-in roles' permissions, seeded into
+// an empty database.
+var DefaultRolePermissions = map[string][]string{
+	RoleAdmin: permissionNames(AllPermissions),
+	RoleCoach: {
+		PermissionProgramsRead,
+		PermissionProgramsWrite,
+		PermissionUsersRead,
+		PermissionBlogPublish,
+		PermissionCoachingClients,
+	},
+	RoleUser: {},
+}
+
+func permissionNames(permissions []Permission) []string {
+	names := make([]string, 0, len(permissions))
+	for _, permission := range permissions {
+		names = append(names, permission.Name)
+	}
+	return names
+}
+
+type Permission struct {
+	ID          uint   `gorm:"primarykey" json:"id"`
+	Name        string `gorm:"size:64;uniqueIndex;not null" json:"name"`
+	Description string `json:"description"`
+}
+
+type Role struct {
+	gorm.Model
+	Name        string       `gorm:"size:64;uniqueIndex;not null" json:"name"`
+	Description string       `json:"description"`
+	Permissions []Permission `gorm:"many2many:role_permissions;" json:"permissions"`
+}
+
+// PermissionNames lists the role's permissions by name.
+func (r *Role) PermissionNames() []string {
+	return permissionNames(r.Permissions)
+}
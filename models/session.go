@@ -0,0 +1,43 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// UserSession is one signed-in device. Access tokens carry its ID, so
+// revoking it signs that device out straight away.
+type UserSession struct {
+	gorm.Model
+	UserID        uint       `gorm:"index;not null" json:"-"`
+	UserAgent     string     `json:"userAgent"`
+	IPAddress     string     `json:"ipAddress"`
+	LastUsedAt    time.Time  `json:"lastUsedAt"`
+	ExpiresAt     time.Time  `gorm:"index" json:"expiresAt"`
+	RevokedAt     *time.Time `gorm:"index" json:"revokedAt,omitempty"`
+	RevokedReason string     `json:"revokedReason,omitempty"`
+	// MFAVerifiedAt is when an authenticator code was last entered on this
+	// device
+	MFAVerifiedAt *time.Time `json:"mfaVerifiedAt,omitempty"`
+}
+
+func (UserSession) TableName() string {
+	return "sessions"
+}
+
+// Active is false once the session is revoked or its refresh token lapses.
+func (s *UserSession) Active(now time.Time) bool {
+	return s.RevokedAt == nil && now.Before(s.ExpiresAt)
+}
+
+// RefreshToken is one link in a session's rotation chain. Only the hash is
+// stored. A token is used once; presenting a used one again means it was
+// copied, and the whole session is revoked.
+type RefreshToken struct {
+	gorm.Model
+	SessionID uint       `gorm:"index;not null"`
+	TokenHash string     `gorm:"uniqueIndex;size:64;not null"`
+	ExpiresAt time.Time  `gorm:"not null"`
+	UsedAt    *time.Time `gorm:"index"`
+}
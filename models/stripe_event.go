@@ -0,0 +1,20 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// StripeEvent is the ledger entry for a webhook event received from Stripe.
+// EventID is unique so a redelivered event is recorded only once.
+type StripeEvent struct {
+	gorm.Model
+	EventID     string     `gorm:"uniqueIndex;not null" json:"eventId"`
+	Type        string     `gorm:"index;not null" json:"type"`
+	Status      string     `gorm:"index;not null;default:'received'" json:"status"`
+	Payload     string     `gorm:"type:text" json:"payload,omitempty"`
+	Error       string     `json:"error"`
+	Attempts    int        `gorm:"default:0" json:"attempts"`
+	ProcessedAt *time.Time `json:"processedAt"`
+}
@@ -0,0 +1,24 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Subscription mirrors a Stripe subscription. Status uses Stripe's values
+// (active, trialing, past_due, canceled, unpaid, ...).
+type Subscription struct {
+	gorm.Model
+	UserID               *uint      `gorm:"index" json:"userId"`
+	ProductID            *uint      `gorm:"index" json:"productId"`
+	StripeSubscriptionID string     `gorm:"uniqueIndex;not null" json:"stripeSubscriptionId"`
+	StripeCustomerID     string     `gorm:"index" json:"stripeCustomerId"`
+	StripePriceID        string     `json:"stripePriceId"`
+	Status               string     `gorm:"index;not null" json:"status"`
+	CurrentPeriodEnd     time.Time  `json:"currentPeriodEnd"`
+	CancelAtPeriodEnd    bool       `json:"cancelAtPeriodEnd"`
+	CanceledAt           *time.Time `json:"canceledAt"`
+	EndedAt              *time.Time `json:"endedAt"`
+	LastPaymentFailedAt  *time.Time `json:"lastPaymentFailedAt"`
+}
@@ -8,21 +8,52 @@ import (
 
 type User struct {
 	gorm.Model
-	Email               string               `gorm:"uniqueIndex;not null" json:"email" binding:"required,email"`
-	PasswordHash        string               `gorm:"not null" json:"-"`
-	Role                string               `gorm:"not null;default:'user'" json:"role"`
-	PasswordResetTokens []PasswordResetToken `gorm:"foreignKey:UserID"`
-	MustChangePassword  bool                 `gorm:"default:false"`
-	AuthTokens          []AuthToken          `gorm:"foreignKey:UserID"`
-	UserPrograms        []UserProgram        `gorm:"foreignKey:UserID"`
-	CompletedDays       map[string]int       `json:"completedDays" gorm:"serializer:json"`
-	ProgramStartDates   map[string]time.Time `json:"programStartDates" gorm:"serializer:json"`
-	CompletedDaysList   map[string][]int     `json:"completedDaysList" gorm:"serializer:json"`
-	Timezone            string               `gorm:"default:'UTC'" json:"timezone"`
-	LastWorkoutDate     *time.Time           `json:"lastWorkoutDate"`
-	CurrentStreak       int                  `gorm:"default:0" json:"currentStreak"`
-	LongestStreak       int                  `gorm:"default:0" json:"longestStreak"`
-	ReminderOptOut      bool                 `gorm:"default:false" json:"reminderOptOut"`
+	Email               string                  `gorm:"uniqueIndex;not null" json:"email" binding:"required,email"`
+	PasswordHash        string                  `gorm:"not null" json:"-"`
+	Role                string                  `gorm:"not null;default:'user'" json:"role"`
+	PasswordResetTokens []PasswordResetToken    `gorm:"foreignKey:UserID"`
+	MustChangePassword  bool                    `gorm:"default:false"`
+	AuthTokens          []AuthToken             `gorm:"foreignKey:UserID"`
+	UserPrograms        []UserProgram           `gorm:"foreignKey:UserID"`
+	CompletedDays       map[string]int          `json:"completedDays" gorm:"serializer:json"`
+	ProgramStartDates   map[string]time.Time    `json:"programStartDates" gorm:"serializer:json"`
+	CompletedDaysList   map[string][]int        `json:"completedDaysList" gorm:"serializer:json"`
+	Timezone            string                  `gorm:"default:'UTC'" json:"timezone"`
+	LastWorkoutDate     *time.Time              `json:"lastWorkoutDate"`
+	CurrentStreak       int                     `gorm:"default:0" json:"currentStreak"`
+	LongestStreak       int                     `gorm:"default:0" json:"longestStreak"`
+	ReminderOptOut      bool                    `gorm:"default:false" json:"reminderOptOut"`
+	Revocations         []EntitlementRevocation `gorm:"foreignKey:UserID" json:"revocations,omitempty"`
+	StripeCustomerID    string                  `gorm:"index" json:"-"`
+	// TOTPSecret is set during enrolment; two-factor login is only on once
+	// TOTPEnabledAt is set too
+	TOTPSecret      string     `json:"-"`
+	TOTPEnabledAt   *time.Time `json:"totpEnabledAt,omitempty"`
+	TOTPLastCounter int64      `gorm:"default:0" json:"-"`
+	// EmailVerifiedAt is set once the user has shown they read mail sent
+	// to Email, by a verification, purchase or login link
+	EmailVerifiedAt *time.Time `gorm:"index" json:"emailVerifiedAt,omitempty"`
+	IsActive        bool       `gorm:"default:true" json:"isActive"`
+	// CoachID is the staff member who follows this client's progress
+	CoachID *uint `gorm:"index" json:"coachId,omitempty"`
+}
+
+func (u *User) EmailVerified() bool {
+	return u.EmailVerifiedAt != nil
+}
+
+// TwoFactorEnabled reports whether logging in needs an authenticator code.
+func (u *User) TwoFactorEnabled() bool {
+	return u.TOTPEnabledAt != nil && u.TOTPSecret != ""
+}
+
+// RecoveryCode is a one-time code for logging in without the
+// authenticator app. Only its hash is stored.
+type RecoveryCode struct {
+	gorm.Model
+	UserID   uint       `gorm:"index;not null"`
+	CodeHash string     `gorm:"size:64;not null"`
+	UsedAt   *time.Time `gorm:"index"`
 }
 
 type UserResponse struct {
@@ -40,6 +71,8 @@ type UserResponse struct {
 	CurrentStreak      int                  `json:"currentStreak"`
 	LongestStreak      int                  `json:"longestStreak"`
 	ReminderOptOut     bool                 `json:"reminderOptOut"`
+	TwoFactorEnabled   bool                 `json:"twoFactorEnabled"`
+	EmailVerified      bool                 `json:"emailVerified"`
 }
 
 type LoginRequest struct {
@@ -66,4 +99,8 @@ type UserProgram struct {
 	ProgramID      uint `gorm:"not null"`
 	User           User
 	WorkoutProgram WorkoutProgram `gorm:"foreignKey:ProgramID"`
+	// ExpiresAt is set when access comes from a subscription; nil means the
+	// program was bought outright
+	ExpiresAt      *time.Time `gorm:"index"`
+	SubscriptionID *uint      `gorm:"index"`
 }
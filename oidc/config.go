@@ -0,0 +1,54 @@
+package oidc
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var providerName = regexp.MustCompile(`^[a-z0-9-]+$`)
+
+// LoadProviders reads OIDC_PROVIDERS, a JSON array of ProviderConfig, or
+// OIDC_PROVIDERS_FILE naming a file holding one. Providers without a
+// redirectUrl come back to <frontendURL>/auth/callback/<name>. No
+// configuration means no providers.
+func LoadProviders(frontendURL string) (map[string]*Provider, error) {
+	raw := os.Getenv("OIDC_PROVIDERS")
+	if path := os.Getenv("OIDC_PROVIDERS_FILE"); path != "" {
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read OIDC_PROVIDERS_FILE: %w", err)
+		}
+		raw = string(contents)
+	}
+	providers := map[string]*Provider{}
+	if strings.TrimSpace(raw) == "" {
+		return providers, nil
+	}
+
+	var configs []ProviderConfig
+	if err := json.Unmarshal([]byte(raw), &configs); err != nil {
+		return nil, fmt.Errorf("could not parse OIDC providers: %w", err)
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	for _, config := range configs {
+		if !providerName.MatchString(config.Name) {
+			return nil, fmt.Errorf("OIDC provider name %q must be lower case letters, digits and dashes", config.Name)
+		}
+		if config.Issuer == "" || config.ClientID == "" {
+			return nil, fmt.Errorf("OIDC provider %q needs an issuer and a clientId", config.Name)
+		}
+		if _, exists := providers[config.Name]; exists {
+			return nil, fmt.Errorf("duplicate OIDC provider %q", config.Name)
+		}
+		if config.RedirectURL == "" {
+			config.RedirectURL = strings.TrimSuffix(frontendURL, "/") + "/auth/callback/" + config.Name
+		}
+		providers[config.Name] = NewProvider(config, client)
+	}
+	return providers, nil
+}
@@ -0,0 +1,147 @@
+package oidc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// keyRefreshInterval limits how often an unknown key ID makes us fetch the
+// JWKS again, so tokens with made-up key IDs can't hammer the provider.
+const keyRefreshInterval = time.Minute
+
+// JWK is a public key from a provider's JWKS.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg,omitempty"`
+	Use       string `json:"use,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+type publicKey struct {
+	alg string
+	key interface{}
+}
+
+// keySet caches a provider's signing keys, fetching them again when a
+// token names a key we haven't seen, which is how providers rotate.
+type keySet struct {
+	url   string
+	fetch func(ctx context.Context, url string, into interface{}) error
+
+	mu        sync.Mutex
+	keys      map[string]publicKey
+	fetchedAt time.Time
+}
+
+func newKeySet(url string, fetch func(ctx context.Context, url string, into interface{}) error) *keySet {
+	return &keySet{url: url, fetch: fetch}
+}
+
+func (s *keySet) get(ctx context.Context, kid, alg string) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k, ok := s.keys[kid]
+	if !ok && time.Since(s.fetchedAt) >= keyRefreshInterval {
+		if err := s.refresh(ctx); err != nil {
+			return nil, err
+		}
+		k, ok = s.keys[kid]
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	if k.alg != alg {
+		return nil, fmt.Errorf("key %q is for %s, not %s", kid, k.alg, alg)
+	}
+	return k.key, nil
+}
+
+func (s *keySet) refresh(ctx context.Context) error {
+	var set JWKSet
+	if err := s.fetch(ctx, s.url, &set); err != nil {
+		return fmt.Errorf("fetching signing keys: %w", err)
+	}
+	keys := make(map[string]publicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		k, err := parseJWK(jwk)
+		if err != nil {
+			// Skip keys we can't use rather than failing on all of them
+			continue
+		}
+		keys[jwk.KeyID] = k
+	}
+	s.keys = keys
+	s.fetchedAt = time.Now()
+	return nil
+}
+
+func parseJWK(jwk JWK) (publicKey, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch jwk.KeyType {
+	case "RSA":
+		n, err := decode(jwk.N)
+		if err != nil {
+			return publicKey{}, err
+		}
+		e, err := decode(jwk.E)
+		if err != nil {
+			return publicKey{}, err
+		}
+		key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if key.N.BitLen() < 2048 {
+			return publicKey{}, fmt.Errorf("RSA key %q is too short", jwk.KeyID)
+		}
+		return publicKey{alg: "RS256", key: key}, nil
+	case "EC":
+		if jwk.Curve != "P-256" {
+			return publicKey{}, fmt.Errorf("unsupported curve %q", jwk.Curve)
+		}
+		x, err := decode(jwk.X)
+		if err != nil {
+			return publicKey{}, err
+		}
+		y, err := decode(jwk.Y)
+		if err != nil {
+			return publicKey{}, err
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return publicKey{}, fmt.Errorf("EC key %q is not on its curve", jwk.KeyID)
+		}
+		return publicKey{alg: "ES256", key: key}, nil
+	case "OKP":
+		if jwk.Curve != "Ed25519" {
+			return publicKey{}, fmt.Errorf("unsupported curve %q", jwk.Curve)
+		}
+		x, err := decode(jwk.X)
+		if err != nil {
+			return publicKey{}, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return publicKey{}, fmt.Errorf("Ed25519 key %q has the wrong size", jwk.KeyID)
+		}
+		return publicKey{alg: "EdDSA", key: ed25519.PublicKey(x)}, nil
+	}
+	return publicKey{}, fmt.Errorf("unsupported key type %q", jwk.KeyType)
+}
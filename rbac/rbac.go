@@ -0,0 +1,108 @@
+// Package rbac resolves a role's permissions from the roles table. Results
+// are cached briefly so checking a permission on every request doesn't mean
+// a join on every request.
+package rbac
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/88warren/lmw-fitness-backend/models"
+	"gorm.io/gorm"
+)
+
+// cacheTTL bounds how long a change to a role takes to apply on other
+// replicas. Changes made through this replica apply at once.
+const cacheTTL = time.Minute
+
+// Set is a role's permissions.
+type Set map[string]bool
+
+func (s Set) Has(permission string) bool {
+	return s[permission]
+}
+
+// Names lists the permissions in the order of models.AllPermissions.
+func (s Set) Names() []string {
+	names := []string{}
+	for _, permission := range models.AllPermissions {
+		if s[permission.Name] {
+			names = append(names, permission.Name)
+		}
+	}
+	return names
+}
+
+func newSet(names []string) Set {
+	set := make(Set, len(names))
+	for _, name := range names {
+		set[name] = true
+	}
+	return set
+}
+
+type cachedSet struct {
+	set      Set
+	loadedAt time.Time
+}
+
+var (
+	mu    sync.Mutex
+	cache = map[string]cachedSet{}
+)
+
+// Permissions returns what role may do. A role missing from the database
+// falls back to its built-in permissions, so a fresh database behaves
+// before roles are seeded; an unknown role has none.
+func Permissions(db *gorm.DB, role string) (Set, error) {
+	mu.Lock()
+	cached, ok := cache[role]
+	mu.Unlock()
+	if ok && time.Since(cached.loadedAt) < cacheTTL {
+		return cached.set, nil
+	}
+
+	set, err := load(db, role)
+	if err != nil {
+		return nil, err
+	}
+	mu.Lock()
+	cache[role] = cachedSet{set: set, loadedAt: time.Now()}
+	mu.Unlock()
+	return set, nil
+}
+
+func load(db *gorm.DB, role string) (Set, error) {
+	if db == nil {
+		return newSet(models.DefaultRolePermissions[role]), nil
+	}
+	var found models.Role
+	err := db.Preload("Permissions").Where("name = ?", role).First(&found).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return newSet(models.DefaultRolePermissions[role]), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newSet(found.PermissionNames()), nil
+}
+
+// Invalidate drops cached permissions after roles change.
+func Invalidate() {
+	mu.Lock()
+	defer mu.Unlock()
+	cache = map[string]cachedSet{}
+}
+
+// RoleExists reports whether users can be given role.
+func RoleExists(db *gorm.DB, role string) (bool, error) {
+	if _, builtIn := models.DefaultRolePermissions[role]; builtIn {
+		return true, nil
+	}
+	var count int64
+	if err := db.Model(&models.Role{}).Where("name = ?", role).Count(&count).Error; err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/88warren/lmw-fitness-backend/controllers"
+	"github.com/88warren/lmw-fitness-backend/database"
+)
+
+// runReconcile implements `lmw-fitness-backend reconcile`, which compares
+// paid Stripe checkout sessions with local fulfilment and exits non-zero if
+// anything is missing. Jobs queued with -enqueue are picked up by the
+// running server's payment worker.
+func runReconcile(args []string) int {
+	flags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	from := flags.String("from", "", "first day to check, YYYY-MM-DD (default: seven days before -to)")
+	to := flags.String("to", "", "last day to check, YYYY-MM-DD (default: today)")
+	enqueue := flags.Bool("enqueue", false, "create or re-run fulfilment jobs for sessions with problems")
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	flags.Parse(args)
+
+	fromTime, toTime, err := controllers.ParseReconcileRange(*from, *to, time.Now())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	database.ConnectToDB()
+	pc := controllers.NewPaymentController(database.GetDB())
+
+	report, err := pc.Reconcile(fromTime, toTime, *enqueue)
+	if err != nil {
+		log.Printf("Reconcile failed: %v", err)
+		return 1
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(report)
+	} else {
+		fmt.Printf("Checked %d paid sessions from %s to %s (%d in progress, %d refunded or disputed)\n",
+			report.SessionsChecked, report.From.Format("2006-01-02"), report.To.AddDate(0, 0, -1).Format("2006-01-02"),
+			report.InProgress, report.Revoked)
+		for _, issue := range report.Issues {
+			line := fmt.Sprintf("%s  %s  %s  %s", issue.Created.Format("2006-01-02 15:04"), issue.SessionID, issue.CustomerEmail, strings.Join(issue.Problems, ","))
+			if issue.Action != "" {
+				line += "  -> " + issue.Action
+			}
+			fmt.Println(line)
+		}
+		fmt.Printf("%d sessions with problems, %d jobs queued\n", len(report.Issues), report.JobsQueued)
+	}
+
+	if len(report.Issues) > report.JobsQueued {
+		return 1
+	}
+	return 0
+}
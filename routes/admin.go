@@ -1,53 +1,102 @@
 package routes
 
 import (
+	"os"
+	"time"
+
 	"github.com/88warren/lmw-fitness-backend/controllers"
 	"github.com/88warren/lmw-fitness-backend/middleware"
+	"github.com/88warren/lmw-fitness-backend/models"
 	"github.com/gin-gonic/gin"
 )
 
+// adminMFAMaxAge is how long a two-factor check lets staff keep using
+// admin routes before being asked again.
+const adminMFAMaxAge = 12 * time.Hour
+
+// staffOnly guards admin routes, which then each require a permission.
+// Staff need a recent two-factor check unless ADMIN_REQUIRE_2FA is "false".
+func staffOnly() gin.HandlerFunc {
+	if os.Getenv("ADMIN_REQUIRE_2FA") == "false" {
+		return middleware.StaffMiddleware()
+	}
+	return middleware.StaffMiddleware(middleware.RequireRecentMFA(adminMFAMaxAge))
+}
+
 func RegisterAdminRoutes(router *gin.Engine, ac *controllers.AdminController) {
 	admin := router.Group("/api/admin")
-	admin.Use(middleware.AuthMiddleware())
-	admin.Use(middleware.AdminMiddleware()) // We'll need to create this middleware
+	admin.Use(middleware.AuthMiddleware(middleware.AllowAPIKeys()))
+	admin.Use(staffOnly())
 	{
+		readPrograms := middleware.RequirePermission(models.PermissionProgramsRead)
+		writePrograms := middleware.RequirePermission(models.PermissionProgramsWrite)
+		readProducts := middleware.RequirePermission(models.PermissionProductsRead)
+		writeProducts := middleware.RequirePermission(models.PermissionProductsWrite)
+		readUsers := middleware.RequirePermission(models.PermissionUsersRead)
+		writeUsers := middleware.RequirePermission(models.PermissionUsersWrite)
+		manageRoles := middleware.RequirePermission(models.PermissionRolesManage)
+		readAudit := middleware.RequirePermission(models.PermissionAuditRead)
+
 		// Analytics dashboard
-		admin.GET("/analytics", ac.GetAnalyticsDashboard)
+		admin.GET("/analytics", middleware.RequirePermission(models.PermissionAnalyticsRead), ac.GetAnalyticsDashboard)
 
 		// Exercise management
-		admin.GET("/exercises", ac.GetAllExercises)
-		admin.GET("/exercises/:id", ac.GetExercise)
-		admin.POST("/exercises", ac.CreateExercise)
-		admin.PUT("/exercises/:id", ac.UpdateExercise)
-		admin.DELETE("/exercises/:id", ac.DeleteExercise)
+		admin.GET("/exercises", readPrograms, ac.GetAllExercises)
+		admin.GET("/exercises/:id", readPrograms, ac.GetExercise)
+		admin.POST("/exercises", writePrograms, ac.CreateExercise)
+		admin.PUT("/exercises/:id", writePrograms, ac.UpdateExercise)
+		admin.DELETE("/exercises/:id", writePrograms, ac.DeleteExercise)
 
 		// Program management
-		admin.GET("/programs", ac.GetAllPrograms)
-		admin.GET("/programs/:id", ac.GetProgram)
-		admin.POST("/programs", ac.CreateProgram)
-		admin.PUT("/programs/:id", ac.UpdateProgram)
-		admin.DELETE("/programs/:id", ac.DeleteProgram)
+		admin.GET("/programs", readPrograms, ac.GetAllPrograms)
+		admin.GET("/programs/:id", readPrograms, ac.GetProgram)
+		admin.POST("/programs", writePrograms, ac.CreateProgram)
+		admin.PUT("/programs/:id", writePrograms, ac.UpdateProgram)
+		admin.DELETE("/programs/:id", writePrograms, ac.DeleteProgram)
+
+		// Product catalog management
+		admin.GET("/products", readProducts, ac.GetAllProducts)
+		admin.GET("/products/:id", readProducts, ac.GetProduct)
+		admin.POST("/products", writeProducts, ac.CreateProduct)
+		admin.PUT("/products/:id", writeProducts, ac.UpdateProduct)
+		admin.DELETE("/products/:id", writeProducts, ac.DeleteProduct)
 
 		// Workout day management
-		admin.POST("/workout-days", ac.CreateWorkoutDay)
-		admin.PUT("/workout-days/:id", ac.UpdateWorkoutDay)
-		admin.DELETE("/workout-days/:id", ac.DeleteWorkoutDay)
+		admin.POST("/workout-days", writePrograms, ac.CreateWorkoutDay)
+		admin.PUT("/workout-days/:id", writePrograms, ac.UpdateWorkoutDay)
+		admin.DELETE("/workout-days/:id", writePrograms, ac.DeleteWorkoutDay)
 
 		// Workout block management
-		admin.POST("/workout-blocks", ac.CreateWorkoutBlock)
-		admin.PUT("/workout-blocks/:id", ac.UpdateWorkoutBlock)
-		admin.DELETE("/workout-blocks/:id", ac.DeleteWorkoutBlock)
+		admin.POST("/workout-blocks", writePrograms, ac.CreateWorkoutBlock)
+		admin.PUT("/workout-blocks/:id", writePrograms, ac.UpdateWorkoutBlock)
+		admin.DELETE("/workout-blocks/:id", writePrograms, ac.DeleteWorkoutBlock)
 
 		// Workout exercise management
-		admin.POST("/workout-exercises", ac.CreateWorkoutExercise)
-		admin.PUT("/workout-exercises/:id", ac.UpdateWorkoutExercise)
-		admin.DELETE("/workout-exercises/:id", ac.DeleteWorkoutExercise)
+		admin.POST("/workout-exercises", writePrograms, ac.CreateWorkoutExercise)
+		admin.PUT("/workout-exercises/:id", writePrograms, ac.UpdateWorkoutExercise)
+		admin.DELETE("/workout-exercises/:id", writePrograms, ac.DeleteWorkoutExercise)
 
 		// User management
-		admin.GET("/users", ac.GetAllUsers)
-		admin.GET("/users/:id", ac.GetUser)
-		admin.PUT("/users/:id", ac.UpdateUser)
-		admin.DELETE("/users/:id", ac.DeleteUser)
-		admin.POST("/users/:id/reset-password", ac.ResetUserPassword)
+		admin.GET("/users", readUsers, ac.GetAllUsers)
+		admin.GET("/users/:id", readUsers, ac.GetUser)
+		admin.PUT("/users/:id", writeUsers, ac.UpdateUser)
+		admin.DELETE("/users/:id", writeUsers, ac.DeleteUser)
+		admin.POST("/users/:id/reset-password", writeUsers, ac.ResetUserPassword)
+		admin.POST("/users/:id/unlock", writeUsers, ac.UnlockUser)
+		admin.PUT("/users/:id/coach", writeUsers, ac.AssignCoach)
+
+		// Coaching
+		admin.GET("/clients/:id/progress", middleware.RequirePermission(models.PermissionCoachingClients), ac.GetClientProgress)
+
+		// Roles and permissions
+		admin.GET("/permissions", manageRoles, ac.ListPermissions)
+		admin.GET("/roles", manageRoles, ac.ListRoles)
+		admin.POST("/roles", manageRoles, ac.CreateRole)
+		admin.PUT("/roles/:id", manageRoles, ac.UpdateRole)
+		admin.DELETE("/roles/:id", manageRoles, ac.DeleteRole)
+
+		// Audit log
+		admin.GET("/audit", readAudit, ac.SearchAuditEvents)
+		admin.GET("/audit/export", readAudit, ac.ExportAuditEvents)
 	}
 }
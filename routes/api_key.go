@@ -0,0 +1,27 @@
+package routes
+
+import (
+	"github.com/88warren/lmw-fitness-backend/controllers"
+	"github.com/88warren/lmw-fitness-backend/middleware"
+	"github.com/88warren/lmw-fitness-backend/models"
+	"github.com/gin-gonic/gin"
+)
+
+func RegisterAPIKeyRoutes(router *gin.Engine, kc *controllers.APIKeyController) {
+	// Keys can't manage keys, so a leaked one can't mint more
+	keys := router.Group("/api/api-keys")
+	keys.Use(middleware.AuthMiddleware(), staffOnly())
+	{
+		keys.GET("", kc.ListMyAPIKeys)
+		keys.POST("", kc.CreateAPIKey)
+		keys.DELETE("/:id", kc.RevokeMyAPIKey)
+	}
+
+	admin := router.Group("/api/admin")
+	admin.Use(middleware.AuthMiddleware())
+	admin.Use(staffOnly())
+	{
+		admin.GET("/api-keys", middleware.RequirePermission(models.PermissionUsersRead), kc.ListAPIKeys)
+		admin.DELETE("/api-keys/:id", middleware.RequirePermission(models.PermissionUsersWrite), kc.RevokeAPIKey)
+	}
+}
@@ -3,6 +3,7 @@ package routes
 import (
 	"github.com/88warren/lmw-fitness-backend/controllers"
 	"github.com/88warren/lmw-fitness-backend/middleware"
+	"github.com/88warren/lmw-fitness-backend/models"
 	"github.com/gin-gonic/gin"
 )
 
@@ -26,10 +27,14 @@ func RegisterAssessmentRoutes(router *gin.Engine, ac *controllers.AssessmentCont
 		// Get Day 1 assessment for specific exercise (for Day 30 comparison)
 		authenticated.GET("/:programName/exercise/:exerciseId/day1", ac.GetDay1Assessment)
 
-		// Debug endpoint to see all Day 1 assessments (admin only)
-		authenticated.GET("/debug/day1/all", ac.GetAllDay1Assessments)
-
 		// Delete specific assessment
 		authenticated.DELETE("/:id", ac.DeleteAssessment)
 	}
+
+	// Day 1 assessments across clients, for staff following their progress
+	staff := router.Group("/api/assessments/debug")
+	staff.Use(middleware.AuthMiddleware(), staffOnly(), middleware.RequirePermission(models.PermissionCoachingClients))
+	{
+		staff.GET("/day1/all", ac.GetAllDay1Assessments)
+	}
 }
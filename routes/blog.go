@@ -5,6 +5,7 @@ import (
 
 	"github.com/88warren/lmw-fitness-backend/controllers"
 	"github.com/88warren/lmw-fitness-backend/middleware"
+	"github.com/88warren/lmw-fitness-backend/models"
 	"github.com/gin-gonic/gin"
 )
 
@@ -14,7 +15,6 @@ func RegisterBlogRoutes(router *gin.Engine, bc *controllers.BlogController) {
 
 	authenticated := router.Group("/api")
 	authenticated.Use(middleware.AuthMiddleware())
-
 	{
 		authenticated.GET("/protected", func(c *gin.Context) {
 			userID := c.MustGet("userID").(uint)
@@ -22,8 +22,14 @@ func RegisterBlogRoutes(router *gin.Engine, bc *controllers.BlogController) {
 			userRole := c.MustGet("userRole").(string)
 			c.JSON(http.StatusOK, gin.H{"message": "Welcome, authenticated user!", "userID": userID, "email": userEmail, "role": userRole})
 		})
-		authenticated.POST("/blog", middleware.RoleMiddleware("admin"), bc.CreateBlog)
-		authenticated.PUT("/blog/:id", middleware.RoleMiddleware("admin"), bc.UpdateBlog)
-		authenticated.DELETE("/blog/:id", middleware.RoleMiddleware("admin"), bc.DeleteBlog)
+	}
+
+	publishing := router.Group("/api/blog")
+	publishing.Use(middleware.AuthMiddleware(middleware.AllowAPIKeys()))
+	publishing.Use(staffOnly(), middleware.RequirePermission(models.PermissionBlogPublish))
+	{
+		publishing.POST("", bc.CreateBlog)
+		publishing.PUT("/:id", bc.UpdateBlog)
+		publishing.DELETE("/:id", bc.DeleteBlog)
 	}
 }
@@ -0,0 +1,26 @@
+package routes
+
+import (
+	"github.com/88warren/lmw-fitness-backend/controllers"
+	"github.com/88warren/lmw-fitness-backend/middleware"
+	"github.com/88warren/lmw-fitness-backend/models"
+	"github.com/gin-gonic/gin"
+)
+
+func RegisterOrderRoutes(router *gin.Engine, oc *controllers.OrderController) {
+	orders := router.Group("/api/orders")
+	orders.Use(middleware.AuthMiddleware())
+	{
+		orders.GET("", oc.GetMyOrders)
+		orders.GET("/:id", oc.GetMyOrder)
+		orders.GET("/:id/invoice", oc.GetMyOrderInvoice)
+	}
+
+	admin := router.Group("/api/admin")
+	admin.Use(middleware.AuthMiddleware(middleware.AllowAPIKeys()))
+	admin.Use(staffOnly(), middleware.RequirePermission(models.PermissionOrdersRead))
+	{
+		admin.GET("/orders", oc.SearchOrders)
+		admin.GET("/orders/:id/invoice", oc.GetOrderInvoice)
+	}
+}
@@ -2,6 +2,8 @@ package routes
 
 import (
 	"github.com/88warren/lmw-fitness-backend/controllers"
+	"github.com/88warren/lmw-fitness-backend/middleware"
+	"github.com/88warren/lmw-fitness-backend/models"
 	"github.com/gin-gonic/gin"
 )
 
@@ -13,5 +15,34 @@ func RegisterPaymentRoutes(router *gin.Engine, pc *controllers.PaymentController
 		api.GET("/test-webhook", pc.TestWebhook)
 		api.POST("/get-workout-link", pc.GetWorkoutLink)
 		api.POST("/validate-coupon", pc.ValidateCoupon)
+		api.GET("/prices", pc.ListPrices)
+	}
+
+	authenticated := router.Group("/api")
+	authenticated.Use(middleware.AuthMiddleware())
+	{
+		authenticated.GET("/subscriptions", pc.GetMySubscriptions)
+		authenticated.POST("/billing-portal", pc.CreateBillingPortalSession)
+		authenticated.POST("/gifts/redeem", middleware.RequireVerifiedEmail(), pc.RedeemGiftCode)
+	}
+
+	admin := router.Group("/api/admin")
+	admin.Use(middleware.AuthMiddleware(middleware.AllowAPIKeys()))
+	admin.Use(staffOnly(), middleware.RequirePermission(models.PermissionPaymentsManage))
+	{
+		// Stripe webhook event ledger
+		admin.GET("/stripe-events", pc.ListStripeEvents)
+		admin.GET("/stripe-events/:id", pc.GetStripeEvent)
+		admin.POST("/stripe-events/:id/replay", pc.ReplayStripeEvent)
+
+		// Payment fulfilment job queue
+		admin.GET("/jobs", pc.ListJobs)
+		admin.GET("/jobs/:id", pc.GetJob)
+		admin.POST("/jobs/:id/retry", pc.RetryJob)
+		admin.POST("/jobs/:id/cancel", pc.CancelJob)
+		admin.POST("/jobs/rerun", pc.RerunFulfilment)
+
+		// Compare paid Stripe sessions with what was fulfilled
+		admin.POST("/reconcile", pc.ReconcileStripe)
 	}
 }
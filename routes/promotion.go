@@ -0,0 +1,21 @@
+package routes
+
+import (
+	"github.com/88warren/lmw-fitness-backend/controllers"
+	"github.com/88warren/lmw-fitness-backend/middleware"
+	"github.com/88warren/lmw-fitness-backend/models"
+	"github.com/gin-gonic/gin"
+)
+
+func RegisterPromotionRoutes(router *gin.Engine, prc *controllers.PromotionController) {
+	admin := router.Group("/api/admin")
+	admin.Use(middleware.AuthMiddleware(middleware.AllowAPIKeys()))
+	admin.Use(staffOnly(), middleware.RequirePermission(models.PermissionPromotionsWrite))
+	{
+		admin.GET("/promotions", prc.ListPromotions)
+		admin.GET("/promotions/:id", prc.GetPromotion)
+		admin.POST("/promotions", prc.CreatePromotion)
+		admin.PUT("/promotions/:id", prc.UpdatePromotion)
+		admin.DELETE("/promotions/:id", prc.DeactivatePromotion)
+	}
+}
@@ -0,0 +1,26 @@
+package routes
+
+import (
+	"github.com/88warren/lmw-fitness-backend/controllers"
+	"github.com/88warren/lmw-fitness-backend/middleware"
+	"github.com/88warren/lmw-fitness-backend/models"
+	"github.com/gin-gonic/gin"
+)
+
+func RegisterReferralRoutes(router *gin.Engine, rc *controllers.ReferralController) {
+	referrals := router.Group("/api/referrals")
+	referrals.Use(middleware.AuthMiddleware())
+	{
+		referrals.GET("/me", rc.GetMyReferral)
+	}
+
+	admin := router.Group("/api/admin")
+	admin.Use(middleware.AuthMiddleware(middleware.AllowAPIKeys()))
+	admin.Use(staffOnly(), middleware.RequirePermission(models.PermissionReferralsManage))
+	{
+		admin.GET("/referrals/conversions", rc.ListConversions)
+		admin.GET("/referrals/payouts", rc.GetPayoutReport)
+		admin.GET("/referrals/payouts/export", rc.ExportPayoutReport)
+		admin.POST("/referrals/payouts/:userId", rc.RecordPayout)
+	}
+}
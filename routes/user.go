@@ -7,24 +7,48 @@ import (
 )
 
 func RegisterUserRoutes(router *gin.Engine, uc *controllers.UserController) {
+	router.GET("/.well-known/jwks.json", uc.JWKS)
+
 	api := router.Group("/api")
 	{
 		api.POST("/register", uc.RegisterUser)
 		api.POST("/login", uc.LoginUser)
+		api.POST("/login/magic-link", uc.RequestMagicLink)
+		api.POST("/login/2fa", uc.LoginTwoFactor)
+		api.GET("/login/oidc", uc.ListOIDCProviders)
+		api.POST("/login/oidc/:provider", uc.StartOIDCLogin)
+		api.POST("/login/oidc/:provider/callback", uc.CompleteOIDCLogin)
 		api.POST("/forgot-password", uc.RequestPasswordReset)
 		api.POST("/verify-reset-token", uc.VerifyResetToken)
 		api.POST("/reset-password", uc.ResetPassword)
 		api.POST("/verify-workout-token", uc.VerifyWorkoutToken)
-		api.POST("/refresh-token", middleware.AuthMiddleware(), uc.RefreshToken)
+		api.POST("/verify-email", uc.VerifyEmail)
+		api.POST("/refresh-token", uc.RefreshToken)
+		api.POST("/logout", uc.Logout)
 		api.POST("/test-email", uc.TestEmail) // Test endpoint for SMTP debugging
 	}
 	authenticated := api.Group("")
 	authenticated.Use(middleware.AuthMiddleware())
 	{
-		authenticated.PUT("/change-password-first-login", uc.ChangePassword)
-		authenticated.POST("/set-first-time-password", uc.SetFirstTimePassword)
+		authenticated.POST("/verify-email/resend", uc.ResendVerificationEmail)
 		authenticated.GET("/profile", uc.GetProfile)
 		authenticated.PUT("/timezone", uc.UpdateTimezone)
 		authenticated.PUT("/reminder-opt-out", uc.UpdateReminderOptOut)
+
+		authenticated.PUT("/change-password-first-login", middleware.RequireVerifiedEmail(), uc.ChangePassword)
+		authenticated.POST("/set-first-time-password", middleware.RequireVerifiedEmail(), uc.SetFirstTimePassword)
+
+		// Signed-in devices
+		authenticated.GET("/sessions", uc.ListSessions)
+		authenticated.DELETE("/sessions", uc.RevokeOtherSessions)
+		authenticated.DELETE("/sessions/:id", uc.RevokeSession)
+
+		// Two-factor authentication
+		authenticated.GET("/2fa", uc.GetTwoFactorStatus)
+		authenticated.POST("/2fa/setup", uc.SetupTwoFactor)
+		authenticated.POST("/2fa/enable", uc.EnableTwoFactor)
+		authenticated.POST("/2fa/verify", uc.VerifyTwoFactor)
+		authenticated.POST("/2fa/recovery-codes", uc.RegenerateRecoveryCodes)
+		authenticated.POST("/2fa/disable", uc.DisableTwoFactor)
 	}
 }
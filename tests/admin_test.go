@@ -0,0 +1,120 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/88warren/lmw-fitness-backend/controllers"
+	"github.com/88warren/lmw-fitness-backend/database"
+	"github.com/88warren/lmw-fitness-backend/models"
+	"github.com/88warren/lmw-fitness-backend/rbac"
+	"github.com/88warren/lmw-fitness-backend/routes"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRolePermissions(t *testing.T) {
+	db := GetTestDB()
+	if db == nil {
+		t.Skip("Skipping database test - no connection available")
+	}
+	t.Setenv("ADMIN_REQUIRE_2FA", "false")
+	database.RoleSeed(db)
+	rbac.Invalidate()
+
+	suffix := time.Now().UnixNano()
+	newUser := func(name, role string) (models.User, string) {
+		user := models.User{Email: fmt.Sprintf("%s_%d@example.com", name, suffix), PasswordHash: "x", Role: role}
+		require.NoError(t, db.Create(&user).Error)
+		return user, sessionToken(t, user)
+	}
+	_, adminToken := newUser("rbac_admin", models.RoleAdmin)
+	coach, coachToken := newUser("rbac_coach", models.RoleCoach)
+	client, clientToken := newUser("rbac_client", models.RoleUser)
+	spare, _ := newUser("rbac_spare", models.RoleUser)
+	defer db.Unscoped().Where("email LIKE ?", fmt.Sprintf("rbac_%%_%d@example.com", suffix)).Delete(&models.User{})
+
+	router := gin.New()
+	routes.RegisterAdminRoutes(router, controllers.NewAdminController(db))
+	send := func(method, path, token string, body interface{}) *httptest.ResponseRecorder {
+		jsonBody, _ := json.Marshal(body)
+		req, _ := http.NewRequest(method, path, bytes.NewBuffer(jsonBody))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// A coach can work on programs and see their own clients, but not manage
+	// accounts
+	assert.Equal(t, http.StatusOK, send("GET", "/api/admin/exercises", coachToken, nil).Code)
+	progress := fmt.Sprintf("/api/admin/clients/%d/progress", client.ID)
+	assert.Equal(t, http.StatusForbidden, send("GET", progress, coachToken, nil).Code)
+	assert.Equal(t, http.StatusForbidden, send("PUT", fmt.Sprintf("/api/admin/users/%d/coach", client.ID), coachToken, map[string]uint{"coachId": coach.ID}).Code)
+	assert.Equal(t, http.StatusBadRequest, send("PUT", fmt.Sprintf("/api/admin/users/%d/coach", client.ID), adminToken, map[string]uint{"coachId": spare.ID}).Code)
+	require.Equal(t, http.StatusOK, send("PUT", fmt.Sprintf("/api/admin/users/%d/coach", client.ID), adminToken, map[string]uint{"coachId": coach.ID}).Code)
+	assert.Equal(t, http.StatusOK, send("GET", progress, coachToken, nil).Code)
+	assert.Equal(t, http.StatusForbidden, send("GET", fmt.Sprintf("/api/admin/clients/%d/progress", spare.ID), coachToken, nil).Code)
+	assert.Equal(t, http.StatusOK, send("GET", fmt.Sprintf("/api/admin/users/%d", client.ID), coachToken, nil).Code)
+	assert.Equal(t, http.StatusForbidden, send("DELETE", fmt.Sprintf("/api/admin/users/%d", spare.ID), coachToken, nil).Code)
+	assert.Equal(t, http.StatusForbidden, send("GET", "/api/admin/analytics", coachToken, nil).Code)
+	assert.Equal(t, http.StatusForbidden, send("GET", "/api/admin/roles", coachToken, nil).Code)
+	assert.Equal(t, http.StatusForbidden, send("GET", "/api/admin/products", coachToken, nil).Code)
+
+	// Customers don't get into the admin API at all
+	assert.Equal(t, http.StatusForbidden, send("GET", "/api/admin/exercises", clientToken, nil).Code)
+
+	// A custom role with read-only access to programs and products
+	w := send("POST", "/api/admin/roles", adminToken, map[string]interface{}{
+		"name":        fmt.Sprintf("assistant_%d", suffix),
+		"permissions": []string{models.PermissionProgramsRead, models.PermissionProductsRead},
+	})
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var role models.Role
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &role))
+	defer db.Unscoped().Select("Permissions").Delete(&role)
+	assert.Equal(t, http.StatusBadRequest, send("POST", "/api/admin/roles", adminToken, map[string]interface{}{
+		"name":        fmt.Sprintf("bogus_%d", suffix),
+		"permissions": []string{"everything:all"},
+	}).Code)
+
+	// The role applies to the client's existing token straight away
+	assert.Equal(t, http.StatusBadRequest, send("PUT", fmt.Sprintf("/api/admin/users/%d", client.ID), adminToken, map[string]string{"role": "nonexistent"}).Code)
+	w = send("PUT", fmt.Sprintf("/api/admin/users/%d", client.ID), adminToken, map[string]string{"role": role.Name})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, http.StatusOK, send("GET", "/api/admin/exercises", clientToken, nil).Code)
+	assert.Equal(t, http.StatusForbidden, send("POST", "/api/admin/exercises", clientToken, map[string]string{"name": "Nope"}).Code)
+	assert.Equal(t, http.StatusOK, send("GET", "/api/admin/products", clientToken, nil).Code)
+	assert.Equal(t, http.StatusForbidden, send("POST", "/api/admin/products", clientToken, map[string]string{"name": "Nope"}).Code)
+
+	// Roles in use can't be deleted
+	path := fmt.Sprintf("/api/admin/roles/%d", role.ID)
+	assert.Equal(t, http.StatusConflict, send("DELETE", path, adminToken, nil).Code)
+	require.Equal(t, http.StatusOK, send("PUT", fmt.Sprintf("/api/admin/users/%d", client.ID), adminToken, map[string]string{"role": models.RoleUser}).Code)
+	assert.Equal(t, http.StatusOK, send("DELETE", path, adminToken, nil).Code)
+
+	// Managing accounts covers customers, but not staff with more access
+	w = send("POST", "/api/admin/roles", adminToken, map[string]interface{}{
+		"name":        fmt.Sprintf("support_%d", suffix),
+		"permissions": []string{models.PermissionUsersRead, models.PermissionUsersWrite},
+	})
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var support models.Role
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &support))
+	defer db.Unscoped().Select("Permissions").Delete(&support)
+	_, supportToken := newUser("rbac_support", support.Name)
+	assert.Equal(t, http.StatusForbidden, send("DELETE", fmt.Sprintf("/api/admin/users/%d", coach.ID), supportToken, nil).Code)
+	assert.Equal(t, http.StatusForbidden, send("POST", fmt.Sprintf("/api/admin/users/%d/reset-password", coach.ID), supportToken, nil).Code)
+	assert.Equal(t, http.StatusNoContent, send("DELETE", fmt.Sprintf("/api/admin/users/%d", spare.ID), supportToken, nil).Code)
+
+	// Admins keep full access
+	assert.Equal(t, http.StatusOK, send("GET", "/api/admin/analytics", adminToken, nil).Code)
+	assert.Equal(t, http.StatusOK, send("GET", fmt.Sprintf("/api/admin/clients/%d/progress", client.ID), adminToken, nil).Code)
+}
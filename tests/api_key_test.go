@@ -0,0 +1,104 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/88warren/lmw-fitness-backend/controllers"
+	"github.com/88warren/lmw-fitness-backend/database"
+	"github.com/88warren/lmw-fitness-backend/models"
+	"github.com/88warren/lmw-fitness-backend/rbac"
+	"github.com/88warren/lmw-fitness-backend/routes"
+	"github.com/88warren/lmw-fitness-backend/utils/auth"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPIKeys(t *testing.T) {
+	db := GetTestDB()
+	if db == nil {
+		t.Skip("Skipping database test - no connection available")
+	}
+	t.Setenv("ADMIN_REQUIRE_2FA", "false")
+	database.RoleSeed(db)
+	rbac.Invalidate()
+
+	suffix := time.Now().UnixNano()
+	newUser := func(name, role string) (models.User, string) {
+		user := models.User{Email: fmt.Sprintf("%s_%d@example.com", name, suffix), PasswordHash: "x", Role: role}
+		require.NoError(t, db.Create(&user).Error)
+		return user, sessionToken(t, user)
+	}
+	_, adminToken := newUser("apikey_admin", models.RoleAdmin)
+	coach, coachToken := newUser("apikey_coach", models.RoleCoach)
+	defer db.Unscoped().Where("user_id = ?", coach.ID).Delete(&models.APIKey{})
+	defer db.Unscoped().Where("email LIKE ?", fmt.Sprintf("apikey_%%_%d@example.com", suffix)).Delete(&models.User{})
+
+	router := gin.New()
+	routes.RegisterAdminRoutes(router, controllers.NewAdminController(db))
+	routes.RegisterAPIKeyRoutes(router, controllers.NewAPIKeyController(db))
+	routes.RegisterUserRoutes(router, controllers.NewUserController(db))
+	send := func(method, path, token string, body interface{}) *httptest.ResponseRecorder {
+		jsonBody, _ := json.Marshal(body)
+		req, _ := http.NewRequest(method, path, bytes.NewBuffer(jsonBody))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// Keys can only carry permissions their owner has
+	assert.Equal(t, http.StatusBadRequest, send("POST", "/api/api-keys", coachToken, map[string]interface{}{
+		"name": "Too much", "scopes": []string{models.PermissionUsersWrite},
+	}).Code)
+	w := send("POST", "/api/api-keys", coachToken, map[string]interface{}{
+		"name": "Blog prerender", "scopes": []string{models.PermissionProgramsRead},
+	})
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var created struct {
+		Key    string        `json:"key"`
+		APIKey models.APIKey `json:"apiKey"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	require.True(t, auth.IsAPIKey(created.Key))
+	assert.Contains(t, created.Key, created.APIKey.Prefix+"_")
+	assert.NotContains(t, w.Body.String(), auth.HashToken(created.Key))
+
+	// The key acts as the coach, limited to its scopes
+	assert.Equal(t, http.StatusOK, send("GET", "/api/admin/exercises", created.Key, nil).Code)
+	assert.Equal(t, http.StatusForbidden, send("POST", "/api/admin/exercises", created.Key, map[string]string{"name": "Nope"}).Code)
+
+	// Only permission-checked routes take keys, so a key can't act as its
+	// owner elsewhere, touch account security or mint more keys
+	assert.Equal(t, http.StatusForbidden, send("GET", "/api/profile", created.Key, nil).Code)
+	assert.Equal(t, http.StatusForbidden, send("GET", "/api/sessions", created.Key, nil).Code)
+	assert.Equal(t, http.StatusForbidden, send("POST", "/api/api-keys", created.Key, map[string]interface{}{
+		"name": "Another", "scopes": []string{models.PermissionProgramsRead},
+	}).Code)
+
+	var stored models.APIKey
+	require.NoError(t, db.First(&stored, created.APIKey.ID).Error)
+	require.NotNil(t, stored.LastUsedAt)
+	assert.Equal(t, auth.HashToken(created.Key), stored.KeyHash)
+
+	// Wrong secrets and expired keys are refused
+	assert.Equal(t, http.StatusUnauthorized, send("GET", "/api/admin/exercises", created.APIKey.Prefix+"_wrong", nil).Code)
+	expiresAt := stored.ExpiresAt
+	require.NoError(t, db.Model(&stored).Update("expires_at", time.Now().Add(-time.Minute)).Error)
+	assert.Equal(t, http.StatusUnauthorized, send("GET", "/api/admin/exercises", created.Key, nil).Code)
+	require.NoError(t, db.Model(&stored).Update("expires_at", expiresAt).Error)
+
+	// Staff can find and revoke a leaked key
+	w = send("GET", fmt.Sprintf("/api/admin/api-keys?userId=%d", coach.ID), adminToken, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), created.APIKey.Prefix)
+	require.Equal(t, http.StatusOK, send("DELETE", fmt.Sprintf("/api/admin/api-keys/%d", created.APIKey.ID), adminToken, nil).Code)
+	assert.Equal(t, http.StatusUnauthorized, send("GET", "/api/admin/exercises", created.Key, nil).Code)
+}
@@ -7,12 +7,17 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/88warren/lmw-fitness-backend/config"
 	"github.com/88warren/lmw-fitness-backend/controllers"
+	"github.com/88warren/lmw-fitness-backend/database"
 	"github.com/88warren/lmw-fitness-backend/models"
+	"github.com/88warren/lmw-fitness-backend/rbac"
 	"github.com/88warren/lmw-fitness-backend/routes"
+	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -192,6 +197,70 @@ func TestSaveAssessmentDay30(t *testing.T) {
 	db.Delete(&user)
 }
 
+func TestDay1AssessmentsForStaff(t *testing.T) {
+	db := GetTestDB()
+	if db == nil {
+		t.Skip("Skipping database test - no connection available")
+	}
+	t.Setenv("ADMIN_REQUIRE_2FA", "false")
+	database.RoleSeed(db)
+	rbac.Invalidate()
+
+	router := gin.New()
+	routes.RegisterAssessmentRoutes(router, controllers.NewAssessmentController(db))
+
+	suffix := time.Now().UnixNano()
+	newUser := func(name, role string, coachID *uint) models.User {
+		user := models.User{Email: fmt.Sprintf("%s_%d@example.com", name, suffix), PasswordHash: "x", Role: role, CoachID: coachID}
+		require.NoError(t, db.Create(&user).Error)
+		return user
+	}
+	coach := newUser("day1_coach", models.RoleCoach, nil)
+	admin := newUser("day1_admin", models.RoleAdmin, nil)
+	client := newUser("day1_client", models.RoleUser, &coach.ID)
+	stranger := newUser("day1_stranger", models.RoleUser, nil)
+
+	exercise := models.Exercise{Name: fmt.Sprintf("Day 1 Squats %d", suffix)}
+	require.NoError(t, db.Create(&exercise).Error)
+	for _, user := range []models.User{client, stranger} {
+		reps := 20
+		require.NoError(t, db.Create(&models.FitnessAssessment{
+			UserID: user.ID, ProgramName: "beginner-program", DayNumber: 1,
+			ExerciseID: exercise.ID, ExerciseName: exercise.Name, Reps: &reps, RecordedDate: time.Now(),
+		}).Error)
+	}
+
+	list := func(user models.User) (int, []string) {
+		req, _ := http.NewRequest("GET", "/api/assessments/debug/day1/all", nil)
+		req.Header.Set("Authorization", "Bearer "+sessionToken(t, user))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var rows []struct {
+			UserEmail string `json:"userEmail"`
+		}
+		_ = json.Unmarshal(w.Body.Bytes(), &rows)
+		emails := []string{}
+		for _, row := range rows {
+			emails = append(emails, row.UserEmail)
+		}
+		return w.Code, emails
+	}
+
+	code, _ := list(stranger)
+	assert.Equal(t, http.StatusForbidden, code)
+
+	// A coach only sees their own clients
+	code, emails := list(coach)
+	require.Equal(t, http.StatusOK, code)
+	assert.Contains(t, emails, client.Email)
+	assert.NotContains(t, emails, stranger.Email)
+
+	code, emails = list(admin)
+	require.Equal(t, http.StatusOK, code)
+	assert.Contains(t, emails, client.Email)
+	assert.Contains(t, emails, stranger.Email)
+}
+
 // Helper function to create JWT token for testing
 func createTestJWTToken(userID uint) string {
 	// This is a simplified token for testing
@@ -0,0 +1,115 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/88warren/lmw-fitness-backend/audit"
+	"github.com/88warren/lmw-fitness-backend/controllers"
+	"github.com/88warren/lmw-fitness-backend/database"
+	"github.com/88warren/lmw-fitness-backend/models"
+	"github.com/88warren/lmw-fitness-backend/rbac"
+	"github.com/88warren/lmw-fitness-backend/routes"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditDiff(t *testing.T) {
+	before, after := audit.Diff(
+		map[string]interface{}{"email": "a@example.com", "role": "user"},
+		map[string]interface{}{"email": "a@example.com", "role": "coach", "name": "A"},
+	)
+	assert.Equal(t, map[string]interface{}{"role": "user"}, before)
+	assert.Equal(t, map[string]interface{}{"role": "coach", "name": "A"}, after)
+
+	// Created and deleted things keep the whole snapshot
+	before, after = audit.Diff(nil, map[string]interface{}{"name": "assistant"})
+	assert.Nil(t, before)
+	assert.Equal(t, map[string]interface{}{"name": "assistant"}, after)
+}
+
+func TestAuditLog(t *testing.T) {
+	db := GetTestDB()
+	if db == nil {
+		t.Skip("Skipping database test - no connection available")
+	}
+	t.Setenv("ADMIN_REQUIRE_2FA", "false")
+	database.RoleSeed(db)
+	rbac.Invalidate()
+
+	suffix := time.Now().UnixNano()
+	newUser := func(name, role string) (models.User, string) {
+		user := models.User{Email: fmt.Sprintf("%s_%d@example.com", name, suffix), PasswordHash: "x", Role: role}
+		require.NoError(t, db.Create(&user).Error)
+		return user, sessionToken(t, user)
+	}
+	admin, adminToken := newUser("audit_admin", models.RoleAdmin)
+	_, coachToken := newUser("audit_coach", models.RoleCoach)
+	client, _ := newUser("audit_client", models.RoleUser)
+	defer db.Unscoped().Where("email LIKE ?", fmt.Sprintf("audit_%%_%d@example.com", suffix)).Delete(&models.User{})
+
+	router := gin.New()
+	routes.RegisterAdminRoutes(router, controllers.NewAdminController(db))
+	send := func(method, path, token string, body interface{}) *httptest.ResponseRecorder {
+		jsonBody, _ := json.Marshal(body)
+		req, _ := http.NewRequest(method, path, bytes.NewBuffer(jsonBody))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("User-Agent", "=HYPERLINK(\"http://evil\")")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send("PUT", fmt.Sprintf("/api/admin/users/%d", client.ID), adminToken, map[string]interface{}{"role": models.RoleCoach, "isActive": false})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	// The role change is recorded with who made it and what changed, apart
+	// from the other changes made with it
+	search := func(action string) []models.AuditEvent {
+		w := send("GET", fmt.Sprintf("/api/admin/audit?targetType=user&targetId=%d&action=%s", client.ID, action), adminToken, nil)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var response struct {
+			Events []models.AuditEvent `json:"events"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		return response.Events
+	}
+	updated := search(audit.ActionUserUpdated)
+	require.Len(t, updated, 1)
+	assert.Equal(t, map[string]interface{}{"is_active": true}, updated[0].Before)
+	assert.Equal(t, map[string]interface{}{"is_active": false}, updated[0].After)
+	roleChanges := search(audit.ActionUserRoleChanged)
+	require.Len(t, roleChanges, 1)
+	event := roleChanges[0]
+	assert.Equal(t, audit.ActionUserRoleChanged, event.Action)
+	require.NotNil(t, event.ActorID)
+	assert.Equal(t, admin.ID, *event.ActorID)
+	assert.Equal(t, admin.Email, event.ActorEmail)
+	assert.Equal(t, models.RoleUser, event.Before["role"])
+	assert.Equal(t, models.RoleCoach, event.After["role"])
+
+	// Events can't be rewritten
+	assert.ErrorIs(t, db.Model(&event).Update("action", "nothing").Error, models.ErrAuditEventImmutable)
+
+	// The export is CSV, and cells that look like formulas are defused
+	w = send("GET", fmt.Sprintf("/api/admin/audit/export?targetType=user&targetId=%d", client.ID), adminToken, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "text/csv", w.Header().Get("Content-Type"))
+	records, err := csv.NewReader(w.Body).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	assert.ElementsMatch(t, []string{audit.ActionUserRoleChanged, audit.ActionUserUpdated}, []string{records[1][2], records[2][2]})
+	assert.Equal(t, "'=HYPERLINK(\"http://evil\")", records[1][12])
+
+	// Bad filters and staff without audit:read are refused
+	assert.Equal(t, http.StatusBadRequest, send("GET", "/api/admin/audit?from=yesterday", adminToken, nil).Code)
+	assert.Equal(t, http.StatusForbidden, send("GET", "/api/admin/audit", coachToken, nil).Code)
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/88warren/lmw-fitness-backend/config"
 	"github.com/88warren/lmw-fitness-backend/controllers"
 	"github.com/88warren/lmw-fitness-backend/routes"
+	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -36,3 +37,28 @@ func TestDatabaseHealthCheck(t *testing.T) {
 	err = sqlDB.Ping()
 	assert.NoError(t, err)
 }
+
+func TestClientIPIgnoresUntrustedForwarding(t *testing.T) {
+	clientIP := func(remoteAddr, forwardedFor string) string {
+		router := config.SetupServer()
+		router.GET("/test/ip", func(c *gin.Context) {
+			c.String(http.StatusOK, c.ClientIP())
+		})
+		req, _ := http.NewRequest("GET", "/test/ip", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Body.String()
+	}
+
+	// Anyone can send X-Forwarded-For, so by default it is ignored
+	t.Setenv("TRUSTED_PROXIES", "")
+	assert.Equal(t, "203.0.113.9", clientIP("203.0.113.9:4321", "198.51.100.1"))
+
+	// Behind a listed proxy the forwarded address is used, but only when the
+	// request actually came through that proxy
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8")
+	assert.Equal(t, "198.51.100.1", clientIP("10.1.2.3:4321", "198.51.100.1"))
+	assert.Equal(t, "203.0.113.9", clientIP("203.0.113.9:4321", "198.51.100.1"))
+}
@@ -0,0 +1,126 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/88warren/lmw-fitness-backend/controllers"
+	"github.com/88warren/lmw-fitness-backend/database"
+	"github.com/88warren/lmw-fitness-backend/gateway"
+	"github.com/88warren/lmw-fitness-backend/models"
+	"github.com/88warren/lmw-fitness-backend/rbac"
+	"github.com/88warren/lmw-fitness-backend/routes"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+func TestAdminJobEndpoints(t *testing.T) {
+	db := GetTestDB()
+	if db == nil {
+		t.Skip("Skipping database test - no connection available")
+	}
+	t.Setenv("ADMIN_REQUIRE_2FA", "false")
+	database.RoleSeed(db)
+	rbac.Invalidate()
+
+	suffix := time.Now().UnixNano()
+	admin := models.User{Email: fmt.Sprintf("jobs_admin_%d@example.com", suffix), PasswordHash: "x", Role: models.RoleAdmin}
+	require.NoError(t, db.Create(&admin).Error)
+	defer db.Unscoped().Delete(&admin)
+	adminToken := sessionToken(t, admin)
+
+	newJob := func(name, status string) models.Job {
+		job := models.Job{
+			SessionID:     fmt.Sprintf("cs_jobs_%s_%d", name, suffix),
+			CustomerEmail: fmt.Sprintf("jobs_%d@example.com", suffix),
+			Status:        status,
+			Attempts:      3,
+			NextRunAt:     time.Now().Add(time.Hour),
+			LastError:     "fulfilment failed",
+		}
+		require.NoError(t, db.Create(&job).Error)
+		return job
+	}
+	reload := func(job models.Job) models.Job {
+		require.NoError(t, db.First(&job, job.ID).Error)
+		return job
+	}
+
+	dead := newJob("dead", models.JobStatusDead)
+	require.NoError(t, db.Create(&models.JobAttempt{JobID: dead.ID, Attempt: 3, WorkerID: "worker-1", StartedAt: time.Now(), Error: "fulfilment failed"}).Error)
+	pending := newJob("pending", models.JobStatusPending)
+	leased := newJob("leased", models.JobStatusProcessing)
+
+	fake := gateway.NewFake()
+	brevo := newFakeBrevo()
+	defer brevo.server.Close()
+	_, router := newPurchaseTestController(fake, brevo)
+	send := func(router *gin.Engine, method, path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// Listing filters by session, and a job comes back with its attempts
+	w := send(router, "GET", "/api/admin/jobs?sessionId="+dead.SessionID)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var list struct {
+		Jobs  []models.Job `json:"jobs"`
+		Total int64        `json:"total"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	require.Equal(t, int64(1), list.Total)
+	assert.Equal(t, dead.ID, list.Jobs[0].ID)
+
+	w = send(router, "GET", fmt.Sprintf("/api/admin/jobs/%d", dead.ID))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var detail models.Job
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &detail))
+	require.Len(t, detail.AttemptHistory, 1)
+	assert.Equal(t, "worker-1", detail.AttemptHistory[0].WorkerID)
+	assert.Equal(t, http.StatusNotFound, send(router, "GET", "/api/admin/jobs/999999999").Code)
+
+	// Retrying a dead job gives it a fresh set of attempts, due now
+	w = send(router, "POST", fmt.Sprintf("/api/admin/jobs/%d/retry", dead.ID))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	dead = reload(dead)
+	assert.Equal(t, models.JobStatusPending, dead.Status)
+	assert.Zero(t, dead.Attempts)
+	assert.False(t, dead.NextRunAt.After(time.Now()))
+
+	// A leased job can be neither retried nor cancelled
+	assert.Equal(t, http.StatusConflict, send(router, "POST", fmt.Sprintf("/api/admin/jobs/%d/retry", leased.ID)).Code)
+	assert.Equal(t, http.StatusConflict, send(router, "POST", fmt.Sprintf("/api/admin/jobs/%d/cancel", leased.ID)).Code)
+	assert.Equal(t, models.JobStatusProcessing, reload(leased).Status)
+
+	// Cancelling only happens once
+	require.Equal(t, http.StatusOK, send(router, "POST", fmt.Sprintf("/api/admin/jobs/%d/cancel", pending.ID)).Code)
+	assert.Equal(t, models.JobStatusCancelled, reload(pending).Status)
+	assert.Equal(t, http.StatusConflict, send(router, "POST", fmt.Sprintf("/api/admin/jobs/%d/cancel", pending.ID)).Code)
+
+	// A worker claiming the job between the handler loading and updating it
+	// is reported as a conflict, not as a successful retry
+	sqlDB, err := db.DB()
+	require.NoError(t, err)
+	racingDB, err := gorm.Open(postgres.New(postgres.Config{Conn: sqlDB}), &gorm.Config{})
+	require.NoError(t, err)
+	racing := newJob("racing", models.JobStatusDead)
+	require.NoError(t, racingDB.Callback().Update().Before("gorm:update").Register("test:claim_job", func(tx *gorm.DB) {
+		db.Model(&models.Job{}).Where("id = ?", racing.ID).Update("status", models.JobStatusProcessing)
+	}))
+	racingRouter := gin.New()
+	routes.RegisterPaymentRoutes(racingRouter, controllers.NewPaymentControllerWithGateway(racingDB, fake))
+	assert.Equal(t, http.StatusConflict, send(racingRouter, "POST", fmt.Sprintf("/api/admin/jobs/%d/retry", racing.ID)).Code)
+	racing = reload(racing)
+	assert.Equal(t, models.JobStatusProcessing, racing.Status)
+	assert.Equal(t, 3, racing.Attempts)
+}
@@ -0,0 +1,171 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/88warren/lmw-fitness-backend/controllers"
+	"github.com/88warren/lmw-fitness-backend/internal/oidctest"
+	"github.com/88warren/lmw-fitness-backend/models"
+	"github.com/88warren/lmw-fitness-backend/oidc"
+	"github.com/88warren/lmw-fitness-backend/routes"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const stubRedirectURL = "http://localhost:3000/auth/callback/stub"
+
+func newStubIdP(t *testing.T) (*oidctest.Stub, *oidc.Provider) {
+	server := httptest.NewServer(nil)
+	t.Cleanup(server.Close)
+	stub, err := oidctest.NewStub(server.URL, "lmw-test-client", "lmw-test-secret")
+	require.NoError(t, err)
+	server.Config.Handler = stub
+	return stub, oidc.NewProvider(stub.Config("stub", stubRedirectURL), server.Client())
+}
+
+func TestOIDCVerification(t *testing.T) {
+	stub, provider := newStubIdP(t)
+	ctx := context.Background()
+	identity := oidctest.Identity{Subject: "sub-1", Email: "Someone@Example.com", EmailVerified: true}
+
+	// The happy path, with the code sent to the redirect URL
+	verifier, _ := oidc.RandomString()
+	authURL, err := provider.AuthCodeURL(ctx, "state-1", "nonce-1", oidc.CodeChallenge(verifier))
+	require.NoError(t, err)
+	callback, err := stub.Authorize(authURL, identity)
+	require.NoError(t, err)
+	parsed, _ := url.Parse(callback)
+	assert.Equal(t, "state-1", parsed.Query().Get("state"))
+	claims, err := provider.Exchange(ctx, parsed.Query().Get("code"), verifier, "nonce-1")
+	require.NoError(t, err)
+	assert.Equal(t, "sub-1", claims.Subject)
+	assert.Equal(t, "someone@example.com", claims.Email)
+	assert.True(t, claims.EmailVerified)
+
+	// PKCE: a stolen code is useless without the verifier
+	callback, _ = stub.Authorize(authURL, identity)
+	parsed, _ = url.Parse(callback)
+	otherVerifier, _ := oidc.RandomString()
+	_, err = provider.Exchange(ctx, parsed.Query().Get("code"), otherVerifier, "nonce-1")
+	assert.Error(t, err)
+
+	// Nonce, lifetime and signature are all checked
+	token, _ := stub.IDToken(identity, "nonce-1", time.Minute)
+	_, err = provider.Verify(ctx, token, "nonce-2")
+	assert.ErrorIs(t, err, oidc.ErrNonceMismatch)
+	token, _ = stub.IDToken(identity, "nonce-1", -time.Hour)
+	_, err = provider.Verify(ctx, token, "nonce-1")
+	assert.ErrorIs(t, err, oidc.ErrInvalidIDToken)
+	impostor, err := oidctest.NewStub(stub.Issuer, stub.ClientID, stub.ClientSecret)
+	require.NoError(t, err)
+	token, _ = impostor.IDToken(identity, "nonce-1", time.Minute)
+	_, err = provider.Verify(ctx, token, "nonce-1")
+	assert.ErrorIs(t, err, oidc.ErrInvalidIDToken)
+
+	// Tokens for another client are refused
+	otherClient, _ := oidctest.NewStub(stub.Issuer, "someone-else", "")
+	otherProvider := oidc.NewProvider(otherClient.Config("other", stubRedirectURL), nil)
+	otherProvider.Config.AuthURL = stub.Issuer + "/authorize"
+	otherProvider.Config.TokenURL = stub.Issuer + "/token"
+	otherProvider.Config.JWKSURL = stub.Issuer + "/jwks"
+	token, _ = stub.IDToken(identity, "nonce-1", time.Minute)
+	_, err = otherProvider.Verify(ctx, token, "nonce-1")
+	assert.ErrorIs(t, err, oidc.ErrInvalidIDToken)
+}
+
+func TestOIDCLogin(t *testing.T) {
+	db := GetTestDB()
+	if db == nil {
+		t.Skip("Skipping database test - no connection available")
+	}
+
+	stub, provider := newStubIdP(t)
+	uc := controllers.NewUserController(db)
+	uc.OIDC = map[string]*oidc.Provider{"stub": provider}
+	router := gin.New()
+	routes.RegisterUserRoutes(router, uc)
+
+	send := func(path string, body interface{}) *httptest.ResponseRecorder {
+		jsonBody, _ := json.Marshal(body)
+		req, _ := http.NewRequest("POST", path, bytes.NewBuffer(jsonBody))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	type loginResponse struct {
+		Token   string              `json:"token"`
+		Created bool                `json:"created"`
+		User    models.UserResponse `json:"user"`
+	}
+	// signIn runs the browser's side of the flow and returns the callback
+	// request the frontend would make
+	signIn := func(identity oidctest.Identity) map[string]string {
+		w := send("/api/login/oidc/stub", nil)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var started struct {
+			AuthorizationURL string `json:"authorizationUrl"`
+			State            string `json:"state"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &started))
+		callback, err := stub.Authorize(started.AuthorizationURL, identity)
+		require.NoError(t, err)
+		parsed, _ := url.Parse(callback)
+		require.Equal(t, started.State, parsed.Query().Get("state"))
+		return map[string]string{"code": parsed.Query().Get("code"), "state": parsed.Query().Get("state")}
+	}
+	login := func(callback map[string]string) loginResponse {
+		w := send("/api/login/oidc/stub/callback", callback)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var response loginResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		require.NotEmpty(t, response.Token)
+		return response
+	}
+
+	suffix := time.Now().UnixNano()
+	email := fmt.Sprintf("oidc_%d@example.com", suffix)
+	now := time.Now()
+	existing := models.User{Email: email, PasswordHash: "x", Role: models.RoleUser, EmailVerifiedAt: &now}
+	require.NoError(t, db.Create(&existing).Error)
+	defer db.Unscoped().Where("email LIKE ?", fmt.Sprintf("oidc_%%%d@example.com", suffix)).Delete(&models.User{})
+	defer db.Unscoped().Where("subject LIKE ?", fmt.Sprintf("%%-%d", suffix)).Delete(&models.UserIdentity{})
+
+	// A verified email links to the existing account
+	subject := fmt.Sprintf("google-%d", suffix)
+	callback := signIn(oidctest.Identity{Subject: subject, Email: email, EmailVerified: true})
+	response := login(callback)
+	assert.Equal(t, existing.ID, response.User.ID)
+	assert.False(t, response.Created)
+
+	// Each sign-in completes once
+	assert.Equal(t, http.StatusBadRequest, send("/api/login/oidc/stub/callback", callback).Code)
+
+	// Once linked, the subject finds the account even if the email changes
+	response = login(signIn(oidctest.Identity{Subject: subject, Email: "changed@example.com"}))
+	assert.Equal(t, existing.ID, response.User.ID)
+
+	// An unverified email can't claim an account
+	w := send("/api/login/oidc/stub/callback", signIn(oidctest.Identity{Subject: fmt.Sprintf("other-%d", suffix), Email: email}))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// A new verified email gets a new, verified account
+	newEmail := fmt.Sprintf("oidc_new_%d@example.com", suffix)
+	response = login(signIn(oidctest.Identity{Subject: fmt.Sprintf("new-%d", suffix), Email: newEmail, EmailVerified: true}))
+	assert.True(t, response.Created)
+	assert.Equal(t, newEmail, response.User.Email)
+	assert.True(t, response.User.EmailVerified)
+
+	// Unknown providers and forged states are refused
+	assert.Equal(t, http.StatusNotFound, send("/api/login/oidc/nope", nil).Code)
+	assert.Equal(t, http.StatusBadRequest, send("/api/login/oidc/stub/callback", map[string]string{"code": "x", "state": "forged"}).Code)
+}
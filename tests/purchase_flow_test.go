@@ -0,0 +1,1705 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/88warren/lmw-fitness-backend/controllers"
+	"github.com/88warren/lmw-fitness-backend/gateway"
+	"github.com/88warren/lmw-fitness-backend/models"
+	"github.com/88warren/lmw-fitness-backend/routes"
+	"github.com/88warren/lmw-fitness-backend/workers"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+type brevoRequest struct {
+	Path string
+	Body map[string]interface{}
+}
+
+// fakeBrevo records every call made to the Brevo API and accepts them all.
+type fakeBrevo struct {
+	mu       sync.Mutex
+	requests []brevoRequest
+	server   *httptest.Server
+}
+
+func newFakeBrevo() *fakeBrevo {
+	fb := &fakeBrevo{}
+	fb.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var decoded map[string]interface{}
+		json.Unmarshal(body, &decoded)
+
+		fb.mu.Lock()
+		fb.requests = append(fb.requests, brevoRequest{Path: r.URL.Path, Body: decoded})
+		fb.mu.Unlock()
+
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{}`))
+	}))
+	return fb
+}
+
+func (fb *fakeBrevo) paths() []string {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	paths := []string{}
+	for _, r := range fb.requests {
+		paths = append(paths, r.Path)
+	}
+	return paths
+}
+
+func (fb *fakeBrevo) sentTemplates() []int64 {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	templates := []int64{}
+	for _, r := range fb.requests {
+		if r.Path == "/smtp/email" {
+			if id, ok := r.Body["templateId"].(float64); ok {
+				templates = append(templates, int64(id))
+			}
+		}
+	}
+	return templates
+}
+
+func postWebhook(router *gin.Engine, payload []byte, signature string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", "/api/stripe-webhook", bytes.NewBuffer(payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Stripe-Signature", signature)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func newPurchaseTestController(fake *gateway.Fake, brevo *fakeBrevo) (*controllers.PaymentController, *gin.Engine) {
+	pc := controllers.NewPaymentControllerWithGateway(testDB, fake)
+	pc.StripeWebhookSecret = fake.WebhookSecret
+	pc.BrevoAPIURL = brevo.server.URL
+	pc.FrontendURL = "http://localhost:3000"
+	pc.BrevoNewsletterListID = 0
+	pc.BrevoOrderConfirmationTemplateID = 10
+
+	router := gin.New()
+	routes.RegisterPaymentRoutes(router, pc)
+	return pc, router
+}
+
+// startCheckout posts a basket to the checkout endpoint and returns the
+// ID of the session it created.
+func startCheckout(t *testing.T, router *gin.Engine, priceID, email string) string {
+	return postCheckout(t, router, map[string]interface{}{
+		"items":         []map[string]interface{}{{"priceId": priceID, "quantity": 1}},
+		"customerEmail": email,
+	})
+}
+
+func postCheckout(t *testing.T, router *gin.Engine, request map[string]interface{}) string {
+	body, _ := json.Marshal(request)
+	req, _ := http.NewRequest("POST", "/api/create-checkout-session", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var checkoutResponse struct {
+		URL string `json:"url"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &checkoutResponse))
+	return checkoutResponse.URL[strings.LastIndex(checkoutResponse.URL, "/")+1:]
+}
+
+func TestPurchaseFlowEndToEnd(t *testing.T) {
+	if testDB == nil {
+		t.Skip("Skipping end to end purchase test - no database")
+	}
+
+	suffix := time.Now().UnixNano()
+	priceID := fmt.Sprintf("price_e2e_%d", suffix)
+	email := fmt.Sprintf("buyer_%d@example.com", suffix)
+
+	program := models.WorkoutProgram{Name: fmt.Sprintf("e2e-program-%d", suffix), Difficulty: "beginner"}
+	require.NoError(t, testDB.Create(&program).Error)
+	product := models.Product{
+		Name:             "E2E Program",
+		StripePriceID:    priceID,
+		Programs:         []models.WorkoutProgram{program},
+		BrevoListIDs:     []int64{42},
+		BrevoTemplateIDs: []int64{6},
+		IsActive:         true,
+	}
+	require.NoError(t, testDB.Create(&product).Error)
+
+	fake := gateway.NewFake()
+	fake.AddPrice(priceID, "E2E Program", 4999, "gbp")
+
+	brevo := newFakeBrevo()
+	defer brevo.server.Close()
+
+	pc, router := newPurchaseTestController(fake, brevo)
+
+	sessionID := startCheckout(t, router, priceID, email)
+
+	// Customer pays and Stripe sends the webhook, twice
+	session, err := fake.CompleteCheckoutSession(sessionID, "")
+	require.NoError(t, err)
+	payload, signature, err := fake.SignedEvent("checkout.session.completed", session)
+	require.NoError(t, err)
+
+	w := postWebhook(router, payload, signature)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = postWebhook(router, payload, signature)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Event already received")
+
+	w = postWebhook(router, payload, "t=1,v1=bad")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	var jobCount int64
+	testDB.Model(&models.Job{}).Where("session_id = ?", sessionID).Count(&jobCount)
+	assert.Equal(t, int64(1), jobCount)
+
+	// Worker fulfils the purchase
+	workers.NewJobProcessor(testDB, pc).ProcessPendingJobs()
+
+	var job models.Job
+	require.NoError(t, testDB.Where("session_id = ?", sessionID).First(&job).Error)
+	assert.Equal(t, models.JobStatusCompleted, job.Status, job.LastError)
+
+	var user models.User
+	require.NoError(t, testDB.Where("email = ?", email).First(&user).Error)
+
+	var userPrograms int64
+	testDB.Model(&models.UserProgram{}).Where("user_id = ? AND program_id = ?", user.ID, program.ID).Count(&userPrograms)
+	assert.Equal(t, int64(1), userPrograms)
+
+	var tokens int64
+	testDB.Model(&models.AuthToken{}).Where("session_id = ? AND is_used = ?", sessionID, false).Count(&tokens)
+	assert.Equal(t, int64(1), tokens)
+
+	var order models.Order
+	require.NoError(t, testDB.Preload("Items").Where("stripe_session_id = ?", sessionID).First(&order).Error)
+	assert.Equal(t, int64(4999), order.TotalAmount)
+	assert.Equal(t, "gbp", order.Currency)
+	assert.Len(t, order.Items, 1)
+
+	assert.ElementsMatch(t, []int64{6, 10}, brevo.sentTemplates())
+	assert.Contains(t, brevo.paths(), "/contacts")
+
+	// The customer is refunded in full
+	charge, err := fake.ChargeForSession(sessionID)
+	require.NoError(t, err)
+	refunded, err := fake.RefundCharge(charge.ID, 0)
+	require.NoError(t, err)
+	payload, signature, err = fake.SignedEvent("charge.refunded", refunded)
+	require.NoError(t, err)
+
+	w = postWebhook(router, payload, signature)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	testDB.Model(&models.UserProgram{}).Where("user_id = ? AND program_id = ?", user.ID, program.ID).Count(&userPrograms)
+	assert.Equal(t, int64(0), userPrograms)
+
+	testDB.Model(&models.AuthToken{}).Where("session_id = ? AND is_used = ?", sessionID, false).Count(&tokens)
+	assert.Equal(t, int64(0), tokens)
+
+	var revocation models.EntitlementRevocation
+	require.NoError(t, testDB.Where("session_id = ?", sessionID).First(&revocation).Error)
+	assert.Equal(t, controllers.RevocationReasonRefund, revocation.Reason)
+
+	require.NoError(t, testDB.First(&order, order.ID).Error)
+	assert.Equal(t, models.OrderStatusRefunded, order.Status)
+
+	assert.Contains(t, brevo.paths(), "/contacts/lists/42/contacts/remove")
+}
+
+func TestInactiveProductCheckout(t *testing.T) {
+	if testDB == nil {
+		t.Skip("Skipping inactive product test - no database")
+	}
+
+	suffix := time.Now().UnixNano()
+	priceID := fmt.Sprintf("price_e2e_retired_%d", suffix)
+	product := models.Product{Name: "E2E Retired Program", StripePriceID: priceID, IsActive: true}
+	require.NoError(t, testDB.Create(&product).Error)
+	require.NoError(t, testDB.Model(&product).Update("is_active", false).Error)
+
+	fake := gateway.NewFake()
+	fake.AddPrice(priceID, "E2E Retired Program", 4999, "gbp")
+	brevo := newFakeBrevo()
+	defer brevo.server.Close()
+	_, router := newPurchaseTestController(fake, brevo)
+
+	post := func(path string, request map[string]interface{}) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(request)
+		req, _ := http.NewRequest("POST", path, bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	items := []map[string]interface{}{{"priceId": priceID, "quantity": 1}}
+
+	// A deactivated product can't be bought, even by its old price ID
+	w := post("/api/create-checkout-session", map[string]interface{}{"items": items, "customerEmail": "retired@example.com"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "no longer available")
+	w = post("/api/validate-coupon", map[string]interface{}{"items": items, "couponCode": "ANY"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Reactivating it puts it back on sale
+	require.NoError(t, testDB.Model(&product).Update("is_active", true).Error)
+	startCheckout(t, router, priceID, "retired@example.com")
+}
+
+func TestStripeWebhookRedelivery(t *testing.T) {
+	if testDB == nil {
+		t.Skip("Skipping webhook redelivery test - no database")
+	}
+
+	suffix := time.Now().UnixNano()
+	priceID := fmt.Sprintf("price_e2e_redeliver_%d", suffix)
+	product := models.Product{Name: "E2E Redelivered Program", StripePriceID: priceID, IsActive: true}
+	require.NoError(t, testDB.Create(&product).Error)
+
+	fake := gateway.NewFake()
+	fake.AddPrice(priceID, "E2E Redelivered Program", 4999, "gbp")
+	brevo := newFakeBrevo()
+	defer brevo.server.Close()
+	_, router := newPurchaseTestController(fake, brevo)
+
+	sessionID := startCheckout(t, router, priceID, fmt.Sprintf("redeliver_%d@example.com", suffix))
+	session, err := fake.CompleteCheckoutSession(sessionID, "")
+	require.NoError(t, err)
+	payload, signature, err := fake.SignedEvent("checkout.session.completed", session)
+	require.NoError(t, err)
+	var envelope struct {
+		ID string `json:"id"`
+	}
+	require.NoError(t, json.Unmarshal(payload, &envelope))
+
+	jobs := func() int64 {
+		var count int64
+		testDB.Model(&models.Job{}).Where("session_id = ?", sessionID).Count(&count)
+		return count
+	}
+	// setLedger puts the ledger row in the state a crashed or failed
+	// delivery would have left, without touching updated_at
+	setLedger := func(status string, updatedAt time.Time) {
+		require.NoError(t, testDB.Model(&models.StripeEvent{}).Where("event_id = ?", envelope.ID).
+			UpdateColumns(map[string]interface{}{"status": status, "updated_at": updatedAt}).Error)
+	}
+	ledgerStatus := func() string {
+		var stripeEvent models.StripeEvent
+		require.NoError(t, testDB.Where("event_id = ?", envelope.ID).First(&stripeEvent).Error)
+		return stripeEvent.Status
+	}
+
+	require.Equal(t, http.StatusOK, postWebhook(router, payload, signature).Code)
+	require.Equal(t, int64(1), jobs())
+
+	// A processed event is acknowledged without being handled again
+	w := postWebhook(router, payload, signature)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Event already received")
+
+	// The first delivery crashed before queueing the job. While its lease
+	// runs Stripe is asked to come back later...
+	require.NoError(t, testDB.Unscoped().Where("session_id = ?", sessionID).Delete(&models.Job{}).Error)
+	setLedger(controllers.StripeEventStatusReceived, time.Now())
+	assert.Equal(t, http.StatusConflict, postWebhook(router, payload, signature).Code)
+	assert.Equal(t, int64(0), jobs())
+
+	// ...and once it has lapsed the redelivery takes the event over
+	setLedger(controllers.StripeEventStatusReceived, time.Now().Add(-time.Hour))
+	require.Equal(t, http.StatusOK, postWebhook(router, payload, signature).Code)
+	assert.Equal(t, int64(1), jobs())
+	assert.Equal(t, controllers.StripeEventStatusProcessed, ledgerStatus())
+
+	// A failed event is retried straight away
+	require.NoError(t, testDB.Unscoped().Where("session_id = ?", sessionID).Delete(&models.Job{}).Error)
+	setLedger(controllers.StripeEventStatusFailed, time.Now())
+	require.Equal(t, http.StatusOK, postWebhook(router, payload, signature).Code)
+	assert.Equal(t, int64(1), jobs())
+	assert.Equal(t, controllers.StripeEventStatusProcessed, ledgerStatus())
+}
+
+func TestRefundKeepsProgramsOwnedElsewhere(t *testing.T) {
+	if testDB == nil {
+		t.Skip("Skipping refund test - no database")
+	}
+
+	suffix := time.Now().UnixNano()
+	priceID := fmt.Sprintf("price_e2e_twice_%d", suffix)
+	bundlePriceID := fmt.Sprintf("price_e2e_bundle_%d", suffix)
+	email := fmt.Sprintf("twice_%d@example.com", suffix)
+
+	program := models.WorkoutProgram{Name: fmt.Sprintf("e2e-twice-program-%d", suffix), Difficulty: "beginner"}
+	require.NoError(t, testDB.Create(&program).Error)
+	product := models.Product{Name: "E2E Single", StripePriceID: priceID, Programs: []models.WorkoutProgram{program}, IsActive: true}
+	require.NoError(t, testDB.Create(&product).Error)
+	bundle := models.Product{Name: "E2E Bundle", StripePriceID: bundlePriceID, Programs: []models.WorkoutProgram{program}, IsActive: true}
+	require.NoError(t, testDB.Create(&bundle).Error)
+
+	fake := gateway.NewFake()
+	fake.AddPrice(priceID, "E2E Single", 4999, "gbp")
+	fake.AddPrice(bundlePriceID, "E2E Bundle", 7999, "gbp")
+	brevo := newFakeBrevo()
+	defer brevo.server.Close()
+	pc, router := newPurchaseTestController(fake, brevo)
+
+	buy := func(priceID string) string {
+		sessionID := startCheckout(t, router, priceID, email)
+		session, err := fake.CompleteCheckoutSession(sessionID, "")
+		require.NoError(t, err)
+		payload, signature, err := fake.SignedEvent("checkout.session.completed", session)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, postWebhook(router, payload, signature).Code)
+		workers.NewJobProcessor(testDB, pc).ProcessPendingJobs()
+		return sessionID
+	}
+	refund := func(sessionID string, amount int64) {
+		charge, err := fake.ChargeForSession(sessionID)
+		require.NoError(t, err)
+		refunded, err := fake.RefundCharge(charge.ID, amount)
+		require.NoError(t, err)
+		payload, signature, err := fake.SignedEvent("charge.refunded", refunded)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, postWebhook(router, payload, signature).Code)
+	}
+	hasProgram := func() bool {
+		var count int64
+		testDB.Model(&models.UserProgram{}).
+			Joins("JOIN users ON users.id = user_programs.user_id").
+			Where("users.email = ? AND user_programs.program_id = ?", email, program.ID).
+			Count(&count)
+		return count > 0
+	}
+
+	first := buy(priceID)
+	second := buy(bundlePriceID)
+	require.True(t, hasProgram())
+
+	// A partial refund leaves the purchase alone
+	refund(first, 1000)
+	assert.True(t, hasProgram())
+	var order models.Order
+	require.NoError(t, testDB.Where("stripe_session_id = ?", first).First(&order).Error)
+	assert.Equal(t, models.OrderStatusPaid, order.Status)
+
+	// Refunding one of two orders for the program keeps it
+	refund(first, 0)
+	assert.True(t, hasProgram())
+	require.NoError(t, testDB.Where("stripe_session_id = ?", first).First(&order).Error)
+	assert.Equal(t, models.OrderStatusRefunded, order.Status)
+	var revocation models.EntitlementRevocation
+	require.NoError(t, testDB.Where("session_id = ?", first).First(&revocation).Error)
+	assert.Empty(t, revocation.ProgramIDs)
+
+	// Refunding the other takes it away
+	refund(second, 0)
+	assert.False(t, hasProgram())
+	require.NoError(t, testDB.Where("session_id = ?", second).First(&revocation).Error)
+	assert.Equal(t, []uint{program.ID}, revocation.ProgramIDs)
+}
+
+func TestSubscriptionLifecycle(t *testing.T) {
+	if testDB == nil {
+		t.Skip("Skipping subscription lifecycle test - no database")
+	}
+
+	suffix := time.Now().UnixNano()
+	priceID := fmt.Sprintf("price_e2e_sub_%d", suffix)
+	email := fmt.Sprintf("member_%d@example.com", suffix)
+
+	program := models.WorkoutProgram{Name: fmt.Sprintf("e2e-membership-%d", suffix), Difficulty: "beginner"}
+	require.NoError(t, testDB.Create(&program).Error)
+	product := models.Product{
+		Name:          "E2E Membership",
+		StripePriceID: priceID,
+		Programs:      []models.WorkoutProgram{program},
+		BrevoListIDs:  []int64{43},
+		IsActive:      true,
+		Recurring:     true,
+	}
+	require.NoError(t, testDB.Create(&product).Error)
+
+	fake := gateway.NewFake()
+	fake.AddPrice(priceID, "E2E Membership", 1999, "gbp")
+	brevo := newFakeBrevo()
+	defer brevo.server.Close()
+	pc, router := newPurchaseTestController(fake, brevo)
+
+	sessionID := startCheckout(t, router, priceID, email)
+	checkoutSession, err := fake.GetCheckoutSession(sessionID)
+	require.NoError(t, err)
+	assert.Equal(t, "subscription", string(checkoutSession.Mode))
+
+	session, err := fake.CompleteCheckoutSession(sessionID, "")
+	require.NoError(t, err)
+	payload, signature, err := fake.SignedEvent("checkout.session.completed", session)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, postWebhook(router, payload, signature).Code)
+
+	workers.NewJobProcessor(testDB, pc).ProcessPendingJobs()
+
+	var user models.User
+	require.NoError(t, testDB.Where("email = ?", email).First(&user).Error)
+	assert.Equal(t, session.Customer.ID, user.StripeCustomerID)
+
+	var subscription models.Subscription
+	require.NoError(t, testDB.Where("stripe_subscription_id = ?", session.Subscription.ID).First(&subscription).Error)
+	assert.Equal(t, "active", subscription.Status)
+	require.NotNil(t, subscription.UserID)
+	assert.Equal(t, user.ID, *subscription.UserID)
+
+	var userProgram models.UserProgram
+	require.NoError(t, testDB.Where("user_id = ? AND program_id = ?", user.ID, program.ID).First(&userProgram).Error)
+	require.NotNil(t, userProgram.ExpiresAt)
+	assert.True(t, userProgram.ExpiresAt.After(subscription.CurrentPeriodEnd))
+
+	// Renewal pushes access out to the new period end
+	renewedUntil := subscription.CurrentPeriodEnd.AddDate(0, 1, 0)
+	renewed, err := fake.UpdateSubscription(session.Subscription.ID, "active", renewedUntil)
+	require.NoError(t, err)
+	payload, signature, err = fake.SignedEvent("customer.subscription.updated", renewed)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, postWebhook(router, payload, signature).Code)
+
+	require.NoError(t, testDB.First(&userProgram, userProgram.ID).Error)
+	assert.True(t, userProgram.ExpiresAt.After(renewedUntil))
+
+	// Cancellation ends access straight away
+	cancelled, err := fake.UpdateSubscription(session.Subscription.ID, "canceled", time.Time{})
+	require.NoError(t, err)
+	payload, signature, err = fake.SignedEvent("customer.subscription.deleted", cancelled)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, postWebhook(router, payload, signature).Code)
+
+	var remaining int64
+	testDB.Model(&models.UserProgram{}).Where("user_id = ? AND program_id = ?", user.ID, program.ID).Count(&remaining)
+	assert.Equal(t, int64(0), remaining)
+	assert.Contains(t, brevo.paths(), "/contacts/lists/43/contacts/remove")
+}
+
+func TestWorkoutLinkShownOnce(t *testing.T) {
+	if testDB == nil {
+		t.Skip("Skipping workout link test - no database")
+	}
+
+	suffix := time.Now().UnixNano()
+	priceID := fmt.Sprintf("price_e2e_link_%d", suffix)
+	program := models.WorkoutProgram{Name: fmt.Sprintf("e2e-link-program-%d", suffix), Difficulty: "beginner"}
+	require.NoError(t, testDB.Create(&program).Error)
+	product := models.Product{Name: "E2E Link Program", StripePriceID: priceID, Programs: []models.WorkoutProgram{program}, IsActive: true}
+	require.NoError(t, testDB.Create(&product).Error)
+
+	fake := gateway.NewFake()
+	fake.AddPrice(priceID, "E2E Link Program", 4999, "gbp")
+	brevo := newFakeBrevo()
+	defer brevo.server.Close()
+	pc, router := newPurchaseTestController(fake, brevo)
+
+	buy := func(email string) string {
+		sessionID := startCheckout(t, router, priceID, email)
+		session, err := fake.CompleteCheckoutSession(sessionID, "")
+		require.NoError(t, err)
+		payload, signature, err := fake.SignedEvent("checkout.session.completed", session)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, postWebhook(router, payload, signature).Code)
+		workers.NewJobProcessor(testDB, pc).ProcessPendingJobs()
+		return sessionID
+	}
+	getLink := func(sessionID string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]string{"sessionId": sessionID})
+		req, _ := http.NewRequest("POST", "/api/get-workout-link", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// The success page gets one link, and asking again gets nothing
+	sessionID := buy(fmt.Sprintf("link_once_%d@example.com", suffix))
+	w := getLink(sessionID)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), "/workout-auth?token=")
+	assert.Equal(t, http.StatusGone, getLink(sessionID).Code)
+
+	var issued int64
+	testDB.Model(&models.AuthToken{}).Where("session_id = ? AND purpose = ?", sessionID, models.AuthTokenPurposeSuccessPage).Count(&issued)
+	assert.Equal(t, int64(1), issued)
+
+	// Nor does a session fulfilled a while ago
+	lateID := buy(fmt.Sprintf("link_late_%d@example.com", suffix))
+	require.NoError(t, testDB.Model(&models.AuthToken{}).Where("session_id = ?", lateID).
+		Update("created_at", time.Now().Add(-2*time.Hour)).Error)
+	assert.Equal(t, http.StatusGone, getLink(lateID).Code)
+}
+
+func TestGiftPurchaseAndRedemption(t *testing.T) {
+	if testDB == nil {
+		t.Skip("Skipping gift purchase test - no database")
+	}
+
+	suffix := time.Now().UnixNano()
+	priceID := fmt.Sprintf("price_e2e_gift_%d", suffix)
+	buyerEmail := fmt.Sprintf("gifter_%d@example.com", suffix)
+	recipientEmail := fmt.Sprintf("giftee_%d@example.com", suffix)
+
+	program := models.WorkoutProgram{Name: fmt.Sprintf("e2e-gift-program-%d", suffix), Difficulty: "beginner"}
+	require.NoError(t, testDB.Create(&program).Error)
+	product := models.Product{
+		Name:             "E2E Gift Program",
+		StripePriceID:    priceID,
+		Programs:         []models.WorkoutProgram{program},
+		BrevoListIDs:     []int64{44},
+		BrevoTemplateIDs: []int64{7},
+		IsActive:         true,
+	}
+	require.NoError(t, testDB.Create(&product).Error)
+
+	fake := gateway.NewFake()
+	fake.AddPrice(priceID, "E2E Gift Program", 4999, "gbp")
+	brevo := newFakeBrevo()
+	defer brevo.server.Close()
+	pc, router := newPurchaseTestController(fake, brevo)
+	pc.BrevoGiftCodeTemplateID = 11
+
+	sessionID := postCheckout(t, router, map[string]interface{}{
+		"items":              []map[string]interface{}{{"priceId": priceID, "quantity": 1}},
+		"customerEmail":      buyerEmail,
+		"giftRecipientEmail": recipientEmail,
+		"giftMessage":        "Happy birthday!",
+	})
+
+	session, err := fake.CompleteCheckoutSession(sessionID, "")
+	require.NoError(t, err)
+	payload, signature, err := fake.SignedEvent("checkout.session.completed", session)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, postWebhook(router, payload, signature).Code)
+
+	workers.NewJobProcessor(testDB, pc).ProcessPendingJobs()
+
+	// The buyer gets a confirmation but no access, the recipient gets a code
+	var gift models.GiftCode
+	require.NoError(t, testDB.Where("session_id = ?", sessionID).First(&gift).Error)
+	assert.Equal(t, recipientEmail, gift.RecipientEmail)
+	assert.Equal(t, "Happy birthday!", gift.Message)
+	assert.NotNil(t, gift.EmailedAt)
+	assert.Nil(t, gift.RedeemedAt)
+	assert.ElementsMatch(t, []int64{10, 11}, brevo.sentTemplates())
+
+	var buyerPrograms int64
+	testDB.Model(&models.UserProgram{}).
+		Joins("JOIN users ON users.id = user_programs.user_id").
+		Where("users.email = ? AND user_programs.program_id = ?", buyerEmail, program.ID).
+		Count(&buyerPrograms)
+	assert.Equal(t, int64(0), buyerPrograms)
+
+	recipient := models.User{Email: recipientEmail, PasswordHash: "hash"}
+	require.NoError(t, testDB.Create(&recipient).Error)
+
+	redeemRouter := gin.New()
+	redeemRouter.POST("/api/gifts/redeem", func(ctx *gin.Context) {
+		ctx.Set("userID", recipient.ID)
+		ctx.Set("userEmail", recipient.Email)
+		pc.RedeemGiftCode(ctx)
+	})
+	redeem := func(code string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]string{"code": code})
+		req, _ := http.NewRequest("POST", "/api/gifts/redeem", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		redeemRouter.ServeHTTP(w, req)
+		return w
+	}
+
+	w := redeem(strings.ToLower(gift.Code))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var recipientPrograms int64
+	testDB.Model(&models.UserProgram{}).Where("user_id = ? AND program_id = ?", recipient.ID, program.ID).Count(&recipientPrograms)
+	assert.Equal(t, int64(1), recipientPrograms)
+	assert.Contains(t, brevo.paths(), "/contacts")
+
+	assert.Equal(t, http.StatusConflict, redeem(gift.Code).Code)
+	assert.Equal(t, http.StatusNotFound, redeem("LMW-NOPE-NOPE-NOPE").Code)
+
+	// Refunding the gift takes the program back from whoever redeemed it
+	charge, err := fake.ChargeForSession(sessionID)
+	require.NoError(t, err)
+	refunded, err := fake.RefundCharge(charge.ID, 0)
+	require.NoError(t, err)
+	payload, signature, err = fake.SignedEvent("charge.refunded", refunded)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, postWebhook(router, payload, signature).Code)
+
+	testDB.Model(&models.UserProgram{}).Where("user_id = ? AND program_id = ?", recipient.ID, program.ID).Count(&recipientPrograms)
+	assert.Equal(t, int64(0), recipientPrograms)
+
+	require.NoError(t, testDB.First(&gift, gift.ID).Error)
+	assert.NotNil(t, gift.RevokedAt)
+
+	var revocation models.EntitlementRevocation
+	require.NoError(t, testDB.Where("session_id = ?", sessionID).First(&revocation).Error)
+	assert.Equal(t, recipient.ID, revocation.UserID)
+	assert.Contains(t, brevo.paths(), "/contacts/lists/44/contacts/remove")
+}
+
+func TestGiftCodesPerUnit(t *testing.T) {
+	if testDB == nil {
+		t.Skip("Skipping gift purchase test - no database")
+	}
+
+	suffix := time.Now().UnixNano()
+	priceID := fmt.Sprintf("price_e2e_gifts_%d", suffix)
+	buyerEmail := fmt.Sprintf("bulk_gifter_%d@example.com", suffix)
+	recipientEmail := fmt.Sprintf("bulk_giftee_%d@example.com", suffix)
+
+	program := models.WorkoutProgram{Name: fmt.Sprintf("e2e-gifts-program-%d", suffix), Difficulty: "beginner"}
+	require.NoError(t, testDB.Create(&program).Error)
+	product := models.Product{Name: "E2E Gift Pack", StripePriceID: priceID, Programs: []models.WorkoutProgram{program}, IsActive: true}
+	require.NoError(t, testDB.Create(&product).Error)
+
+	fake := gateway.NewFake()
+	fake.AddPrice(priceID, "E2E Gift Pack", 4999, "gbp")
+	brevo := newFakeBrevo()
+	defer brevo.server.Close()
+	pc, router := newPurchaseTestController(fake, brevo)
+
+	// Without a Brevo gift template the codes go out as plain emails
+	pc.BrevoGiftCodeTemplateID = 0
+	var emailed []string
+	pc.SendEmail = func(to, subject, body string) error {
+		assert.Equal(t, recipientEmail, to)
+		emailed = append(emailed, body)
+		return nil
+	}
+
+	sessionID := postCheckout(t, router, map[string]interface{}{
+		"items":              []map[string]interface{}{{"priceId": priceID, "quantity": 2}},
+		"customerEmail":      buyerEmail,
+		"giftRecipientEmail": recipientEmail,
+	})
+	session, err := fake.CompleteCheckoutSession(sessionID, "")
+	require.NoError(t, err)
+	payload, signature, err := fake.SignedEvent("checkout.session.completed", session)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, postWebhook(router, payload, signature).Code)
+	workers.NewJobProcessor(testDB, pc).ProcessPendingJobs()
+
+	// Two bought, two codes, each emailed once
+	var gifts []models.GiftCode
+	require.NoError(t, testDB.Where("session_id = ?", sessionID).Order("unit").Find(&gifts).Error)
+	require.Len(t, gifts, 2)
+	assert.Equal(t, []int{1, 2}, []int{gifts[0].Unit, gifts[1].Unit})
+	assert.NotEqual(t, gifts[0].Code, gifts[1].Code)
+	require.Len(t, emailed, 2)
+	for i, gift := range gifts {
+		assert.NotNil(t, gift.EmailedAt)
+		assert.Contains(t, emailed[i], gift.Code)
+	}
+	assert.ElementsMatch(t, []int64{10}, brevo.sentTemplates())
+
+	// Fulfilling again neither issues nor sends any more
+	require.NoError(t, pc.ProcessPaymentSuccess(sessionID, buyerEmail))
+	var count int64
+	testDB.Model(&models.GiftCode{}).Where("session_id = ?", sessionID).Count(&count)
+	assert.Equal(t, int64(2), count)
+	assert.Len(t, emailed, 2)
+}
+
+func TestPromotionCheckout(t *testing.T) {
+	if testDB == nil {
+		t.Skip("Skipping promotion checkout test - no database")
+	}
+
+	suffix := time.Now().UnixNano()
+	priceID := fmt.Sprintf("price_e2e_promo_%d", suffix)
+	otherPriceID := fmt.Sprintf("price_e2e_promo_other_%d", suffix)
+	email := fmt.Sprintf("saver_%d@example.com", suffix)
+	code := fmt.Sprintf("SAVE%d", suffix%1000000)
+
+	product := models.Product{Name: "E2E Promo Program", StripePriceID: priceID, IsActive: true}
+	require.NoError(t, testDB.Create(&product).Error)
+	other := models.Product{Name: "E2E Other Program", StripePriceID: otherPriceID, IsActive: true}
+	require.NoError(t, testDB.Create(&other).Error)
+	promotion := models.Promotion{
+		Code:                  code,
+		DiscountType:          models.PromotionTypePercent,
+		PercentOff:            15,
+		Currency:              "gbp",
+		ProductIDs:            []uint{product.ID},
+		MaxRedemptionsPerUser: 1,
+		IsActive:              true,
+	}
+	require.NoError(t, testDB.Create(&promotion).Error)
+
+	fake := gateway.NewFake()
+	fake.AddPrice(priceID, "E2E Promo Program", 4999, "gbp")
+	fake.AddPrice(otherPriceID, "E2E Other Program", 2000, "gbp")
+	brevo := newFakeBrevo()
+	defer brevo.server.Close()
+	pc, router := newPurchaseTestController(fake, brevo)
+
+	items := []map[string]interface{}{
+		{"priceId": priceID, "quantity": 1},
+		{"priceId": otherPriceID, "quantity": 1},
+	}
+	validate := func(couponCode string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]interface{}{
+			"couponCode":    couponCode,
+			"items":         items,
+			"customerEmail": email,
+		})
+		req, _ := http.NewRequest("POST", "/api/validate-coupon", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// 15% of the restricted product only: 4999 * 0.15 = 749.85, rounded to 750
+	w := validate(strings.ToLower(code))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var validated controllers.ValidateCouponResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &validated))
+	assert.Equal(t, int64(6999), validated.Subtotal)
+	assert.Equal(t, int64(750), validated.Discount)
+	assert.Equal(t, int64(6249), validated.Total)
+
+	assert.Equal(t, http.StatusBadRequest, validate("NOSUCHCODE").Code)
+
+	sessionID := postCheckout(t, router, map[string]interface{}{
+		"items":         items,
+		"customerEmail": email,
+		"couponCode":    code,
+	})
+	checkoutSession, err := fake.GetCheckoutSession(sessionID)
+	require.NoError(t, err)
+	assert.Equal(t, int64(750), checkoutSession.TotalDetails.AmountDiscount)
+
+	require.NoError(t, testDB.First(&promotion, promotion.ID).Error)
+	assert.NotEmpty(t, promotion.StripePromotionCodeID)
+
+	session, err := fake.CompleteCheckoutSession(sessionID, "")
+	require.NoError(t, err)
+	payload, signature, err := fake.SignedEvent("checkout.session.completed", session)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, postWebhook(router, payload, signature).Code)
+	workers.NewJobProcessor(testDB, pc).ProcessPendingJobs()
+
+	var redemption models.PromotionRedemption
+	require.NoError(t, testDB.Where("promotion_id = ? AND session_id = ?", promotion.ID, sessionID).First(&redemption).Error)
+	assert.Equal(t, email, redemption.CustomerEmail)
+	assert.Equal(t, int64(750), redemption.DiscountAmount)
+
+	// The per-customer limit is now used up
+	w = validate(code)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "already used")
+}
+
+func TestBundlePromotion(t *testing.T) {
+	if testDB == nil {
+		t.Skip("Skipping bundle promotion test - no database")
+	}
+
+	suffix := time.Now().UnixNano()
+	packagePriceID := fmt.Sprintf("price_e2e_package_%d", suffix)
+	otherPriceID := fmt.Sprintf("price_e2e_package_other_%d", suffix)
+	eurPackagePriceID := fmt.Sprintf("price_e2e_package_eur_%d", suffix)
+	eurOtherPriceID := fmt.Sprintf("price_e2e_package_other_eur_%d", suffix)
+	email := fmt.Sprintf("bundler_%d@example.com", suffix)
+
+	pkg := models.Product{Name: "E2E Mindset Package", StripePriceID: packagePriceID, Prices: []models.ProductPrice{{Currency: "eur", StripePriceID: eurPackagePriceID}}, IsActive: true}
+	require.NoError(t, testDB.Create(&pkg).Error)
+	other := models.Product{Name: "E2E Bundled Program", StripePriceID: otherPriceID, Prices: []models.ProductPrice{{Currency: "eur", StripePriceID: eurOtherPriceID}}, IsActive: true}
+	require.NoError(t, testDB.Create(&other).Error)
+	promotion := models.Promotion{
+		Code:                 fmt.Sprintf("BUNDLE%d", suffix%1000000),
+		DiscountType:         models.PromotionTypeAmount,
+		AmountOff:            1000,
+		Currency:             "gbp",
+		ProductIDs:           []uint{pkg.ID},
+		RequiresOtherProduct: true,
+		Automatic:            true,
+		IsActive:             true,
+	}
+	require.NoError(t, testDB.Create(&promotion).Error)
+	defer testDB.Model(&promotion).Update("is_active", false)
+
+	fake := gateway.NewFake()
+	fake.AddPrice(packagePriceID, "E2E Mindset Package", 3000, "gbp")
+	fake.AddPrice(otherPriceID, "E2E Bundled Program", 4999, "gbp")
+	fake.AddPrice(eurPackagePriceID, "E2E Mindset Package", 3500, "eur")
+	fake.AddPrice(eurOtherPriceID, "E2E Bundled Program", 5800, "eur")
+	brevo := newFakeBrevo()
+	defer brevo.server.Close()
+	_, router := newPurchaseTestController(fake, brevo)
+
+	discountOn := func(request map[string]interface{}) int64 {
+		request["customerEmail"] = email
+		checkoutSession, err := fake.GetCheckoutSession(postCheckout(t, router, request))
+		require.NoError(t, err)
+		return checkoutSession.TotalDetails.AmountDiscount
+	}
+	item := func(priceID string) map[string]interface{} {
+		return map[string]interface{}{"priceId": priceID, "quantity": 1}
+	}
+
+	// The package on its own pays full price, and the old client flag
+	// no longer takes anything off
+	assert.Zero(t, discountOn(map[string]interface{}{
+		"items":             []map[string]interface{}{item(packagePriceID)},
+		"isDiscountApplied": true,
+	}))
+
+	// Bought with another product, the deal is applied without a code
+	assert.Equal(t, int64(1000), discountOn(map[string]interface{}{
+		"items": []map[string]interface{}{item(packagePriceID), item(otherPriceID)},
+	}))
+
+	// The amount is in pounds, so it isn't taken off other currencies
+	assert.Zero(t, discountOn(map[string]interface{}{
+		"items":    []map[string]interface{}{item(packagePriceID), item(otherPriceID)},
+		"currency": "eur",
+	}))
+
+	// Entering the code doesn't get round the bundle rule
+	body, _ := json.Marshal(map[string]interface{}{
+		"couponCode":    promotion.Code,
+		"items":         []map[string]interface{}{item(packagePriceID)},
+		"customerEmail": email,
+	})
+	req, _ := http.NewRequest("POST", "/api/validate-coupon", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "bought with another product")
+}
+
+func TestFirstPurchasePromotion(t *testing.T) {
+	if testDB == nil {
+		t.Skip("Skipping first purchase promotion test - no database")
+	}
+
+	suffix := time.Now().UnixNano()
+	priceID := fmt.Sprintf("price_e2e_first_%d", suffix)
+	product := models.Product{Name: "E2E First Purchase Program", StripePriceID: priceID, IsActive: true}
+	require.NoError(t, testDB.Create(&product).Error)
+	promotion := models.Promotion{
+		Code:              fmt.Sprintf("FIRST%d", suffix%1000000),
+		DiscountType:      models.PromotionTypePercent,
+		PercentOff:        10,
+		Currency:          "gbp",
+		FirstPurchaseOnly: true,
+		IsActive:          true,
+	}
+	require.NoError(t, testDB.Create(&promotion).Error)
+
+	fake := gateway.NewFake()
+	fake.AddPrice(priceID, "E2E First Purchase Program", 4999, "gbp")
+	brevo := newFakeBrevo()
+	defer brevo.server.Close()
+	_, router := newPurchaseTestController(fake, brevo)
+
+	validate := func(email string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]interface{}{
+			"couponCode":    promotion.Code,
+			"items":         []map[string]interface{}{{"priceId": priceID, "quantity": 1}},
+			"customerEmail": email,
+		})
+		req, _ := http.NewRequest("POST", "/api/validate-coupon", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	email := fmt.Sprintf("returning_%d@example.com", suffix)
+	require.Equal(t, http.StatusOK, validate(email).Code)
+
+	// An earlier order counts however the email was capitalised on it
+	order := models.Order{CustomerEmail: strings.ToUpper(email), StripeSessionID: fmt.Sprintf("cs_first_%d", suffix), Status: models.OrderStatusPaid, Currency: "gbp", TotalAmount: 4999}
+	require.NoError(t, testDB.Create(&order).Error)
+	w := validate(email)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "first purchase")
+}
+
+func TestPromotionReservation(t *testing.T) {
+	if testDB == nil {
+		t.Skip("Skipping promotion reservation test - no database")
+	}
+
+	suffix := time.Now().UnixNano()
+	priceID := fmt.Sprintf("price_e2e_reserve_%d", suffix)
+	product := models.Product{Name: "E2E Reserved Program", StripePriceID: priceID, IsActive: true}
+	require.NoError(t, testDB.Create(&product).Error)
+
+	fake := gateway.NewFake()
+	fake.AddPrice(priceID, "E2E Reserved Program", 4999, "gbp")
+	brevo := newFakeBrevo()
+	defer brevo.server.Close()
+	pc, router := newPurchaseTestController(fake, brevo)
+
+	newPromotion := func(name string, maxRedemptions int64) models.Promotion {
+		promotion := models.Promotion{
+			Code:           fmt.Sprintf("%s%d", name, suffix%1000000),
+			DiscountType:   models.PromotionTypePercent,
+			PercentOff:     10,
+			Currency:       "gbp",
+			MaxRedemptions: maxRedemptions,
+			IsActive:       true,
+		}
+		require.NoError(t, testDB.Create(&promotion).Error)
+		return promotion
+	}
+	checkout := func(code, email string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]interface{}{
+			"items":         []map[string]interface{}{{"priceId": priceID, "quantity": 1}},
+			"customerEmail": email,
+			"couponCode":    code,
+		})
+		req, _ := http.NewRequest("POST", "/api/create-checkout-session", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	email := func(name string) string {
+		return fmt.Sprintf("%s_%d@example.com", name, suffix)
+	}
+
+	// An open checkout holds the only use, and Stripe is told the cap too
+	single := newPromotion("ONCE", 1)
+	firstID := postCheckout(t, router, map[string]interface{}{
+		"items":         []map[string]interface{}{{"priceId": priceID, "quantity": 1}},
+		"customerEmail": email("reserve_first"),
+		"couponCode":    single.Code,
+	})
+	var reservation models.PromotionRedemption
+	require.NoError(t, testDB.Where("promotion_id = ? AND session_id = ?", single.ID, firstID).First(&reservation).Error)
+	assert.NotNil(t, reservation.ReservedUntil)
+	stripePromo, err := fake.FindPromotionCode(single.Code)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), stripePromo.MaxRedemptions)
+
+	w := checkout(single.Code, email("reserve_second"))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "fully redeemed")
+
+	// Once that checkout expires the use is free again
+	abandoned, err := fake.GetCheckoutSession(firstID)
+	require.NoError(t, err)
+	abandoned.Status = "expired"
+	payload, signature, err := fake.SignedEvent("checkout.session.expired", abandoned)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, postWebhook(router, payload, signature).Code)
+	var held int64
+	testDB.Model(&models.PromotionRedemption{}).Where("promotion_id = ?", single.ID).Count(&held)
+	assert.Zero(t, held)
+
+	secondID := postCheckout(t, router, map[string]interface{}{
+		"items":         []map[string]interface{}{{"priceId": priceID, "quantity": 1}},
+		"customerEmail": email("reserve_second"),
+		"couponCode":    single.Code,
+	})
+	session, err := fake.CompleteCheckoutSession(secondID, "")
+	require.NoError(t, err)
+	payload, signature, err = fake.SignedEvent("checkout.session.completed", session)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, postWebhook(router, payload, signature).Code)
+	workers.NewJobProcessor(testDB, pc).ProcessPendingJobs()
+
+	// Paying turns the reservation into a redemption
+	require.NoError(t, testDB.Where("promotion_id = ? AND session_id = ?", single.ID, secondID).First(&reservation).Error)
+	assert.Nil(t, reservation.ReservedUntil)
+	assert.Equal(t, int64(500), reservation.DiscountAmount)
+
+	// Customers checking out at the same moment can't go past the limit. The
+	// first checkout is on its own so the promotion is already in Stripe.
+	limited := newPromotion("RUSH", 3)
+	require.Equal(t, http.StatusOK, checkout(limited.Code, email("rush_first")).Code)
+	results := make(chan int, 6)
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results <- checkout(limited.Code, email(fmt.Sprintf("rush_%d", i))).Code
+		}(i)
+	}
+	wg.Wait()
+	close(results)
+	succeeded := 0
+	for code := range results {
+		if code == http.StatusOK {
+			succeeded++
+		} else {
+			assert.Equal(t, http.StatusBadRequest, code)
+		}
+	}
+	assert.Equal(t, 2, succeeded)
+}
+
+func TestAbandonedCheckoutRecovery(t *testing.T) {
+	if testDB == nil {
+		t.Skip("Skipping abandoned checkout test - no database")
+	}
+
+	suffix := time.Now().UnixNano()
+	priceID := fmt.Sprintf("price_e2e_abandon_%d", suffix)
+	email := fmt.Sprintf("browser_%d@example.com", suffix)
+
+	product := models.Product{Name: "E2E Abandoned Program", StripePriceID: priceID, IsActive: true}
+	require.NoError(t, testDB.Create(&product).Error)
+
+	fake := gateway.NewFake()
+	fake.AddPrice(priceID, "E2E Abandoned Program", 4999, "gbp")
+	brevo := newFakeBrevo()
+	defer brevo.server.Close()
+	pc, router := newPurchaseTestController(fake, brevo)
+
+	abandonedID := startCheckout(t, router, priceID, email)
+
+	var record models.CheckoutRecord
+	require.NoError(t, testDB.Where("session_id = ?", abandonedID).First(&record).Error)
+	assert.Equal(t, models.CheckoutStatusOpen, record.Status)
+	assert.Equal(t, email, record.CustomerEmail)
+	assert.Equal(t, []string{"E2E Abandoned Program"}, record.ProductNames)
+
+	abandoned, err := fake.GetCheckoutSession(abandonedID)
+	require.NoError(t, err)
+	abandoned.Status = "expired"
+	payload, signature, err := fake.SignedEvent("checkout.session.expired", abandoned)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, postWebhook(router, payload, signature).Code)
+
+	require.NoError(t, testDB.First(&record, record.ID).Error)
+	assert.Equal(t, models.CheckoutStatusExpired, record.Status)
+
+	type sentEmail struct{ to, body string }
+	var sent []sentEmail
+	worker := workers.NewCartRecoveryWorker(testDB)
+	worker.DiscountPercent = 10
+	worker.Send = func(to, subject, body string) error {
+		sent = append(sent, sentEmail{to, body})
+		return nil
+	}
+
+	// Nothing is sent until the delay has passed
+	worker.RunOnce()
+	assert.Empty(t, sent)
+
+	testDB.Model(&record).Update("expired_at", time.Now().Add(-2*workers.CartRecoveryDelay))
+	worker.RunOnce()
+	require.Len(t, sent, 1)
+	assert.Equal(t, email, sent[0].to)
+
+	require.NoError(t, testDB.First(&record, record.ID).Error)
+	require.NotNil(t, record.RecoveryEmailSentAt)
+	require.NotNil(t, record.RecoveryPromotionID)
+
+	var promotion models.Promotion
+	require.NoError(t, testDB.First(&promotion, *record.RecoveryPromotionID).Error)
+	assert.Equal(t, int64(10), promotion.PercentOff)
+	assert.Equal(t, int64(1), promotion.MaxRedemptions)
+	assert.Contains(t, sent[0].body, promotion.Code)
+
+	// Only one email per abandoned basket
+	worker.RunOnce()
+	assert.Len(t, sent, 1)
+
+	// The customer comes back and buys
+	recoveredID := postCheckout(t, router, map[string]interface{}{
+		"items":         []map[string]interface{}{{"priceId": priceID, "quantity": 1}},
+		"customerEmail": email,
+		"couponCode":    promotion.Code,
+	})
+	session, err := fake.CompleteCheckoutSession(recoveredID, "")
+	require.NoError(t, err)
+	payload, signature, err = fake.SignedEvent("checkout.session.completed", session)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, postWebhook(router, payload, signature).Code)
+	workers.NewJobProcessor(testDB, pc).ProcessPendingJobs()
+
+	require.NoError(t, testDB.First(&record, record.ID).Error)
+	require.NotNil(t, record.ConvertedAt)
+	assert.Equal(t, recoveredID, record.ConvertedSessionID)
+
+	var completed models.CheckoutRecord
+	require.NoError(t, testDB.Where("session_id = ?", recoveredID).First(&completed).Error)
+	assert.Equal(t, models.CheckoutStatusCompleted, completed.Status)
+}
+
+func TestReferralCommission(t *testing.T) {
+	if testDB == nil {
+		t.Skip("Skipping referral test - no database")
+	}
+
+	suffix := time.Now().UnixNano()
+	priceID := fmt.Sprintf("price_e2e_referral_%d", suffix)
+	friendEmail := fmt.Sprintf("friend_%d@example.com", suffix)
+
+	product := models.Product{Name: "E2E Referral Program", StripePriceID: priceID, IsActive: true}
+	require.NoError(t, testDB.Create(&product).Error)
+	referrer := models.User{Email: fmt.Sprintf("referrer_%d@example.com", suffix), PasswordHash: "hash"}
+	require.NoError(t, testDB.Create(&referrer).Error)
+
+	fake := gateway.NewFake()
+	fake.AddPrice(priceID, "E2E Referral Program", 4999, "gbp")
+	brevo := newFakeBrevo()
+	defer brevo.server.Close()
+	pc, router := newPurchaseTestController(fake, brevo)
+	pc.ReferralCommissionPercent = 10
+
+	rc := controllers.NewReferralController(testDB)
+	rc.DiscountPercent = 10
+	referralRouter := gin.New()
+	referralRouter.Use(func(ctx *gin.Context) {
+		ctx.Set("userID", referrer.ID)
+		ctx.Set("userEmail", referrer.Email)
+	})
+	referralRouter.GET("/api/referrals/me", rc.GetMyReferral)
+	referralRouter.GET("/api/admin/referrals/payouts", rc.GetPayoutReport)
+	referralRouter.GET("/api/admin/referrals/payouts/export", rc.ExportPayoutReport)
+	referralRouter.POST("/api/admin/referrals/payouts/:userId", rc.RecordPayout)
+	call := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		var reader io.Reader
+		if body != nil {
+			raw, _ := json.Marshal(body)
+			reader = bytes.NewBuffer(raw)
+		}
+		req, _ := http.NewRequest(method, path, reader)
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		referralRouter.ServeHTTP(w, req)
+		return w
+	}
+
+	w := call("GET", "/api/referrals/me", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var mine struct {
+		Code              string `json:"code"`
+		Link              string `json:"link"`
+		PendingCommission int64  `json:"pendingCommission"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &mine))
+	assert.True(t, strings.HasPrefix(mine.Code, "REFERR"), mine.Code)
+	assert.Contains(t, mine.Link, "ref="+mine.Code)
+
+	// Asking again returns the same code
+	w = call("GET", "/api/referrals/me", nil)
+	assert.Contains(t, w.Body.String(), mine.Code)
+
+	items := []map[string]interface{}{{"priceId": priceID, "quantity": 1}}
+	validate := func(email string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]interface{}{"couponCode": mine.Code, "items": items, "customerEmail": email})
+		req, _ := http.NewRequest("POST", "/api/validate-coupon", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	w = validate(referrer.Email)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "own referral code")
+
+	w = validate(friendEmail)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), `"discount":500`)
+
+	sessionID := postCheckout(t, router, map[string]interface{}{
+		"items":         items,
+		"customerEmail": friendEmail,
+		"couponCode":    mine.Code,
+	})
+	session, err := fake.CompleteCheckoutSession(sessionID, "")
+	require.NoError(t, err)
+	payload, signature, err := fake.SignedEvent("checkout.session.completed", session)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, postWebhook(router, payload, signature).Code)
+	workers.NewJobProcessor(testDB, pc).ProcessPendingJobs()
+
+	// 10% of the 44.99 paid, rounded to the penny
+	var conversion models.ReferralConversion
+	require.NoError(t, testDB.Where("session_id = ?", sessionID).First(&conversion).Error)
+	assert.Equal(t, referrer.ID, conversion.ReferrerUserID)
+	assert.Equal(t, int64(4499), conversion.OrderTotal)
+	assert.Equal(t, int64(450), conversion.CommissionAmount)
+	assert.Equal(t, models.CommissionStatusPending, conversion.Status)
+
+	w = call("GET", "/api/admin/referrals/payouts", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), `"pendingCommission":450`)
+
+	w = call("GET", "/api/admin/referrals/payouts/export", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/csv", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), fmt.Sprintf("%d,%s,%s,GBP,1,4.50,0.00", referrer.ID, referrer.Email, mine.Code))
+
+	payoutPath := fmt.Sprintf("/api/admin/referrals/payouts/%d", referrer.ID)
+	w = call("POST", payoutPath, map[string]string{"reference": "BACS-0001"})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), `"amount":450`)
+	assert.Equal(t, http.StatusNotFound, call("POST", payoutPath, map[string]string{"reference": "BACS-0002"}).Code)
+
+	require.NoError(t, testDB.First(&conversion, conversion.ID).Error)
+	assert.Equal(t, models.CommissionStatusPaid, conversion.Status)
+	assert.Equal(t, "BACS-0001", conversion.PayoutReference)
+	assert.NotNil(t, conversion.PaidAt)
+
+	// Commission in another currency is kept apart from the pounds
+	for i, amount := range []int64{120, 180} {
+		require.NoError(t, testDB.Create(&models.ReferralConversion{
+			ReferralCodeID:   conversion.ReferralCodeID,
+			ReferrerUserID:   referrer.ID,
+			SessionID:        fmt.Sprintf("cs_e2e_referral_eur_%d_%d", i, suffix),
+			CustomerEmail:    friendEmail,
+			Currency:         "eur",
+			OrderTotal:       amount * 10,
+			CommissionAmount: amount,
+			Status:           models.CommissionStatusPending,
+		}).Error)
+	}
+	w = call("GET", "/api/referrals/me", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var balances struct {
+		Conversions       int64 `json:"conversions"`
+		PendingCommission int64 `json:"pendingCommission"`
+		Commission        []struct {
+			Currency string `json:"currency"`
+			Pending  int64  `json:"pendingCommission"`
+			Paid     int64  `json:"paidCommission"`
+		} `json:"commission"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &balances))
+	assert.Equal(t, int64(3), balances.Conversions)
+	assert.Zero(t, balances.PendingCommission)
+	require.Len(t, balances.Commission, 2)
+	assert.Equal(t, "eur", balances.Commission[0].Currency)
+	assert.Equal(t, int64(300), balances.Commission[0].Pending)
+	assert.Equal(t, "gbp", balances.Commission[1].Currency)
+	assert.Equal(t, int64(450), balances.Commission[1].Paid)
+
+	// Payouts recorded at the same time pay each commission once
+	results := make(chan *httptest.ResponseRecorder, 4)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results <- call("POST", payoutPath, map[string]string{"reference": fmt.Sprintf("SEPA-%d", i), "currency": "eur"})
+		}(i)
+	}
+	wg.Wait()
+	close(results)
+	paidOut := 0
+	for w := range results {
+		if w.Code == http.StatusOK {
+			paidOut++
+			assert.Contains(t, w.Body.String(), `"amount":300`)
+		} else {
+			assert.Equal(t, http.StatusNotFound, w.Code)
+		}
+	}
+	assert.Equal(t, 1, paidOut)
+}
+
+func TestInvoiceForMultiItemOrder(t *testing.T) {
+	if testDB == nil {
+		t.Skip("Skipping invoice test - no database")
+	}
+
+	suffix := time.Now().UnixNano()
+	email := fmt.Sprintf("invoiced_%d@example.com", suffix)
+	names := []string{"E2E Invoice Program A", "E2E Invoice Program B", "E2E Invoice Program C"}
+
+	fake := gateway.NewFake()
+	items := []map[string]interface{}{}
+	for i, name := range names {
+		priceID := fmt.Sprintf("price_e2e_invoice_%d_%d", i, suffix)
+		require.NoError(t, testDB.Create(&models.Product{Name: name, StripePriceID: priceID, IsActive: true}).Error)
+		fake.AddPrice(priceID, name, 1200, "gbp")
+		items = append(items, map[string]interface{}{"priceId": priceID, "quantity": 1})
+	}
+	brevo := newFakeBrevo()
+	defer brevo.server.Close()
+	pc, router := newPurchaseTestController(fake, brevo)
+	pc.AttachInvoicePDF = true
+	pc.InvoiceIssuer = controllers.InvoiceIssuer{Name: "LMW Fitness", VATNumber: "GB123456789", VATRate: 2000, NumberPrefix: "TEST"}
+
+	sessionID := postCheckout(t, router, map[string]interface{}{"items": items, "customerEmail": email})
+	session, err := fake.CompleteCheckoutSession(sessionID, "")
+	require.NoError(t, err)
+	payload, signature, err := fake.SignedEvent("checkout.session.completed", session)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, postWebhook(router, payload, signature).Code)
+	workers.NewJobProcessor(testDB, pc).ProcessPendingJobs()
+
+	var order models.Order
+	require.NoError(t, testDB.Where("stripe_session_id = ?", sessionID).First(&order).Error)
+	var invoice models.Invoice
+	require.NoError(t, testDB.Where("order_id = ?", order.ID).First(&invoice).Error)
+	assert.Regexp(t, `^TEST-\d{6}$`, invoice.Number)
+	assert.Len(t, invoice.Lines, 3)
+	assert.Equal(t, int64(3600), invoice.TotalAmount)
+	// 20% VAT inside each £12.00 line is £2.00
+	assert.Equal(t, int64(600), invoice.VATAmount)
+	assert.Equal(t, int64(3000), invoice.NetAmount)
+	assert.Equal(t, "GB123456789", invoice.SellerVATNumber)
+
+	// The confirmation email lists every item and carries the PDF
+	var confirmation map[string]interface{}
+	brevo.mu.Lock()
+	for _, r := range brevo.requests {
+		if r.Path == "/smtp/email" && r.Body["templateId"] == float64(10) {
+			confirmation = r.Body
+		}
+	}
+	brevo.mu.Unlock()
+	require.NotNil(t, confirmation)
+	params := confirmation["params"].(map[string]interface{})
+	assert.Len(t, params["ITEMS"], 3)
+	assert.Equal(t, invoice.Number, params["INVOICE_NUMBER"])
+	attachments := confirmation["attachment"].([]interface{})
+	require.Len(t, attachments, 1)
+	assert.Equal(t, invoice.Number+".pdf", attachments[0].(map[string]interface{})["name"])
+
+	now := time.Now()
+	buyer := models.User{Email: email, PasswordHash: "x", Role: models.RoleUser, EmailVerifiedAt: &now}
+	require.NoError(t, testDB.Create(&buyer).Error)
+	oc := controllers.NewOrderController(testDB)
+	invoiceRouter := gin.New()
+	invoiceRouter.GET("/api/orders/:id/invoice", func(ctx *gin.Context) {
+		ctx.Set("userID", buyer.ID)
+		ctx.Set("userEmail", email)
+		oc.GetMyOrderInvoice(ctx)
+	})
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/api/orders/%d/invoice", order.ID), nil)
+	w := httptest.NewRecorder()
+	invoiceRouter.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "application/pdf", w.Header().Get("Content-Type"))
+	assert.True(t, strings.HasPrefix(w.Body.String(), "%PDF-"))
+	assert.Contains(t, w.Body.String(), invoice.Number)
+
+	// Downloading again doesn't use up another number
+	var issued int64
+	testDB.Model(&models.Invoice{}).Where("order_id = ?", order.ID).Count(&issued)
+	assert.Equal(t, int64(1), issued)
+}
+
+func TestStripeReconciliation(t *testing.T) {
+	if testDB == nil {
+		t.Skip("Skipping reconciliation test - no database")
+	}
+
+	suffix := time.Now().UnixNano()
+	priceID := fmt.Sprintf("price_e2e_reconcile_%d", suffix)
+	require.NoError(t, testDB.Create(&models.Product{Name: "E2E Reconcile Program", StripePriceID: priceID, IsActive: true}).Error)
+
+	fake := gateway.NewFake()
+	fake.AddPrice(priceID, "E2E Reconcile Program", 2500, "gbp")
+	brevo := newFakeBrevo()
+	defer brevo.server.Close()
+	pc, router := newPurchaseTestController(fake, brevo)
+
+	// One purchase goes through normally, the other's webhook never arrives
+	delivered := startCheckout(t, router, priceID, fmt.Sprintf("delivered_%d@example.com", suffix))
+	session, err := fake.CompleteCheckoutSession(delivered, "")
+	require.NoError(t, err)
+	payload, signature, err := fake.SignedEvent("checkout.session.completed", session)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, postWebhook(router, payload, signature).Code)
+	workers.NewJobProcessor(testDB, pc).ProcessPendingJobs()
+
+	missed := startCheckout(t, router, priceID, fmt.Sprintf("missed_%d@example.com", suffix))
+	_, err = fake.CompleteCheckoutSession(missed, "")
+	require.NoError(t, err)
+
+	// An unpaid session isn't listed at all
+	startCheckout(t, router, priceID, fmt.Sprintf("browsing_%d@example.com", suffix))
+
+	from, to := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	report, err := pc.Reconcile(from, to, false)
+	require.NoError(t, err)
+	assert.Equal(t, 2, report.SessionsChecked)
+	require.Len(t, report.Issues, 1)
+	assert.Equal(t, missed, report.Issues[0].SessionID)
+	assert.ElementsMatch(t, []string{controllers.ReconcileJobMissing, controllers.ReconcileOrderMissing}, report.Issues[0].Problems)
+	assert.Empty(t, report.Issues[0].Action)
+
+	var jobs int64
+	testDB.Model(&models.Job{}).Where("session_id = ?", missed).Count(&jobs)
+	assert.Equal(t, int64(0), jobs)
+
+	report, err = pc.Reconcile(from, to, true)
+	require.NoError(t, err)
+	require.Len(t, report.Issues, 1)
+	assert.Equal(t, "job_created", report.Issues[0].Action)
+	assert.Equal(t, 1, report.JobsQueued)
+
+	workers.NewJobProcessor(testDB, pc).ProcessPendingJobs()
+
+	report, err = pc.Reconcile(from, to, false)
+	require.NoError(t, err)
+	assert.Empty(t, report.Issues)
+
+	var order models.Order
+	assert.NoError(t, testDB.Where("stripe_session_id = ?", missed).First(&order).Error)
+}
+
+func TestLocalisedCurrencyCheckout(t *testing.T) {
+	if testDB == nil {
+		t.Skip("Skipping currency test - no database")
+	}
+
+	suffix := time.Now().UnixNano()
+	email := fmt.Sprintf("euro_buyer_%d@example.com", suffix)
+	gbpPriceID := fmt.Sprintf("price_e2e_currency_gbp_%d", suffix)
+	eurPriceID := fmt.Sprintf("price_e2e_currency_eur_%d", suffix)
+	product := models.Product{
+		Name:          "E2E Currency Program",
+		StripePriceID: gbpPriceID,
+		IsActive:      true,
+		Prices:        []models.ProductPrice{{Currency: "eur", StripePriceID: eurPriceID}},
+	}
+	require.NoError(t, testDB.Create(&product).Error)
+
+	fake := gateway.NewFake()
+	fake.AddPrice(gbpPriceID, product.Name, 3000, "gbp")
+	fake.AddPrice(eurPriceID, product.Name, 3500, "eur")
+	brevo := newFakeBrevo()
+	defer brevo.server.Close()
+	pc, router := newPurchaseTestController(fake, brevo)
+
+	// A German visitor sees the euro price
+	req, _ := http.NewRequest("GET", "/api/prices", nil)
+	req.Header.Set("CF-IPCountry", "DE")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var listed struct {
+		Currency string                   `json:"currency"`
+		Prices   []controllers.LocalPrice `json:"prices"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &listed))
+	assert.Equal(t, "eur", listed.Currency)
+	var found *controllers.LocalPrice
+	for i := range listed.Prices {
+		if listed.Prices[i].ProductID == product.ID {
+			found = &listed.Prices[i]
+		}
+	}
+	require.NotNil(t, found)
+	assert.Equal(t, gbpPriceID, found.PriceID)
+	assert.Equal(t, int64(3500), found.UnitAmount)
+	assert.Equal(t, "€35.00", found.Formatted)
+
+	// Unsupported currencies are refused rather than silently charged in GBP
+	body, _ := json.Marshal(map[string]interface{}{
+		"items":    []map[string]interface{}{{"priceId": gbpPriceID, "quantity": 1}},
+		"currency": "chf",
+	})
+	req, _ = http.NewRequest("POST", "/api/create-checkout-session", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Checking out the default price in euros charges the euro price
+	sessionID := postCheckout(t, router, map[string]interface{}{
+		"items":         []map[string]interface{}{{"priceId": gbpPriceID, "quantity": 1}},
+		"customerEmail": email,
+		"currency":      "EUR",
+	})
+	session, err := fake.CompleteCheckoutSession(sessionID, "")
+	require.NoError(t, err)
+	assert.Equal(t, "eur", string(session.Currency))
+	assert.Equal(t, int64(3500), session.AmountTotal)
+	payload, signature, err := fake.SignedEvent("checkout.session.completed", session)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, postWebhook(router, payload, signature).Code)
+	workers.NewJobProcessor(testDB, pc).ProcessPendingJobs()
+
+	// The euro price maps back to the same product
+	var order models.Order
+	require.NoError(t, testDB.Preload("Items").Where("stripe_session_id = ?", sessionID).First(&order).Error)
+	assert.Equal(t, "eur", order.Currency)
+	assert.Equal(t, int64(3500), order.TotalAmount)
+	require.Len(t, order.Items, 1)
+	require.NotNil(t, order.Items[0].ProductID)
+	assert.Equal(t, product.ID, *order.Items[0].ProductID)
+
+	var confirmation map[string]interface{}
+	brevo.mu.Lock()
+	for _, r := range brevo.requests {
+		if r.Path == "/smtp/email" && r.Body["templateId"] == float64(10) {
+			confirmation = r.Body
+		}
+	}
+	brevo.mu.Unlock()
+	require.NotNil(t, confirmation)
+	assert.Equal(t, "€35.00", confirmation["params"].(map[string]interface{})["TOTAL_PAID"])
+}
+
+func TestMyOrdersNeedVerifiedEmail(t *testing.T) {
+	if testDB == nil {
+		t.Skip("Skipping order history test - no database")
+	}
+
+	suffix := time.Now().UnixNano()
+	email := fmt.Sprintf("guest_buyer_%d@example.com", suffix)
+	guestOrder := models.Order{CustomerEmail: email, StripeSessionID: fmt.Sprintf("cs_guest_%d", suffix), Status: models.OrderStatusPaid, Currency: "gbp", TotalAmount: 4999}
+	require.NoError(t, testDB.Create(&guestOrder).Error)
+
+	// Someone signs up with the guest's address but can't read their mail
+	squatter := models.User{Email: email, PasswordHash: "x", Role: models.RoleUser}
+	require.NoError(t, testDB.Create(&squatter).Error)
+	linkedOrder := models.Order{UserID: &squatter.ID, CustomerEmail: "other@example.com", StripeSessionID: fmt.Sprintf("cs_linked_%d", suffix), Status: models.OrderStatusPaid, Currency: "gbp", TotalAmount: 1999}
+	require.NoError(t, testDB.Create(&linkedOrder).Error)
+	token := sessionToken(t, squatter)
+
+	router := gin.New()
+	routes.RegisterOrderRoutes(router, controllers.NewOrderController(testDB))
+	get := func(path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	orderIDs := func() []uint {
+		w := get("/api/orders")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var orders []models.Order
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &orders))
+		ids := []uint{}
+		for _, order := range orders {
+			ids = append(ids, order.ID)
+		}
+		return ids
+	}
+
+	// Buying with the address doesn't link the order to their account either
+	priceID := fmt.Sprintf("price_e2e_guest_%d", suffix)
+	require.NoError(t, testDB.Create(&models.Product{Name: "E2E Guest Extra", StripePriceID: priceID, IsActive: true}).Error)
+	fake := gateway.NewFake()
+	fake.AddPrice(priceID, "E2E Guest Extra", 500, "gbp")
+	brevo := newFakeBrevo()
+	defer brevo.server.Close()
+	pc, paymentRouter := newPurchaseTestController(fake, brevo)
+	sessionID := startCheckout(t, paymentRouter, priceID, strings.ToUpper(email))
+	session, err := fake.CompleteCheckoutSession(sessionID, "")
+	require.NoError(t, err)
+	payload, signature, err := fake.SignedEvent("checkout.session.completed", session)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, postWebhook(paymentRouter, payload, signature).Code)
+	workers.NewJobProcessor(testDB, pc).ProcessPendingJobs()
+	var boughtOrder models.Order
+	require.NoError(t, testDB.Where("stripe_session_id = ?", sessionID).First(&boughtOrder).Error)
+	assert.Nil(t, boughtOrder.UserID)
+
+	// Orders linked to the account are always theirs; ones matched only
+	// on email wait until the address is verified
+	assert.Equal(t, []uint{linkedOrder.ID}, orderIDs())
+	assert.Equal(t, http.StatusNotFound, get(fmt.Sprintf("/api/orders/%d", guestOrder.ID)).Code)
+	assert.Equal(t, http.StatusNotFound, get(fmt.Sprintf("/api/orders/%d/invoice", guestOrder.ID)).Code)
+
+	require.NoError(t, testDB.Model(&squatter).Update("email_verified_at", time.Now()).Error)
+	assert.ElementsMatch(t, []uint{linkedOrder.ID, guestOrder.ID, boughtOrder.ID}, orderIDs())
+	assert.Equal(t, http.StatusOK, get(fmt.Sprintf("/api/orders/%d", guestOrder.ID)).Code)
+}
+
+func TestFulfilmentRetryEmailsOnce(t *testing.T) {
+	if testDB == nil {
+		t.Skip("Skipping fulfilment retry test - no database")
+	}
+
+	suffix := time.Now().UnixNano()
+	priceID := fmt.Sprintf("price_e2e_retry_%d", suffix)
+	email := fmt.Sprintf("retried_%d@example.com", suffix)
+	code := fmt.Sprintf("RETRY%d", suffix%1000000)
+
+	program := models.WorkoutProgram{Name: fmt.Sprintf("e2e-retry-program-%d", suffix), Difficulty: "beginner"}
+	require.NoError(t, testDB.Create(&program).Error)
+	product := models.Product{Name: "E2E Retry Program", StripePriceID: priceID, Programs: []models.WorkoutProgram{program}, BrevoTemplateIDs: []int64{6}, IsActive: true}
+	require.NoError(t, testDB.Create(&product).Error)
+	require.NoError(t, testDB.Create(&models.Promotion{Code: code, DiscountType: models.PromotionTypePercent, PercentOff: 10, Currency: "gbp", IsActive: true}).Error)
+
+	fake := gateway.NewFake()
+	fake.AddPrice(priceID, "E2E Retry Program", 4999, "gbp")
+	brevo := newFakeBrevo()
+	defer brevo.server.Close()
+	pc, router := newPurchaseTestController(fake, brevo)
+
+	// Recording the promotion's use fails once, as a dropped connection would
+	sqlDB, err := testDB.DB()
+	require.NoError(t, err)
+	flakyDB, err := gorm.Open(postgres.New(postgres.Config{Conn: sqlDB}), &gorm.Config{})
+	require.NoError(t, err)
+	failRedemptions := false
+	require.NoError(t, flakyDB.Callback().Create().Before("gorm:create").Register("test:fail_redemption", func(tx *gorm.DB) {
+		if failRedemptions && tx.Statement.Table == "promotion_redemptions" {
+			tx.AddError(errors.New("connection reset by peer"))
+		}
+	}))
+	pc.DB = flakyDB
+
+	sessionID := postCheckout(t, router, map[string]interface{}{
+		"items":         []map[string]interface{}{{"priceId": priceID, "quantity": 1}},
+		"customerEmail": email,
+		"couponCode":    code,
+	})
+	session, err := fake.CompleteCheckoutSession(sessionID, "")
+	require.NoError(t, err)
+	payload, signature, err := fake.SignedEvent("checkout.session.completed", session)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, postWebhook(router, payload, signature).Code)
+
+	failRedemptions = true
+	processor := workers.NewJobProcessor(testDB, pc)
+	processor.ProcessPendingJobs()
+	var job models.Job
+	require.NoError(t, testDB.Where("session_id = ?", sessionID).First(&job).Error)
+	assert.Equal(t, models.JobStatusPending, job.Status)
+	assert.Empty(t, brevo.sentTemplates())
+	var tokens int64
+	testDB.Model(&models.AuthToken{}).Where("session_id = ?", sessionID).Count(&tokens)
+	assert.Zero(t, tokens)
+
+	// The retry sends everything once, and running again sends nothing
+	failRedemptions = false
+	require.NoError(t, testDB.Model(&job).Update("next_run_at", time.Now().Add(-time.Second)).Error)
+	processor.ProcessPendingJobs()
+	require.NoError(t, testDB.First(&job, job.ID).Error)
+	require.Equal(t, models.JobStatusCompleted, job.Status, job.LastError)
+	require.NoError(t, pc.ProcessPaymentSuccess(sessionID, email))
+
+	assert.ElementsMatch(t, []int64{6, 10}, brevo.sentTemplates())
+	testDB.Model(&models.AuthToken{}).Where("session_id = ?", sessionID).Count(&tokens)
+	assert.Equal(t, int64(1), tokens)
+	var order models.Order
+	require.NoError(t, testDB.Where("stripe_session_id = ?", sessionID).First(&order).Error)
+	assert.NotNil(t, order.FulfilledAt)
+}
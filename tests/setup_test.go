@@ -3,10 +3,14 @@ package tests
 import (
 	"os"
 	"testing"
+	"time"
 
 	"github.com/88warren/lmw-fitness-backend/config"
 	"github.com/88warren/lmw-fitness-backend/database"
+	"github.com/88warren/lmw-fitness-backend/models"
+	"github.com/88warren/lmw-fitness-backend/utils/auth"
 	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
 	"gorm.io/gorm"
 )
 
@@ -90,3 +94,13 @@ func cleanup() {
 func GetTestDB() *gorm.DB {
 	return testDB
 }
+
+// sessionToken signs user in on a new session and returns its access token,
+// as a login would.
+func sessionToken(t *testing.T, user models.User) string {
+	session := models.UserSession{UserID: user.ID, LastUsedAt: time.Now(), ExpiresAt: time.Now().Add(auth.RefreshTokenTTL)}
+	require.NoError(t, testDB.Create(&session).Error)
+	token, _, err := auth.IssueAccessToken(user.ID, user.Email, user.Role, session.ID)
+	require.NoError(t, err)
+	return token
+}
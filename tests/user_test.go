@@ -3,15 +3,26 @@ package tests
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/88warren/lmw-fitness-backend/config"
 	"github.com/88warren/lmw-fitness-backend/controllers"
+	"github.com/88warren/lmw-fitness-backend/database"
+	"github.com/88warren/lmw-fitness-backend/lockout"
+	"github.com/88warren/lmw-fitness-backend/middleware"
 	"github.com/88warren/lmw-fitness-backend/models"
+	"github.com/88warren/lmw-fitness-backend/rbac"
 	"github.com/88warren/lmw-fitness-backend/routes"
+	"github.com/88warren/lmw-fitness-backend/utils/auth"
+	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -124,3 +135,405 @@ func TestUserValidation(t *testing.T) {
 
 	assert.Equal(t, http.StatusBadRequest, w.Code)
 }
+
+func TestSessionRefreshAndRevocation(t *testing.T) {
+	db := GetTestDB()
+	if db == nil {
+		t.Skip("Skipping database test - no connection available")
+	}
+
+	email := fmt.Sprintf("sessions_%d@example.com", time.Now().UnixNano())
+	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("Testpassword123!"), bcrypt.DefaultCost)
+	require.NoError(t, db.Create(&models.User{Email: email, PasswordHash: string(hashedPassword), Role: "user"}).Error)
+
+	router := gin.New()
+	routes.RegisterUserRoutes(router, controllers.NewUserController(db))
+
+	send := func(method, path, token string, body interface{}) *httptest.ResponseRecorder {
+		jsonBody, _ := json.Marshal(body)
+		req, _ := http.NewRequest(method, path, bytes.NewBuffer(jsonBody))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	type tokenPair struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refreshToken"`
+	}
+	login := func() tokenPair {
+		w := send("POST", "/api/login", "", map[string]string{"email": email, "password": "Testpassword123!"})
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var pair tokenPair
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &pair))
+		require.NotEmpty(t, pair.Token)
+		require.NotEmpty(t, pair.RefreshToken)
+		return pair
+	}
+
+	laptop := login()
+	phone := login()
+
+	// Refreshing rotates the refresh token
+	w := send("POST", "/api/refresh-token", "", map[string]string{"refreshToken": laptop.RefreshToken})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var rotated tokenPair
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &rotated))
+	assert.NotEqual(t, laptop.RefreshToken, rotated.RefreshToken)
+
+	// Refresh tokens are only stored hashed
+	var stored int64
+	db.Model(&models.RefreshToken{}).Where("token_hash = ?", rotated.RefreshToken).Count(&stored)
+	assert.Zero(t, stored)
+
+	// The phone sees both sessions and signs the laptop out
+	w = send("GET", "/api/sessions", phone.Token, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var listed struct {
+		Sessions []struct {
+			ID      uint `json:"ID"`
+			Current bool `json:"current"`
+		} `json:"sessions"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &listed))
+	require.Len(t, listed.Sessions, 2)
+	w = send("DELETE", "/api/sessions", phone.Token, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	// The laptop's access and refresh tokens stop working at once
+	assert.Equal(t, http.StatusUnauthorized, send("GET", "/api/sessions", rotated.Token, nil).Code)
+	assert.Equal(t, http.StatusUnauthorized, send("POST", "/api/refresh-token", "", map[string]string{"refreshToken": rotated.RefreshToken}).Code)
+	assert.Equal(t, http.StatusOK, send("GET", "/api/sessions", phone.Token, nil).Code)
+
+	// Replaying a used refresh token revokes the session it belongs to
+	w = send("POST", "/api/refresh-token", "", map[string]string{"refreshToken": phone.RefreshToken})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var phoneRotated tokenPair
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &phoneRotated))
+	assert.Equal(t, http.StatusUnauthorized, send("POST", "/api/refresh-token", "", map[string]string{"refreshToken": phone.RefreshToken}).Code)
+	assert.Equal(t, http.StatusUnauthorized, send("GET", "/api/sessions", phoneRotated.Token, nil).Code)
+	var reused models.UserSession
+	require.NoError(t, db.Order("id DESC").Where("revoked_reason = ?", controllers.SessionRevokedTokenReuse).First(&reused).Error)
+
+	// Logging out ends the session
+	tablet := login()
+	require.Equal(t, http.StatusOK, send("POST", "/api/logout", "", map[string]string{"refreshToken": tablet.RefreshToken}).Code)
+	assert.Equal(t, http.StatusUnauthorized, send("GET", "/api/sessions", tablet.Token, nil).Code)
+}
+
+func TestMagicLinkLogin(t *testing.T) {
+	db := GetTestDB()
+	if db == nil {
+		t.Skip("Skipping database test - no connection available")
+	}
+
+	email := fmt.Sprintf("magic_%d@example.com", time.Now().UnixNano())
+	user := models.User{Email: email, PasswordHash: "unused", Role: "user"}
+	require.NoError(t, db.Create(&user).Error)
+
+	var sent []string
+	uc := controllers.NewUserController(db)
+	uc.SendEmail = func(to, subject, body string) error {
+		sent = append(sent, body)
+		return nil
+	}
+	router := gin.New()
+	routes.RegisterUserRoutes(router, uc)
+
+	post := func(path string, body interface{}) *httptest.ResponseRecorder {
+		jsonBody, _ := json.Marshal(body)
+		req, _ := http.NewRequest("POST", path, bytes.NewBuffer(jsonBody))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	tokenPattern := regexp.MustCompile(`workout-auth\?token=([0-9a-f]+)`)
+	requestLink := func() string {
+		before := len(sent)
+		w := post("/api/login/magic-link", map[string]string{"email": email})
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		if len(sent) == before {
+			return ""
+		}
+		match := tokenPattern.FindStringSubmatch(sent[len(sent)-1])
+		require.Len(t, match, 2)
+		return match[1]
+	}
+
+	// Unknown accounts get the same answer and no email
+	w := post("/api/login/magic-link", map[string]string{"email": "nobody_" + email})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, sent)
+
+	token := requestLink()
+	require.NotEmpty(t, token)
+
+	// Only the hash is stored
+	var plain int64
+	db.Model(&models.AuthToken{}).Where("token = ?", token).Count(&plain)
+	assert.Zero(t, plain)
+
+	w = post("/api/verify-workout-token", map[string]string{"token": token})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var verified struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refreshToken"`
+		Purpose      string `json:"purpose"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &verified))
+	assert.NotEmpty(t, verified.Token)
+	assert.NotEmpty(t, verified.RefreshToken)
+	assert.Equal(t, models.AuthTokenPurposeLogin, verified.Purpose)
+
+	// Links work once
+	assert.Equal(t, http.StatusUnauthorized, post("/api/verify-workout-token", map[string]string{"token": token}).Code)
+
+	// Expired links are refused
+	expiring := requestLink()
+	require.NotEmpty(t, expiring)
+	require.NoError(t, db.Model(&models.AuthToken{}).Where("user_id = ? AND is_used = ?", user.ID, false).
+		Update("expires_at", time.Now().Add(-time.Minute)).Error)
+	assert.Equal(t, http.StatusUnauthorized, post("/api/verify-workout-token", map[string]string{"token": expiring}).Code)
+
+	// A third link is allowed, a fourth in the same window is not sent
+	assert.NotEmpty(t, requestLink())
+	assert.Empty(t, requestLink())
+}
+
+func TestLoginLockout(t *testing.T) {
+	db := GetTestDB()
+	if db == nil {
+		t.Skip("Skipping database test - no connection available")
+	}
+
+	email := fmt.Sprintf("lockout_%d@example.com", time.Now().UnixNano())
+	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("Testpassword123!"), bcrypt.DefaultCost)
+	user := models.User{Email: email, PasswordHash: string(hashedPassword), Role: "user"}
+	require.NoError(t, db.Create(&user).Error)
+
+	limiter := lockout.New(lockout.NewMemoryStore())
+	limiter.Account.DelayAfter = 0
+	var warnings []string
+	uc := controllers.NewUserController(db)
+	uc.Lockout = limiter
+	uc.SendEmail = func(to, subject, body string) error {
+		warnings = append(warnings, to)
+		return nil
+	}
+	router := gin.New()
+	routes.RegisterUserRoutes(router, uc)
+
+	login := func(password string) *httptest.ResponseRecorder {
+		jsonBody, _ := json.Marshal(map[string]string{"email": email, "password": password})
+		req, _ := http.NewRequest("POST", "/api/login", bytes.NewBuffer(jsonBody))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	for i := 0; i < limiter.Account.LockAfter; i++ {
+		require.Equal(t, http.StatusUnauthorized, login("Wrongpassword1!").Code)
+	}
+	// Warned at the fifth failure and again when locked
+	assert.Equal(t, []string{email, email}, warnings)
+
+	// Even the right password is refused while locked
+	w := login("Testpassword123!")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+
+	// An admin lifts the lock
+	ac := controllers.NewAdminController(db)
+	ac.Lockout = limiter
+	unlock := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(unlock)
+	c.Params = gin.Params{{Key: "id", Value: fmt.Sprint(user.ID)}}
+	ac.UnlockUser(c)
+	require.Equal(t, http.StatusOK, unlock.Code, unlock.Body.String())
+
+	assert.Equal(t, http.StatusOK, login("Testpassword123!").Code)
+}
+
+func TestTwoFactorLogin(t *testing.T) {
+	db := GetTestDB()
+	if db == nil {
+		t.Skip("Skipping database test - no connection available")
+	}
+
+	email := fmt.Sprintf("totp_%d@example.com", time.Now().UnixNano())
+	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("Testpassword123!"), bcrypt.DefaultCost)
+	user := models.User{Email: email, PasswordHash: string(hashedPassword), Role: "admin"}
+	require.NoError(t, db.Create(&user).Error)
+	database.RoleSeed(db)
+	rbac.Invalidate()
+
+	uc := controllers.NewUserController(db)
+	uc.Lockout = lockout.New(lockout.NewMemoryStore())
+	router := gin.New()
+	routes.RegisterUserRoutes(router, uc)
+	router.GET("/admin-check", middleware.AuthMiddleware(), middleware.StaffMiddleware(middleware.RequireRecentMFA(time.Hour)), func(c *gin.Context) {
+		c.Status(http.StatusNoContent)
+	})
+
+	send := func(method, path, token string, body interface{}) *httptest.ResponseRecorder {
+		jsonBody, _ := json.Marshal(body)
+		req, _ := http.NewRequest(method, path, bytes.NewBuffer(jsonBody))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	var login struct {
+		Token       string `json:"token"`
+		MFARequired bool   `json:"mfaRequired"`
+		MFAToken    string `json:"mfaToken"`
+	}
+	logIn := func() {
+		w := send("POST", "/api/login", "", map[string]string{"email": email, "password": "Testpassword123!"})
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		login.Token, login.MFAToken = "", ""
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &login))
+	}
+
+	logIn()
+	require.False(t, login.MFARequired)
+	token := login.Token
+	assert.Equal(t, http.StatusForbidden, send("GET", "/admin-check", token, nil).Code)
+
+	// Enrol
+	w := send("POST", "/api/2fa/setup", token, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var setup struct {
+		Secret          string `json:"secret"`
+		ProvisioningURI string `json:"provisioningUri"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &setup))
+	assert.Contains(t, setup.ProvisioningURI, "otpauth://totp/")
+	step := auth.TOTPCounter(time.Now())
+	code, _ := auth.TOTPCode(setup.Secret, step)
+	w = send("POST", "/api/2fa/enable", token, map[string]string{"code": code})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var enabled struct {
+		RecoveryCodes []string `json:"recoveryCodes"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &enabled))
+	require.Len(t, enabled.RecoveryCodes, 10)
+
+	// Enrolling counts as a two-factor check for this session
+	assert.Equal(t, http.StatusNoContent, send("GET", "/admin-check", token, nil).Code)
+
+	// The password alone now only gets a challenge
+	logIn()
+	require.True(t, login.MFARequired)
+	assert.Empty(t, login.Token)
+	assert.Equal(t, http.StatusUnauthorized, send("POST", "/api/login/2fa", "", map[string]string{"mfaToken": login.MFAToken, "code": "000000"}).Code)
+	nextCode, _ := auth.TOTPCode(setup.Secret, step+1)
+	w = send("POST", "/api/login/2fa", "", map[string]string{"mfaToken": login.MFAToken, "code": nextCode})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var finished struct {
+		Token string `json:"token"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &finished))
+	assert.Equal(t, http.StatusNoContent, send("GET", "/admin-check", finished.Token, nil).Code)
+
+	// Codes and challenges work once
+	assert.Equal(t, http.StatusUnauthorized, send("POST", "/api/login/2fa", "", map[string]string{"mfaToken": login.MFAToken, "code": nextCode}).Code)
+	logIn()
+	assert.Equal(t, http.StatusUnauthorized, send("POST", "/api/login/2fa", "", map[string]string{"mfaToken": login.MFAToken, "code": nextCode}).Code)
+
+	// A recovery code works in place of the app, once
+	w = send("POST", "/api/login/2fa", "", map[string]string{"mfaToken": login.MFAToken, "code": strings.ToUpper(enabled.RecoveryCodes[0])})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	logIn()
+	assert.Equal(t, http.StatusUnauthorized, send("POST", "/api/login/2fa", "", map[string]string{"mfaToken": login.MFAToken, "code": enabled.RecoveryCodes[0]}).Code)
+
+	// An old check no longer satisfies the admin middleware
+	require.NoError(t, db.Model(&models.UserSession{}).Where("user_id = ?", user.ID).
+		Update("mfa_verified_at", time.Now().Add(-2*time.Hour)).Error)
+	assert.Equal(t, http.StatusForbidden, send("GET", "/admin-check", finished.Token, nil).Code)
+	require.Equal(t, http.StatusOK, send("POST", "/api/2fa/verify", finished.Token, map[string]string{"code": enabled.RecoveryCodes[1]}).Code)
+	assert.Equal(t, http.StatusNoContent, send("GET", "/admin-check", finished.Token, nil).Code)
+}
+
+func TestEmailVerification(t *testing.T) {
+	db := GetTestDB()
+	if db == nil {
+		t.Skip("Skipping database test - no connection available")
+	}
+
+	var sent []string
+	uc := controllers.NewUserController(db)
+	uc.SendEmail = func(to, subject, body string) error {
+		sent = append(sent, body)
+		return nil
+	}
+	router := gin.New()
+	routes.RegisterUserRoutes(router, uc)
+
+	send := func(method, path, token string, body interface{}) *httptest.ResponseRecorder {
+		jsonBody, _ := json.Marshal(body)
+		req, _ := http.NewRequest(method, path, bytes.NewBuffer(jsonBody))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	tokenPattern := regexp.MustCompile(`verify-email\?token=([0-9a-f]+)`)
+	lastLink := func() string {
+		require.NotEmpty(t, sent)
+		match := tokenPattern.FindStringSubmatch(sent[len(sent)-1])
+		require.Len(t, match, 2)
+		return match[1]
+	}
+
+	email := fmt.Sprintf("verify_%d@example.com", time.Now().UnixNano())
+	w := send("POST", "/api/register", "", map[string]string{"email": email, "password": "Testpassword123!"})
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var registered struct {
+		Token string `json:"token"`
+		User  struct {
+			EmailVerified bool `json:"emailVerified"`
+		} `json:"user"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &registered))
+	assert.False(t, registered.User.EmailVerified)
+	firstLink := lastLink()
+
+	changePassword := map[string]string{"oldPassword": "Testpassword123!", "newPassword": "Newpassword123!", "confirmNewPassword": "Newpassword123!"}
+	w = send("PUT", "/api/change-password-first-login", registered.Token, changePassword)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "email_unverified")
+
+	// Resending retires the earlier link
+	require.Equal(t, http.StatusOK, send("POST", "/api/verify-email/resend", registered.Token, nil).Code)
+	secondLink := lastLink()
+	assert.NotEqual(t, firstLink, secondLink)
+	assert.Equal(t, http.StatusBadRequest, send("POST", "/api/verify-email", "", map[string]string{"token": firstLink}).Code)
+
+	require.Equal(t, http.StatusOK, send("POST", "/api/verify-email", "", map[string]string{"token": secondLink}).Code)
+	assert.Equal(t, http.StatusBadRequest, send("POST", "/api/verify-email", "", map[string]string{"token": secondLink}).Code)
+
+	w = send("GET", "/api/profile", registered.Token, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), `"emailVerified":true`)
+	assert.Equal(t, http.StatusOK, send("PUT", "/api/change-password-first-login", registered.Token, changePassword).Code)
+
+	// Only a few resends are allowed in a row
+	var user models.User
+	require.NoError(t, db.Where("email = ?", email).First(&user).Error)
+	require.NoError(t, db.Model(&user).Update("email_verified_at", nil).Error)
+	w = send("POST", "/api/verify-email/resend", registered.Token, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, http.StatusTooManyRequests, send("POST", "/api/verify-email/resend", registered.Token, nil).Code)
+}
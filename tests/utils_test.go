@@ -1,9 +1,26 @@
 package tests
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/88warren/lmw-fitness-backend/lockout"
+	"github.com/88warren/lmw-fitness-backend/utils/auth"
+	"github.com/88warren/lmw-fitness-backend/utils/money"
+	"github.com/88warren/lmw-fitness-backend/utils/pdf"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -84,3 +101,228 @@ func TestStringValidation(t *testing.T) {
 	assert.True(t, len(normalString) > 3 && len(normalString) < 50)
 	assert.True(t, len(longString) > 50)
 }
+
+func TestPDFDocument(t *testing.T) {
+	doc := pdf.New()
+	doc.Text(50, 70, 12, true, "Invoice (copy)")
+	doc.TextRight(545, 70, 12, false, "£44.99")
+	doc.AddPage()
+	doc.Line(50, 100, 545, 100)
+	out := doc.Bytes()
+
+	assert.True(t, bytes.HasPrefix(out, []byte("%PDF-1.4")))
+	assert.True(t, bytes.HasSuffix(out, []byte("%%EOF\n")))
+	assert.Contains(t, string(out), "/Count 2")
+	assert.Contains(t, string(out), `(Invoice \(copy\)) Tj`)
+	assert.Contains(t, string(out), "(\xa344.99) Tj")
+
+	// Every xref entry must point at the start of its object
+	match := regexp.MustCompile(`startxref\n(\d+)`).FindSubmatch(out)
+	require.NotNil(t, match)
+	xref, _ := strconv.Atoi(string(match[1]))
+	require.True(t, bytes.HasPrefix(out[xref:], []byte("xref\n")))
+	entries := regexp.MustCompile(`(\d{10}) 00000 n`).FindAllSubmatch(out[xref:], -1)
+	require.Len(t, entries, 8)
+	for i, entry := range entries {
+		offset, _ := strconv.Atoi(string(entry[1]))
+		assert.True(t, bytes.HasPrefix(out[offset:], []byte(fmt.Sprintf("%d 0 obj", i+1))), "object %d", i+1)
+	}
+
+	assert.InDelta(t, 22.78, pdf.TextWidth("Hello", 10, false), 0.01)
+	assert.Greater(t, pdf.TextWidth("Hello", 10, true), pdf.TextWidth("Hello", 10, false))
+}
+
+func TestMoneyFormat(t *testing.T) {
+	assert.Equal(t, "£12.34", money.Format(1234, "gbp"))
+	assert.Equal(t, "€0.05", money.Format(5, "EUR"))
+	assert.Equal(t, "-$1.50", money.Format(-150, "usd"))
+	// Zero-decimal currencies are already in major units
+	assert.Equal(t, "¥500", money.Format(500, "jpy"))
+	assert.Equal(t, "12.00 CHF", money.Format(1200, "chf"))
+	assert.Equal(t, "12.00", money.Decimal(1200, "gbp"))
+}
+
+func TestJWTKeyRotation(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	privateDER, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	require.NoError(t, err)
+	publicDER, err := x509.MarshalPKIXPublicKey(publicKey)
+	require.NoError(t, err)
+	privatePEM := string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER}))
+	publicPEM := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}))
+	oldKey := auth.KeyConfig{ID: "2026-01", Algorithm: auth.AlgHS256, Secret: "an-old-secret-that-is-long-enough-to-use"}
+
+	oldRing, err := auth.NewKeyRing([]auth.KeyConfig{oldKey}, "")
+	require.NoError(t, err)
+	oldToken, _, err := oldRing.IssueAccessToken(7, "rotate@example.com", "user", 3)
+	require.NoError(t, err)
+
+	// The new key signs; the old one still verifies tokens issued with it
+	ring, err := auth.NewKeyRing([]auth.KeyConfig{{ID: "2026-10", Algorithm: auth.AlgEdDSA, PrivateKey: privatePEM}, oldKey}, "")
+	require.NoError(t, err)
+	assert.Equal(t, "2026-10", ring.SigningKeyID())
+	claims, err := ring.ParseAccessToken(oldToken)
+	require.NoError(t, err)
+	assert.Equal(t, uint(7), claims.UserID)
+	assert.Equal(t, uint(3), claims.SessionID)
+
+	newToken, _, err := ring.IssueAccessToken(7, "rotate@example.com", "user", 3)
+	require.NoError(t, err)
+	_, err = oldRing.ParseAccessToken(newToken)
+	assert.Error(t, err, "a ring without the new key can't verify its tokens")
+
+	// Another service can verify with just the published public key
+	verifier, err := auth.NewKeyRing([]auth.KeyConfig{
+		{ID: "2026-10", Algorithm: auth.AlgEdDSA, PublicKey: publicPEM},
+		{ID: "signer", Algorithm: auth.AlgHS256, Secret: "unrelated-secret-for-the-verifier-ring"},
+	}, "signer")
+	require.NoError(t, err)
+	_, err = verifier.ParseAccessToken(newToken)
+	assert.NoError(t, err)
+
+	// Tokens must name a session and the key that signed them, so none
+	// escape revocation
+	noSession, _, err := ring.IssueAccessToken(7, "rotate@example.com", "user", 0)
+	require.NoError(t, err)
+	_, err = ring.ParseAccessToken(noSession)
+	assert.Error(t, err, "a token without a session is refused")
+	legacy := jwt.NewWithClaims(jwt.SigningMethodHS256, auth.Claims{
+		UserID:           7,
+		SessionID:        3,
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))},
+	})
+	legacyToken, err := legacy.SignedString([]byte(oldKey.Secret))
+	require.NoError(t, err)
+	_, err = ring.ParseAccessToken(legacyToken)
+	assert.Error(t, err, "a token without a kid is refused")
+
+	// Once the old key is retired its tokens stop working
+	retired, err := auth.NewKeyRing([]auth.KeyConfig{{ID: "2026-10", Algorithm: auth.AlgEdDSA, PrivateKey: privatePEM}}, "")
+	require.NoError(t, err)
+	_, err = retired.ParseAccessToken(oldToken)
+	assert.Error(t, err)
+
+	jwks := ring.JWKS()
+	require.Len(t, jwks.Keys, 1, "HS256 secrets are never published")
+	assert.Equal(t, "2026-10", jwks.Keys[0].KeyID)
+	assert.Equal(t, "OKP", jwks.Keys[0].KeyType)
+	assert.Equal(t, base64.RawURLEncoding.EncodeToString(publicKey), jwks.Keys[0].X)
+
+	// A public key alone can't sign
+	_, err = auth.NewKeyRing([]auth.KeyConfig{{ID: "verify-only", Algorithm: auth.AlgEdDSA, PublicKey: publicPEM}}, "")
+	assert.ErrorIs(t, err, auth.ErrNoSigningKeys)
+
+	// Production refuses to fall back to the development secret
+	t.Setenv("GO_ENV", "production")
+	t.Setenv("JWT_SECRET", "")
+	t.Setenv("JWT_KEYS", "")
+	t.Setenv("JWT_KEYS_FILE", "")
+	_, err = auth.LoadKeyRing()
+	assert.ErrorIs(t, err, auth.ErrNoSigningKeys)
+}
+
+func TestLockoutLimiter(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	limiter := lockout.New(lockout.NewMemoryStore())
+	limiter.Now = func() time.Time { return now }
+	const email, ip = "Runner@Example.com", "203.0.113.7"
+
+	var failure lockout.Failure
+	fail := func() {
+		var err error
+		failure, err = limiter.Fail(lockout.ScopeLogin, email, ip)
+		require.NoError(t, err)
+	}
+	wait := func() time.Duration {
+		w, err := limiter.Wait(lockout.ScopeLogin, email, ip)
+		require.NoError(t, err)
+		return w
+	}
+
+	// The first few failures cost nothing, then each one doubles the wait
+	for i := 0; i < 2; i++ {
+		fail()
+	}
+	assert.Zero(t, wait())
+	fail()
+	assert.Equal(t, time.Second, wait())
+	fail()
+	assert.Equal(t, 2*time.Second, wait())
+	now = now.Add(2 * time.Second)
+	assert.Zero(t, wait())
+
+	// The owner is told once, on the fifth failure
+	fail()
+	assert.True(t, failure.Notify)
+	fail()
+	assert.False(t, failure.Notify)
+
+	// The tenth failure locks the account
+	for failure.Failures < 10 {
+		fail()
+	}
+	assert.True(t, failure.Locked)
+	assert.True(t, failure.Notify)
+	assert.Equal(t, 15*time.Minute, wait())
+
+	// Email case doesn't matter and other scopes are unaffected
+	w, err := limiter.Wait(lockout.ScopeLogin, "runner@example.com", "")
+	require.NoError(t, err)
+	assert.Equal(t, 15*time.Minute, w)
+	w, err = limiter.Wait(lockout.ScopeResetRequest, email, ip)
+	require.NoError(t, err)
+	assert.Zero(t, w)
+
+	// Unlocking clears the account but not the IP's count
+	require.NoError(t, limiter.Unlock(email))
+	w, err = limiter.Wait(lockout.ScopeLogin, email, "")
+	require.NoError(t, err)
+	assert.Zero(t, w)
+	w, err = limiter.Wait(lockout.ScopeLogin, "", ip)
+	require.NoError(t, err)
+	assert.Positive(t, w)
+
+	// Failures are forgotten after an hour without one
+	now = now.Add(2 * time.Hour)
+	assert.Zero(t, wait())
+	fail()
+	assert.Equal(t, 1, failure.Failures)
+}
+
+func TestTOTP(t *testing.T) {
+	// RFC 6238 test vectors for SHA-1, truncated to six digits
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+	for unix, want := range vectors {
+		code, err := auth.TOTPCode(secret, auth.TOTPCounter(time.Unix(unix, 0)))
+		require.NoError(t, err)
+		assert.Equal(t, want, code, "at %d", unix)
+	}
+
+	now := time.Unix(1234567890, 0)
+	counter, ok := auth.VerifyTOTP(secret, "005924", now, 0)
+	require.True(t, ok)
+	// A code from the previous step is still accepted
+	_, ok = auth.VerifyTOTP(secret, "005924", now.Add(auth.TOTPPeriod), 0)
+	assert.True(t, ok)
+	// but never twice
+	_, ok = auth.VerifyTOTP(secret, "005924", now, counter)
+	assert.False(t, ok)
+	_, ok = auth.VerifyTOTP(secret, "123456", now, 0)
+	assert.False(t, ok)
+
+	uri := auth.TOTPProvisioningURI("runner@example.com", secret)
+	assert.True(t, strings.HasPrefix(uri, "otpauth://totp/LMW%20Fitness:runner@example.com?"), uri)
+	assert.Contains(t, uri, "secret="+strings.TrimRight(secret, "="))
+
+	code, err := auth.NewRecoveryCode()
+	require.NoError(t, err)
+	assert.Regexp(t, `^[a-z2-7]{5}-[a-z2-7]{5}$`, code)
+	assert.Equal(t, code, auth.NormaliseRecoveryCode(strings.ToUpper(strings.ReplaceAll(code, "-", ""))))
+}
@@ -0,0 +1,149 @@
+package tests
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/88warren/lmw-fitness-backend/models"
+	"github.com/88warren/lmw-fitness-backend/workers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm/clause"
+)
+
+func TestJobBackoff(t *testing.T) {
+	assert.Equal(t, 30*time.Second, workers.Backoff(0))
+	assert.Equal(t, 30*time.Second, workers.Backoff(1))
+	assert.Equal(t, time.Minute, workers.Backoff(2))
+	assert.Equal(t, 2*time.Minute, workers.Backoff(3))
+	assert.Equal(t, 4*time.Minute, workers.Backoff(4))
+	assert.Equal(t, time.Hour, workers.Backoff(20))
+	assert.Equal(t, time.Hour, workers.Backoff(1000))
+}
+
+// fakeFulfilment records the sessions it is asked to fulfil and fails the
+// ones listed in failing.
+type fakeFulfilment struct {
+	mu      sync.Mutex
+	runs    []string
+	failing map[string]bool
+}
+
+func (f *fakeFulfilment) ProcessPaymentSuccess(sessionID string, customerEmail string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.runs = append(f.runs, sessionID)
+	if f.failing[sessionID] {
+		return errors.New("fulfilment failed")
+	}
+	return nil
+}
+
+func (f *fakeFulfilment) ran(sessionID string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	count := 0
+	for _, run := range f.runs {
+		if run == sessionID {
+			count++
+		}
+	}
+	return count
+}
+
+func TestJobLeasing(t *testing.T) {
+	if GetTestDB() == nil {
+		t.Skip("Skipping database test - no connection available")
+	}
+
+	suffix := time.Now().UnixNano()
+	past := time.Now().Add(-time.Minute)
+	future := time.Now().Add(time.Hour)
+	newJob := func(name string, job models.Job) models.Job {
+		job.SessionID = fmt.Sprintf("cs_worker_%s_%d", name, suffix)
+		job.CustomerEmail = fmt.Sprintf("worker_%d@example.com", suffix)
+		if job.Status == "" {
+			job.Status = models.JobStatusPending
+		}
+		if job.NextRunAt.IsZero() {
+			job.NextRunAt = past
+		}
+		require.NoError(t, testDB.Create(&job).Error)
+		return job
+	}
+	reload := func(job models.Job) models.Job {
+		require.NoError(t, testDB.First(&job, job.ID).Error)
+		return job
+	}
+
+	locked := newJob("locked", models.Job{})
+	free := newJob("free", models.Job{})
+	abandoned := newJob("abandoned", models.Job{Status: models.JobStatusProcessing, Attempts: 1, LeaseOwner: "dead-worker", LeaseExpiresAt: &past})
+	leased := newJob("leased", models.Job{Status: models.JobStatusProcessing, Attempts: 1, LeaseOwner: "live-worker", LeaseExpiresAt: &future})
+	flaky := newJob("flaky", models.Job{})
+	lastChance := newJob("last", models.Job{Attempts: workers.MaxJobAttempts - 1})
+	crashedLast := newJob("crashed", models.Job{Status: models.JobStatusProcessing, Attempts: workers.MaxJobAttempts, LeaseOwner: "dead-worker", LeaseExpiresAt: &past})
+	notYet := newJob("later", models.Job{NextRunAt: future})
+
+	fulfilment := &fakeFulfilment{failing: map[string]bool{flaky.SessionID: true, lastChance.SessionID: true}}
+	processor := workers.NewJobProcessor(testDB, fulfilment)
+
+	// Another worker holds a row lock on one job; this one skips it rather
+	// than waiting
+	tx := testDB.Begin()
+	require.NoError(t, tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&models.Job{}, locked.ID).Error)
+	done := make(chan struct{})
+	go func() {
+		processor.ProcessPendingJobs()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("worker blocked on a locked job")
+	}
+	assert.Zero(t, fulfilment.ran(locked.SessionID))
+	assert.Equal(t, models.JobStatusPending, reload(locked).Status)
+	require.NoError(t, tx.Rollback().Error)
+
+	assert.Equal(t, models.JobStatusCompleted, reload(free).Status)
+
+	// An expired lease is taken over; a live one is left alone
+	abandoned = reload(abandoned)
+	assert.Equal(t, models.JobStatusCompleted, abandoned.Status)
+	assert.Equal(t, 2, abandoned.Attempts)
+	assert.Empty(t, abandoned.LeaseOwner)
+	assert.Zero(t, fulfilment.ran(leased.SessionID))
+	assert.Equal(t, "live-worker", reload(leased).LeaseOwner)
+
+	// A failure is retried later, with the attempt kept in the history
+	flaky = reload(flaky)
+	assert.Equal(t, models.JobStatusPending, flaky.Status)
+	assert.Equal(t, "fulfilment failed", flaky.LastError)
+	assert.True(t, flaky.NextRunAt.After(time.Now()))
+	var attempts []models.JobAttempt
+	require.NoError(t, testDB.Where("job_id = ?", flaky.ID).Find(&attempts).Error)
+	require.Len(t, attempts, 1)
+	assert.False(t, attempts[0].Succeeded)
+	assert.NotNil(t, attempts[0].FinishedAt)
+
+	// Failing the last attempt, or crashing during it, is final
+	lastChance = reload(lastChance)
+	assert.Equal(t, models.JobStatusDead, lastChance.Status)
+	assert.Equal(t, workers.MaxJobAttempts, lastChance.Attempts)
+	crashedLast = reload(crashedLast)
+	assert.Equal(t, models.JobStatusDead, crashedLast.Status)
+	assert.Equal(t, "lease expired on final attempt", crashedLast.LastError)
+	assert.Zero(t, fulfilment.ran(crashedLast.SessionID))
+
+	assert.Zero(t, fulfilment.ran(notYet.SessionID))
+
+	// Once the lock is gone the skipped job runs, and nothing runs twice
+	processor.ProcessPendingJobs()
+	assert.Equal(t, models.JobStatusCompleted, reload(locked).Status)
+	assert.Equal(t, 1, fulfilment.ran(free.SessionID))
+	assert.Equal(t, 1, fulfilment.ran(flaky.SessionID))
+}
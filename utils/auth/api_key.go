@@ -0,0 +1,47 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/base64"
+	"strings"
+)
+
+// APIKeyPrefix starts every API key, so they can be told apart from JWTs
+// and spotted by secret scanners.
+const APIKeyPrefix = "lmw_"
+
+var keyIDEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewAPIKey returns a key of the form lmw_<id>_<secret>, the lmw_<id> part
+// to look it up by, and the hash to store.
+func NewAPIKey() (key, prefix, hash string, err error) {
+	id := make([]byte, 5)
+	if _, err := rand.Read(id); err != nil {
+		return "", "", "", err
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", "", err
+	}
+	prefix = APIKeyPrefix + strings.ToLower(keyIDEncoding.EncodeToString(id))
+	key = prefix + "_" + base64.RawURLEncoding.EncodeToString(secret)
+	return key, prefix, HashToken(key), nil
+}
+
+// IsAPIKey reports whether a bearer token is an API key rather than a JWT.
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, APIKeyPrefix)
+}
+
+// ParseAPIKey returns the lmw_<id> part of key.
+func ParseAPIKey(key string) (prefix string, ok bool) {
+	if !IsAPIKey(key) {
+		return "", false
+	}
+	i := strings.Index(key[len(APIKeyPrefix):], "_")
+	if i <= 0 {
+		return "", false
+	}
+	return key[:len(APIKeyPrefix)+i], true
+}
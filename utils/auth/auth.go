@@ -0,0 +1,112 @@
+// Package auth issues and checks the short-lived JWT access tokens sent as
+// "Authorization: Bearer <token>". Sessions and their refresh tokens live
+// in the database; an access token only names the session it came from.
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	AccessTokenTTL  = 15 * time.Minute
+	RefreshTokenTTL = 30 * 24 * time.Hour
+)
+
+// Claims keeps the user_id/email/role names earlier tokens used. Every
+// access token names the session it was issued for.
+type Claims struct {
+	UserID    uint   `json:"user_id"`
+	Email     string `json:"email"`
+	Role      string `json:"role"`
+	SessionID uint   `json:"sid,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// IssueAccessToken signs a token for the user that expires after
+// AccessTokenTTL.
+func IssueAccessToken(userID uint, email, role string, sessionID uint) (string, time.Time, error) {
+	ring, err := Keys()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return ring.IssueAccessToken(userID, email, role, sessionID)
+}
+
+// ParseAccessToken checks the token's signature and expiry.
+func ParseAccessToken(tokenString string) (*Claims, error) {
+	ring, err := Keys()
+	if err != nil {
+		return nil, err
+	}
+	return ring.ParseAccessToken(tokenString)
+}
+
+// ParseAccessTokenAllowExpired checks the signature but not the expiry, for
+// logging out with a token that has already lapsed.
+func ParseAccessTokenAllowExpired(tokenString string) (*Claims, error) {
+	ring, err := Keys()
+	if err != nil {
+		return nil, err
+	}
+	claims := &Claims{}
+	if _, err := jwt.ParseWithClaims(tokenString, claims, ring.keyFunc, jwt.WithoutClaimsValidation()); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (r *KeyRing) IssueAccessToken(userID uint, email, role string, sessionID uint) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(AccessTokenTTL)
+	claims := Claims{
+		UserID:    userID,
+		Email:     email,
+		Role:      role,
+		SessionID: sessionID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}
+	signed, err := r.sign(claims)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return signed, expiresAt, nil
+}
+
+func (r *KeyRing) ParseAccessToken(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, r.keyFunc, jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid || claims.UserID == 0 || claims.SessionID == 0 {
+		return nil, errors.New("invalid token claims")
+	}
+	return claims, nil
+}
+
+// NewRefreshToken returns an opaque token for the client and the hash to
+// store in its place.
+func NewRefreshToken() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	return token, HashToken(token), nil
+}
+
+// HashToken is how refresh tokens are looked up without storing them.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
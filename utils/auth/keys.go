@@ -0,0 +1,321 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Algorithms a signing key can use
+const (
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+	AlgEdDSA = "EdDSA"
+)
+
+// legacyKeyID names the JWT_SECRET key.
+const legacyKeyID = "default"
+
+const devSecret = "supersecretjwtkey"
+
+var ErrNoSigningKeys = errors.New("no JWT signing keys configured: set JWT_KEYS, JWT_KEYS_FILE or JWT_SECRET")
+
+// KeyConfig is one entry of the JWT_KEYS JSON array. HS256 keys take a
+// secret; RS256 and EdDSA keys take a PEM private key, or only a public key
+// for a retired key whose tokens should still verify.
+type KeyConfig struct {
+	ID         string `json:"kid"`
+	Algorithm  string `json:"alg"`
+	Secret     string `json:"secret,omitempty"`
+	PrivateKey string `json:"privateKey,omitempty"`
+	PublicKey  string `json:"publicKey,omitempty"`
+}
+
+type key struct {
+	id        string
+	method    jwt.SigningMethod
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+// KeyRing signs with one key and verifies with all of them, so a new key
+// can take over signing while tokens from the old one run out.
+type KeyRing struct {
+	signing *key
+	keys    map[string]*key
+}
+
+// NewKeyRing builds a ring from configs. signingKeyID picks the key that
+// signs; when empty the first key that can sign does. The others only
+// verify.
+func NewKeyRing(configs []KeyConfig, signingKeyID string) (*KeyRing, error) {
+	ring := &KeyRing{keys: make(map[string]*key, len(configs))}
+	for _, config := range configs {
+		k, err := parseKey(config)
+		if err != nil {
+			return nil, err
+		}
+		if _, exists := ring.keys[k.id]; exists {
+			return nil, fmt.Errorf("duplicate JWT key id %q", k.id)
+		}
+		ring.keys[k.id] = k
+		if k.signKey == nil {
+			continue
+		}
+		if (signingKeyID == "" && ring.signing == nil) || k.id == signingKeyID {
+			ring.signing = k
+		}
+	}
+	if ring.signing == nil {
+		if signingKeyID != "" {
+			return nil, fmt.Errorf("signing key %q is not configured or has no private key", signingKeyID)
+		}
+		return nil, ErrNoSigningKeys
+	}
+	return ring, nil
+}
+
+func parseKey(config KeyConfig) (*key, error) {
+	if config.ID == "" {
+		return nil, errors.New("JWT key is missing its kid")
+	}
+	k := &key{id: config.ID}
+	privatePEM := pemFromEnv(config.PrivateKey)
+	publicPEM := pemFromEnv(config.PublicKey)
+	var err error
+
+	switch config.Algorithm {
+	case AlgHS256, "":
+		if config.Secret == "" {
+			return nil, fmt.Errorf("HS256 key %q has no secret", config.ID)
+		}
+		if len(config.Secret) < 32 {
+			log.Printf("Warning: HS256 key %q is shorter than 32 bytes", config.ID)
+		}
+		k.method = jwt.SigningMethodHS256
+		k.signKey = []byte(config.Secret)
+		k.verifyKey = k.signKey
+
+	case AlgRS256:
+		k.method = jwt.SigningMethodRS256
+		if privatePEM != "" {
+			private, parseErr := jwt.ParseRSAPrivateKeyFromPEM([]byte(privatePEM))
+			if parseErr != nil {
+				return nil, fmt.Errorf("RS256 key %q: %w", config.ID, parseErr)
+			}
+			k.signKey, k.verifyKey = private, &private.PublicKey
+		} else if publicPEM != "" {
+			k.verifyKey, err = jwt.ParseRSAPublicKeyFromPEM([]byte(publicPEM))
+		} else {
+			err = errors.New("needs a privateKey or publicKey")
+		}
+
+	case AlgEdDSA:
+		k.method = jwt.SigningMethodEdDSA
+		if privatePEM != "" {
+			private, parseErr := jwt.ParseEdPrivateKeyFromPEM([]byte(privatePEM))
+			if parseErr != nil {
+				return nil, fmt.Errorf("EdDSA key %q: %w", config.ID, parseErr)
+			}
+			k.signKey, k.verifyKey = private, private.(ed25519.PrivateKey).Public()
+		} else if publicPEM != "" {
+			k.verifyKey, err = jwt.ParseEdPublicKeyFromPEM([]byte(publicPEM))
+		} else {
+			err = errors.New("needs a privateKey or publicKey")
+		}
+
+	default:
+		return nil, fmt.Errorf("JWT key %q has unsupported alg %q", config.ID, config.Algorithm)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s key %q: %w", config.Algorithm, config.ID, err)
+	}
+	return k, nil
+}
+
+// pemFromEnv allows PEM blocks written on one line with literal "\n".
+func pemFromEnv(s string) string {
+	return strings.ReplaceAll(strings.TrimSpace(s), `\n`, "\n")
+}
+
+// SigningKeyID is the kid new tokens carry.
+func (r *KeyRing) SigningKeyID() string {
+	return r.signing.id
+}
+
+func (r *KeyRing) sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(r.signing.method, claims)
+	token.Header["kid"] = r.signing.id
+	return token.SignedString(r.signing.signKey)
+}
+
+func (r *KeyRing) keyFunc(token *jwt.Token) (interface{}, error) {
+	// Tokens from before key IDs have no kid. They were not tied to a
+	// session, so nothing could revoke them, and they are no longer accepted.
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		return nil, errors.New("token has no kid")
+	}
+	k, ok := r.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	if token.Method.Alg() != k.method.Alg() {
+		return nil, jwt.ErrSignatureInvalid
+	}
+	return k.verifyKey, nil
+}
+
+// JWK is a public key in the JSON Web Key format.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS publishes the ring's asymmetric public keys so other services can
+// verify our tokens. HS256 secrets are never included.
+func (r *KeyRing) JWKS() JWKSet {
+	set := JWKSet{Keys: []JWK{}}
+	ids := make([]string, 0, len(r.keys))
+	for id := range r.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		k := r.keys[id]
+		switch public := k.verifyKey.(type) {
+		case *rsa.PublicKey:
+			set.Keys = append(set.Keys, JWK{
+				KeyType:   "RSA",
+				KeyID:     k.id,
+				Algorithm: AlgRS256,
+				Use:       "sig",
+				N:         base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+				E:         base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+			})
+		case ed25519.PublicKey:
+			set.Keys = append(set.Keys, JWK{
+				KeyType:   "OKP",
+				KeyID:     k.id,
+				Algorithm: AlgEdDSA,
+				Use:       "sig",
+				Curve:     "Ed25519",
+				X:         base64.RawURLEncoding.EncodeToString(public),
+			})
+		}
+	}
+	return set
+}
+
+// LoadKeyRing reads the keys from the environment:
+//
+//   - JWT_KEYS, a JSON array of KeyConfig, or JWT_KEYS_FILE naming a file
+//     holding one. The first key signs unless JWT_SIGNING_KEY_ID names
+//     another.
+//   - JWT_SECRET, an HS256 secret with kid "default". It signs when no
+//     other keys are configured and otherwise only verifies.
+//
+// Outside production a fixed development secret is used when nothing is
+// configured; in production that is an error.
+func LoadKeyRing() (*KeyRing, error) {
+	raw := os.Getenv("JWT_KEYS")
+	if path := os.Getenv("JWT_KEYS_FILE"); path != "" {
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read JWT_KEYS_FILE: %w", err)
+		}
+		raw = string(contents)
+	}
+
+	configs := []KeyConfig{}
+	if strings.TrimSpace(raw) != "" {
+		if err := json.Unmarshal([]byte(raw), &configs); err != nil {
+			return nil, fmt.Errorf("could not parse JWT keys: %w", err)
+		}
+	}
+	signingKeyID := os.Getenv("JWT_SIGNING_KEY_ID")
+
+	if secret := os.Getenv("JWT_SECRET"); secret != "" {
+		legacy := KeyConfig{ID: legacyKeyID, Algorithm: AlgHS256, Secret: secret}
+		if len(configs) > 0 && signingKeyID == "" {
+			signingKeyID = configs[0].ID
+		}
+		configs = append(configs, legacy)
+	}
+
+	if len(configs) == 0 {
+		if os.Getenv("GO_ENV") == "production" {
+			return nil, ErrNoSigningKeys
+		}
+		log.Println("No JWT keys configured. Using a development secret (NOT SECURE FOR PRODUCTION!).")
+		configs = []KeyConfig{{ID: legacyKeyID, Algorithm: AlgHS256, Secret: devSecret}}
+	}
+	return NewKeyRing(configs, signingKeyID)
+}
+
+var (
+	ringMu  sync.RWMutex
+	current *KeyRing
+)
+
+// Init loads the key ring from the environment. The server calls it at
+// startup so a bad configuration stops it there rather than at first login.
+func Init() error {
+	ring, err := LoadKeyRing()
+	if err != nil {
+		return err
+	}
+	SetKeyRing(ring)
+	log.Printf("JWT key ring loaded: %d keys, signing with %q", len(ring.keys), ring.SigningKeyID())
+	return nil
+}
+
+// SetKeyRing replaces the keys used by the package-level functions.
+func SetKeyRing(ring *KeyRing) {
+	ringMu.Lock()
+	defer ringMu.Unlock()
+	current = ring
+}
+
+// Keys returns the ring in use, loading it on first use if Init wasn't
+// called.
+func Keys() (*KeyRing, error) {
+	ringMu.RLock()
+	ring := current
+	ringMu.RUnlock()
+	if ring != nil {
+		return ring, nil
+	}
+
+	ringMu.Lock()
+	defer ringMu.Unlock()
+	if current == nil {
+		loaded, err := LoadKeyRing()
+		if err != nil {
+			return nil, err
+		}
+		current = loaded
+	}
+	return current, nil
+}
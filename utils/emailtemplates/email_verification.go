@@ -0,0 +1,87 @@
+package emailtemplates
+
+import (
+	"fmt"
+	"html"
+)
+
+func GenerateEmailVerificationEmailBody(recipientEmail, verifyLink string, validFor string) string {
+	return fmt.Sprintf(`
+<!DOCTYPE html>
+<html lang="en">
+  <head>
+    <meta charset="utf-8">
+    <meta name="viewport" content="width=device-width">
+    <title>LMW Fitness - Confirm your email</title>
+    <style>
+      :root {
+        --color-brightYellow: #ffcf00;
+        --color-hotPink: #ff11ff;
+        --color-customGray: #2a3241;
+        --color-logoGray: #cecece;
+        --color-customWhite: #f3f4f6;
+        --font-titillium: titillium, sans-serif;
+        --font-higherJump: higherJump, sans-serif;
+      }
+      .preheader { display:none !important; visibility:hidden; opacity:0; color:transparent; height:0; width:0; overflow:hidden; }
+      @media only screen and (max-width:600px){
+        .container{ width:100%% !important; }
+      }
+    </style>
+  </head>
+  <body style="margin:0; padding:0; background-color:#f3f4f6;">
+    <div class="preheader">Confirm your email address to finish setting up your LMW Fitness account.</div>
+    <center style="width:100%%; background-color:#f3f4f6;">
+      <table cellpadding="0" cellspacing="0" border="0" width="100%%" style="background-color:#f3f4f6;">
+        <tr><td align="center">
+          <table cellpadding="0" cellspacing="0" border="0" width="600" class="container" style="width:600px; max-width:600px;">
+            <tr><td style="height:24px;">&nbsp;</td></tr>
+            <tr>
+              <td style="padding:0 24px;">
+                <table width="100%%" cellpadding="0" cellspacing="0" border="0" style="background:#ffffff; border-radius:12px; box-shadow:0 4px 14px rgba(0,0,0,0.06);">
+                  <tr>
+                    <td style="padding:28px;">
+                      <h1 style="margin:16px; padding-bottom:8px; font-family:var(--font-higherJump); font-size:26px; color:var(--color-customGray);">
+                        Confirm your email
+                      </h1>
+                      <p style="margin:16px; font-family:var(--font-titillium); font-size:17px; line-height:26px; color:#444444;">
+                        Hello %s,
+                      </p>
+                      <p style="margin:16px; font-family:var(--font-titillium); font-size:16px; line-height:24px; color:#444444;">
+                        Thanks for signing up! Tap the button below to confirm this is your email address.
+                      </p>
+                      <div style="text-align:center; margin:28px 0;">
+                        <a href="%s" style="display:inline-block; padding:14px 32px; background-color:#ffcf00; color:#2a3241; text-decoration:none; border-radius:8px; font-weight:bold; font-family:var(--font-titillium); font-size:16px;">
+                          Confirm My Email
+                        </a>
+                      </div>
+                      <hr style="border:none; border-top:1px solid #efefef; margin:18px 0;">
+                      <p style="margin:16px; font-family:var(--font-titillium); font-size:16px; line-height:24px; color:#444444;">
+                        <strong>Important:</strong> This link expires in %s. You can ask for a new one from your profile.
+                      </p>
+                      <p style="margin:16px; font-family:var(--font-titillium); font-size:13px; line-height:20px; color:#888888;">
+                        If you didn't create an LMW Fitness account, you can ignore this email.
+                      </p>
+                      <p style="margin:16px; font-family:var(--font-titillium); font-size:16px; line-height:24px; color:var(--color-customGray);">
+                        All the best,<br>Laura
+                      </p>
+                    </td>
+                  </tr>
+                </table>
+              </td>
+            </tr>
+            <tr>
+              <td align="center" style="padding:18px 24px 32px;">
+                <p style="margin:0; font-family:var(--font-titillium); font-size:12px; color:var(--color-logoGray);">
+                  © 2025 LMW Fitness • Live More With Fitness
+                </p>
+              </td>
+            </tr>
+          </table>
+        </td></tr>
+      </table>
+    </center>
+  </body>
+</html>
+`, html.EscapeString(recipientEmail), verifyLink, validFor)
+}
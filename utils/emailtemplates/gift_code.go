@@ -0,0 +1,92 @@
+package emailtemplates
+
+import (
+	"fmt"
+	"html"
+)
+
+// GenerateGiftCodeEmailBody sends a gift code to its recipient, for when no
+// Brevo template is configured. message is the buyer's note and may be empty.
+func GenerateGiftCodeEmailBody(purchaserEmail, productName, giftCode, message, redeemLink, expiresAt string) string {
+	messageSection := ""
+	if message != "" {
+		messageSection = fmt.Sprintf(`
+                      <p style="margin:16px; padding:12px 16px; border-left:4px solid #ffcf00; font-family:var(--font-titillium); font-size:16px; line-height:24px; color:#444444; font-style:italic;">
+                        %s
+                      </p>`, html.EscapeString(message))
+	}
+
+	return fmt.Sprintf(`
+<!DOCTYPE html>
+<html lang="en">
+  <head>
+    <meta charset="utf-8">
+    <meta name="viewport" content="width=device-width">
+    <title>LMW Fitness - You've been sent a gift</title>
+    <style>
+      :root {
+        --color-brightYellow: #ffcf00;
+        --color-hotPink: #ff11ff;
+        --color-customGray: #2a3241;
+        --color-logoGray: #cecece;
+        --color-customWhite: #f3f4f6;
+        --font-titillium: titillium, sans-serif;
+        --font-higherJump: higherJump, sans-serif;
+      }
+      .preheader { display:none !important; visibility:hidden; opacity:0; color:transparent; height:0; width:0; overflow:hidden; }
+      @media only screen and (max-width:600px){
+        .container{ width:100%% !important; }
+      }
+    </style>
+  </head>
+  <body style="margin:0; padding:0; background-color:#f3f4f6;">
+    <div class="preheader">Someone has bought you an LMW Fitness programme.</div>
+    <center style="width:100%%; background-color:#f3f4f6;">
+      <table cellpadding="0" cellspacing="0" border="0" width="100%%" style="background-color:#f3f4f6;">
+        <tr><td align="center">
+          <table cellpadding="0" cellspacing="0" border="0" width="600" class="container" style="width:600px; max-width:600px;">
+            <tr><td style="height:24px;">&nbsp;</td></tr>
+            <tr>
+              <td style="padding:0 24px;">
+                <table width="100%%" cellpadding="0" cellspacing="0" border="0" style="background:#ffffff; border-radius:12px; box-shadow:0 4px 14px rgba(0,0,0,0.06);">
+                  <tr>
+                    <td style="padding:28px;">
+                      <h1 style="margin:16px; padding-bottom:8px; font-family:var(--font-higherJump); font-size:26px; color:var(--color-customGray);">
+                        You've been sent a gift
+                      </h1>
+                      <p style="margin:16px; font-family:var(--font-titillium); font-size:16px; line-height:24px; color:#444444;">
+                        %s has bought you <strong>%s</strong>.
+                      </p>%s
+                      <p style="margin:16px; font-family:var(--font-titillium); font-size:16px; line-height:24px; color:#444444;">
+                        Your gift code is
+                        <strong style="font-size:18px; letter-spacing:1px; color:var(--color-customGray);">%s</strong>.
+                        Redeem it before %s to start training.
+                      </p>
+                      <div style="text-align:center; margin:28px 0;">
+                        <a href="%s" style="display:inline-block; padding:14px 32px; background-color:#ffcf00; color:#2a3241; text-decoration:none; border-radius:8px; font-weight:bold; font-family:var(--font-titillium); font-size:16px;">
+                          Redeem My Gift
+                        </a>
+                      </div>
+                      <p style="margin:16px; font-family:var(--font-titillium); font-size:16px; line-height:24px; color:var(--color-customGray);">
+                        All the best,<br>Laura
+                      </p>
+                    </td>
+                  </tr>
+                </table>
+              </td>
+            </tr>
+            <tr>
+              <td align="center" style="padding:18px 24px 32px;">
+                <p style="margin:0; font-family:var(--font-titillium); font-size:12px; color:var(--color-logoGray);">
+                  © 2025 LMW Fitness • Live More With Fitness
+                </p>
+              </td>
+            </tr>
+          </table>
+        </td></tr>
+      </table>
+    </center>
+  </body>
+</html>
+`, html.EscapeString(purchaserEmail), html.EscapeString(productName), messageSection, html.EscapeString(giftCode), expiresAt, redeemLink)
+}
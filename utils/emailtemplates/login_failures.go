@@ -0,0 +1,93 @@
+package emailtemplates
+
+import (
+	"fmt"
+	"html"
+)
+
+// GenerateLoginFailuresEmailBody warns an account holder about repeated
+// failed logins. lockedFor is empty unless the account has been locked.
+func GenerateLoginFailuresEmailBody(recipientEmail string, failures int, lockedFor string, resetLink string) string {
+	lockedNotice := ""
+	if lockedFor != "" {
+		lockedNotice = fmt.Sprintf(`
+                      <p style="margin:16px; font-family:var(--font-titillium); font-size:16px; line-height:24px; color:#444444;">
+                        <strong>To keep your account safe, logging in has been paused for %s.</strong>
+                      </p>`, html.EscapeString(lockedFor))
+	}
+
+	return fmt.Sprintf(`
+<!DOCTYPE html>
+<html lang="en">
+  <head>
+    <meta charset="utf-8">
+    <meta name="viewport" content="width=device-width">
+    <title>LMW Fitness - Failed login attempts</title>
+    <style>
+      :root {
+        --color-brightYellow: #ffcf00;
+        --color-hotPink: #ff11ff;
+        --color-customGray: #2a3241;
+        --color-logoGray: #cecece;
+        --color-customWhite: #f3f4f6;
+        --font-titillium: titillium, sans-serif;
+        --font-higherJump: higherJump, sans-serif;
+      }
+      .preheader { display:none !important; visibility:hidden; opacity:0; color:transparent; height:0; width:0; overflow:hidden; }
+      @media only screen and (max-width:600px){
+        .container{ width:100%% !important; }
+      }
+    </style>
+  </head>
+  <body style="margin:0; padding:0; background-color:#f3f4f6;">
+    <div class="preheader">Someone has been trying to log in to your LMW Fitness account.</div>
+    <center style="width:100%%; background-color:#f3f4f6;">
+      <table cellpadding="0" cellspacing="0" border="0" width="100%%" style="background-color:#f3f4f6;">
+        <tr><td align="center">
+          <table cellpadding="0" cellspacing="0" border="0" width="600" class="container" style="width:600px; max-width:600px;">
+            <tr><td style="height:24px;">&nbsp;</td></tr>
+            <tr>
+              <td style="padding:0 24px;">
+                <table width="100%%" cellpadding="0" cellspacing="0" border="0" style="background:#ffffff; border-radius:12px; box-shadow:0 4px 14px rgba(0,0,0,0.06);">
+                  <tr>
+                    <td style="padding:28px;">
+                      <h1 style="margin:16px; padding-bottom:8px; font-family:var(--font-higherJump); font-size:26px; color:var(--color-customGray);">
+                        Failed login attempts
+                      </h1>
+                      <p style="margin:16px; font-family:var(--font-titillium); font-size:17px; line-height:26px; color:#444444;">
+                        Hello %s,
+                      </p>
+                      <p style="margin:16px; font-family:var(--font-titillium); font-size:16px; line-height:24px; color:#444444;">
+                        There have been %d failed attempts to log in to your account with a wrong password or authenticator code.
+                      </p>%s
+                      <p style="margin:16px; font-family:var(--font-titillium); font-size:16px; line-height:24px; color:#444444;">
+                        If this was you, you can reset your password below. If it wasn't, we recommend resetting it anyway.
+                      </p>
+                      <div style="text-align:center; margin:28px 0;">
+                        <a href="%s" style="display:inline-block; padding:14px 32px; background-color:#ffcf00; color:#2a3241; text-decoration:none; border-radius:8px; font-weight:bold; font-family:var(--font-titillium); font-size:16px;">
+                          Reset My Password
+                        </a>
+                      </div>
+                      <p style="margin:16px; font-family:var(--font-titillium); font-size:16px; line-height:24px; color:var(--color-customGray);">
+                        All the best,<br>Laura
+                      </p>
+                    </td>
+                  </tr>
+                </table>
+              </td>
+            </tr>
+            <tr>
+              <td align="center" style="padding:18px 24px 32px;">
+                <p style="margin:0; font-family:var(--font-titillium); font-size:12px; color:var(--color-logoGray);">
+                  © 2025 LMW Fitness • Live More With Fitness
+                </p>
+              </td>
+            </tr>
+          </table>
+        </td></tr>
+      </table>
+    </center>
+  </body>
+</html>
+`, html.EscapeString(recipientEmail), failures, lockedNotice, resetLink)
+}
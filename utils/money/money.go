@@ -0,0 +1,55 @@
+// Package money formats amounts held as integer minor units (pence, cents)
+// with a lower-case ISO 4217 currency code, the way Stripe reports them.
+package money
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Currencies whose minor unit isn't a hundredth. Stripe treats these as
+// zero-decimal, so an amount of 500 JPY is ¥500.
+var zeroDecimal = map[string]bool{
+	"bif": true, "clp": true, "djf": true, "gnf": true, "jpy": true, "kmf": true, "krw": true, "mga": true,
+	"pyg": true, "rwf": true, "ugx": true, "vnd": true, "vuv": true, "xaf": true, "xof": true, "xpf": true,
+}
+
+var symbols = map[string]string{
+	"gbp": "£",
+	"eur": "€",
+	"usd": "$",
+	"jpy": "¥",
+}
+
+// Normalise returns the currency code in the lower-case form Stripe uses.
+func Normalise(currency string) string {
+	return strings.ToLower(strings.TrimSpace(currency))
+}
+
+// Decimal renders amount in major units without a symbol, e.g. "12.34".
+func Decimal(amount int64, currency string) string {
+	if zeroDecimal[Normalise(currency)] {
+		return fmt.Sprintf("%d", amount)
+	}
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, amount/100, amount%100)
+}
+
+// Format renders amount for customers: "£12.34", "€12.34", "$12.34", or
+// "12.34 CHF" for currencies without a common symbol.
+func Format(amount int64, currency string) string {
+	currency = Normalise(currency)
+	value := Decimal(amount, currency)
+	symbol, ok := symbols[currency]
+	if !ok {
+		return value + " " + strings.ToUpper(currency)
+	}
+	if strings.HasPrefix(value, "-") {
+		return "-" + symbol + value[1:]
+	}
+	return symbol + value
+}
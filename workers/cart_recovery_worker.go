@@ -0,0 +1,249 @@
+package workers
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/88warren/lmw-fitness-backend/models"
+	"github.com/88warren/lmw-fitness-backend/utils/email"
+	"github.com/88warren/lmw-fitness-backend/utils/emailtemplates"
+	"gorm.io/gorm"
+)
+
+const (
+	// How long after a session expires before the customer is emailed
+	CartRecoveryDelay = time.Hour
+	// Baskets older than this are not chased
+	CartRecoveryMaxAge = 7 * 24 * time.Hour
+	// A customer gets at most one recovery email in this period, and a
+	// purchase within it counts as a recovered cart
+	CartRecoveryAttributionWindow = 7 * 24 * time.Hour
+	CartRecoveryPromoValidity     = 72 * time.Hour
+
+	cartRecoveryInterval  = 15 * time.Minute
+	cartRecoveryBatchSize = 100
+)
+
+// CartRecoveryWorker emails customers whose checkout session expired unpaid.
+type CartRecoveryWorker struct {
+	DB          *gorm.DB
+	FrontendURL string
+	// DiscountPercent is the size of the single-use code offered in the
+	// email. Zero sends the email without a code.
+	DiscountPercent int64
+	Send            func(to, subject, body string) error
+}
+
+func NewCartRecoveryWorker(db *gorm.DB) *CartRecoveryWorker {
+	frontendURL := os.Getenv("FRONTEND_URL")
+	if frontendURL == "" {
+		frontendURL = "https://lmwfitness.co.uk"
+	}
+	discountPercent, _ := strconv.ParseInt(os.Getenv("CART_RECOVERY_DISCOUNT_PERCENT"), 10, 64)
+	if discountPercent < 0 || discountPercent > 100 {
+		log.Printf("Cart recovery worker: ignoring invalid CART_RECOVERY_DISCOUNT_PERCENT %d", discountPercent)
+		discountPercent = 0
+	}
+
+	return &CartRecoveryWorker{
+		DB:              db,
+		FrontendURL:     frontendURL,
+		DiscountPercent: discountPercent,
+		Send:            sendSMTPEmail,
+	}
+}
+
+func StartCartRecoveryWorker(db *gorm.DB) {
+	log.Println("Cart recovery worker started")
+	worker := NewCartRecoveryWorker(db)
+
+	go func() {
+		worker.RunOnce()
+		ticker := time.NewTicker(cartRecoveryInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			worker.RunOnce()
+		}
+	}()
+}
+
+// RunOnce emails every abandoned checkout that is due a recovery email and
+// returns how many were sent.
+func (w *CartRecoveryWorker) RunOnce() int {
+	now := time.Now()
+
+	var due []models.CheckoutRecord
+	if err := w.DB.Where("status = ? AND recovery_email_sent_at IS NULL AND expired_at <= ? AND created_at >= ?",
+		models.CheckoutStatusExpired, now.Add(-CartRecoveryDelay), now.Add(-CartRecoveryMaxAge)).
+		Order("expired_at").
+		Limit(cartRecoveryBatchSize).
+		Find(&due).Error; err != nil {
+		log.Printf("Cart recovery worker: failed to query abandoned checkouts: %v", err)
+		return 0
+	}
+
+	sent := 0
+	for i := range due {
+		record := &due[i]
+
+		skip, err := w.shouldSkip(record, now)
+		if err != nil {
+			log.Printf("Cart recovery worker: failed to check %s: %v", record.SessionID, err)
+			continue
+		}
+		if skip {
+			continue
+		}
+
+		// Claim the record so a second pod can't email the same customer
+		claim := w.DB.Model(&models.CheckoutRecord{}).
+			Where("id = ? AND recovery_email_sent_at IS NULL", record.ID).
+			Update("recovery_email_sent_at", now)
+		if claim.Error != nil || claim.RowsAffected == 0 {
+			continue
+		}
+
+		if err := w.sendRecoveryEmail(record, now); err != nil {
+			log.Printf("Cart recovery worker: failed to email %s about %s: %v", record.CustomerEmail, record.SessionID, err)
+			w.DB.Model(&models.CheckoutRecord{}).Where("id = ?", record.ID).Updates(map[string]interface{}{
+				"recovery_email_sent_at": nil,
+				"recovery_promotion_id":  nil,
+			})
+			continue
+		}
+		sent++
+	}
+
+	if sent > 0 {
+		log.Printf("Cart recovery worker: sent %d recovery emails", sent)
+	}
+	return sent
+}
+
+// shouldSkip reports whether the customer has bought since abandoning the
+// basket or was already sent a recovery email recently.
+func (w *CartRecoveryWorker) shouldSkip(record *models.CheckoutRecord, now time.Time) (bool, error) {
+	var purchases int64
+	if err := w.DB.Model(&models.Order{}).
+		Where("customer_email = ? AND created_at > ?", record.CustomerEmail, record.CreatedAt).
+		Count(&purchases).Error; err != nil {
+		return false, err
+	}
+	if purchases == 0 {
+		if err := w.DB.Model(&models.CheckoutRecord{}).
+			Where("customer_email = ? AND status = ? AND created_at > ?", record.CustomerEmail, models.CheckoutStatusCompleted, record.CreatedAt).
+			Count(&purchases).Error; err != nil {
+			return false, err
+		}
+	}
+	if purchases > 0 {
+		return true, nil
+	}
+
+	var recent int64
+	if err := w.DB.Model(&models.CheckoutRecord{}).
+		Where("customer_email = ? AND recovery_email_sent_at > ?", record.CustomerEmail, now.Add(-CartRecoveryAttributionWindow)).
+		Count(&recent).Error; err != nil {
+		return false, err
+	}
+	return recent > 0, nil
+}
+
+func (w *CartRecoveryWorker) sendRecoveryEmail(record *models.CheckoutRecord, now time.Time) error {
+	if w.Send == nil {
+		return errors.New("no email sender configured")
+	}
+
+	var promotion *models.Promotion
+	if w.DiscountPercent > 0 {
+		var err error
+		promotion, err = w.createRecoveryPromotion(record, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	promoCode, promoExpiry := "", ""
+	if promotion != nil {
+		promoCode = promotion.Code
+		promoExpiry = promotion.EndsAt.Format("2 January 2006")
+	}
+	body := emailtemplates.GenerateCartRecoveryEmailBody(record.CustomerEmail, record.ProductNames, promoCode, w.DiscountPercent, promoExpiry, w.FrontendURL)
+
+	if err := w.Send(record.CustomerEmail, "Still thinking it over?", body); err != nil {
+		if promotion != nil {
+			w.DB.Model(promotion).Update("is_active", false)
+		}
+		return err
+	}
+	log.Printf("Cart recovery worker: emailed %s about checkout %s", record.CustomerEmail, record.SessionID)
+	return nil
+}
+
+// createRecoveryPromotion makes a single-use percentage code that expires
+// a few days after the email is sent.
+func (w *CartRecoveryWorker) createRecoveryPromotion(record *models.CheckoutRecord, now time.Time) (*models.Promotion, error) {
+	code, err := recoveryPromotionCode()
+	if err != nil {
+		return nil, err
+	}
+	endsAt := now.Add(CartRecoveryPromoValidity)
+	promotion := models.Promotion{
+		Code:                  code,
+		Description:           fmt.Sprintf("Cart recovery for %s", record.CustomerEmail),
+		DiscountType:          models.PromotionTypePercent,
+		PercentOff:            w.DiscountPercent,
+		Currency:              "gbp",
+		ProductIDs:            []uint{},
+		MaxRedemptions:        1,
+		MaxRedemptionsPerUser: 1,
+		EndsAt:                &endsAt,
+		IsActive:              true,
+	}
+	if err := w.DB.Create(&promotion).Error; err != nil {
+		return nil, fmt.Errorf("could not create recovery promotion: %w", err)
+	}
+	if err := w.DB.Model(&models.CheckoutRecord{}).Where("id = ?", record.ID).
+		Update("recovery_promotion_id", promotion.ID).Error; err != nil {
+		return nil, fmt.Errorf("could not link recovery promotion: %w", err)
+	}
+	return &promotion, nil
+}
+
+func recoveryPromotionCode() (string, error) {
+	const alphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	for i := range b {
+		b[i] = alphabet[int(b[i])%len(alphabet)]
+	}
+	return "COMEBACK" + string(b), nil
+}
+
+// sendSMTPEmail sends from SMTP_FROM using the password from the
+// environment or the mounted Kubernetes secret.
+func sendSMTPEmail(to, subject, body string) error {
+	password := smtpPassword()
+	if password == "" {
+		return errors.New("SMTP_PASSWORD not set")
+	}
+	return email.SendEmail(os.Getenv("SMTP_FROM"), to, subject, body, "", password)
+}
+
+func smtpPassword() string {
+	password := os.Getenv("SMTP_PASSWORD")
+	if password == "" {
+		// Try Kubernetes secret path
+		if data, err := os.ReadFile("/etc/secrets/smtp-password"); err == nil {
+			password = string(data)
+		}
+	}
+	return password
+}
@@ -0,0 +1,36 @@
+package workers
+
+import (
+	"log"
+	"time"
+
+	"github.com/88warren/lmw-fitness-backend/models"
+	"gorm.io/gorm"
+)
+
+// StartEntitlementExpiryWorker removes subscription access whose paid period
+// has ended. Lapsed subscriptions are normally ended straight away by their
+// webhook; this catches any whose final event was missed.
+func StartEntitlementExpiryWorker(db *gorm.DB) {
+	log.Println("Entitlement expiry worker started")
+
+	go func() {
+		expireEntitlements(db)
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for range ticker.C {
+			expireEntitlements(db)
+		}
+	}()
+}
+
+func expireEntitlements(db *gorm.DB) {
+	result := db.Where("expires_at IS NOT NULL AND expires_at < ?", time.Now()).Delete(&models.UserProgram{})
+	if result.Error != nil {
+		log.Printf("Entitlement expiry worker: failed to expire programs: %v", result.Error)
+		return
+	}
+	if result.RowsAffected > 0 {
+		log.Printf("Entitlement expiry worker: expired %d program entitlements", result.RowsAffected)
+	}
+}
@@ -1,11 +1,22 @@
 package workers
 
 import (
+	"errors"
+	"fmt"
 	"log"
+	"os"
 	"time"
 
 	"github.com/88warren/lmw-fitness-backend/models"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	MaxJobAttempts    = 5
+	JobLeaseDuration  = 10 * time.Minute
+	JobRetryBaseDelay = 30 * time.Second
+	JobRetryMaxDelay  = time.Hour
 )
 
 type PaymentProcessor interface {
@@ -17,6 +28,7 @@ type JobProcessor struct {
 	pc       PaymentProcessor
 	jobChan  chan struct{}
 	stopChan chan struct{}
+	workerID string
 }
 
 func NewJobProcessor(db *gorm.DB, pc PaymentProcessor) *JobProcessor {
@@ -25,7 +37,18 @@ func NewJobProcessor(db *gorm.DB, pc PaymentProcessor) *JobProcessor {
 		pc:       pc,
 		jobChan:  make(chan struct{}, 100),
 		stopChan: make(chan struct{}),
+		workerID: workerID(),
+	}
+}
+
+// workerID identifies this process as a lease holder. Pods have unique
+// hostnames, and the pid separates processes sharing a host.
+func workerID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
 	}
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
 }
 
 func StartPaymentWorker(db *gorm.DB, pc PaymentProcessor) {
@@ -36,7 +59,7 @@ func StartPaymentWorker(db *gorm.DB, pc PaymentProcessor) {
 	// log.Printf("=== PAYMENT WORKER STARTED ===")
 	// log.Printf("Worker is ready to process jobs immediately")
 
-	processor.processPendingJobs()
+	processor.ProcessPendingJobs()
 
 	go processor.workerLoop()
 
@@ -44,18 +67,19 @@ func StartPaymentWorker(db *gorm.DB, pc PaymentProcessor) {
 }
 
 func (jp *JobProcessor) workerLoop() {
-	fallbackTicker := time.NewTicker(5 * time.Minute)
+	// Frequent enough to pick up retries and expired leases close to schedule
+	fallbackTicker := time.NewTicker(30 * time.Second)
 	defer fallbackTicker.Stop()
 
 	for {
 		select {
 		case <-jp.jobChan:
 			// log.Printf("=== Processing jobs triggered by event ===")
-			jp.processPendingJobs()
+			jp.ProcessPendingJobs()
 
 		case <-fallbackTicker.C:
 			// log.Printf("=== Fallback check for missed jobs ===")
-			jp.processPendingJobs()
+			jp.ProcessPendingJobs()
 
 		case <-jp.stopChan:
 			// log.Printf("=== PAYMENT WORKER STOPPED ===")
@@ -77,50 +101,149 @@ func (jp *JobProcessor) Stop() {
 	close(jp.stopChan)
 }
 
-func (jp *JobProcessor) processPendingJobs() {
-	var jobs []models.Job
-	result := jp.db.Where("status = ? AND attempts < ?", "pending", 5).Find(&jobs)
-
-	if result.Error != nil {
-		log.Printf("Error querying for pending jobs: %v", result.Error)
-		return
+// ProcessPendingJobs claims and runs due jobs one at a time until none are
+// left. Claiming uses SKIP LOCKED so several replicas can drain the queue
+// concurrently without picking the same row.
+func (jp *JobProcessor) ProcessPendingJobs() {
+	for {
+		job, err := jp.claimJob()
+		if err != nil {
+			log.Printf("Error claiming payment job: %v", err)
+			return
+		}
+		if job == nil {
+			return
+		}
+		jp.runJob(job)
 	}
+}
+
+// claimJob leases the next due job: a pending job whose NextRunAt has
+// passed, or a processing job whose lease has expired because its worker
+// died. It returns nil when there is nothing to do.
+func (jp *JobProcessor) claimJob() (*models.Job, error) {
+	var job models.Job
+	claimed := false
+
+	err := jp.db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			// "failed" is the retryable state used before jobs had NextRunAt
+			Where("(status IN ? AND next_run_at <= ?) OR (status = ? AND (lease_expires_at IS NULL OR lease_expires_at < ?))",
+				[]string{models.JobStatusPending, "failed"}, now, models.JobStatusProcessing, now).
+			Order("next_run_at").
+			First(&job).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		claimed = true
+
+		if job.Attempts >= MaxJobAttempts {
+			// The last attempt crashed without reporting back
+			if job.LastError == "" {
+				job.LastError = "lease expired on final attempt"
+			}
+			job.Status = models.JobStatusDead
+			job.LeaseOwner = ""
+			job.LeaseExpiresAt = nil
+			return tx.Save(&job).Error
+		}
 
-	if len(jobs) == 0 {
-		// log.Printf("No pending jobs found")
-		return
+		leaseExpiresAt := now.Add(JobLeaseDuration)
+		job.Status = models.JobStatusProcessing
+		job.Attempts++
+		job.LastAttempt = now
+		job.LeaseOwner = jp.workerID
+		job.LeaseExpiresAt = &leaseExpiresAt
+		return tx.Save(&job).Error
+	})
+	if err != nil || !claimed {
+		return nil, err
+	}
+	if job.Status == models.JobStatusDead {
+		log.Printf("Job for session %s is dead after %d attempts: %s", job.SessionID, job.Attempts, job.LastError)
+		// Look for another job straight away
+		return jp.claimJob()
 	}
+	return &job, nil
+}
 
-	// log.Printf("Found %d pending jobs", len(jobs))
+func (jp *JobProcessor) runJob(job *models.Job) {
+	// Recorded before the run so an attempt that crashes the worker still
+	// shows up, unfinished, in the history
+	attempt := models.JobAttempt{
+		JobID:     job.ID,
+		Attempt:   job.Attempts,
+		WorkerID:  jp.workerID,
+		StartedAt: time.Now(),
+	}
+	if err := jp.db.Create(&attempt).Error; err != nil {
+		log.Printf("Error recording attempt %d for job %d: %v", attempt.Attempt, job.ID, err)
+	}
 
-	for _, job := range jobs {
-		// log.Printf("=== Processing job for session: %s ===", job.SessionID)
-		// log.Printf("Job details: ID=%d, Email=%s, Status=%s, Attempts=%d",
-		// 	job.ID, job.CustomerEmail, job.Status, job.Attempts)
+	runErr := jp.pc.ProcessPaymentSuccess(job.SessionID, job.CustomerEmail)
 
-		job.Status = "processing"
-		if err := jp.db.Save(&job).Error; err != nil {
-			log.Printf("Error updating job status to processing: %v", err)
-			continue
+	if attempt.ID != 0 {
+		attemptUpdates := map[string]interface{}{
+			"finished_at": time.Now(),
+			"succeeded":   runErr == nil,
+		}
+		if runErr != nil {
+			attemptUpdates["error"] = runErr.Error()
+		}
+		if err := jp.db.Model(&attempt).Updates(attemptUpdates).Error; err != nil {
+			log.Printf("Error updating attempt %d for job %d: %v", attempt.Attempt, job.ID, err)
 		}
+	}
 
-		err := jp.pc.ProcessPaymentSuccess(job.SessionID, job.CustomerEmail)
-		if err != nil {
-			log.Printf("Job for session %s failed: %v", job.SessionID, err)
-			job.Status = "failed"
-			job.Attempts++
-			if err := jp.db.Save(&job).Error; err != nil {
-				log.Printf("Error updating failed job: %v", err)
-			}
-		} else {
-			job.Status = "completed"
-			if err := jp.db.Save(&job).Error; err != nil {
-				log.Printf("Error updating completed job: %v", err)
-			} else {
-				// log.Printf("Job for session %s completed successfully.", job.SessionID)
-			}
+	updates := map[string]interface{}{
+		"lease_owner":      "",
+		"lease_expires_at": nil,
+	}
+	if runErr == nil {
+		updates["status"] = models.JobStatusCompleted
+		updates["last_error"] = ""
+	} else if job.Attempts >= MaxJobAttempts {
+		log.Printf("Job for session %s failed on final attempt %d, marking dead: %v", job.SessionID, job.Attempts, runErr)
+		updates["status"] = models.JobStatusDead
+		updates["last_error"] = runErr.Error()
+	} else {
+		delay := Backoff(job.Attempts)
+		log.Printf("Job for session %s failed (attempt %d), retrying in %s: %v", job.SessionID, job.Attempts, delay, runErr)
+		updates["status"] = models.JobStatusPending
+		updates["last_error"] = runErr.Error()
+		updates["next_run_at"] = time.Now().Add(delay)
+	}
+
+	// Only the lease holder may report back. If the lease expired and the job
+	// was claimed elsewhere, this update matches nothing.
+	result := jp.db.Model(&models.Job{}).
+		Where("id = ? AND lease_owner = ?", job.ID, jp.workerID).
+		Updates(updates)
+	if result.Error != nil {
+		log.Printf("Error updating job for session %s: %v", job.SessionID, result.Error)
+	} else if result.RowsAffected == 0 {
+		log.Printf("Lost lease on job for session %s before it finished", job.SessionID)
+	}
+}
+
+// Backoff returns how long to wait before retrying a job that has failed
+// the given number of attempts: 30s, 1m, 2m, 4m and so on, capped at an hour.
+func Backoff(attempts int) time.Duration {
+	if attempts < 1 {
+		attempts = 1
+	}
+	delay := JobRetryBaseDelay
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= JobRetryMaxDelay {
+			return JobRetryMaxDelay
 		}
 	}
+	return delay
 }
 
 var globalProcessor *JobProcessor
@@ -27,13 +27,7 @@ func StartReminderWorker(db *gorm.DB) {
 }
 
 func sendReminders(db *gorm.DB) {
-	smtpPassword := os.Getenv("SMTP_PASSWORD")
-	if smtpPassword == "" {
-		// Try Kubernetes secret path
-		if data, err := os.ReadFile("/etc/secrets/smtp-password"); err == nil {
-			smtpPassword = string(data)
-		}
-	}
+	smtpPassword := smtpPassword()
 	if smtpPassword == "" {
 		log.Println("Reminder worker: SMTP_PASSWORD not set, skipping")
 		return